@@ -2,29 +2,51 @@ package agent
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/guseggert/clustertest/agent/process"
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/sysstats"
 	"github.com/julienschmidt/httprouter"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"nhooyr.io/websocket"
 )
 
+// FileModeHeader is the response header containing the octal os.FileMode of a file read from the node.
+const FileModeHeader = "X-File-Mode"
+
+// FileModTimeHeader is the request header containing the RFC 3339 modification time to set on an uploaded file.
+// Uploads also accept FileModeHeader to set the permission bits of the file,
+// and may be compressed with a Content-Encoding listed in InfoResponse.UploadEncodings.
+const FileModTimeHeader = "X-File-Mod-Time"
+
+// FileChecksumHeader is the request header containing the expected checksum of an uploaded file, as "<algorithm>:<hex checksum>".
+// If the checksum of the received file doesn't match, the file isn't written and the upload fails with 422 Unprocessable Entity.
+const FileChecksumHeader = "X-File-Checksum"
+
 // NodeAgent is an HTTP agent that runs on each node.
-// The agent requires mTLS for both traffic encryption and authz.
+// The agent requires mTLS for both traffic encryption and authz, unless it's explicitly run insecurely with WithInsecureNoTLS.
 type NodeAgent struct {
 	logger *zap.SugaredLogger
 
@@ -35,6 +57,14 @@ type NodeAgent struct {
 	heartbeatFailureHandler func()
 	heartbeatTimeout        time.Duration
 	listenAddr              string
+	basePath                string
+	clock                   Clock
+	handlers                []customHandler
+	insecureNoTLS           bool
+	// commandPolicy restricts the commands that the agent runs, if set.
+	commandPolicy *CommandPolicy
+	// diagnosticsPaths are the files that are always collected for diagnostics.
+	diagnosticsPaths []string
 
 	httpServer    *http.Server
 	commandServer *process.Server
@@ -42,10 +72,16 @@ type NodeAgent struct {
 	closed        chan struct{}
 	heartbeatMut  sync.Mutex
 	lastHeartbeat time.Time
+
+	statsMut       sync.Mutex
+	sysStats       sysstats.Stats
+	statsSampledAt time.Time
 }
 
 type Option func(n *NodeAgent)
 
+// WithHeartbeatTimeout sets how long the agent waits without receiving a heartbeat from any client before calling the heartbeat failure handler (default 1m).
+// This is a backstop against leaking nodes when the test process dies without cleaning up. Zero disables the heartbeat check.
 func WithHeartbeatTimeout(d time.Duration) Option {
 	return func(n *NodeAgent) {
 		n.heartbeatTimeout = d
@@ -58,6 +94,65 @@ func WithHeartbeatFailureHandler(f func()) Option {
 	}
 }
 
+// WithMaxProcesses limits the number of processes the agent runs concurrently, to protect small nodes from being overwhelmed.
+// Processes beyond the limit are rejected, and starting them returns a StartError wrapping ErrTooManyProcesses.
+// Zero means no limit.
+func WithMaxProcesses(max int) Option {
+	return func(n *NodeAgent) {
+		n.commandServer.MaxProcs = max
+	}
+}
+
+// WithMaxProcessRuntime sets the maximum time any process run by the agent may run, after which the agent kills it,
+// as a safety net against runaway processes, such as when a client doesn't set a timeout.
+// This is an absolute cap that applies regardless of the request's timeout, and the result of a killed process reports MaxRuntimeExceeded.
+// Zero means no limit.
+func WithMaxProcessRuntime(d time.Duration) Option {
+	return func(n *NodeAgent) {
+		n.commandServer.MaxRuntime = d
+	}
+}
+
+// WithInsecureNoTLS serves plain HTTP instead of requiring mTLS, for clients using WithClientInsecureNoTLS.
+// This disables both encryption and authz, so anyone who can reach the agent can run commands on its node.
+// It must only be used on a fully trusted network, such as a local Docker network, where the TLS handshake is pure overhead.
+// The agent's certs are not used and may be nil.
+func WithInsecureNoTLS() Option {
+	return func(n *NodeAgent) {
+		n.insecureNoTLS = true
+	}
+}
+
+// WithBasePath serves all endpoints under a path prefix, such as "/agents/1".
+// Clients must be configured with the same prefix using WithClientBasePath.
+func WithBasePath(p string) Option {
+	return func(n *NodeAgent) {
+		n.basePath = cleanBasePath(p)
+	}
+}
+
+// WithClock sets the clock used by the heartbeat watchdog, such as a fake clock in tests.
+func WithClock(clock Clock) Option {
+	return func(n *NodeAgent) {
+		n.clock = clock
+	}
+}
+
+// WithHandler serves a custom endpoint alongside the built-in ones, for extending the agent.
+// The path uses httprouter syntax, and is served under the base path with the same mTLS authz as the built-in endpoints.
+// Clients can reach it with Client.Do, or Client.DialWebSocket for streaming endpoints.
+func WithHandler(method, path string, h http.Handler) Option {
+	return func(n *NodeAgent) {
+		n.handlers = append(n.handlers, customHandler{method: method, path: path, handler: h})
+	}
+}
+
+type customHandler struct {
+	method  string
+	path    string
+	handler http.Handler
+}
+
 func WithListenAddr(s string) Option {
 	return func(n *NodeAgent) {
 		n.listenAddr = s
@@ -67,6 +162,7 @@ func WithListenAddr(s string) Option {
 func WithLogger(l *zap.Logger) Option {
 	return func(n *NodeAgent) {
 		n.logger = l.Sugar()
+		n.commandServer.Log = l.Named("command_server").Sugar()
 	}
 }
 
@@ -104,6 +200,7 @@ func NewNodeAgent(caCertPEM, certPEM, keyPEM []byte, opts ...Option) (*NodeAgent
 		keyPEM:           keyPEM,
 		heartbeatTimeout: 1 * time.Minute,
 		listenAddr:       "0.0.0.0:8080",
+		clock:            realClock{},
 	}
 	for _, o := range opts {
 		o(n)
@@ -111,30 +208,37 @@ func NewNodeAgent(caCertPEM, certPEM, keyPEM []byte, opts ...Option) (*NodeAgent
 	return n, nil
 }
 
-// startHeartbeatCheck starts a goroutine that checks for a heartbeat timeout and shuts down the node when a timeout occurs.
+// startHeartbeatCheck starts a watchdog goroutine that checks for a heartbeat timeout and calls the heartbeat failure handler when a timeout occurs.
+// Any heartbeat from any client resets the watchdog. The handler is called at most once, after which the watchdog stops.
+// A non-positive heartbeat timeout disables the watchdog.
 func (a *NodeAgent) startHeartbeatCheck() {
+	if a.heartbeatTimeout <= 0 {
+		return
+	}
 	go func() {
 		a.heartbeatMut.Lock()
-		a.lastHeartbeat = time.Now()
+		a.lastHeartbeat = a.clock.Now()
 		a.heartbeatMut.Unlock()
 
+		ticker := a.clock.NewTicker(1 * time.Second)
+		defer ticker.Stop()
 		for {
-			ticker := time.NewTicker(1 * time.Second)
-			defer ticker.Stop()
 			select {
 			case <-a.closed:
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 			}
 
 			a.heartbeatMut.Lock()
 			lastHeartbeat := a.lastHeartbeat
 			a.heartbeatMut.Unlock()
 
-			if lastHeartbeat.Add(a.heartbeatTimeout).Before(time.Now()) {
+			if lastHeartbeat.Add(a.heartbeatTimeout).Before(a.clock.Now()) {
+				a.logger.Warnf("no heartbeat received since %s, which exceeds the heartbeat timeout of %s", lastHeartbeat.Format(time.RFC3339), a.heartbeatTimeout)
 				if a.heartbeatFailureHandler != nil {
 					a.heartbeatFailureHandler()
 				}
+				return
 			}
 		}
 	}()
@@ -146,28 +250,56 @@ func (a *NodeAgent) runHTTPServer() error {
 		return fmt.Errorf("listening TCP: %w", err)
 	}
 
-	tlsConfig, err := ServerTLSConfig(a.caCertPEM, a.certPEM, a.keyPEM)
-	if err != nil {
-		return fmt.Errorf("building server TLS config: %w", err)
+	listener := tcpListener
+	if a.insecureNoTLS {
+		a.logger.Warnf("serving on %s without TLS, which is insecure", a.listenAddr)
+	} else {
+		tlsConfig, err := ServerTLSConfig(a.caCertPEM, a.certPEM, a.keyPEM)
+		if err != nil {
+			return fmt.Errorf("building server TLS config: %w", err)
+		}
+		listener = tls.NewListener(tcpListener, tlsConfig)
 	}
 
-	tlsListener := tls.NewListener(tcpListener, tlsConfig)
-
 	router := httprouter.New()
 	router.GET("/heartbeat", a.heartbeat)
+	router.GET("/time", a.time)
+	router.GET("/ping", a.ping)
+	router.GET("/info", a.info)
+	router.GET("/stats", a.stats)
+	router.GET("/environ", a.environ)
+	router.GET("/diagnostics", a.diagnostics)
 	router.GET("/command", a.commandWS)
 	router.POST("/command", a.command)
 	router.POST("/file/*path", a.postFile)
 	router.GET("/file/*path", a.readFile)
+	router.GET("/stat/*path", a.stat)
+	router.GET("/dir/*path", a.readDir)
+	router.GET("/manifest/*path", a.manifest)
+	router.GET("/checksum/*path", a.checksum)
+	router.DELETE("/file/*path", a.deleteFile)
+	router.POST("/removeglob", a.removeGlob)
+	router.POST("/symlink", a.symlink)
+	router.POST("/tempdir", a.tempDir)
+	router.POST("/rename", a.rename)
+	router.POST("/chmod", a.chmod)
+	router.POST("/chown", a.chown)
 	router.GET("/connect/:network/:addr", a.connect)
 	router.POST("/fetch", a.fetch)
+	for _, h := range a.handlers {
+		router.Handler(h.method, h.path, h.handler)
+	}
 
-	handler := a.logHandler(router)
+	var handler http.Handler = router
+	if a.basePath != "" {
+		handler = http.StripPrefix(a.basePath, handler)
+	}
+	handler = a.logHandler(handler)
 
 	server := http.Server{Handler: handler}
 	a.httpServer = &server
 
-	err = server.Serve(tlsListener)
+	err = server.Serve(listener)
 	if errors.Is(err, http.ErrServerClosed) {
 		a.logger.Info("server closed gracefully")
 		return nil
@@ -211,30 +343,30 @@ func (a *NodeAgent) fetch(w http.ResponseWriter, r *http.Request, params httprou
 	var req FetchRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	f, err := os.Create(req.Dest)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
 	httpReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, req.URL, nil)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
 	_, err = io.Copy(f, resp.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 }
@@ -244,23 +376,26 @@ func (a *NodeAgent) connect(w http.ResponseWriter, r *http.Request, params httpr
 	network := params.ByName("network")
 	addr := params.ByName("addr")
 
+	// dial before accepting the WebSocket, so that a failed dial is reported to the client as an error response,
+	// instead of as a conn that is closed as soon as it's used
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+	localConn, err := dialer.DialContext(r.Context(), network, addr)
+	if err != nil {
+		a.logger.Debugf("connect dial error: %s", err)
+		writeError(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
 	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionContextTakeover,
 	})
 	if err != nil {
 		a.logger.Debugf("connect WebSocket accept error: %s", err)
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		localConn.Close()
 		return
 	}
 	remoteConn := websocket.NetConn(r.Context(), wsConn, websocket.MessageBinary)
 
-	localConn, err := net.DialTimeout(network, addr, 5*time.Second)
-	if err != nil {
-		a.logger.Debugf("connect dial error: %s", err)
-		remoteConn.Close()
-		return
-	}
-
 	go func() {
 		defer remoteConn.Close()
 		defer localConn.Close()
@@ -275,29 +410,232 @@ func (a *NodeAgent) connect(w http.ResponseWriter, r *http.Request, params httpr
 	}
 }
 
+// postFile writes the request body to a file.
+// The body is written to a temporary file in the same directory, which replaces the file once the upload completes,
+// so that a truncated file is never observed. If the upload fails or is aborted, such as by the client canceling it,
+// the temporary file is removed and an existing file is left as it was.
+// Some files can't be replaced and are written in place instead, see openUploadFile.
 func (a *NodeAgent) postFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	path := params.ByName("path")
 
 	dir := filepath.Dir(path)
 	err := os.MkdirAll(dir, 0777)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var expectedSum string
+	var h hash.Hash
+	if checksum := r.Header.Get(FileChecksumHeader); checksum != "" {
+		algo, sum, ok := strings.Cut(checksum, ":")
+		if !ok {
+			writeError(w, fmt.Sprintf("invalid %s header %q", FileChecksumHeader, checksum), http.StatusBadRequest)
+			return
+		}
+		h, err = ChecksumAlgorithm(algo).NewHash()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		expectedSum = strings.ToLower(sum)
+	}
+
+	var body io.Reader = r.Body
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, fmt.Sprintf("reading gzip-encoded body: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		writeError(w, fmt.Sprintf("unsupported content encoding %q", encoding), http.StatusUnsupportedMediaType)
 		return
 	}
 
-	f, err := os.Create(path)
+	f, err := openUploadFile(path)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	defer f.Close()
+	complete := false
+	defer func() {
+		if !complete && !f.inPlace {
+			f.Close()
+			if err := os.Remove(f.Name()); err != nil {
+				a.logger.Debugf("error removing partial file %q: %s", f.Name(), err)
+			}
+		}
+	}()
 
-	_, err = io.Copy(f, r.Body)
+	var dst io.Writer = f
+	if h != nil {
+		dst = io.MultiWriter(f, h)
+	}
+	n, err := io.Copy(dst, body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if body == r.Body && r.ContentLength >= 0 && n != r.ContentLength {
+		writeError(w, fmt.Sprintf("received %d bytes but the content length is %d", n, r.ContentLength), http.StatusBadRequest)
 		return
 	}
+	if h != nil {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != expectedSum {
+			writeErrorCode(w, fmt.Sprintf("checksum of received file is %s, expected %s", sum, expectedSum), http.StatusUnprocessableEntity, ErrorCodeChecksumMismatch)
+			return
+		}
+	}
 
+	if mode := r.Header.Get(FileModeHeader); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			writeError(w, fmt.Sprintf("parsing %s header: %s", FileModeHeader, err), http.StatusBadRequest)
+			return
+		}
+		err = f.Chmod(os.FileMode(m).Perm())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if f.existing != nil && !f.inPlace {
+		// keep the mode of the file being replaced, as writing to it would
+		err = f.Chmod(f.existing.Mode().Perm())
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := f.Close(); err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if modTime := r.Header.Get(FileModTimeHeader); modTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, modTime)
+		if err != nil {
+			writeError(w, fmt.Sprintf("parsing %s header: %s", FileModTimeHeader, err), http.StatusBadRequest)
+			return
+		}
+		err = os.Chtimes(f.Name(), t, t)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !f.inPlace {
+		if err := os.Rename(f.Name(), f.target); err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	complete = true
+	writeJSON(w, SendFileResponse{Size: n})
+}
+
+// uploadFile is the file that an upload is written to, see openUploadFile.
+type uploadFile struct {
+	*os.File
+	// target is the path of the uploaded file with symlinks resolved, which the file replaces once the upload completes.
+	target string
+	// existing is the file at target before the upload, if there is one.
+	existing os.FileInfo
+	// inPlace is true if the upload is written to target itself, instead of to a temporary file.
+	inPlace bool
+}
+
+// openUploadFile opens the file that an upload to path is written to.
+// This is normally a new temporary file, with the owner and group of the file at path, that replaces it once the upload completes.
+// Uploads to a symlink go to the file it points to, leaving the symlink in place.
+// Files that can't be replaced that way are written in place instead, as writing to path would:
+// special files such as devices and FIFOs, the targets of dangling symlinks, files whose owner the agent can't give to another file,
+// and files in directories that the agent can't create files in. Those files are truncated even if the upload fails.
+func openUploadFile(path string) (*uploadFile, error) {
+	u := &uploadFile{target: path}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		u.target = resolved
+	}
+	existing, err := os.Stat(u.target)
+	if err == nil {
+		u.existing = existing
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	replaceable := u.existing == nil || u.existing.Mode().IsRegular()
+	if u.existing == nil {
+		if info, err := os.Lstat(u.target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			// a dangling symlink, whose target is created by writing to it
+			replaceable = false
+		}
+	}
+	if replaceable {
+		f, err := createUploadFile(u.target)
+		if err == nil && u.existing != nil {
+			if err = chownLike(f, u.existing); err != nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+		if err == nil {
+			u.File = f
+			return u, nil
+		}
+		if u.existing == nil || !errors.Is(err, os.ErrPermission) {
+			return nil, err
+		}
+	}
+
+	u.File, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	u.inPlace = true
+	return u, nil
+}
+
+// createUploadFile creates a temporary file in the directory of path, for an upload to be written to before it replaces path.
+// Unlike os.CreateTemp, the file has the permissions that creating path would, subject to the umask.
+func createUploadFile(path string) (*os.File, error) {
+	dir, base := filepath.Split(path)
+	for i := 0; ; i++ {
+		name := filepath.Join(dir, fmt.Sprintf(".%s.upload-%d", base, time.Now().UnixNano()+int64(i)))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// SendFileResponse is the response to a file upload.
+type SendFileResponse struct {
+	// Size is the number of bytes written to the file, after decoding the upload's content encoding.
+	Size int64
+}
+
+// deleteFile removes a file or empty directory, or with the "all" query param, the path and any children it contains,
+// in which case a path that doesn't exist is not an error.
+func (a *NodeAgent) deleteFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	remove := os.Remove
+	if r.URL.Query().Get("all") != "" {
+		remove = os.RemoveAll
+	}
+	err := remove(params.ByName("path"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 func (a *NodeAgent) readFile(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -306,12 +644,32 @@ func (a *NodeAgent) readFile(w http.ResponseWriter, r *http.Request, params http
 	f, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			http.Error(w, "no such file or directory", http.StatusNotFound)
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	etag := fileETag(fi)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	w.Header().Set(FileModeHeader, strconv.FormatUint(uint64(fi.Mode()), 8))
+
+	if notModified(r, etag, fi.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if fi.Mode().IsRegular() {
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	}
 
 	_, err = io.Copy(w, f)
 	if err != nil {
@@ -319,10 +677,441 @@ func (a *NodeAgent) readFile(w http.ResponseWriter, r *http.Request, params http
 	}
 }
 
+// fileETag returns a weak ETag for a file, derived from its modification time and size.
+func fileETag(fi os.FileInfo) string {
+	return fmt.Sprintf(`W/"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// notModified returns true if the request's conditional headers indicate that the client already has the current file.
+// If-None-Match takes precedence over If-Modified-Since, per RFC 7232.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return inm == etag
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// FileInfo describes a file on the node.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	// LinkTarget is the target of the file if it is a symlink, otherwise it is empty.
+	LinkTarget string
+}
+
+func newFileInfo(path string, fi os.FileInfo) (FileInfo, error) {
+	info := FileInfo{
+		Name:    fi.Name(),
+		Size:    fi.Size(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return info, fmt.Errorf("reading link %q: %w", path, err)
+		}
+		info.LinkTarget = target
+	}
+	return info, nil
+}
+
+// ErrorResponse is the body of the agent's error responses.
+type ErrorResponse struct {
+	Error string
+	// Code is a machine-readable ErrorCode for errors that clients handle, and is otherwise empty.
+	Code string `json:",omitempty"`
+}
+
+// Error codes of ErrorResponse, which tell apart errors with the same status code.
+const (
+	// ErrorCodeNotExist is for a file that doesn't exist, as opposed to a 404 for a route that doesn't exist.
+	ErrorCodeNotExist = "not_exist"
+	// ErrorCodeCrossDevice is for a rename across filesystems.
+	ErrorCodeCrossDevice = "cross_device"
+	// ErrorCodeChecksumMismatch is for a received file that doesn't match its checksum.
+	ErrorCodeChecksumMismatch = "checksum_mismatch"
+)
+
+// writeError is like http.Error, but writes an ErrorResponse, so that clients can tell the agent's errors apart from those of proxies.
+func writeError(w http.ResponseWriter, msg string, code int) {
+	writeErrorCode(w, msg, code, "")
+}
+
+// writeErrorCode is like writeError, but also sets the machine-readable ErrorResponse.Code.
+func writeErrorCode(w http.ResponseWriter, msg string, code int, errCode string) {
+	b, _ := json.Marshal(ErrorResponse{Error: msg, Code: errCode})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// stat returns info about a file, without following symlinks.
+func (a *NodeAgent) stat(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	path := params.ByName("path")
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	info, err := newFileInfo(path, fi)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, info)
+}
+
+// readDir returns info about the entries of a directory, without following symlinks.
+func (a *NodeAgent) readDir(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	path := params.ByName("path")
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	infos := []FileInfo{}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		info, err := newFileInfo(filepath.Join(path, e.Name()), fi)
+		if err != nil {
+			writeError(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		infos = append(infos, info)
+	}
+	writeJSON(w, infos)
+}
+
+// ManifestEntry describes a regular file in a directory tree.
+type ManifestEntry struct {
+	// Path is the slash-separated path of the file relative to the root of the tree.
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	// SHA256 is the hex-encoded SHA-256 checksum of the file, if checksums were requested.
+	SHA256 string
+}
+
+// manifest lists the regular files in a directory tree, optionally with their checksums if the "checksum" query param is set.
+func (a *NodeAgent) manifest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	root := params.ByName("path")
+	checksum := r.URL.Query().Get("checksum") != ""
+
+	entries := []ManifestEntry{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    fi.Size(),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		}
+		if checksum {
+			entry.SHA256, err = fileSHA256(path)
+			if err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// fileSHA256 returns the hex-encoded SHA-256 checksum of the file.
+func fileSHA256(path string) (string, error) {
+	return FileChecksum(path, ChecksumSHA256)
+}
+
+// ChecksumAlgorithm is an algorithm for computing checksums of files, see clusteriface.ChecksumAlgorithm.
+type ChecksumAlgorithm = clusteriface.ChecksumAlgorithm
+
+const (
+	ChecksumSHA256 = clusteriface.ChecksumSHA256
+	ChecksumCRC32C = clusteriface.ChecksumCRC32C
+)
+
+// FileChecksum returns the hex-encoded checksum of the local file, such as to compare it with the checksum of a file on a node.
+var FileChecksum = clusteriface.FileChecksum
+
+// ChecksumResponse is the response to a request for the checksum of a file.
+type ChecksumResponse struct {
+	Algorithm ChecksumAlgorithm
+	// Sum is the hex-encoded checksum.
+	Sum string
+}
+
+// checksum computes the checksum of a file with the algorithm in the "algo" query param, SHA-256 by default.
+func (a *NodeAgent) checksum(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	algo := ChecksumAlgorithm(r.URL.Query().Get("algo"))
+	if algo == "" {
+		algo = ChecksumSHA256
+	}
+	if _, err := algo.NewHash(); err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sum, err := FileChecksum(params.ByName("path"), algo)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, "no such file or directory", http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, ChecksumResponse{Algorithm: algo, Sum: sum})
+}
+
+// TempDirRequest is a request to create a new, unique directory.
+type TempDirRequest struct {
+	// Dir is the directory in which to create the directory, or the node's default temporary directory if empty.
+	Dir string
+	// Prefix is the prefix of the directory's name, which is followed by a random string.
+	Prefix string
+}
+
+// TempDirResponse is the response to a TempDirRequest.
+type TempDirResponse struct {
+	Path string
+}
+
+func (a *NodeAgent) tempDir(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req TempDirRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dir, err := os.MkdirTemp(req.Dir, req.Prefix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			writeErrorCode(w, err.Error(), http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, TempDirResponse{Path: dir})
+}
+
+type SymlinkRequest struct {
+	Oldname string
+	Newname string
+}
+
+// symlink creates Newname as a symbolic link to Oldname.
+// On Windows, creating symlinks generally requires elevated privileges or developer mode.
+func (a *NodeAgent) symlink(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req SymlinkRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir := filepath.Dir(req.Newname)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		writeErrorCode(w, fmt.Sprintf("directory %q does not exist", dir), http.StatusNotFound, ErrorCodeNotExist)
+		return
+	}
+
+	err = os.Symlink(req.Oldname, req.Newname)
+	if err != nil {
+		if os.IsExist(err) {
+			writeError(w, fmt.Sprintf("%q already exists", req.Newname), http.StatusConflict)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type RenameRequest struct {
+	Oldpath string
+	Newpath string
+}
+
+// rename renames (moves) Oldpath to Newpath.
+// Renames across filesystems are not supported, and respond with http.StatusUnprocessableEntity.
+func (a *NodeAgent) rename(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req RenameRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = os.Rename(req.Oldpath, req.Newpath)
+	if err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			writeErrorCode(w, err.Error(), http.StatusUnprocessableEntity, ErrorCodeCrossDevice)
+			return
+		}
+		if os.IsNotExist(err) {
+			writeErrorCode(w, err.Error(), http.StatusNotFound, ErrorCodeNotExist)
+			return
+		}
+		writeError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+type ChmodRequest struct {
+	Path string
+	Mode os.FileMode
+}
+
+func (a *NodeAgent) chmod(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req ChmodRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = os.Chmod(req.Path, req.Mode)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+}
+
+type ChownRequest struct {
+	Path string
+	UID  int
+	GID  int
+}
+
+func (a *NodeAgent) chown(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req ChownRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = os.Chown(req.Path, req.UID, req.GID)
+	if err != nil {
+		writeFileError(w, err)
+		return
+	}
+}
+
+// writeFileError writes an HTTP error for a filesystem error, with a status code that reflects the kind of error.
+func writeFileError(w http.ResponseWriter, err error) {
+	switch {
+	case os.IsNotExist(err):
+		writeErrorCode(w, err.Error(), http.StatusNotFound, ErrorCodeNotExist)
+	case os.IsPermission(err):
+		writeError(w, err.Error(), http.StatusForbidden)
+	default:
+		writeError(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// TimeResponse is the response to a request for the node's current time.
+type TimeResponse struct {
+	Time time.Time
+}
+
+func (a *NodeAgent) time(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeJSON(w, TimeResponse{Time: time.Now()})
+}
+
+// ping responds with no content, for measuring the round-trip time to the agent without resetting the heartbeat watchdog.
+func (a *NodeAgent) ping(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// InfoResponse describes the platform of the node.
+type InfoResponse struct {
+	// OS and Arch are the GOOS and GOARCH of the agent.
+	OS   string
+	Arch string
+	// UploadEncodings are the content encodings of file uploads that the agent decodes, such as "gzip".
+	UploadEncodings []string
+}
+
+func (a *NodeAgent) info(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	writeJSON(w, InfoResponse{OS: runtime.GOOS, Arch: runtime.GOARCH, UploadEncodings: []string{"gzip"}})
+}
+
+// RedactedValue replaces the values of redacted env vars returned by the environ endpoint.
+const RedactedValue = clusteriface.RedactedValue
+
+// environ returns the environment of the agent, which processes inherit,
+// with the values of keys matching any of the "redact" query param patterns replaced with RedactedValue.
+func (a *NodeAgent) environ(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	env, err := clusteriface.RedactEnv(os.Environ(), r.URL.Query()["redact"]...)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, env)
+}
+
 func (a *NodeAgent) heartbeat(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	a.heartbeatMut.Lock()
 	lastHeartbeat := a.lastHeartbeat
-	a.lastHeartbeat = time.Now()
+	a.lastHeartbeat = a.clock.Now()
 	a.heartbeatMut.Unlock()
 	response := struct {
 		LastHeartbeat string
@@ -350,6 +1139,10 @@ type PostCommandResponse struct {
 	TimeMS   int64
 	Stdout   string
 	Stderr   string
+	// MaxRuntimeExceeded is true if the agent killed the process for exceeding its max runtime, see WithMaxProcessRuntime.
+	MaxRuntimeExceeded bool
+	// Reason is why the process ended, which is empty if it exited on its own.
+	Reason clusteriface.ExitReason
 }
 
 func (a *NodeAgent) commandWS(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
@@ -363,11 +1156,15 @@ func (a *NodeAgent) command(w http.ResponseWriter, r *http.Request, params httpr
 	dec := json.NewDecoder(r.Body)
 	err := dec.Decode(&req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if req.Command == "" {
-		http.Error(w, "request contained no command", http.StatusBadRequest)
+		writeError(w, "request contained no command", http.StatusBadRequest)
+		return
+	}
+	if a.commandPolicy != nil && !a.commandPolicy.Allowed(req.Command) {
+		writeError(w, fmt.Sprintf("%s: %q", ErrCommandNotAllowed, req.Command), http.StatusForbidden)
 		return
 	}
 
@@ -388,29 +1185,58 @@ func (a *NodeAgent) command(w http.ResponseWriter, r *http.Request, params httpr
 	start := time.Now()
 	err = cmd.Start()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// If the request is aborted, kill the process.
+	// If the request is aborted or the process exceeds the max runtime, kill the process.
 	// In the normal case, this is a no-op as the process will already be finished when the context is done.
+	ctx := r.Context()
+	if maxRuntime := a.commandServer.MaxRuntime; maxRuntime > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxRuntime)
+		defer cancel()
+	}
+	exited := make(chan struct{})
+	// reason is set by the killer goroutine, and is safe to read once killed is closed
+	var reason clusteriface.ExitReason
+	killed := make(chan struct{})
 	go func() {
-		<-r.Context().Done()
-		cmd.Process.Kill()
+		defer close(killed)
+		select {
+		case <-ctx.Done():
+			reason = clusteriface.ExitReasonKilledOnDisconnect
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				a.logger.Warnf("process %d exceeded the max runtime of %s, killing it", cmd.Process.Pid, a.commandServer.MaxRuntime)
+				reason = clusteriface.ExitReasonRuntimeCap
+			}
+			cmd.Process.Kill()
+		case <-exited:
+		}
 	}()
 
 	cmd.Wait()
+	close(exited)
 	exeTime := time.Since(start)
+	<-killed
+	if reason == "" {
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			reason = clusteriface.ExitReasonSignaled
+		}
+	}
 
 	resp := PostCommandResponse{
 		ExitCode: cmd.ProcessState.ExitCode(),
 		TimeMS:   exeTime.Milliseconds(),
 		Stdout:   stdout.String(),
 		Stderr:   stderr.String(),
+
+		MaxRuntimeExceeded: reason == clusteriface.ExitReasonRuntimeCap,
+		Reason:             reason,
 	}
 	b, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -1,22 +1,43 @@
 package agent
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/guseggert/clustertest/agent/process"
 	"github.com/guseggert/clustertest/cluster"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"nhooyr.io/websocket"
 )
 
 var (
@@ -126,6 +147,7 @@ func TestConnect(t *testing.T) {
 
 	conn, err := client.Dial("tcp", addrPort.String())
 	require.NoError(t, err)
+	assert.Equal(t, net.TCPAddrFromAddrPort(addrPort), conn.RemoteAddr())
 
 	req, err := http.NewRequest(http.MethodGet, "/", nil)
 	require.NoError(t, err)
@@ -173,6 +195,7 @@ func TestCommand(t *testing.T) {
 		cmd                   string
 		args                  []string
 		stdin                 string
+		stdinString           string
 		stdinFileContents     string
 		expStdout             string
 		expStderr             string
@@ -209,6 +232,12 @@ func TestCommand(t *testing.T) {
 			stdin:     "foo",
 			expStdout: "foo bar\n",
 		},
+		{
+			name:        "stdin from string",
+			cmd:         "cat",
+			stdinString: "foo",
+			expStdout:   "foo",
+		},
 		{
 			name:              "stdin from file",
 			cmd:               "cat",
@@ -269,6 +298,7 @@ func TestCommand(t *testing.T) {
 			if c.stdin != "" {
 				req.Stdin = bytes.NewReader([]byte(c.stdin))
 			}
+			req.StdinString = c.stdinString
 			if c.stdinFileContents != "" {
 				f, err := os.CreateTemp("", "")
 				require.NoError(t, err)
@@ -310,3 +340,2557 @@ func TestCommand(t *testing.T) {
 type noopWriteCloser struct{ io.Writer }
 
 func (c *noopWriteCloser) Close() error { return nil }
+
+// startAgent starts a node agent on a local port and returns a client connected to it.
+// The agent is stopped when the test finishes.
+func startAgent(t *testing.T, opts ...Option) *Client {
+	return startAgentWithClientOpts(t, opts, nil)
+}
+
+// startAgentWithClientOpts is like startAgent, but also configures the client.
+func startAgentWithClientOpts(t *testing.T, opts []Option, clientOpts []ClientOption) *Client {
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+
+	opts = append([]Option{WithListenAddr("127.0.0.1:9998")}, opts...)
+	agent, err := NewNodeAgent(
+		cert.CA.CertPEMBytes,
+		cert.Server.CertPEMBytes,
+		cert.Server.KeyPEMBytes,
+		opts...,
+	)
+	require.NoError(t, err)
+
+	go agent.Run()
+	t.Cleanup(func() {
+		require.NoError(t, agent.Stop())
+	})
+
+	client, err := NewClient(log, cert, "127.0.0.1", 9998, clientOpts...)
+	require.NoError(t, err)
+
+	err = client.WaitForServer(context.Background())
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestServerName(t *testing.T) {
+	ctx := context.Background()
+	certs, err := GenerateCerts()
+	require.NoError(t, err)
+	serverCert, err := buildCert(certs.CA.x509Cert, certs.CA.privKey, &pkix.Name{CommonName: "agent"}, "agent.example.com")
+	require.NoError(t, err)
+
+	agent, err := NewNodeAgent(certs.CA.CertPEMBytes, serverCert.CertPEMBytes, serverCert.KeyPEMBytes, WithListenAddr("127.0.0.1:9998"))
+	require.NoError(t, err)
+	go agent.Run()
+	t.Cleanup(func() {
+		require.NoError(t, agent.Stop())
+	})
+
+	client, err := NewClient(log, certs, "127.0.0.1", 9998, WithClientServerName("agent.example.com"))
+	require.NoError(t, err)
+	require.NoError(t, client.WaitForServer(ctx))
+	_, err = client.Info(ctx)
+	require.NoError(t, err)
+
+	// the cert isn't valid for the default name
+	defaultClient, err := NewClient(log, certs, "127.0.0.1", 9998)
+	require.NoError(t, err)
+	var hostnameErr x509.HostnameError
+	assert.ErrorAs(t, defaultClient.probe(ctx), &hostnameErr)
+}
+
+func TestInsecureNoTLS(t *testing.T) {
+	ctx := context.Background()
+	agent, err := NewNodeAgent(nil, nil, nil, WithListenAddr("127.0.0.1:9998"), WithInsecureNoTLS())
+	require.NoError(t, err)
+	go agent.Run()
+	t.Cleanup(func() {
+		require.NoError(t, agent.Stop())
+	})
+
+	client, err := NewClient(log, nil, "127.0.0.1", 9998, WithClientInsecureNoTLS())
+	require.NoError(t, err)
+	require.NoError(t, client.WaitForServer(ctx))
+
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "echo", Args: []string{"hello"}, Stdout: stdout})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "hello\n", stdout.String())
+
+	// a client using mTLS can't talk to the agent
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	tlsClient, err := NewClient(log, cert, "127.0.0.1", 9998, WithClientWaitTimeout(time.Second))
+	require.NoError(t, err)
+	assert.Error(t, tlsClient.SendHeartbeat(ctx))
+}
+
+func TestSymlink(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.WriteFile(target, []byte("hello"), 0644))
+
+	err := client.Symlink(ctx, target, link)
+	require.NoError(t, err)
+
+	info, err := client.Stat(ctx, link)
+	require.NoError(t, err)
+	assert.Equal(t, target, info.LinkTarget)
+	assert.NotZero(t, info.Mode&os.ModeSymlink)
+
+	infos, err := client.ReadDir(ctx, dir)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, "link", infos[0].Name)
+	assert.Equal(t, target, infos[0].LinkTarget)
+	assert.Equal(t, "target", infos[1].Name)
+	assert.Equal(t, "", infos[1].LinkTarget)
+
+	err = client.Symlink(ctx, target, link)
+	assert.ErrorIs(t, err, os.ErrExist)
+
+	err = client.Symlink(ctx, target, filepath.Join(dir, "nonexistent", "link"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = client.Stat(ctx, filepath.Join(dir, "nonexistent"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRename(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	dir := t.TempDir()
+	oldpath := filepath.Join(dir, "old")
+	newpath := filepath.Join(dir, "new")
+	require.NoError(t, os.WriteFile(oldpath, []byte("hello"), 0644))
+
+	err := client.Rename(ctx, oldpath, newpath)
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(newpath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	err = client.Rename(ctx, oldpath, newpath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestUnprocessableEntityIsNotErrCrossDevice(t *testing.T) {
+	ctx := context.Background()
+	// such as a custom endpoint that rejects its request
+	reject := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, "invalid request", http.StatusUnprocessableEntity)
+	})
+	client := startAgent(t, WithHandler(http.MethodPost, "/reject", reject))
+
+	err := client.postJSON(ctx, "/reject", "posting", struct{}{})
+	assert.NotErrorIs(t, err, ErrCrossDevice)
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusUnprocessableEntity, agentErr.StatusCode)
+	assert.Equal(t, "invalid request", agentErr.Message)
+}
+
+func TestMissingRouteIsNotErrNotExist(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	// such as a route that an older agent doesn't have
+	var v any
+	err := client.getJSON(ctx, "/nonexistent", "getting", &v)
+	assert.NotErrorIs(t, err, os.ErrNotExist)
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusNotFound, agentErr.StatusCode)
+
+	err = client.postJSON(ctx, "/nonexistent", "posting", struct{}{})
+	assert.NotErrorIs(t, err, os.ErrNotExist)
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusNotFound, agentErr.StatusCode)
+}
+
+func TestChmod(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	p := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(p, []byte("hello"), 0644))
+
+	err := client.Chmod(ctx, p, 0600)
+	require.NoError(t, err)
+
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	err = client.Chmod(ctx, p+"nonexistent", 0600)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	p := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(p, []byte("hello"), 0640))
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+
+	f, err := client.OpenFile(ctx, p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	assert.Equal(t, int64(5), f.Size)
+	assert.Equal(t, os.FileMode(0640), f.Mode)
+	assert.Equal(t, fi.ModTime().Truncate(time.Second).UTC(), f.ModTime.UTC())
+
+	b, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestReadFileNotModified(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	p := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(p, []byte("hello"), 0644))
+
+	f, err := client.OpenFile(ctx, p)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = client.OpenFile(ctx, p, IfNoneMatch(f.ETag))
+	assert.ErrorIs(t, err, ErrNotModified)
+
+	_, err = client.OpenFile(ctx, p, IfModifiedSince(f.ModTime))
+	assert.ErrorIs(t, err, ErrNotModified)
+
+	newModTime := f.ModTime.Add(time.Hour)
+	require.NoError(t, os.Chtimes(p, newModTime, newModTime))
+
+	f2, err := client.OpenFile(ctx, p, IfNoneMatch(f.ETag))
+	require.NoError(t, err)
+	require.NoError(t, f2.Close())
+	assert.NotEqual(t, f.ETag, f2.ETag)
+
+	f3, err := client.OpenFile(ctx, p, IfModifiedSince(f.ModTime))
+	require.NoError(t, err)
+	require.NoError(t, f3.Close())
+}
+
+func TestReadFileDecompress(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	dir := t.TempDir()
+	p := filepath.Join(dir, "file.gz")
+	buf := &bytes.Buffer{}
+	gzWriter := gzip.NewWriter(buf)
+	_, err := gzWriter.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, gzWriter.Close())
+	require.NoError(t, os.WriteFile(p, buf.Bytes(), 0644))
+
+	rc, err := client.ReadFile(ctx, p, Decompress())
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	assert.Equal(t, "hello", string(b))
+
+	plain := filepath.Join(dir, "plain")
+	require.NoError(t, os.WriteFile(plain, []byte("hello, this is not gzip-compressed"), 0644))
+	_, err = client.ReadFile(ctx, plain, Decompress())
+	assert.ErrorIs(t, err, gzip.ErrHeader)
+}
+
+// stallingWriter stalls on the first write, to simulate a slow client.
+type stallingWriter struct {
+	stall time.Duration
+	once  sync.Once
+	n     int
+}
+
+func (w *stallingWriter) Write(b []byte) (int, error) {
+	w.once.Do(func() { time.Sleep(w.stall) })
+	w.n += len(b)
+	return len(b), nil
+}
+
+func TestCommandOutputBuffer(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	total := 32 * 1024 * 1024
+	stdout := &stallingWriter{stall: time.Second}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:          "head",
+		Args:             []string{"-c", strconv.Itoa(total), "/dev/zero"},
+		Stdout:           stdout,
+		OutputBufferSize: 4096,
+	})
+	require.NoError(t, err)
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, res.ExitCode)
+	assert.NotZero(t, res.StdoutDroppedBytes)
+	assert.Equal(t, int64(total), int64(stdout.n)+res.StdoutDroppedBytes)
+}
+
+func TestCommandSignaled(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "kill -SEGV $$"},
+	})
+	require.NoError(t, err)
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+
+	assert.True(t, res.Signaled)
+	assert.Equal(t, syscall.SIGSEGV, res.Signal)
+}
+
+func TestCommandUsage(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "i=0; while [ $i -lt 100000 ]; do i=$((i+1)); done"},
+	})
+	require.NoError(t, err)
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Greater(t, res.Usage.UserTime+res.Usage.SystemTime, time.Duration(0))
+	assert.Greater(t, res.Usage.MaxRSSBytes, int64(0))
+}
+
+func TestStreamByteCounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	// output is counted even though it's discarded
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:     "sh",
+		Args:        []string{"-c", "cat >/dev/null; head -c 100000 /dev/zero; printf err >&2"},
+		StdinString: "hello",
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(100000), res.StdoutBytes)
+	assert.Equal(t, int64(3), res.StderrBytes)
+	assert.Equal(t, int64(5), res.StdinBytes)
+
+	stdoutFile := filepath.Join(t.TempDir(), "stdout")
+	stderr := &bytes.Buffer{}
+	proc, err = client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "printf out; printf err >&2"},
+		StdoutFile: stdoutFile,
+		Stderr:     stderr,
+	})
+	require.NoError(t, err)
+	res, err = proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res.StdoutBytes)
+	assert.Equal(t, int64(3), res.StderrBytes)
+	assert.Equal(t, int64(0), res.StdinBytes)
+}
+
+func TestCancelPolicy(t *testing.T) {
+	client := startAgent(t)
+	// the process can't report anything once it's abandoned, so it records the signals it receives in a file
+	signals := filepath.Join(t.TempDir(), "signals")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args: []string{"-c", fmt.Sprintf(
+			`trap 'echo INT >> %[1]s' INT; trap 'echo TERM >> %[1]s; exit 3' TERM; while true; do sleep 0.05; done`,
+			signals,
+		)},
+		CancelPolicy: &cluster.CancelPolicy{Steps: []cluster.CancelStep{
+			{Signal: syscall.SIGINT, Grace: 200 * time.Millisecond},
+			{Signal: syscall.SIGTERM, Grace: 5 * time.Second},
+		}},
+	})
+	require.NoError(t, err)
+	_, err = proc.PID(ctx)
+	require.NoError(t, err)
+	cancel()
+
+	// the process ignores SIGINT, so it's sent SIGTERM after the grace period, and exits
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(signals)
+		return string(b) == "INT\nTERM\n"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestCancelPolicyOnDisconnect(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not supported on Windows")
+	}
+	ctx := context.Background()
+	conns := &connRecorder{}
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientTransport(conns.transport())})
+	signals := filepath.Join(t.TempDir(), "signals")
+
+	_, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args: []string{"-c", fmt.Sprintf(
+			`trap 'echo TERM >> %[1]s; exit 3' TERM; echo READY >> %[1]s; while true; do sleep 0.05; done`,
+			signals,
+		)},
+		StopSignal:      syscall.SIGINT,
+		KillGracePeriod: 5 * time.Second,
+		CancelPolicy: &cluster.CancelPolicy{Steps: []cluster.CancelStep{
+			{Signal: syscall.SIGTERM, Grace: 5 * time.Second},
+		}},
+	})
+	require.NoError(t, err)
+	// wait for the trap to be set, since the process starts before the shell has run it
+	require.Eventually(t, func() bool {
+		b, _ := os.ReadFile(signals)
+		return string(b) == "READY\n"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the connection is lost while the client still waits on the process
+	conns.cut()
+
+	// the agent stops the process with the policy, not the stop signal
+	assert.Eventually(t, func() bool {
+		b, _ := os.ReadFile(signals)
+		return string(b) == "READY\nTERM\n"
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestMaxProcesses(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t, WithMaxProcesses(1))
+
+	proc1, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"1"}})
+	require.NoError(t, err)
+
+	_, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "true"})
+	assert.ErrorIs(t, err, ErrTooManyProcesses)
+	var startErr *StartError
+	assert.ErrorAs(t, err, &startErr)
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, process.StatusTooManyProcesses, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, "the limit is 1")
+
+	res, err := proc1.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestMaxProcessRuntime(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t, WithMaxProcessRuntime(500*time.Millisecond))
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "true"})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.False(t, res.MaxRuntimeExceeded)
+
+	// the cap applies regardless of the request's timeout
+	proc, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}, Timeout: time.Minute})
+	require.NoError(t, err)
+	res, err = proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.True(t, res.MaxRuntimeExceeded)
+	assert.Equal(t, cluster.ExitReasonRuntimeCap, res.Reason)
+	assert.Less(t, res.TimeMS, int64(5000))
+	if runtime.GOOS != "windows" {
+		assert.True(t, res.Signaled)
+		assert.Equal(t, syscall.SIGKILL, res.Signal)
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	run := func(req cluster.StartProcRequest, f func(cluster.Process)) *cluster.ProcessResult {
+		proc, err := client.StartProc(ctx, req)
+		require.NoError(t, err)
+		if f != nil {
+			f(proc)
+		}
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		return res
+	}
+
+	// processes that exit on their own have no reason, whatever the exit code
+	res := run(cluster.StartProcRequest{Command: "true"}, nil)
+	assert.Equal(t, cluster.ExitReason(""), res.Reason)
+	res = run(cluster.StartProcRequest{Command: "false"}, nil)
+	assert.Equal(t, 1, res.ExitCode)
+	assert.Equal(t, cluster.ExitReason(""), res.Reason)
+
+	res = run(cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}, Timeout: 100 * time.Millisecond}, nil)
+	assert.Equal(t, cluster.ExitReasonTimeout, res.Reason)
+
+	res = run(cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}}, func(proc cluster.Process) {
+		_, err := proc.PID(ctx)
+		require.NoError(t, err)
+		require.NoError(t, proc.Signal(ctx, syscall.SIGTERM))
+	})
+	assert.Equal(t, cluster.ExitReasonSignaled, res.Reason)
+
+	if runtime.GOOS == "linux" {
+		// a directory standing in for the cgroup, whose OOM kill count the process bumps before killing itself like the OOM killer would,
+		// after a delay so that the count is read before the process bumps it
+		cgroupPath := t.TempDir()
+		events := filepath.Join(cgroupPath, "memory.events")
+		require.NoError(t, os.WriteFile(events, []byte("oom 0\noom_kill 0\n"), 0644))
+		res = run(cluster.StartProcRequest{
+			Command:    "sh",
+			Args:       []string{"-c", fmt.Sprintf(`sleep 0.2; printf 'oom 1\noom_kill 1\n' > %s; kill -9 $$`, events)},
+			CgroupPath: cgroupPath,
+		}, nil)
+		assert.Equal(t, cluster.ExitReasonOOM, res.Reason)
+	}
+}
+
+func TestExitReasonKilledOnDisconnect(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zap.DebugLevel)
+	conns := &connRecorder{}
+	client := startAgentWithClientOpts(t, []Option{WithLogger(zap.New(core))}, []ClientOption{WithClientTransport(conns.transport())})
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}})
+	require.NoError(t, err)
+	_, err = proc.PID(ctx)
+	require.NoError(t, err)
+
+	conns.cut()
+
+	// the result can't reach the client, so the agent logs the reason
+	assert.Eventually(t, func() bool {
+		for _, e := range logs.FilterMessage("process exited, sending result").All() {
+			if e.ContextMap()["Reason"] == string(cluster.ExitReasonKilledOnDisconnect) {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestPing(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	rtt, err := client.Ping(ctx)
+	require.NoError(t, err)
+	assert.Greater(t, rtt, time.Duration(0))
+	assert.Less(t, rtt, time.Second)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = client.Ping(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDialDeadlines(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	write := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for s := range write {
+			conn.Write([]byte(s))
+		}
+	}()
+
+	conn, err := client.DialContext(ctx, "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// a read past the deadline times out
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 5))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// the conn is still usable after extending the deadline
+	require.NoError(t, conn.SetReadDeadline(time.Time{}))
+	write <- "hello"
+	close(write)
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// a write past the deadline times out
+	require.NoError(t, conn.SetWriteDeadline(time.Now().Add(-time.Second)))
+	_, err = conn.Write([]byte("hello"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
+
+func TestDialWait(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	// reserve a free port, and only start listening on it after a while
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	_, err = client.DialContext(ctx, "tcp", addr)
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusBadGateway, agentErr.StatusCode)
+
+	shortCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	_, err = client.DialWait(shortCtx, "tcp", addr)
+	require.ErrorAs(t, err, &agentErr)
+	assert.Contains(t, agentErr.Message, "refused")
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello"))
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	conn, err := client.DialWait(waitCtx, "tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestDialWaitShrinkingBackoff(t *testing.T) {
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientWaitInterval(0), WithClientWaitBackoff(0.5, 0)})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	// the interval stays positive, so the dials back off until the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = client.DialWait(ctx, "tcp", addr)
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+}
+
+func TestCommandPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix commands")
+	}
+	ctx := context.Background()
+	client := startAgent(t, WithCommandPolicy(CommandPolicy{Allow: []string{"echo", "true"}, Deny: []string{"true"}}))
+
+	run := func(command string) error {
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: command})
+		if err != nil {
+			return err
+		}
+		_, err = proc.Wait(ctx)
+		return err
+	}
+
+	assert.NoError(t, run("echo"))
+	echoPath, err := exec.LookPath("echo")
+	require.NoError(t, err)
+	assert.NoError(t, run(echoPath))
+
+	err = run("true")
+	assert.ErrorIs(t, err, ErrCommandNotAllowed)
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, process.StatusCommandNotAllowed, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, `"true"`)
+
+	assert.ErrorIs(t, run("false"), ErrCommandNotAllowed)
+
+	assert.True(t, CommandPolicy{}.Allowed("anything"))
+	assert.False(t, CommandPolicy{Deny: []string{"/no/such/rm"}}.Allowed("/no/such/rm"))
+	assert.True(t, CommandPolicy{Deny: []string{"/no/such/rm"}}.Allowed("/other/rm"))
+}
+
+func TestClockOffset(t *testing.T) {
+	client := startAgent(t)
+
+	offset, err := client.ClockOffset(context.Background())
+	require.NoError(t, err)
+	assert.Less(t, offset.Abs(), time.Second)
+}
+
+func TestProcessPIDAndKill(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"60"}})
+	require.NoError(t, err)
+
+	pid, err := proc.PID(ctx)
+	require.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	require.NoError(t, proc.Kill(ctx))
+	// the process has been reaped by the time Kill returns
+	if p, err := os.FindProcess(pid); err == nil {
+		assert.ErrorIs(t, p.Signal(syscall.Signal(0)), os.ErrProcessDone)
+	}
+	// killing an exited process is a no-op
+	require.NoError(t, proc.Kill(ctx))
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.True(t, res.Signaled)
+	assert.Equal(t, syscall.SIGKILL, res.Signal)
+}
+
+func TestProcessSignal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh and SIGHUP")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", `trap 'echo reloaded; exit 3' HUP; echo ready; while true; do sleep 0.1; done`},
+		StdoutPipe: true,
+	})
+	require.NoError(t, err)
+	stdout := bufio.NewReader(proc.Stdout())
+	line, err := stdout.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "ready\n", line)
+
+	require.NoError(t, proc.Signal(ctx, syscall.SIGHUP))
+	line, err = stdout.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "reloaded\n", line)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.ExitCode)
+
+	assert.ErrorIs(t, proc.Signal(ctx, os.Interrupt), cluster.ErrProcessExited)
+}
+
+func TestProcessStdoutPipe(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "echo ready; sleep 0.2; echo done"},
+		StdoutPipe: true,
+	})
+	require.NoError(t, err)
+
+	stdout := bufio.NewReader(proc.Stdout())
+	line, err := stdout.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+
+	rest, err := io.ReadAll(stdout)
+	require.NoError(t, err)
+	assert.Equal(t, "done\n", string(rest))
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+}
+
+func TestBasePath(t *testing.T) {
+	ctx := context.Background()
+	client := startAgentWithClientOpts(t, []Option{WithBasePath("/agents/1/")}, []ClientOption{WithClientBasePath("agents/1")})
+
+	dir := t.TempDir()
+	require.NoError(t, client.SendFile(ctx, filepath.Join(dir, "foo"), strings.NewReader("bar")))
+
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "cat",
+		Args:    []string{filepath.Join(dir, "foo")},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "bar", stdout.String())
+}
+
+func TestClientTransport(t *testing.T) {
+	ctx := context.Background()
+	var requests int32
+	transport := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return nil, errors.New("injected fault")
+	})
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientTransport(&http.Transport{})})
+
+	dir := t.TempDir()
+	require.NoError(t, client.SendFile(ctx, filepath.Join(dir, "foo"), strings.NewReader("bar")))
+
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	faultyClient, err := NewClient(log, cert, "127.0.0.1", 9998,
+		WithClientTransport(transport),
+		WithCustomizeRetryableClient(func(r *retryablehttp.Client) { r.RetryMax = 0 }),
+	)
+	require.NoError(t, err)
+	err = faultyClient.SendHeartbeat(ctx)
+	require.ErrorContains(t, err, "injected fault")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestOutputWriteError(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	writeErr := errors.New("broken sink")
+	stdout := &failingWriter{n: 1024, err: writeErr}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "head -c 1000000 /dev/zero; exit 3"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+
+	res, err := proc.Wait(ctx)
+	require.ErrorIs(t, err, writeErr)
+	require.NotNil(t, res)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, 1024, stdout.written)
+}
+
+// failingWriter accepts n bytes and then returns err.
+type failingWriter struct {
+	n       int
+	written int
+	err     error
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.written+len(b) > w.n {
+		n := w.n - w.written
+		w.written = w.n
+		return n, w.err
+	}
+	w.written += len(b)
+	return len(b), nil
+}
+
+func TestProcessHooks(t *testing.T) {
+	ctx := context.Background()
+	hooks := &recordingHooks{}
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientProcessHooks(hooks)})
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "exit 2"},
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.ExitCode)
+
+	hooks.mut.Lock()
+	defer hooks.mut.Unlock()
+	assert.Equal(t, []string{"dial", "start", "exit 2"}, hooks.events)
+}
+
+type recordingHooks struct {
+	process.NopHooks
+	mut    sync.Mutex
+	events []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordingHooks) OnDial(process.StartProcRequest, time.Duration) { h.record("dial") }
+func (h *recordingHooks) OnStart(process.StartProcRequest, int, time.Duration) {
+	h.record("start")
+}
+func (h *recordingHooks) OnExit(_ process.StartProcRequest, code int, _ time.Duration) {
+	h.record(fmt.Sprintf("exit %d", code))
+}
+
+func TestStartProcDialError(t *testing.T) {
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	client, err := NewClient(log, cert, "127.0.0.1", 1,
+		WithCustomizeRetryableClient(func(r *retryablehttp.Client) { r.RetryMax = 0 }),
+	)
+	require.NoError(t, err)
+
+	_, err = client.StartProc(context.Background(), cluster.StartProcRequest{Command: "true"})
+	var dialErr *DialError
+	require.ErrorAs(t, err, &dialErr)
+	var protocolErr *ProtocolError
+	assert.False(t, errors.As(err, &protocolErr))
+}
+
+type traceIDKey struct{}
+
+func TestEnvFromContext(t *testing.T) {
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientEnvFromContext(func(ctx context.Context) []string {
+		if id, ok := ctx.Value(traceIDKey{}).(string); ok {
+			return []string{"TRACE_ID=" + id}
+		}
+		return nil
+	})})
+	ctx := context.WithValue(context.Background(), traceIDKey{}, "abc123")
+
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "echo $TRACE_ID $OTHER"},
+		Env:     []string{"OTHER=foo"},
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "abc123 foo\n", stdout.String())
+}
+
+func TestClientDefaults(t *testing.T) {
+	ctx := context.Background()
+	defaultDir := t.TempDir()
+	client := startAgentWithClientOpts(t, nil, []ClientOption{
+		WithClientDefaultWD(defaultDir),
+		WithClientDefaultEnv("A=default", "B=default"),
+	})
+
+	run := func(req cluster.StartProcRequest) string {
+		stdout := &bytes.Buffer{}
+		req.Command = "sh"
+		req.Args = []string{"-c", "echo $A $B; pwd"}
+		req.Stdout = stdout
+		proc, err := client.StartProc(ctx, req)
+		require.NoError(t, err)
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, res.ExitCode)
+		return stdout.String()
+	}
+
+	assert.Equal(t, "default default\n"+defaultDir+"\n", run(cluster.StartProcRequest{}))
+
+	// the request's values take precedence
+	dir := t.TempDir()
+	assert.Equal(t, "default override\n"+dir+"\n", run(cluster.StartProcRequest{Env: []string{"B=override"}, WD: dir}))
+}
+
+func TestStdinFlowControl(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	size := 8 * 1024 * 1024
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "sleep 0.2; wc -c"},
+		Stdin:   bytes.NewReader(make([]byte, size)),
+		Stdout:  stdout,
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, strconv.Itoa(size), strings.TrimSpace(stdout.String()))
+
+	stats := proc.(*process.Process).StdinStats()
+	assert.Equal(t, int64(size), stats.Bytes)
+	assert.Greater(t, stats.Throughput(), float64(0))
+}
+
+func TestSendLocalFile(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	localPath := filepath.Join(t.TempDir(), "script.sh")
+	require.NoError(t, os.WriteFile(localPath, []byte("#!/bin/sh\necho hi\n"), 0750))
+
+	remotePath := filepath.Join(t.TempDir(), "script.sh")
+	n, err := client.SendLocalFile(ctx, localPath, remotePath, PreserveMode())
+	require.NoError(t, err)
+	assert.Equal(t, int64(18), n)
+
+	b, err := os.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, "#!/bin/sh\necho hi\n", string(b))
+	info, err := os.Stat(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+}
+
+func TestDownloadFile(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	remotePath := filepath.Join(t.TempDir(), "remote")
+	require.NoError(t, os.WriteFile(remotePath, []byte("hello"), 0640))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(remotePath, modTime, modTime))
+	// sha256("hello")
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	localDir := t.TempDir()
+	localPath := filepath.Join(localDir, "local")
+	n, err := client.DownloadFile(ctx, remotePath, localPath, PreserveRemoteMode(), PreserveRemoteModTime(), VerifySHA256(sum))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	b, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	info, err := os.Stat(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, modTime.Equal(info.ModTime()))
+
+	// a checksum mismatch leaves the local file untouched and cleans up the temp file
+	require.NoError(t, os.WriteFile(remotePath, []byte("changed"), 0640))
+	_, err = client.DownloadFile(ctx, remotePath, localPath, VerifySHA256(sum))
+	require.ErrorContains(t, err, "checksum mismatch")
+	b, err = os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	entries, err := os.ReadDir(localDir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestInfo(t *testing.T) {
+	client := startAgent(t)
+	info, err := client.Info(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, runtime.GOOS, info.OS)
+	assert.Equal(t, runtime.GOARCH, info.Arch)
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	stats, err := client.Stats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.RunningProcesses)
+	assert.Equal(t, runtime.NumCPU(), stats.NumCPU)
+	assert.False(t, stats.SampledAt.IsZero())
+	if runtime.GOOS == "linux" {
+		assert.NotZero(t, stats.MemTotalBytes)
+		assert.LessOrEqual(t, stats.MemAvailableBytes, stats.MemTotalBytes)
+		assert.NotZero(t, stats.DiskTotalBytes)
+		assert.LessOrEqual(t, stats.DiskAvailableBytes, stats.DiskTotalBytes)
+	}
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}})
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		stats, err := client.Stats(ctx)
+		return err == nil && stats.RunningProcesses == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, proc.Kill(ctx))
+	assert.Eventually(t, func() bool {
+		stats, err := client.Stats(ctx)
+		return err == nil && stats.RunningProcesses == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSyncDir(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "synced")
+	require.NoError(t, os.MkdirAll(filepath.Join(localDir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "a"), []byte("a"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "sub", "b"), []byte("b"), 0755))
+
+	res, err := client.SyncDir(ctx, localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "sub/b"}, res.Transferred)
+	assert.Empty(t, res.Skipped)
+	info, err := os.Stat(filepath.Join(remoteDir, "sub", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	// change a file and add an extraneous remote file
+	require.NoError(t, os.WriteFile(filepath.Join(localDir, "a"), []byte("aa"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(remoteDir, "extra"), []byte("extra"), 0644))
+
+	res, err = client.SyncDir(ctx, localDir, remoteDir, SyncDelete(), SyncChecksum())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+	assert.Equal(t, []string{"sub/b"}, res.Skipped)
+	assert.Equal(t, []string{"extra"}, res.Deleted)
+
+	b, err := os.ReadFile(filepath.Join(remoteDir, "a"))
+	require.NoError(t, err)
+	assert.Equal(t, "aa", string(b))
+	_, err = os.Stat(filepath.Join(remoteDir, "extra"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// fakeClock is a Clock whose time only moves when advanced, which fires all of its tickers and the timers that are due.
+type fakeClock struct {
+	mut     sync.Mutex
+	now     time.Time
+	tickers []chan time.Time
+	timers  map[*fakeTimer]bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	ch := make(chan time.Time, 1)
+	c.tickers = append(c.tickers, ch)
+	return &fakeTicker{c: ch}
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.timers == nil {
+		c.timers = map[*fakeTimer]bool{}
+	}
+	t := &fakeTimer{clock: c, deadline: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.timers[t] = true
+	return t
+}
+
+// timerCount returns the number of timers that haven't fired or been stopped.
+func (c *fakeClock) timerCount() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.timers)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.now = c.now.Add(d)
+	for _, ch := range c.tickers {
+		select {
+		case ch <- c.now:
+		default:
+		}
+	}
+	for t := range c.timers {
+		if !t.deadline.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+type fakeTicker struct{ c chan time.Time }
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+func (t *fakeTicker) Stop()               {}
+
+type fakeTimer struct {
+	clock    *fakeClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mut.Lock()
+	defer t.clock.mut.Unlock()
+	pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+func TestHeartbeatTimeoutWithFakeClock(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	failed := make(chan struct{})
+	startAgentWithClientOpts(t, []Option{
+		WithClock(clock),
+		WithHeartbeatTimeout(time.Minute),
+		WithHeartbeatFailureHandler(func() { close(failed) }),
+	}, nil)
+
+	clock.Advance(30 * time.Second)
+	select {
+	case <-failed:
+		t.Fatal("heartbeat failure handler called before the timeout")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat failure handler not called after the timeout")
+	}
+}
+
+func TestClientTimeoutsWithFakeClock(t *testing.T) {
+	ctx := context.Background()
+	certs, err := GenerateCerts()
+	require.NoError(t, err)
+
+	// a server that accepts connections but never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			accepted <- conn
+		}
+	}()
+
+	clock := &fakeClock{now: time.Now()}
+	client, err := NewClient(log, certs, "127.0.0.1", l.Addr().(*net.TCPAddr).Port,
+		WithClientClock(clock),
+		WithClientWaitTimeout(time.Minute),
+		WithClientWaitInterval(time.Second),
+	)
+	require.NoError(t, err)
+
+	t.Run("heartbeat", func(t *testing.T) {
+		errCh := make(chan error, 1)
+		go func() { errCh <- client.SendHeartbeat(ctx) }()
+		<-accepted
+
+		clock.Advance(heartbeatRequestTimeout - time.Millisecond)
+		select {
+		case err := <-errCh:
+			t.Fatalf("heartbeat returned before its timeout: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		clock.Advance(time.Millisecond)
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(time.Second):
+			t.Fatal("heartbeat didn't time out")
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		errCh := make(chan error, 1)
+		go func() { errCh <- client.WaitForServerTimeout(ctx) }()
+		require.Eventually(t, func() bool { return clock.timerCount() == 1 }, time.Second, time.Millisecond)
+
+		clock.Advance(time.Minute)
+		select {
+		case err := <-errCh:
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+		case <-time.After(time.Second):
+			t.Fatal("waiting for the server didn't time out")
+		}
+	})
+}
+
+func TestDialWebSocket(t *testing.T) {
+	ctx := context.Background()
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close(websocket.StatusNormalClosure, "")
+		typ, b, err := conn.Read(r.Context())
+		if err != nil {
+			return
+		}
+		_ = conn.Write(r.Context(), typ, bytes.ToUpper(b))
+	})
+	client := startAgentWithClientOpts(t, []Option{WithHandler(http.MethodGet, "/echo", echo)}, nil)
+
+	conn, err := client.DialWebSocket(ctx, "/echo", nil)
+	require.NoError(t, err)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	require.NoError(t, conn.Write(ctx, websocket.MessageText, []byte("hello")))
+	_, b, err := conn.Read(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(b))
+}
+
+func TestClientHeaders(t *testing.T) {
+	ctx := context.Background()
+	var mut sync.Mutex
+	var got []http.Header
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mut.Lock()
+		got = append(got, r.Header.Clone())
+		mut.Unlock()
+		if r.Header.Get("Upgrade") != "" {
+			conn, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				return
+			}
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+	})
+	client := startAgentWithClientOpts(t,
+		[]Option{WithHandler(http.MethodPost, "/record", record), WithHandler(http.MethodGet, "/record", record)},
+		[]ClientOption{
+			WithClientHeaders(http.Header{"Authorization": {"Bearer token"}}),
+			WithClientHeaders(http.Header{"X-Extra": {"a"}, "Content-Type": {"text/plain"}}),
+		},
+	)
+
+	resp, err := client.Do(ctx, http.MethodPost, "/record", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	conn, err := client.DialWebSocket(ctx, "/record", &websocket.DialOptions{HTTPHeader: http.Header{"X-Extra": {"b"}}})
+	require.NoError(t, err)
+	conn.Close(websocket.StatusNormalClosure, "")
+
+	mut.Lock()
+	defer mut.Unlock()
+	require.Len(t, got, 2)
+	assert.Equal(t, "Bearer token", got[0].Get("Authorization"))
+	assert.Equal(t, []string{"a"}, got[0].Values("X-Extra"))
+	// headers set by the client take precedence
+	assert.Equal(t, []string{"application/json"}, got[0].Values("Content-Type"))
+
+	assert.Equal(t, "Bearer token", got[1].Get("Authorization"))
+	assert.Equal(t, []string{"b"}, got[1].Values("X-Extra"))
+	assert.Equal(t, "websocket", got[1].Get("Upgrade"))
+}
+
+func TestFileOpErrors(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, []byte("hello"), 0644))
+
+	// the parent of the path is a file, so the agent fails to write it
+	err := client.SendFile(ctx, filepath.Join(file, "child"), strings.NewReader("hello"))
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusInternalServerError, agentErr.StatusCode)
+	assert.Equal(t, "sending file", agentErr.Action)
+	assert.NotContains(t, agentErr.Message, "{")
+	assert.Contains(t, agentErr.Message, "not a directory")
+	assert.True(t, agentErr.Retryable())
+
+	// nothing is listening on the port
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	downClient, err := NewClient(log, cert, "127.0.0.1", 9997, WithCustomizeRetryableClient(func(c *retryablehttp.Client) { c.RetryMax = 0 }))
+	require.NoError(t, err)
+	_, err = downClient.ReadFile(ctx, file)
+	var transportErr *TransportError
+	require.ErrorAs(t, err, &transportErr)
+	assert.Equal(t, "reading file", transportErr.Action)
+	assert.True(t, transportErr.Retryable())
+	_, err = client.ReadFile(ctx, filepath.Join(dir, "missing"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDo(t *testing.T) {
+	ctx := context.Background()
+	upper := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write(bytes.ToUpper(b))
+	})
+	client := startAgentWithClientOpts(t, []Option{WithHandler(http.MethodPost, "/upper", upper)}, nil)
+
+	resp, err := client.Do(ctx, http.MethodPost, "/upper", strings.NewReader("hello"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "HELLO", string(b))
+
+	resp, err = client.Do(ctx, http.MethodGet, "/nonexistent", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDoHeadersAndRetries(t *testing.T) {
+	ctx := context.Background()
+	contentType := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Content-Type")))
+	})
+	var attempts sync.Map
+	fail := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := attempts.LoadOrStore(r.Method, new(int32))
+		atomic.AddInt32(n.(*int32), 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	client := startAgentWithClientOpts(t, []Option{
+		WithHandler(http.MethodPost, "/content-type", contentType),
+		WithHandler(http.MethodPost, "/fail", fail),
+		WithHandler(http.MethodPut, "/fail", fail),
+	}, nil)
+
+	respBody := func(resp *http.Response) string {
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("default Content-Type", func(t *testing.T) {
+		resp, err := client.Do(ctx, http.MethodPost, "/content-type", nil)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", respBody(resp))
+	})
+	t.Run("Content-Type set by the caller", func(t *testing.T) {
+		resp, err := client.Do(ctx, http.MethodPost, "/content-type", strings.NewReader("a,b"), WithRequestHeader("Content-Type", "text/csv"))
+		require.NoError(t, err)
+		assert.Equal(t, "text/csv", respBody(resp))
+	})
+	t.Run("non-idempotent requests are sent once", func(t *testing.T) {
+		resp, err := client.Do(ctx, http.MethodPost, "/fail", strings.NewReader("x"))
+		require.NoError(t, err)
+		respBody(resp)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		n, _ := attempts.Load(http.MethodPost)
+		assert.EqualValues(t, 1, atomic.LoadInt32(n.(*int32)))
+	})
+	t.Run("idempotent requests are retried", func(t *testing.T) {
+		resp, err := client.Do(ctx, http.MethodPut, "/fail", strings.NewReader("x"))
+		require.NoError(t, err)
+		respBody(resp)
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		n, _ := attempts.Load(http.MethodPut)
+		assert.Greater(t, atomic.LoadInt32(n.(*int32)), int32(1))
+	})
+}
+
+func TestStartProcTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not supported on Windows")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	t.Run("default kills the process", func(t *testing.T) {
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command: "sleep",
+			Args:    []string{"10"},
+			Timeout: 100 * time.Millisecond,
+		})
+		require.NoError(t, err)
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.True(t, res.Signaled)
+		assert.Equal(t, syscall.SIGKILL, res.Signal)
+	})
+
+	t.Run("stop signal lets the process exit gracefully", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command:         "sh",
+			Args:            []string{"-c", `trap 'echo stopping; exit 3' TERM; sleep 10 >/dev/null 2>&1 & wait`},
+			Stdout:          stdout,
+			Timeout:         200 * time.Millisecond,
+			StopSignal:      syscall.SIGTERM,
+			KillGracePeriod: 5 * time.Second,
+		})
+		require.NoError(t, err)
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, res.ExitCode)
+		assert.Equal(t, "stopping\n", stdout.String())
+	})
+
+	t.Run("stop signal without a grace period isn't followed by an immediate kill", func(t *testing.T) {
+		stdout := &bytes.Buffer{}
+		proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+			Command:    "sh",
+			Args:       []string{"-c", `trap 'sleep 0.2; echo stopping; exit 3' TERM; sleep 10 >/dev/null 2>&1 & wait`},
+			Stdout:     stdout,
+			Timeout:    200 * time.Millisecond,
+			StopSignal: syscall.SIGTERM,
+		})
+		require.NoError(t, err)
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 3, res.ExitCode)
+		assert.Equal(t, "stopping\n", stdout.String())
+	})
+}
+
+func TestStartProcStartFailed(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	_, err := client.StartProc(ctx, cluster.StartProcRequest{Command: "/no/such/command"})
+	var startErr *StartError
+	require.ErrorAs(t, err, &startErr)
+	assert.ErrorIs(t, err, ErrStartFailed)
+	var closeErr *CloseError
+	require.ErrorAs(t, err, &closeErr)
+	assert.Equal(t, process.StatusStartFailed, closeErr.Code)
+	assert.Contains(t, closeErr.Reason, "/no/such/command")
+}
+
+func TestStartProcCgroupError(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are only supported on Linux")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+	marker := filepath.Join(t.TempDir(), "marker")
+
+	_, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "sleep 0.3; touch " + marker},
+		CgroupPath: filepath.Join(t.TempDir(), "missing"),
+	})
+	assert.ErrorIs(t, err, ErrStartFailed)
+
+	// the process must have been killed when it couldn't be moved into the cgroup
+	time.Sleep(time.Second)
+	assert.NoFileExists(t, marker)
+}
+
+func TestHideEnvNotLogged(t *testing.T) {
+	ctx := context.Background()
+	core, logs := observer.New(zap.DebugLevel)
+	client := startAgent(t, WithLogger(zap.New(core)))
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "true",
+		Env:     []string{"GREETING=hello", "SECRET=hunter2"},
+		HideEnv: []string{"SECRET"},
+	})
+	require.NoError(t, err)
+	_, err = proc.Wait(ctx)
+	require.NoError(t, err)
+
+	// fields are encoded as JSON like the agent's logger does
+	encode := func(e observer.LoggedEntry) string {
+		b, err := json.Marshal(e.ContextMap())
+		require.NoError(t, err)
+		return e.Message + string(b)
+	}
+	entries := logs.FilterMessage("got first message").All()
+	require.Len(t, entries, 1)
+	logged := encode(entries[0])
+	assert.Contains(t, logged, "GREETING=hello")
+	assert.Contains(t, logged, "SECRET=REDACTED")
+	for _, e := range logs.All() {
+		assert.NotContains(t, encode(e), "hunter2")
+	}
+}
+
+// connRecorder records the connections of a client to the agent, so that tests can cut them.
+type connRecorder struct {
+	mut   sync.Mutex
+	conns []net.Conn
+}
+
+// transport returns a transport whose connections are recorded.
+// The URL's host is the agent's server name, so the agent's address is dialed instead.
+func (r *connRecorder) transport() *http.Transport {
+	dialer := &net.Dialer{}
+	return &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, "127.0.0.1:9998")
+		if err == nil {
+			r.mut.Lock()
+			r.conns = append(r.conns, conn)
+			r.mut.Unlock()
+		}
+		return conn, err
+	}}
+}
+
+// cut closes the recorded connections.
+func (r *connRecorder) cut() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
+
+func TestPartialResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	conns := &connRecorder{}
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientTransport(conns.transport())})
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "echo hello; sleep 10"},
+		StdoutPipe: true,
+	})
+	require.NoError(t, err)
+	stdout := bufio.NewReader(proc.Stdout())
+	line, err := stdout.ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", line)
+
+	conns.cut()
+
+	// the piped output fails with the connection error instead of ending as if it were complete
+	_, err = io.ReadAll(stdout)
+	var protocolErr *ProtocolError
+	assert.ErrorAs(t, err, &protocolErr)
+
+	_, err = proc.Wait(ctx)
+	var partialErr *process.PartialResultError
+	require.ErrorAs(t, err, &partialErr)
+	assert.True(t, partialErr.Started)
+	assert.False(t, partialErr.Exited)
+	assert.Equal(t, int64(6), partialErr.StdoutBytes)
+	assert.Equal(t, int64(0), partialErr.StderrBytes)
+	assert.False(t, partialErr.StdoutComplete)
+	assert.False(t, partialErr.StderrComplete)
+}
+
+func TestStartInfo(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:   "sh",
+		Args:      []string{"-c", "echo $GREETING"},
+		Env:       []string{"GREETING=hello", "SECRET=hunter2"},
+		WD:        dir,
+		HideEnv:   []string{"SECRET"},
+		ExpandEnv: true,
+	})
+	require.NoError(t, err)
+	_, err = proc.Wait(ctx)
+	require.NoError(t, err)
+
+	info, err := proc.(*process.Process).StartInfo(ctx)
+	require.NoError(t, err)
+	shPath, err := exec.LookPath("sh")
+	require.NoError(t, err)
+	assert.Equal(t, shPath, info.Path)
+	assert.Equal(t, []string{"sh", "-c", "echo hello"}, info.Args)
+	assert.Equal(t, []string{"GREETING=hello"}, info.Env)
+	assert.Equal(t, dir, info.WD)
+	assert.NotZero(t, info.PID)
+}
+
+func TestWaitForServerErrors(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("connection refused", func(t *testing.T) {
+		cert, err := GenerateCerts()
+		require.NoError(t, err)
+		client, err := NewClient(log, cert, "127.0.0.1", 9997,
+			WithClientWaitInterval(10*time.Millisecond),
+			WithClientWaitBackoff(2, 50*time.Millisecond),
+			WithClientWaitTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		err = client.WaitForServerTimeout(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Regexp(t, `\d+ probes, [1-9]\d* connection refused, 0 TLS handshake errors`, err.Error())
+	})
+
+	t.Run("shrinking backoff", func(t *testing.T) {
+		cert, err := GenerateCerts()
+		require.NoError(t, err)
+		client, err := NewClient(log, cert, "127.0.0.1", 9997,
+			WithClientWaitInterval(0),
+			WithClientWaitBackoff(0.5, 0),
+			WithClientWaitTimeout(200*time.Millisecond),
+		)
+		require.NoError(t, err)
+		err = client.WaitForServerTimeout(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("TLS handshake error", func(t *testing.T) {
+		startAgent(t)
+		otherCert, err := GenerateCerts()
+		require.NoError(t, err)
+		client, err := NewClient(log, otherCert, "127.0.0.1", 9998,
+			WithClientWaitInterval(10*time.Millisecond),
+			WithClientWaitTimeout(500*time.Millisecond),
+		)
+		require.NoError(t, err)
+		err = client.WaitForServerTimeout(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Regexp(t, `\d+ probes, 0 connection refused, [1-9]\d* TLS handshake errors`, err.Error())
+	})
+}
+
+func TestMaxFileTransfers(t *testing.T) {
+	ctx := context.Background()
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientMaxFileTransfers(1)})
+	dir := t.TempDir()
+	require.NoError(t, client.SendFile(ctx, filepath.Join(dir, "a"), strings.NewReader("a")))
+
+	// an open file holds the only transfer slot, so other transfers queue until it's closed
+	f, err := client.ReadFile(ctx, filepath.Join(dir, "a"))
+	require.NoError(t, err)
+
+	sent := make(chan error, 1)
+	go func() { sent <- client.SendFile(ctx, filepath.Join(dir, "b"), strings.NewReader("b")) }()
+	select {
+	case err := <-sent:
+		t.Fatalf("transfer finished while the slot was held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = client.ReadFile(timeoutCtx, filepath.Join(dir, "a"))
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	require.NoError(t, f.Close())
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("transfer did not finish after the slot was released")
+	}
+}
+
+func TestFileTransfersUnlimitedByDefault(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+	require.NoError(t, client.SendFile(ctx, filepath.Join(dir, "a"), strings.NewReader("a")))
+
+	// open files don't hold up other transfers without a limit
+	for i := 0; i < 20; i++ {
+		f, err := client.ReadFile(ctx, filepath.Join(dir, "a"))
+		require.NoError(t, err)
+		defer f.Close()
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	require.NoError(t, client.SendFile(timeoutCtx, filepath.Join(dir, "b"), strings.NewReader("b")))
+}
+
+func TestReadFileCancel(t *testing.T) {
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientMaxFileTransfers(1)})
+	dir := t.TempDir()
+
+	// a sparse file that would take a long time to transfer and a lot of memory to buffer
+	huge := filepath.Join(dir, "huge")
+	f, err := os.Create(huge)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4*1024*1024*1024))
+	require.NoError(t, f.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rc, err := client.ReadFile(ctx, huge)
+	require.NoError(t, err)
+	b := make([]byte, 16)
+	_, err = io.ReadFull(rc, b)
+	require.NoError(t, err)
+	assert.Equal(t, make([]byte, 16), b)
+
+	cancel()
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, rc)
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reading did not stop after canceling the context")
+	}
+	require.NoError(t, rc.Close())
+
+	// closing the file released the only transfer slot
+	small := filepath.Join(dir, "small")
+	require.NoError(t, os.WriteFile(small, []byte("hello"), 0644))
+	timeoutCtx, timeoutCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer timeoutCancel()
+	rc, err = client.ReadFile(timeoutCtx, small)
+	require.NoError(t, err)
+	defer rc.Close()
+	contents, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(contents))
+}
+
+func TestRequestTiming(t *testing.T) {
+	ctx := context.Background()
+	var mut sync.Mutex
+	var timings []RequestTiming
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientRequestTiming(func(timing RequestTiming) {
+		mut.Lock()
+		defer mut.Unlock()
+		timings = append(timings, timing)
+	})})
+	_, err := client.Info(ctx)
+	require.NoError(t, err)
+
+	mut.Lock()
+	defer mut.Unlock()
+	require.Len(t, timings, 2)
+
+	// the first request when waiting for the server establishes the connection, which the next request reuses
+	assert.Equal(t, "/heartbeat", timings[0].Path)
+	assert.False(t, timings[0].ReusedConn)
+	assert.NotZero(t, timings[0].Connect)
+	assert.NotZero(t, timings[0].TLSHandshake)
+	assert.GreaterOrEqual(t, timings[0].FirstByte, timings[0].Connect+timings[0].TLSHandshake)
+
+	assert.Equal(t, "/info", timings[1].Path)
+	assert.Equal(t, http.MethodGet, timings[1].Method)
+	assert.True(t, timings[1].ReusedConn)
+	assert.Zero(t, timings[1].TLSHandshake)
+	assert.NotZero(t, timings[1].FirstByte)
+}
+
+func TestHeartbeatConnectionReuse(t *testing.T) {
+	cases := []struct {
+		name       string
+		opts       []ClientOption
+		expReusing bool
+	}{
+		{name: "keep-alive by default", expReusing: true},
+		{name: "closed with WithClientCloseConns", opts: []ClientOption{WithClientCloseConns()}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			var mut sync.Mutex
+			var timings []RequestTiming
+			opts := append([]ClientOption{WithClientRequestTiming(func(timing RequestTiming) {
+				mut.Lock()
+				defer mut.Unlock()
+				timings = append(timings, timing)
+			})}, c.opts...)
+			client := startAgentWithClientOpts(t, nil, opts)
+			for i := 0; i < 3; i++ {
+				require.NoError(t, client.SendHeartbeat(ctx))
+			}
+
+			mut.Lock()
+			defer mut.Unlock()
+			// the first heartbeat is sent when waiting for the server
+			require.Len(t, timings, 4)
+			for _, timing := range timings[1:] {
+				assert.Equal(t, "/heartbeat", timing.Path)
+				assert.Equal(t, c.expReusing, timing.ReusedConn)
+			}
+		})
+	}
+}
+
+func TestStdinPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", `while read line; do echo "got $line"; done`},
+		StdinPipe:  true,
+		StdoutPipe: true,
+	})
+	require.NoError(t, err)
+
+	// each input is written after reading the output for the previous one
+	stdout := bufio.NewReader(proc.Stdout())
+	for _, s := range []string{"a", "b"} {
+		_, err := io.WriteString(proc.Stdin(), s+"\n")
+		require.NoError(t, err)
+		line, err := stdout.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "got "+s+"\n", line)
+	}
+	require.NoError(t, proc.Stdin().Close())
+
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+
+	proc, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "true"})
+	require.NoError(t, err)
+	_, err = proc.Stdin().Write([]byte("a"))
+	assert.ErrorIs(t, err, cluster.ErrStdinNotPiped)
+	_, err = proc.Wait(ctx)
+	require.NoError(t, err)
+}
+
+func TestLargeOutputWrite(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	blob := make([]byte, 8*1024*1024)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	blobFile := filepath.Join(dir, "blob")
+	require.NoError(t, os.WriteFile(blobFile, blob, 0644))
+
+	for _, maxMessageSize := range []int{0, process.MinMaxMessageSize, 1024 * 1024} {
+		t.Run(fmt.Sprintf("max message size %d", maxMessageSize), func(t *testing.T) {
+			client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientMaxMessageSize(maxMessageSize)})
+			stdout := &bytes.Buffer{}
+			// dd writes the blob to stdout in a single write, and the output buffer is written in large chunks too
+			proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+				Command:          "dd",
+				Args:             []string{"if=" + blobFile, "bs=8M", "count=1", "status=none"},
+				Stdout:           stdout,
+				OutputBufferSize: 16 * 1024 * 1024,
+			})
+			require.NoError(t, err)
+			res, err := proc.Wait(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 0, res.ExitCode)
+			assert.Zero(t, res.StdoutDroppedBytes)
+			assert.True(t, bytes.Equal(blob, stdout.Bytes()), "stdout differs from the blob")
+		})
+	}
+
+	cert, err := GenerateCerts()
+	require.NoError(t, err)
+	client, err := NewClient(log, cert, "127.0.0.1", 9998, WithClientMaxMessageSize(100))
+	require.NoError(t, err)
+	_, err = client.StartProc(ctx, cluster.StartProcRequest{Command: "true"})
+	assert.ErrorContains(t, err, "less than the minimum")
+}
+
+func TestTempDir(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	dir, cleanup, err := client.TempDir(ctx, "clustertest-")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(filepath.Base(dir), "clustertest-"))
+	require.NoError(t, client.SendFile(ctx, filepath.Join(dir, "sub", "file"), strings.NewReader("hi")))
+
+	otherDir, otherCleanup, err := client.TempDir(ctx, "clustertest-")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, otherCleanup(ctx)) })
+	assert.NotEqual(t, dir, otherDir)
+
+	require.NoError(t, cleanup(ctx))
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, cleanup(ctx))
+
+	require.NoError(t, client.RemoveAll(ctx, dir))
+}
+
+func TestRemoveGlob(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test-a"), []byte("a"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "test-b", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test-b", "sub", "c"), []byte("c"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0644))
+
+	removed, err := client.RemoveGlob(ctx, filepath.Join(dir, "test-*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "test-a"), filepath.Join(dir, "test-b")}, removed)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "other", entries[0].Name())
+
+	removed, err = client.RemoveGlob(ctx, filepath.Join(dir, "test-*"))
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	_, err = client.RemoveGlob(ctx, "test-*")
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusBadRequest, agentErr.StatusCode)
+
+	// removal continues past paths that can't be removed, which root can remove regardless of permissions
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		return
+	}
+	locked := filepath.Join(dir, "test-locked")
+	require.NoError(t, os.MkdirAll(locked, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(locked, "file"), []byte("file"), 0644))
+	require.NoError(t, os.Chmod(locked, 0555))
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test-z"), []byte("z"), 0644))
+
+	removed, err = client.RemoveGlob(ctx, filepath.Join(dir, "test-*"))
+	var globErr *RemoveGlobError
+	require.ErrorAs(t, err, &globErr)
+	require.Len(t, globErr.Failed, 1)
+	assert.Equal(t, locked, globErr.Failed[0].Path)
+	assert.Equal(t, []string{filepath.Join(dir, "test-z")}, removed)
+}
+
+func TestEnviron(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("CLUSTERTEST_GREETING", "hello")
+	t.Setenv("CLUSTERTEST_SECRET_TOKEN", "hunter2")
+	client := startAgent(t)
+
+	env, err := client.Environ(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, env, "CLUSTERTEST_GREETING=hello")
+	assert.Contains(t, env, "CLUSTERTEST_SECRET_TOKEN=hunter2")
+
+	env, err = client.Environ(ctx, "*SECRET*", "*PASSWORD*")
+	require.NoError(t, err)
+	assert.Contains(t, env, "CLUSTERTEST_GREETING=hello")
+	assert.Contains(t, env, "CLUSTERTEST_SECRET_TOKEN="+RedactedValue)
+
+	_, err = client.Environ(ctx, "[")
+	assert.ErrorContains(t, err, "invalid pattern")
+}
+
+// infiniteReader is an infinite reader that counts the bytes read from it.
+type infiniteReader struct{ n int64 }
+
+func (r *infiniteReader) Read(b []byte) (int, error) {
+	atomic.AddInt64(&r.n, int64(len(b)))
+	return len(b), nil
+}
+
+func TestStdinFunc(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+
+	chunks := []string{"foo", "", "bar", "baz"}
+	i := 0
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command: "cat",
+		StdinFunc: func() ([]byte, bool) {
+			chunk := chunks[i]
+			i++
+			return []byte(chunk), i == len(chunks)
+		},
+		Stdout: stdout,
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "foobarbaz", stdout.String())
+
+	_, err = client.StartProc(ctx, cluster.StartProcRequest{
+		Command:     "cat",
+		StdinString: "foo",
+		StdinFunc:   func() ([]byte, bool) { return nil, true },
+	})
+	assert.ErrorContains(t, err, "only one of")
+
+	// the generator isn't called after the context is done, and stdin ends with the context's error
+	cancelCtx, cancel := context.WithCancel(ctx)
+	reader, err := cluster.StartProcRequest{StdinFunc: func() ([]byte, bool) {
+		cancel()
+		return []byte("foo"), false
+	}}.StdinReaderContext(cancelCtx)
+	require.NoError(t, err)
+	b, err := io.ReadAll(reader)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, "foo", string(b))
+}
+
+func TestStdinWindow(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sleep")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := startAgent(t)
+
+	// the process never reads stdin, so only the window and the pipe buffer should be read from the infinite stdin
+	stdin := &infiniteReader{}
+	_, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:        "sleep",
+		Args:           []string{"10"},
+		Stdin:          stdin,
+		StdinChunkSize: 16 * 1024,
+		StdinWindow:    64 * 1024,
+	})
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+	n := atomic.LoadInt64(&stdin.n)
+	assert.Greater(t, n, int64(0))
+	assert.Less(t, n, int64(process.DefaultStdinWindow))
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "agent.log")
+	require.NoError(t, os.WriteFile(logPath, []byte("agent log"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "extra", "sub"), 0755))
+	extraPath := filepath.Join(dir, "extra", "sub", "file")
+	require.NoError(t, os.WriteFile(extraPath, []byte("extra"), 0644))
+	missingPath := filepath.Join(dir, "missing")
+
+	client := startAgent(t, WithDiagnosticsPaths(logPath))
+
+	rc, err := client.CollectDiagnostics(ctx, filepath.Join(dir, "extra"), missingPath)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	files := map[string]string{}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		files[hdr.Name] = string(b)
+	}
+	trim := func(p string) string { return strings.TrimPrefix(filepath.ToSlash(p), "/") }
+	assert.Equal(t, "agent log", files[trim(logPath)])
+	assert.Equal(t, "extra", files[trim(extraPath)])
+	assert.Contains(t, files["diagnostics-errors.txt"], missingPath)
+	assert.Len(t, files, 3)
+
+	_, err = client.CollectDiagnostics(ctx, "relative")
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusBadRequest, agentErr.StatusCode)
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	ctx := context.Background()
+	startServer := func(protocols []string) *process.Client {
+		server := &process.Server{Log: log, Protocols: protocols}
+		httpServer := httptest.NewServer(server)
+		t.Cleanup(httpServer.Close)
+		return &process.Client{HTTPClient: httpServer.Client(), URL: httpServer.URL, Logger: log}
+	}
+
+	client := startServer(nil)
+	proc, err := client.StartProc(ctx, process.StartProcRequest{Command: "true"})
+	require.NoError(t, err)
+	assert.Equal(t, process.ProtocolV2, proc.Protocol())
+	_, err = proc.Wait(ctx)
+	require.NoError(t, err)
+
+	// an older server doesn't acknowledge stdin, so stdin beyond the flow control window must not block
+	oldClient := startServer([]string{process.ProtocolV1})
+	stdin := bytes.Repeat([]byte("a"), 4*1024*1024)
+	stdout := &bytes.Buffer{}
+	proc, err = oldClient.StartProc(ctx, process.StartProcRequest{
+		Command: "wc",
+		Args:    []string{"-c"},
+		Stdin:   process.InputFD{Reader: bytes.NewReader(stdin)},
+		Stdout:  process.OutputFD{Writer: stdout},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, process.ProtocolV1, proc.Protocol())
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, strconv.Itoa(len(stdin)), strings.TrimSpace(stdout.String()))
+
+	// an older server would ignore newer options, so they are rejected instead
+	for name, req := range map[string]process.StartProcRequest{
+		"Credential":   {Credential: &cluster.Credential{UID: 1000, GID: 1000}},
+		"CgroupPath":   {CgroupPath: "/sys/fs/cgroup/test"},
+		"Timeout":      {Timeout: time.Second},
+		"StopSignal":   {StopSignal: syscall.SIGTERM},
+		"HideEnv":      {HideEnv: []string{"SECRET"}},
+		"CleanEnv":     {CleanEnv: true},
+		"Stdin.Window": {Stdin: process.InputFD{Window: 1024}},
+		"CancelPolicy": {CancelPolicy: &cluster.CancelPolicy{}},
+	} {
+		req.Command = "true"
+		_, err = oldClient.StartProc(ctx, req)
+		var protocolErr *process.ProtocolError
+		assert.ErrorAs(t, err, &protocolErr, name)
+		assert.ErrorContains(t, err, name)
+	}
+
+	oldClient.MaxMessageSize = 2 * process.DefaultMaxMessageSize
+	_, err = oldClient.StartProc(ctx, process.StartProcRequest{Command: "true"})
+	var protocolErr *process.ProtocolError
+	assert.ErrorAs(t, err, &protocolErr)
+}
+
+func TestSendFileCanceled(t *testing.T) {
+	client := startAgent(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(path, []byte("original"), 0644))
+	dirEntries := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	assertOriginal := func() {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "original", string(b))
+	}
+
+	t.Run("client", func(t *testing.T) {
+		// the contents block partway, until the upload is canceled
+		ctx, cancel := context.WithCancel(context.Background())
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte("partial contents"))
+			<-ctx.Done()
+			pw.CloseWithError(ctx.Err())
+		}()
+		time.AfterFunc(100*time.Millisecond, cancel)
+		err := client.SendFile(ctx, path, pr)
+		assert.ErrorIs(t, err, context.Canceled)
+		assertOriginal()
+		assert.Equal(t, []string{"file"}, dirEntries())
+	})
+
+	t.Run("streamed", func(t *testing.T) {
+		// stream the upload with the underlying transport, since the retrying client buffers request bodies,
+		// so that the agent receives part of it before it's canceled
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		pr, pw := io.Pipe()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, client.baseURL+"/file"+filepath.ToSlash(path), pr)
+		require.NoError(t, err)
+		client.prepReq(req)
+		errCh := make(chan error, 1)
+		go func() {
+			resp, err := client.noRetryClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			errCh <- err
+		}()
+
+		_, err = pw.Write([]byte("partial contents"))
+		require.NoError(t, err)
+		// the partial contents are written aside, and the file isn't truncated
+		assert.Eventually(t, func() bool { return len(dirEntries()) == 2 }, 5*time.Second, 10*time.Millisecond)
+		assertOriginal()
+
+		// the transport waits for the body read to return before returning the cancellation
+		cancel()
+		pw.CloseWithError(context.Canceled)
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+		assert.Eventually(t, func() bool { return len(dirEntries()) == 1 }, 5*time.Second, 10*time.Millisecond)
+		assertOriginal()
+	})
+}
+
+func TestSendBytes(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "sub", "config")
+	err := client.SendBytes(ctx, path, []byte("key: value"), SendMode(0600), SendChecksum(ChecksumCRC32C))
+	require.NoError(t, err)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "key: value", string(b))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// a corrupted upload is detected by the checksum and doesn't replace the file
+	header := http.Header{FileChecksumHeader: {"sha256:" + strings.Repeat("0", 64)}}
+	_, err = client.sendFile(ctx, path, strings.NewReader("corrupted"), -1, header)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "key: value", string(b))
+
+	err = client.SendBytes(ctx, path, []byte("x"), SendChecksum("md5"))
+	assert.ErrorContains(t, err, "unsupported checksum algorithm")
+}
+
+func TestSendCompressed(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+
+	text := strings.Repeat("a line of a large text fixture\n", 1000)
+	path := filepath.Join(dir, "fixture.txt")
+	res, err := client.SendFileWithOptions(ctx, path, strings.NewReader(text), SendCompressed(), SendChecksum(ChecksumSHA256))
+	require.NoError(t, err)
+	assert.True(t, res.Compressed)
+	assert.Equal(t, int64(len(text)), res.DiskBytes)
+	assert.Less(t, res.WireBytes, res.DiskBytes/10)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, text, string(b))
+
+	// already-compressed contents are sent as-is
+	gzipped := &bytes.Buffer{}
+	gz := gzip.NewWriter(gzipped)
+	_, err = gz.Write([]byte(text))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	path = filepath.Join(dir, "fixture.txt.gz")
+	res, err = client.SendFileWithOptions(ctx, path, bytes.NewReader(gzipped.Bytes()), SendCompressed())
+	require.NoError(t, err)
+	assert.False(t, res.Compressed)
+	assert.Equal(t, int64(gzipped.Len()), res.WireBytes)
+	assert.Equal(t, int64(gzipped.Len()), res.DiskBytes)
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, gzipped.Bytes(), b)
+
+	_, err = client.sendFile(ctx, path, strings.NewReader("x"), -1, http.Header{"Content-Encoding": {"br"}})
+	var agentErr *AgentError
+	require.ErrorAs(t, err, &agentErr)
+	assert.Equal(t, http.StatusUnsupportedMediaType, agentErr.StatusCode)
+}
+
+func TestSendCompressedNotSent(t *testing.T) {
+	ctx := context.Background()
+	client := startAgentWithClientOpts(t, nil, []ClientOption{WithClientMaxFileTransfers(1)})
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file")
+	require.NoError(t, client.SendFile(ctx, path, strings.NewReader("x")))
+
+	// an open file holds the only transfer slot, so the upload gives up before sending its body
+	f, err := client.ReadFile(ctx, path)
+	require.NoError(t, err)
+	defer f.Close()
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	text := strings.Repeat("a line of a large text fixture\n", 1000)
+	_, err = client.SendFileWithOptions(shortCtx, path, strings.NewReader(text), SendCompressed())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the body is no longer compressed once the upload gives up
+	assert.Eventually(t, func() bool {
+		stacks := make([]byte, 1<<20)
+		return !bytes.Contains(stacks[:runtime.Stack(stacks, true)], []byte("agent.gzipReader"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestChecksum(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local")
+	require.NoError(t, os.WriteFile(localPath, []byte("hello world"), 0644))
+	remotePath := filepath.Join(dir, "remote")
+	_, err := client.SendLocalFile(ctx, localPath, remotePath)
+	require.NoError(t, err)
+
+	for algo, expected := range map[ChecksumAlgorithm]string{
+		ChecksumSHA256: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9",
+		ChecksumCRC32C: "c99465aa",
+	} {
+		sum, err := client.Checksum(ctx, remotePath, algo)
+		require.NoError(t, err)
+		assert.Equal(t, expected, sum)
+		localSum, err := FileChecksum(localPath, algo)
+		require.NoError(t, err)
+		assert.Equal(t, localSum, sum)
+	}
+
+	_, err = client.Checksum(ctx, filepath.Join(dir, "nonexistent"), ChecksumSHA256)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = client.Checksum(ctx, remotePath, "md5")
+	assert.ErrorContains(t, err, "unsupported checksum algorithm")
+}
+
+func TestPipedOutputBeforeRead(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses sh")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "echo ready"},
+		StdoutPipe: true,
+	})
+	require.NoError(t, err)
+
+	// the process writes its output and exits before the reader is first read
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, res.ExitCode)
+
+	line, err := bufio.NewReader(proc.Stdout()).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ready\n", line)
+}
+
+func TestErrorCoalescer(t *testing.T) {
+	e := &ErrorCoalescer{Window: time.Minute}
+	start := time.Now()
+	errDown := errors.New("connection refused")
+	observe := func(d time.Duration, err error) string {
+		msg, ok := e.Observe(start.Add(d), err)
+		if !ok {
+			return ""
+		}
+		return msg
+	}
+
+	assert.Equal(t, "", observe(0, nil))
+	assert.Equal(t, "connection refused", observe(0, errDown))
+	assert.Equal(t, "", observe(10*time.Second, errDown))
+	assert.Equal(t, "", observe(20*time.Second, errDown))
+	assert.Equal(t, "connection refused (repeated 3 times in 1m0s)", observe(time.Minute, errDown))
+	assert.Equal(t, "", observe(70*time.Second, errDown))
+	assert.Equal(t, "timeout (previous error repeated 1 more times)", observe(80*time.Second, errors.New("timeout")))
+	assert.Equal(t, "recovered after 6 consecutive failures", observe(90*time.Second, nil))
+	assert.Equal(t, "", observe(100*time.Second, nil))
+	assert.Equal(t, "connection refused", observe(110*time.Second, errDown))
+}
+
+func TestCleanEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses env")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	run := func(req cluster.StartProcRequest) string {
+		stdout := &bytes.Buffer{}
+		req.Command = "env"
+		req.Stdout = stdout
+		proc, err := client.StartProc(ctx, req)
+		require.NoError(t, err)
+		res, err := proc.Wait(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 0, res.ExitCode)
+		return stdout.String()
+	}
+
+	assert.Equal(t, "A=1\n", run(cluster.StartProcRequest{Env: []string{"A=1"}, CleanEnv: true}))
+	assert.Equal(t, "", run(cluster.StartProcRequest{CleanEnv: true}))
+
+	// by default the env is added to the agent's, taking precedence
+	t.Setenv("CLUSTERTEST_INHERITED", "inherited")
+	env := run(cluster.StartProcRequest{Env: []string{"A=1", "PATH=/overridden"}})
+	assert.Contains(t, env, "A=1\n")
+	assert.Contains(t, env, "CLUSTERTEST_INHERITED=inherited\n")
+	assert.Contains(t, env, "PATH=/overridden\n")
+	assert.NotContains(t, env, "PATH="+os.Getenv("PATH")+"\n")
+}
+
+func TestEnvLastDefinitionWins(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses env")
+	}
+	ctx := context.Background()
+	client := startAgent(t)
+
+	stdout := &bytes.Buffer{}
+	proc, err := client.StartProc(ctx, cluster.StartProcRequest{
+		Command:  "env",
+		Env:      append([]string{"B=1", "A=1"}, cluster.EnvFromMap(map[string]string{"B": "2", "C": "3"})...),
+		CleanEnv: true,
+		Stdout:   stdout,
+	})
+	require.NoError(t, err)
+	res, err := proc.Wait(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "A=1\nB=2\nC=3\n", stdout.String())
+
+	info, err := proc.(*process.Process).StartInfo(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A=1", "B=2", "C=3"}, info.Env)
+}
@@ -1,18 +1,31 @@
 package agent
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/guseggert/clustertest/agent/process"
@@ -22,38 +35,295 @@ import (
 	"nhooyr.io/websocket"
 )
 
+// ErrTooManyProcesses is returned when starting a process that the agent rejected because of its concurrency limit.
+// The process was never started, so it's safe to retry later.
+var ErrTooManyProcesses = process.ErrTooManyProcesses
+
+// ErrCommandNotAllowed is returned when starting a process that the agent rejected because of its CommandPolicy.
+var ErrCommandNotAllowed = process.ErrCommandNotAllowed
+
+// ErrStartFailed is returned when the agent fails to start a process, such as when its command isn't found.
+var ErrStartFailed = process.ErrStartFailed
+
+// StartError is returned when starting a process that the agent rejected or failed to start,
+// as opposed to a failure of the running process.
+type StartError = process.StartError
+
+// DialError is returned when starting a process fails because the connection to the agent can't be established.
+type DialError = process.DialError
+
+// PartialResultError is returned when waiting on a process fails before its result is received, and describes how far it got.
+type PartialResultError = process.PartialResultError
+
+// StartInfo describes how the agent started a process, see process.Process.StartInfo.
+type StartInfo = process.StartInfo
+
+// ProtocolError is returned when communicating with the agent about a process fails after connecting.
+type ProtocolError = process.ProtocolError
+
+// CloseError is the close status and reason of a process connection that the agent closed before the process exited.
+type CloseError = process.CloseError
+
+// ErrCrossDevice is returned when renaming a file across filesystems on the node.
+var ErrCrossDevice = errors.New("cannot rename across filesystems")
+
 type Client struct {
 	Logger     *zap.SugaredLogger
 	HTTPClient *http.Client
 
 	host                     string
+	agentAddr                string
+	basePath                 string
 	tlsClientConfig          *tls.Config
 	dialCtx                  func(ctx context.Context, network, addr string) (net.Conn, error)
 	baseURL                  string
 	customizeRetryableClient func(*retryablehttp.Client)
+	transport                http.RoundTripper
+	closeConns               bool
+	insecureNoTLS            bool
+	headers                  http.Header
+	clock                    Clock
+	processHooks             process.Hooks
+	envFromContext           func(context.Context) []string
+	defaultWD                string
+	defaultEnv               []string
 	commandClient            *process.Client
+	onRequestTiming          func(RequestTiming)
+	maxMessageSize           int
+	// transferSem bounds the number of concurrent file transfers, if not nil.
+	transferSem  chan struct{}
+	maxTransfers int
 
-	waitInterval time.Duration
+	waitInterval      time.Duration
+	waitTimeout       time.Duration
+	waitProbeTimeout  time.Duration
+	waitBackoffFactor float64
+	waitMaxInterval   time.Duration
+	// noRetryClient sends requests without retries, such as server probes.
+	noRetryClient *http.Client
+
+	maxConnsPerHost     int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	keepAlive           time.Duration
 
 	startHeartbeatOnce sync.Once
 	stopHeartbeatOnce  sync.Once
 	stopHeartbeat      chan struct{}
+	heartbeatErrors    *ErrorCoalescer
+
+	// info is the agent's info, cached for negotiating features such as compressed uploads.
+	infoMut sync.Mutex
+	info    *InfoResponse
 }
 
 type ClientOption func(c *Client)
 
+// WithClientWaitInterval sets the interval before the first probe when waiting for the server (default 100ms),
+// see WithClientWaitBackoff for how it changes between probes.
 func WithClientWaitInterval(d time.Duration) ClientOption {
 	return func(c *Client) {
 		c.waitInterval = d
 	}
 }
 
+// WithClientMaxMessageSize sets the maximum size of the WebSocket messages used to run processes (default 32 KiB, minimum 4 KiB).
+// Stdin and output of any size are split across messages, so this only trades memory for per-message overhead.
+func WithClientMaxMessageSize(n int) ClientOption {
+	return func(c *Client) {
+		c.maxMessageSize = n
+	}
+}
+
+// WithClientMaxFileTransfers limits the number of concurrent file transfers with the node, such as SendFile and ReadFile,
+// so that bulk transfers don't saturate the node's disk and starve other operations. By default there is no limit.
+// Transfers beyond the limit wait for a running transfer to finish. A file being read holds its slot until it is closed,
+// so with a limit, leaving a file open can block other transfers. Zero means no limit.
+func WithClientMaxFileTransfers(n int) ClientOption {
+	return func(c *Client) {
+		c.maxTransfers = n
+	}
+}
+
+// WithClientWaitProbeTimeout sets the timeout of each probe when waiting for the server (default 2s).
+func WithClientWaitProbeTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.waitProbeTimeout = d
+	}
+}
+
+// WithClientWaitBackoff multiplies the interval between probes by factor after each failed probe when waiting for the server,
+// up to maxInterval if it's greater than zero. This is useful for slow-booting nodes, to probe often at first and less often later.
+// By default, the interval is fixed. Factors below 1 are treated as 1, since a shrinking interval would end up probing in a busy loop.
+func WithClientWaitBackoff(factor float64, maxInterval time.Duration) ClientOption {
+	return func(c *Client) {
+		c.waitBackoffFactor = factor
+		c.waitMaxInterval = maxInterval
+	}
+}
+
+// WithClientBasePath sets a path prefix under which all agent endpoints are served, such as "/agents/1".
+// This is useful when the agent is behind a path-routing proxy, see also WithBasePath for the agent.
+func WithClientBasePath(p string) ClientOption {
+	return func(c *Client) {
+		c.basePath = cleanBasePath(p)
+	}
+}
+
+// cleanBasePath normalizes a base path to either be empty or to have a leading slash and no trailing slash.
+func cleanBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// WithClientWaitTimeout sets the overall timeout used by WaitForServerTimeout (default 5m).
+func WithClientWaitTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.waitTimeout = d
+	}
+}
+
+// WithClientMaxConnsPerHost limits the number of concurrent connections to the agent (default 100).
+// Requests beyond the limit wait for a connection to become available.
+// Note that running processes and Dial'd connections each hold a connection for their lifetime,
+// so this also bounds the number of concurrent processes and tunneled connections.
+// Zero means no limit.
+func WithClientMaxConnsPerHost(n int) ClientOption {
+	return func(c *Client) {
+		c.maxConnsPerHost = n
+	}
+}
+
+// WithClientMaxIdleConns sets the maximum number of idle keep-alive connections to keep open to the agent (default 10).
+func WithClientMaxIdleConns(n int) ClientOption {
+	return func(c *Client) {
+		c.maxIdleConnsPerHost = n
+	}
+}
+
+// WithClientIdleConnTimeout sets how long an idle keep-alive connection remains open before closing itself (default 90s).
+// Zero means no limit.
+func WithClientIdleConnTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.idleConnTimeout = d
+	}
+}
+
+// WithClientKeepAlive sets the interval between TCP keep-alive probes on connections to the agent (default 30s).
+// A negative value disables keep-alive probes.
+func WithClientKeepAlive(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.keepAlive = d
+	}
+}
+
 func WithClientLogger(l *zap.Logger) ClientOption {
 	return func(c *Client) {
 		c.Logger = l.Named("nodeagentclient").Sugar()
 	}
 }
 
+// WithClientHeaders adds the headers to every request to the agent, including WebSocket handshakes,
+// such as a bearer token for an auth proxy in front of the agent. Multiple calls are merged.
+// Headers that the client sets itself, such as Content-Type, take precedence.
+func WithClientHeaders(h http.Header) ClientOption {
+	return func(c *Client) {
+		if c.headers == nil {
+			c.headers = http.Header{}
+		}
+		for k, vs := range h {
+			for _, v := range vs {
+				c.headers.Add(k, v)
+			}
+		}
+	}
+}
+
+// WithClientServerName sets the name that the agent's cert is verified against, which is also sent as the SNI and Host header
+// (default DefaultServerName). This is for agents whose certs are issued for other names.
+// The name is never resolved, since the client always dials the node's address.
+func WithClientServerName(name string) ClientOption {
+	return func(c *Client) {
+		c.host = name
+	}
+}
+
+// WithClientInsecureNoTLS connects to the agent over plain HTTP instead of mTLS, for agents run with WithInsecureNoTLS.
+// Traffic is neither encrypted nor authenticated, so this must only be used on a fully trusted network, such as a local Docker network,
+// and never for remote nodes. The client's certs are not used and may be nil.
+func WithClientInsecureNoTLS() ClientOption {
+	return func(c *Client) {
+		c.insecureNoTLS = true
+	}
+}
+
+// WithClientHeartbeatLogWindow sets the window over which repeated identical heartbeat errors are coalesced into a single log line
+// (default DefaultErrorLogWindow), so that an unreachable node doesn't flood the logs. Zero logs every error.
+func WithClientHeartbeatLogWindow(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.heartbeatErrors.Window = d
+	}
+}
+
+// WithClientClock sets the clock used for the heartbeat and server wait intervals, and for the dial, heartbeat and wait timeouts,
+// such as a fake clock in tests.
+func WithClientClock(clock Clock) ClientOption {
+	return func(c *Client) {
+		c.clock = clock
+	}
+}
+
+// WithClientCloseConns closes the connection after each request to the agent, instead of reusing connections.
+// By default connections are kept alive, so that frequent requests like heartbeats don't each pay for a TLS handshake.
+func WithClientCloseConns() ClientOption {
+	return func(c *Client) {
+		c.closeConns = true
+	}
+}
+
+// WithClientTransport sets the transport used for all requests to the agent, instead of the built-in one, such as for fault injection or request recording.
+// If the transport is an *http.Transport, the client's mTLS config and agent dialer are set on it unless already set, so it shouldn't be shared between clients.
+// Otherwise the transport is responsible for dialing the agent and for mTLS, and connection options such as WithClientMaxConnsPerHost are ignored.
+func WithClientTransport(rt http.RoundTripper) ClientOption {
+	return func(c *Client) {
+		c.transport = rt
+	}
+}
+
+// WithClientProcessHooks sets hooks that receive lifecycle events of the processes started by the client.
+func WithClientProcessHooks(h process.Hooks) ClientOption {
+	return func(c *Client) {
+		c.processHooks = h
+	}
+}
+
+// WithClientEnvFromContext sets a function that extracts env vars from the context passed to StartProc,
+// in "KEY=value" form, and adds them to the environment of the process, such as to propagate a trace ID.
+// Env vars in the request take precedence over the extracted ones.
+func WithClientEnvFromContext(f func(ctx context.Context) []string) ClientOption {
+	return func(c *Client) {
+		c.envFromContext = f
+	}
+}
+
+// WithClientDefaultWD sets the working directory of processes started by the client whose requests don't set one.
+func WithClientDefaultWD(dir string) ClientOption {
+	return func(c *Client) {
+		c.defaultWD = dir
+	}
+}
+
+// WithClientDefaultEnv adds env vars in "KEY=value" form to the environment of every process started by the client.
+// Env vars in the request take precedence over these.
+func WithClientDefaultEnv(env ...string) ClientOption {
+	return func(c *Client) {
+		c.defaultEnv = append(c.defaultEnv, env...)
+	}
+}
+
 func WithCustomizeRetryableClient(f func(r *retryablehttp.Client)) ClientOption {
 	return func(c *Client) {
 		c.customizeRetryableClient = f
@@ -67,52 +337,89 @@ type logAdapter struct {
 func (a *logAdapter) Printf(msg string, args ...interface{}) { a.Debugf(msg, args...) }
 
 func NewClient(log *zap.SugaredLogger, certs *Certs, ipAddr string, port int, opts ...ClientOption) (*Client, error) {
-	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	c := &Client{
+		Logger:              log.Named("nodeagent_client"),
+		host:                DefaultServerName,
+		waitInterval:        100 * time.Millisecond,
+		waitTimeout:         5 * time.Minute,
+		waitProbeTimeout:    2 * time.Second,
+		waitBackoffFactor:   1,
+		stopHeartbeat:       make(chan struct{}),
+		maxConnsPerHost:     100,
+		maxIdleConnsPerHost: 10,
+		idleConnTimeout:     90 * time.Second,
+		keepAlive:           30 * time.Second,
+		clock:               realClock{},
+		heartbeatErrors:     &ErrorCoalescer{Window: DefaultErrorLogWindow},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	scheme := "https"
+	var tlsConfig *tls.Config
+	if c.insecureNoTLS {
+		scheme = "http"
+		c.Logger.Warnf("connecting to the agent at %s:%d without TLS, which is insecure", ipAddr, port)
+	} else {
+		var err error
+		tlsConfig, err = ClientTLSConfig(certs.CA.CertPEMBytes, certs.Client.CertPEMBytes, certs.Client.KeyPEMBytes)
+		if err != nil {
+			return nil, fmt.Errorf("building client TLS config: %w", err)
+		}
+		c.tlsClientConfig = tlsConfig
+	}
+
+	c.baseURL = fmt.Sprintf("%s://%s:%d%s", scheme, c.host, port, c.basePath)
+	if c.maxTransfers > 0 {
+		c.transferSem = make(chan struct{}, c.maxTransfers)
+	}
+
+	dialer := &net.Dialer{KeepAlive: c.keepAlive}
 	httpDialAddrPort := fmt.Sprintf("%s:%d", ipAddr, port)
+	c.agentAddr = httpDialAddrPort
 
 	// Don't do DNS lookup for dialing.
 	// This prevents the default dialer from modifying the host header, which we need since we are not using public CAs.
 	// Resulting behavior is that the addr host is used for the host header, but it does not resolve the name.
 	// Rationale is that we don't need TLS for server authn, since we control all the hosts anyway.
 	// We just want authz and encryption.
-	dialCtx := func(ctx context.Context, network, addr string) (net.Conn, error) {
+	c.dialCtx = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := withTimeout(ctx, c.clock, dialTimeout)
+		defer cancel()
 		return dialer.DialContext(ctx, "tcp", httpDialAddrPort)
 	}
 
-	tlsConfig, err := ClientTLSConfig(certs.CA.CertPEMBytes, certs.Client.CertPEMBytes, certs.Client.KeyPEMBytes)
-	if err != nil {
-		return nil, fmt.Errorf("building client TLS config: %w", err)
-	}
-
-	baseURL := fmt.Sprintf("https://nodeagent:%d", port)
-	commandURL := baseURL + "/command"
-
-	c := &Client{
-		Logger:          log.Named("nodeagent_client"),
-		host:            "nodeagent",
-		baseURL:         baseURL,
-		tlsClientConfig: tlsConfig,
-		dialCtx:         dialCtx,
-		waitInterval:    100 * time.Millisecond,
-		stopHeartbeat:   make(chan struct{}),
+	var transport http.RoundTripper = &http.Transport{
+		DialContext:         c.dialCtx,
+		MaxConnsPerHost:     c.maxConnsPerHost,
+		MaxIdleConns:        c.maxIdleConnsPerHost,
+		MaxIdleConnsPerHost: c.maxIdleConnsPerHost,
+		IdleConnTimeout:     c.idleConnTimeout,
+		TLSClientConfig:     tlsConfig,
 	}
-
-	for _, opt := range opts {
-		opt(c)
+	if c.transport != nil {
+		transport = c.transport
+		// Cloning here would also clone HTTP/2 state configured without the TLS config, so the transport is modified in place.
+		if t, ok := transport.(*http.Transport); ok {
+			if t.TLSClientConfig == nil {
+				t.TLSClientConfig = tlsConfig
+			}
+			if t.DialContext == nil && t.DialTLSContext == nil {
+				t.DialContext = c.dialCtx
+			}
+		}
 	}
 
 	retryClient := retryablehttp.NewClient()
-	retryClient.HTTPClient = &http.Client{
-		Transport: &http.Transport{
-			DialContext:     dialCtx,
-			MaxConnsPerHost: 0,
-			TLSClientConfig: tlsConfig,
-		},
-	}
+	retryClient.HTTPClient = &http.Client{Transport: transport}
 	retryClient.Backoff = func(min, max time.Duration, attemptNum int, resp *http.Response) time.Duration {
 		return 10 * time.Millisecond
 	}
 	retryClient.RetryMax = 10
+	// return the last response once retries are exhausted, instead of an opaque error, so that the agent's error can be surfaced
+	retryClient.ErrorHandler = retryablehttp.PassthroughErrorHandler
 	retryClient.Logger = &logAdapter{SugaredLogger: log}
 
 	if c.customizeRetryableClient != nil {
@@ -120,22 +427,50 @@ func NewClient(log *zap.SugaredLogger, certs *Certs, ipAddr string, port int, op
 	}
 
 	c.HTTPClient = retryClient.StandardClient()
+	c.noRetryClient = &http.Client{Transport: transport}
 	c.commandClient = &process.Client{
-		HTTPClient: c.HTTPClient,
-		URL:        commandURL,
-		Logger:     log.Named("nodeagent_command_client"),
+		HTTPClient:     c.HTTPClient,
+		URL:            c.baseURL + "/command",
+		Logger:         log.Named("nodeagent_command_client"),
+		Hooks:          c.processHooks,
+		EnvFromContext: c.envFromContext,
+		MaxMessageSize: c.maxMessageSize,
+		Header:         c.headers,
 	}
 
 	return c, nil
 }
 
+// mergeHeaders adds the extra headers to h, except for those already set in h.
+func mergeHeaders(h, extra http.Header) {
+	for k, vs := range extra {
+		if _, ok := h[http.CanonicalHeaderKey(k)]; ok {
+			continue
+		}
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+}
+
 func (c *Client) prepReq(r *http.Request) {
-	r.Header.Add("Content-Type", "application/json")
-	r.Close = true
+	if r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	mergeHeaders(r.Header, c.headers)
+	r.Close = c.closeConns
+	c.traceReq(r)
 }
 
+const (
+	// dialTimeout is how long the client waits for a connection to the agent.
+	dialTimeout = 5 * time.Second
+	// heartbeatRequestTimeout is how long the client waits for the agent to respond to a heartbeat.
+	heartbeatRequestTimeout = 2 * time.Second
+)
+
 func (c *Client) SendHeartbeat(ctx context.Context) error {
-	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	ctx, cancel := withTimeout(ctx, c.clock, heartbeatRequestTimeout)
 	defer cancel()
 	u := fmt.Sprintf(c.baseURL + "/heartbeat")
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
@@ -159,174 +494,1315 @@ func (c *Client) SendHeartbeat(ctx context.Context) error {
 
 }
 
-func (c *Client) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
-	urlPath := path.Join("/file", filePath)
-	u := c.baseURL + urlPath
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, contents)
+// clockSkewWarnThreshold is the clock offset above which ClockOffset logs a warning.
+const clockSkewWarnThreshold = 500 * time.Millisecond
+
+// ClockOffset estimates the offset of the node's clock from the local clock, positive if the node's clock is ahead.
+// The estimate assumes the request and response take equal time, so its error is bounded by half the round-trip time.
+// A warning is logged if the offset is large enough to break time-sensitive tests.
+func (c *Client) ClockOffset(ctx context.Context) (time.Duration, error) {
+	var resp TimeResponse
+	start := time.Now()
+	err := c.getJSON(ctx, "/time", "getting node time", &resp)
 	if err != nil {
-		return fmt.Errorf("building request: %w", err)
+		return 0, err
 	}
+	rtt := time.Since(start)
+	offset := resp.Time.Sub(start.Add(rtt / 2))
+	if offset > clockSkewWarnThreshold || offset < -clockSkewWarnThreshold {
+		c.Logger.Warnf("node clock is offset by %s (round-trip time %s)", offset, rtt)
+	}
+	return offset, nil
+}
 
-	c.prepReq(httpReq)
-
-	httpResp, err := c.HTTPClient.Do(httpReq)
+// Ping sends a minimal request to the agent and returns its round-trip time, such as to assert network conditions between nodes.
+// Unlike SendHeartbeat, this doesn't count as a heartbeat, isn't retried, and has no timeout other than the context's.
+// The request reuses an idle connection if there is one, so the first ping may also include connecting and the TLS handshake.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/ping", nil)
 	if err != nil {
-		return fmt.Errorf("sending file over HTTP: %w", err)
+		return 0, fmt.Errorf("building request: %w", err)
 	}
-	if httpResp.Body != nil {
-		defer httpResp.Body.Close()
+	c.prepReq(req)
+	start := time.Now()
+	resp, err := c.noRetryClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("pinging: %w", err)
 	}
-	if httpResp.StatusCode != http.StatusOK {
-		var body string
-		b, err := io.ReadAll(httpResp.Body)
-		if err != nil {
-			body = fmt.Errorf("error reading body: %w", err).Error()
-		} else {
-			body = string(b)
-		}
-		return fmt.Errorf("non-200 HTTP status code %d received when sending file: %s", httpResp.StatusCode, body)
+	rtt := time.Since(start)
+	defer resp.Body.Close()
+	// drain the body so that the connection is reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, fmt.Errorf("unexpected ping status code %d", resp.StatusCode)
 	}
-	return nil
+	return rtt, nil
 }
 
-// ReadFile reads a file from the remote node, returning io.ErrNotExist if it is not found.
-func (c *Client) ReadFile(ctx context.Context, filePath string) (io.ReadCloser, error) {
-	urlPath := path.Join("/file", filePath)
-	u := c.baseURL + urlPath
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+// Checksum returns the hex-encoded checksum of a file on the node, computed by the node, such as to verify a transfer.
+// See FileChecksum to compute the checksum of a local file. This returns os.ErrNotExist if the file doesn't exist.
+func (c *Client) Checksum(ctx context.Context, filePath string, algo ChecksumAlgorithm) (string, error) {
+	urlPath := path.Join("/checksum", filePath) + "?" + url.Values{"algo": {string(algo)}}.Encode()
+	var resp ChecksumResponse
+	err := c.getJSON(ctx, urlPath, "getting checksum", &resp)
 	if err != nil {
-		return nil, fmt.Errorf("building request: %w", err)
+		return "", err
 	}
+	return resp.Sum, nil
+}
 
-	c.prepReq(httpReq)
+// Environ returns the environment of the agent in "k=v" form, which processes inherit,
+// such as to debug PATH or other env vars before running a process.
+// The values of env vars whose keys match any of the redact patterns, in path.Match syntax such as "AWS_*", are replaced with RedactedValue.
+func (c *Client) Environ(ctx context.Context, redact ...string) ([]string, error) {
+	urlPath := "/environ"
+	if len(redact) > 0 {
+		urlPath += "?" + url.Values{"redact": redact}.Encode()
+	}
+	var env []string
+	err := c.getJSON(ctx, urlPath, "getting node environment", &env)
+	if err != nil {
+		return nil, err
+	}
+	return env, nil
+}
 
-	httpResp, err := c.HTTPClient.Do(httpReq)
+// Info returns the platform of the node, such as to adapt commands to its operating system.
+func (c *Client) Info(ctx context.Context) (*InfoResponse, error) {
+	var resp InfoResponse
+	err := c.getJSON(ctx, "/info", "getting node info", &resp)
 	if err != nil {
-		return nil, fmt.Errorf("reading file over HTTP: %w", err)
+		return nil, err
 	}
-	if httpResp.StatusCode != http.StatusOK {
-		defer httpResp.Body.Close()
-		if httpResp.StatusCode == http.StatusNotFound {
-			return nil, os.ErrNotExist
+	return &resp, nil
+}
+
+// SendFile writes the contents to the file on the node, creating its parent directories if needed.
+// The file is replaced once the upload completes, so if the upload fails or the context is canceled before it completes,
+// an existing file is left as it was, and a truncated file is never observed.
+func (c *Client) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
+	_, err := c.sendFile(ctx, filePath, contents, -1, nil)
+	return err
+}
+
+// ErrChecksumMismatch is returned when an uploaded file doesn't match its checksum, such as with SendChecksum.
+var ErrChecksumMismatch = clusteriface.ErrChecksumMismatch
+
+// SendOption configures an upload with SendBytes or SendFileWithOptions, see clusteriface.SendOption.
+type SendOption = clusteriface.SendOption
+
+var (
+	// SendMode sets the permission bits of the remote file.
+	SendMode = clusteriface.SendMode
+	// SendChecksum has the node verify the checksum of the file it received, see clusteriface.SendChecksum.
+	SendChecksum = clusteriface.SendChecksum
+	// SendCompressed gzips the upload, see clusteriface.SendCompressed.
+	SendCompressed = clusteriface.SendCompressed
+)
+
+// SendResult describes a completed upload.
+type SendResult struct {
+	// WireBytes is the number of bytes of the upload's body, which is less than DiskBytes if it was compressed.
+	WireBytes int64
+	// DiskBytes is the number of bytes written to the file.
+	DiskBytes int64
+	// Compressed is true if the upload was compressed.
+	Compressed bool
+}
+
+// SendBytes writes the data to the file on the node, such as a config file.
+// Unlike SendFile, the length of the data is known up front, so the node verifies that it received all of it.
+func (c *Client) SendBytes(ctx context.Context, filePath string, data []byte, opts ...SendOption) error {
+	_, err := c.SendFileWithOptions(ctx, filePath, bytes.NewReader(data), opts...)
+	return err
+}
+
+// SendFileWithOptions is like SendFile, but configurable with options, and reports the bytes sent and written.
+// With SendChecksum, the contents are read into memory to compute the checksum before they are sent.
+func (c *Client) SendFileWithOptions(ctx context.Context, filePath string, contents io.Reader, opts ...SendOption) (*SendResult, error) {
+	var o clusteriface.SendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	header := http.Header{}
+	if o.ModeSet {
+		header.Set(FileModeHeader, strconv.FormatUint(uint64(o.Mode.Perm()), 8))
+	}
+	if o.Checksum != "" {
+		h, err := o.Checksum.NewHash()
+		if err != nil {
+			return nil, err
 		}
-		var body string
-		b, err := io.ReadAll(httpResp.Body)
+		data, err := io.ReadAll(contents)
+		if err != nil {
+			return nil, fmt.Errorf("reading contents: %w", err)
+		}
+		contents = bytes.NewReader(data)
+		h.Write(data)
+		header.Set(FileChecksumHeader, fmt.Sprintf("%s:%s", o.Checksum, hex.EncodeToString(h.Sum(nil))))
+	}
+
+	size := int64(-1)
+	if br, ok := contents.(*bytes.Reader); ok {
+		size = int64(br.Len())
+	}
+	read := &countingReader{r: contents}
+	body := io.Reader(read)
+	res := &SendResult{}
+	if o.Compress {
+		compress, err := c.supportsEncoding(ctx, "gzip")
 		if err != nil {
-			body = fmt.Errorf("error reading body: %w", err).Error()
+			return nil, err
+		}
+		br := bufio.NewReader(read)
+		if compress && !alreadyCompressed(br) {
+			header.Set("Content-Encoding", "gzip")
+			gz := gzipReader(br)
+			// stop compressing if the upload ends without reading the whole body, such as when it fails before it's sent
+			defer gz.CloseWithError(errors.New("upload ended"))
+			body = gz
+			size = -1
+			res.Compressed = true
 		} else {
-			body = string(b)
+			body = br
 		}
-		return nil, fmt.Errorf("non-200 HTTP status code %d received when reading file: %s", httpResp.StatusCode, body)
 	}
+	wire := &countingReader{r: body}
 
-	return httpResp.Body, nil
+	diskBytes, err := c.sendFile(ctx, filePath, wire, size, header)
+	if err != nil {
+		return nil, err
+	}
+	res.WireBytes = wire.n
+	res.DiskBytes = diskBytes
+	if diskBytes < 0 {
+		// older agents don't report the bytes written
+		res.DiskBytes = read.n
+	}
+	return res, nil
 }
 
-func (c *Client) StartProc(ctx context.Context, runReq clusteriface.StartProcRequest) (clusteriface.Process, error) {
-	return c.commandClient.StartProc(ctx, process.StartProcRequest{
-		Command: runReq.Command,
-		Args:    runReq.Args,
-		Env:     runReq.Env,
-		WD:      runReq.WD,
-		Stdin: process.InputFD{
-			Reader: runReq.Stdin,
-			File:   runReq.StdinFile,
-		},
-		Stdout: process.OutputFD{
-			Writer: runReq.Stdout,
-			File:   runReq.StdoutFile,
-		},
-		Stderr: process.OutputFD{
-			Writer: runReq.Stderr,
-			File:   runReq.StderrFile,
-		},
-	})
+// countingReader counts the bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n int64
 }
 
-func (c *Client) Fetch(ctx context.Context, url, path string) error {
-	fetchReq := FetchRequest{
-		URL:  url,
-		Dest: path,
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipReader returns a reader of the gzip-compressed contents of r.
+// The contents are compressed by a goroutine until they are read to the end or the reader is closed.
+func gzipReader(r io.Reader) *io.PipeReader {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, r)
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// compressedContentTypes are the sniffed content types of data that doesn't compress further.
+var compressedContentTypes = map[string]bool{
+	"application/x-gzip":           true,
+	"application/zip":              true,
+	"application/x-rar-compressed": true,
+	"image/png":                    true,
+	"image/jpeg":                   true,
+	"image/gif":                    true,
+	"image/webp":                   true,
+	"video/mp4":                    true,
+	"video/webm":                   true,
+	"audio/mpeg":                   true,
+}
+
+// compressedMagics are the magic numbers of compressed formats that aren't sniffed by http.DetectContentType.
+var compressedMagics = [][]byte{
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'B', 'Z', 'h'},                    // bzip2
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+}
+
+// alreadyCompressed sniffs the start of the contents to determine if they are already compressed.
+func alreadyCompressed(br *bufio.Reader) bool {
+	head, _ := br.Peek(512)
+	if compressedContentTypes[http.DetectContentType(head)] {
+		return true
 	}
-	u := c.baseURL + "/fetch"
-	b, err := json.Marshal(fetchReq)
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsEncoding returns true if the agent accepts uploads with the content encoding, caching the agent's info.
+func (c *Client) supportsEncoding(ctx context.Context, encoding string) (bool, error) {
+	c.infoMut.Lock()
+	defer c.infoMut.Unlock()
+	if c.info == nil {
+		info, err := c.Info(ctx)
+		if err != nil {
+			return false, err
+		}
+		c.info = info
+	}
+	for _, e := range c.info.UploadEncodings {
+		if e == encoding {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SendLocalFileOption configures an upload with SendLocalFile, see clusteriface.SendLocalFileOption.
+type SendLocalFileOption = clusteriface.SendLocalFileOption
+
+// PreserveMode sets the permission bits of the remote file to those of the local file.
+var PreserveMode = clusteriface.PreserveMode
+
+// SendLocalFile uploads the local file at localPath to remotePath on the node, returning the number of bytes sent.
+func (c *Client) SendLocalFile(ctx context.Context, localPath, remotePath string, opts ...SendLocalFileOption) (int64, error) {
+	var o clusteriface.SendLocalFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	f, err := os.Open(localPath)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("opening local file: %w", err)
 	}
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	defer f.Close()
+	info, err := f.Stat()
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("stating local file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("local file %q is not a regular file", localPath)
 	}
 
-	c.prepReq(httpReq)
-
-	httpResp, err := c.HTTPClient.Do(httpReq)
+	_, err = c.sendFile(ctx, remotePath, f, info.Size(), nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if httpResp.StatusCode != http.StatusOK {
-		defer httpResp.Body.Close()
-		var body string
-		b, err := io.ReadAll(httpResp.Body)
+	if o.PreserveMode {
+		err = c.Chmod(ctx, remotePath, info.Mode().Perm())
 		if err != nil {
-			body = fmt.Errorf("error reading body: %w", err).Error()
-		} else {
-			body = string(b)
+			return info.Size(), fmt.Errorf("preserving mode: %w", err)
 		}
-		return fmt.Errorf("non-200 HTTP status code %d received when fetching: %s", httpResp.StatusCode, body)
 	}
-	return nil
+	return info.Size(), nil
 }
 
-// Dial establishes a connection to the given address, using the node as a proxy.
-func (c *Client) Dial(network, addr string) (net.Conn, error) {
-	return c.DialContext(context.Background(), network, addr)
+// acquireTransfer waits until a file transfer is allowed to start, returning a func to call once it's done.
+func (c *Client) acquireTransfer(ctx context.Context) (func(), error) {
+	if c.transferSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.transferSem <- struct{}{}:
+		return func() { <-c.transferSem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for a file transfer slot: %w", ctx.Err())
+	}
 }
 
-// DialContext establishes a connection to the given address using the given network type, tunneled through a WebSocket connection with the node.
-func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+// releaseOnClose releases a file transfer slot when it's closed.
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
+
+// sendFile uploads the contents to the file, with the given content length, or -1 if unknown, and any extra request headers.
+// It returns the number of bytes written to the file, or -1 if the agent doesn't report it.
+func (c *Client) sendFile(ctx context.Context, filePath string, contents io.Reader, size int64, header http.Header) (int64, error) {
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	urlPath := path.Join("/file", filePath)
+	u := c.baseURL + urlPath
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, contents)
+	if err != nil {
+		return 0, fmt.Errorf("building request: %w", err)
+	}
+	if size >= 0 {
+		httpReq.ContentLength = size
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			httpReq.Header.Add(k, v)
+		}
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return 0, &TransportError{Action: "sending file", Err: err}
+	}
+	if httpResp.Body != nil {
+		defer httpResp.Body.Close()
+	}
+	if httpResp.StatusCode == http.StatusUnprocessableEntity {
+		errResp := readErrorResponse(httpResp)
+		if errResp.Code == ErrorCodeChecksumMismatch {
+			return 0, fmt.Errorf("sending file: %w: %s", ErrChecksumMismatch, errResp.Error)
+		}
+		return 0, &AgentError{Action: "sending file", StatusCode: httpResp.StatusCode, Message: errResp.Error}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return 0, responseError(httpResp, "sending file")
+	}
+	var resp SendFileResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		// older agents respond with an empty body
+		return -1, nil
+	}
+	return resp.Size, nil
+}
+
+// ReadFile reads a file from the remote node, returning os.ErrNotExist if it is not found.
+// See OpenFile for how the file is streamed.
+func (c *Client) ReadFile(ctx context.Context, filePath string, opts ...ReadFileOption) (io.ReadCloser, error) {
+	return c.OpenFile(ctx, filePath, opts...)
+}
+
+// ErrNotModified is returned when reading a file conditionally, and the file has not been modified.
+var ErrNotModified = errors.New("file not modified")
+
+type readFileOptions struct {
+	ifModifiedSince time.Time
+	ifNoneMatch     string
+	decompress      bool
+}
+
+type ReadFileOption func(o *readFileOptions)
+
+// IfModifiedSince only reads the file if it has been modified after the given time, otherwise ErrNotModified is returned.
+// The comparison is done with second granularity, so pass the File.ModTime of a previous read.
+func IfModifiedSince(t time.Time) ReadFileOption {
+	return func(o *readFileOptions) {
+		o.ifModifiedSince = t
+	}
+}
+
+// IfNoneMatch only reads the file if its ETag differs from the given one, otherwise ErrNotModified is returned.
+// Pass the File.ETag of a previous read. This takes precedence over IfModifiedSince.
+func IfNoneMatch(etag string) ReadFileOption {
+	return func(o *readFileOptions) {
+		o.ifNoneMatch = etag
+	}
+}
+
+// Decompress decompresses the gzip-compressed file as it is read, so that the reader returns plaintext.
+// The file is always decompressed, regardless of its extension, and an error is returned if it is not gzip-compressed.
+// File.Size is -1 for decompressed files since the decompressed size is not known up front.
+func Decompress() ReadFileOption {
+	return func(o *readFileOptions) {
+		o.decompress = true
+	}
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g *gzipReadCloser) Close() error {
+	gzErr := g.Reader.Close()
+	err := g.body.Close()
+	if err != nil {
+		return err
+	}
+	return gzErr
+}
+
+// File is a file being read from a remote node, along with its metadata.
+type File struct {
+	io.ReadCloser
+	// Size is the size of the file in bytes, or -1 if the size is unknown.
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+	// ETag identifies the version of the file, for use with IfNoneMatch.
+	ETag string
+}
+
+// OpenFile opens a file on the remote node for reading, returning os.ErrNotExist if it is not found.
+// The file metadata is returned in the same round trip as the contents.
+//
+// The contents are streamed from the node as they are read, without buffering the file in memory on either side,
+// so reading part of a large file only transfers about as much as is read. Canceling the context aborts the transfer,
+// after which reads return the context's error. The file must be closed to release its connection and transfer slot.
+func (c *Client) OpenFile(ctx context.Context, filePath string, opts ...ReadFileOption) (*File, error) {
+	var o readFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	urlPath := path.Join("/file", filePath)
+	u := c.baseURL + urlPath
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+
+	if !o.ifModifiedSince.IsZero() {
+		httpReq.Header.Set("If-Modified-Since", o.ifModifiedSince.UTC().Format(http.TimeFormat))
+	}
+	if o.ifNoneMatch != "" {
+		httpReq.Header.Set("If-None-Match", o.ifNoneMatch)
+	}
+
+	c.prepReq(httpReq)
+
+	release, err := c.acquireTransfer(ctx)
+	if err != nil {
+		return nil, err
+	}
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		release()
+		return nil, &TransportError{Action: "reading file", Err: err}
+	}
+	httpResp.Body = &releaseOnClose{ReadCloser: httpResp.Body, release: release}
+	if httpResp.StatusCode != http.StatusOK {
+		defer httpResp.Body.Close()
+		if httpResp.StatusCode == http.StatusNotFound {
+			return nil, notFoundError(httpResp, "reading file")
+		}
+		if httpResp.StatusCode == http.StatusNotModified {
+			return nil, ErrNotModified
+		}
+		return nil, responseError(httpResp, "reading file")
+	}
+
+	f := &File{
+		ReadCloser: httpResp.Body,
+		Size:       httpResp.ContentLength,
+		ETag:       httpResp.Header.Get("ETag"),
+	}
+	if lastModified := httpResp.Header.Get("Last-Modified"); lastModified != "" {
+		modTime, err := http.ParseTime(lastModified)
+		if err != nil {
+			httpResp.Body.Close()
+			return nil, fmt.Errorf("parsing Last-Modified header %q: %w", lastModified, err)
+		}
+		f.ModTime = modTime
+	}
+	if mode := httpResp.Header.Get(FileModeHeader); mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			httpResp.Body.Close()
+			return nil, fmt.Errorf("parsing %s header %q: %w", FileModeHeader, mode, err)
+		}
+		f.Mode = os.FileMode(m)
+	}
+	if o.decompress {
+		gzReader, err := gzip.NewReader(httpResp.Body)
+		if err != nil {
+			httpResp.Body.Close()
+			return nil, fmt.Errorf("file %q is not gzip-compressed: %w", filePath, err)
+		}
+		f.ReadCloser = &gzipReadCloser{Reader: gzReader, body: httpResp.Body}
+		f.Size = -1
+	}
+	return f, nil
+}
+
+// DownloadFileOption configures a download with DownloadFile, see clusteriface.DownloadFileOption.
+type DownloadFileOption = clusteriface.DownloadFileOption
+
+var (
+	// PreserveRemoteMode sets the permission bits of the local file to those of the remote file.
+	PreserveRemoteMode = clusteriface.PreserveRemoteMode
+	// PreserveRemoteModTime sets the modification time of the local file to that of the remote file, with second granularity.
+	PreserveRemoteModTime = clusteriface.PreserveRemoteModTime
+	// VerifySHA256 fails the download if the SHA-256 checksum of the file, hex-encoded, doesn't match the given one.
+	VerifySHA256 = clusteriface.VerifySHA256
+)
+
+// DownloadFile downloads the file at remotePath on the node to localPath, returning the number of bytes written.
+// The file is written to a temp file in the same directory which is renamed into place once it is complete,
+// so localPath is either left untouched or replaced atomically, and the temp file is removed on error.
+func (c *Client) DownloadFile(ctx context.Context, remotePath, localPath string, opts ...DownloadFileOption) (int64, error) {
+	var o clusteriface.DownloadFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	remoteFile, err := c.OpenFile(ctx, remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer remoteFile.Close()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmpFile, hash), remoteFile)
+	if err != nil {
+		return 0, fmt.Errorf("downloading file: %w", err)
+	}
+	if o.SHA256 != "" {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if sum != o.SHA256 {
+			return 0, fmt.Errorf("checksum mismatch for %q: expected SHA-256 %s, got %s", remotePath, o.SHA256, sum)
+		}
+	}
+	if o.PreserveMode {
+		err = tmpFile.Chmod(remoteFile.Mode.Perm())
+		if err != nil {
+			return 0, fmt.Errorf("preserving mode: %w", err)
+		}
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return 0, fmt.Errorf("closing temp file: %w", err)
+	}
+	if o.PreserveModTime && !remoteFile.ModTime.IsZero() {
+		err = os.Chtimes(tmpPath, remoteFile.ModTime, remoteFile.ModTime)
+		if err != nil {
+			return 0, fmt.Errorf("preserving modification time: %w", err)
+		}
+	}
+	err = os.Rename(tmpPath, localPath)
+	if err != nil {
+		return 0, fmt.Errorf("renaming temp file: %w", err)
+	}
+	succeeded = true
+	return n, nil
+}
+
+// TransportError is returned when a request to the agent fails without a response,
+// such as when the connection is refused or reset, or the TLS handshake fails.
+type TransportError struct {
+	// Action is what the request was for, such as "sending file".
+	Action string
+	Err    error
+}
+
+func (e *TransportError) Error() string { return fmt.Sprintf("%s over HTTP: %s", e.Action, e.Err) }
+
+func (e *TransportError) Unwrap() error { return e.Err }
+
+// Retryable returns true if retrying the request may succeed. TLS handshake errors usually indicate a misconfiguration,
+// and canceled requests were canceled on purpose, so neither is retryable.
+func (e *TransportError) Retryable() bool {
+	return !isTLSError(e.Err) && !errors.Is(e.Err, context.Canceled) && !errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// AgentError is returned when the agent responds to a request with an error status, such as for an invalid request or a failed file operation.
+// Errors with well-known meanings are returned as sentinel errors instead, such as os.ErrNotExist.
+type AgentError struct {
+	// Action is what the request was for, such as "sending file".
+	Action     string
+	StatusCode int
+	// Message is the error message from the agent.
+	Message string
+}
+
+func (e *AgentError) Error() string {
+	return fmt.Sprintf("non-200 HTTP status code %d received when %s: %s", e.StatusCode, e.Action, e.Message)
+}
+
+// Retryable returns true if retrying the request may succeed, which is the case for server errors and throttling,
+// but not for client errors, which fail the same way every time.
+func (e *AgentError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// responseError builds an *AgentError from a non-200 HTTP response, parsing the agent's error from the response body.
+// The caller is responsible for closing the response body.
+func responseError(httpResp *http.Response, action string) error {
+	return &AgentError{Action: action, StatusCode: httpResp.StatusCode, Message: errorMessage(httpResp)}
+}
+
+// errorMessage returns the error message from the body of an error response.
+func errorMessage(httpResp *http.Response) string {
+	return readErrorResponse(httpResp).Error
+}
+
+// readErrorResponse reads the body of an error response, which is an ErrorResponse if it's from the agent,
+// or is returned as-is in the Error field otherwise, such as from a proxy in front of the agent.
+func readErrorResponse(httpResp *http.Response) ErrorResponse {
+	body := readBody(httpResp)
+	var errResp ErrorResponse
+	if strings.HasPrefix(httpResp.Header.Get("Content-Type"), "application/json") && json.Unmarshal([]byte(body), &errResp) == nil && errResp.Error != "" {
+		return errResp
+	}
+	return ErrorResponse{Error: body}
+}
+
+// notFoundError returns an error wrapping os.ErrNotExist for a 404 response about a file that doesn't exist,
+// and an AgentError for other 404s, such as for a route that an older agent doesn't have.
+func notFoundError(httpResp *http.Response, action string) error {
+	errResp := readErrorResponse(httpResp)
+	if errResp.Code != ErrorCodeNotExist {
+		return &AgentError{Action: action, StatusCode: httpResp.StatusCode, Message: errResp.Error}
+	}
+	return fmt.Errorf("%s: %w: %s", action, os.ErrNotExist, errResp.Error)
+}
+
+// Stat returns info about a file on the remote node, returning os.ErrNotExist if it is not found.
+// Symlinks are not followed, and their targets are reported in FileInfo.LinkTarget.
+func (c *Client) Stat(ctx context.Context, filePath string) (*FileInfo, error) {
+	var info FileInfo
+	err := c.getJSON(ctx, path.Join("/stat", filePath), "stating file", &info)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// ReadDir returns info about the entries of a directory on the remote node, returning os.ErrNotExist if it is not found.
+// Symlinks are not followed, and their targets are reported in FileInfo.LinkTarget.
+func (c *Client) ReadDir(ctx context.Context, dirPath string) ([]FileInfo, error) {
+	var infos []FileInfo
+	err := c.getJSON(ctx, path.Join("/dir", dirPath), "reading dir", &infos)
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, urlPath string, action string, v any) error {
+	u := c.baseURL + urlPath
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return &TransportError{Action: action, Err: err}
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode == http.StatusNotFound {
+		return notFoundError(httpResp, action)
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return responseError(httpResp, action)
+	}
+	err = json.NewDecoder(httpResp.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// postJSON sends a JSON-encoded request body to the agent and checks the response status code.
+// A 404 status code for a file that doesn't exist is returned as os.ErrNotExist, 403 as os.ErrPermission, 409 as os.ErrExist,
+// and 422 for a rename across filesystems as ErrCrossDevice, all wrapped with the response body.
+func (c *Client) postJSON(ctx context.Context, urlPath string, action string, reqBody any) error {
+	return c.postJSONResp(ctx, urlPath, action, reqBody, nil)
+}
+
+// postJSONResp is like postJSON, but also decodes the JSON response body into respBody, unless it is nil.
+func (c *Client) postJSONResp(ctx context.Context, urlPath string, action string, reqBody, respBody any) error {
+	b, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("marshaling request: %w", err)
+	}
+	u := c.baseURL + urlPath
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return &TransportError{Action: action, Err: err}
+	}
+	defer httpResp.Body.Close()
+	switch httpResp.StatusCode {
+	case http.StatusOK:
+		if respBody == nil {
+			return nil
+		}
+		err := json.NewDecoder(httpResp.Body).Decode(respBody)
+		if err != nil {
+			return fmt.Errorf("decoding response: %w", err)
+		}
+		return nil
+	case http.StatusNotFound:
+		return notFoundError(httpResp, action)
+	case http.StatusConflict:
+		return fmt.Errorf("%s: %w: %s", action, os.ErrExist, errorMessage(httpResp))
+	case http.StatusForbidden:
+		return fmt.Errorf("%s: %w: %s", action, os.ErrPermission, errorMessage(httpResp))
+	case http.StatusUnprocessableEntity:
+		errResp := readErrorResponse(httpResp)
+		if errResp.Code == ErrorCodeCrossDevice {
+			return fmt.Errorf("%s: %w: %s", action, ErrCrossDevice, errResp.Error)
+		}
+		return &AgentError{Action: action, StatusCode: httpResp.StatusCode, Message: errResp.Error}
+	default:
+		return responseError(httpResp, action)
+	}
+}
+
+type doOptions struct {
+	header http.Header
+}
+
+type DoOption func(o *doOptions)
+
+// WithRequestHeader sets a header of the request sent by Do, which takes precedence over the client's headers
+// and the default Content-Type of application/json.
+func WithRequestHeader(key, value string) DoOption {
+	return func(o *doOptions) {
+		if o.header == nil {
+			o.header = http.Header{}
+		}
+		o.header.Set(key, value)
+	}
+}
+
+// isIdempotent returns true if requests with the method can safely be sent more than once.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Do sends an authenticated request with the given method and body to an arbitrary path on the agent,
+// such as a custom endpoint added with WithHandler, and returns the response as-is.
+// The caller is responsible for checking the status code and closing the response body.
+// The request has a Content-Type of application/json unless it is set with WithRequestHeader.
+// Requests with idempotent methods (GET, HEAD, OPTIONS, TRACE, PUT and DELETE) are retried on connection errors
+// and 5xx responses like the client's other requests, while requests with other methods, such as POST, are sent once.
+func (c *Client) Do(ctx context.Context, method, urlPath string, body io.Reader, opts ...DoOption) (*http.Response, error) {
+	o := &doOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	u := c.baseURL + urlPath
+	httpReq, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	for k, vs := range o.header {
+		httpReq.Header[k] = vs
+	}
+	c.prepReq(httpReq)
+	httpClient := c.HTTPClient
+	if !isIdempotent(method) {
+		httpClient = c.noRetryClient
+	}
+	httpResp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, &TransportError{Action: fmt.Sprintf("sending %s %s", method, urlPath), Err: err}
+	}
+	return httpResp, nil
+}
+
+func readBody(httpResp *http.Response) string {
+	b, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading body: %w", err).Error()
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// Remove removes the file or empty directory on the node, returning os.ErrNotExist if it is not found.
+func (c *Client) Remove(ctx context.Context, filePath string) error {
+	return c.remove(ctx, filePath, false)
+}
+
+// RemoveAll removes the path on the node and any children it contains. A path that doesn't exist is not an error.
+func (c *Client) RemoveAll(ctx context.Context, filePath string) error {
+	return c.remove(ctx, filePath, true)
+}
+
+func (c *Client) remove(ctx context.Context, filePath string, all bool) error {
+	u := c.baseURL + path.Join("/file", filePath)
+	if all {
+		u += "?all=1"
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodDelete, u, nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+	c.prepReq(httpReq)
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return &TransportError{Action: "removing file", Err: err}
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode == http.StatusNotFound {
+		return notFoundError(httpResp, "removing file")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return responseError(httpResp, "removing file")
+	}
+	return nil
+}
+
+// TempDir creates a new, unique directory on the node in its default temporary directory, whose name starts with prefix,
+// and returns its path and a func to remove it and its contents.
+// The cleanup func can be called any number of times, such as from both t.Cleanup and a deferred call,
+// and once it succeeds, later calls do nothing.
+func (c *Client) TempDir(ctx context.Context, prefix string) (string, func(ctx context.Context) error, error) {
+	var resp TempDirResponse
+	err := c.postJSONResp(ctx, "/tempdir", "creating temp dir", TempDirRequest{Prefix: prefix}, &resp)
+	if err != nil {
+		return "", nil, err
+	}
+	var mut sync.Mutex
+	removed := false
+	cleanup := func(ctx context.Context) error {
+		mut.Lock()
+		defer mut.Unlock()
+		if removed {
+			return nil
+		}
+		err := c.RemoveAll(ctx, resp.Path)
+		if err != nil {
+			return fmt.Errorf("removing temp dir %q: %w", resp.Path, err)
+		}
+		removed = true
+		return nil
+	}
+	return resp.Path, cleanup, nil
+}
+
+// Symlink creates newname as a symbolic link to oldname on the remote node.
+// This returns os.ErrExist if newname already exists, and os.ErrNotExist if the directory of newname does not exist.
+// On Windows nodes, creating symlinks generally requires elevated privileges or developer mode.
+func (c *Client) Symlink(ctx context.Context, oldname, newname string) error {
+	return c.postJSON(ctx, "/symlink", "creating symlink", SymlinkRequest{Oldname: oldname, Newname: newname})
+}
+
+// Rename atomically renames (moves) oldpath to newpath on the remote node, replacing newpath if it exists.
+// This only works within a single filesystem; renames across filesystems return ErrCrossDevice.
+func (c *Client) Rename(ctx context.Context, oldpath, newpath string) error {
+	return c.postJSON(ctx, "/rename", "renaming file", RenameRequest{Oldpath: oldpath, Newpath: newpath})
+}
+
+// Chmod changes the mode of the file on the remote node.
+func (c *Client) Chmod(ctx context.Context, filePath string, mode os.FileMode) error {
+	return c.postJSON(ctx, "/chmod", "changing file mode", ChmodRequest{Path: filePath, Mode: mode})
+}
+
+// Chown changes the numeric uid and gid of the file on the remote node.
+// This returns os.ErrPermission if the agent lacks the privilege to change ownership.
+func (c *Client) Chown(ctx context.Context, filePath string, uid, gid int) error {
+	return c.postJSON(ctx, "/chown", "changing file owner", ChownRequest{Path: filePath, UID: uid, GID: gid})
+}
+
+func (c *Client) StartProc(ctx context.Context, runReq clusteriface.StartProcRequest) (clusteriface.Process, error) {
+	stdin, err := runReq.StdinReaderContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	env := runReq.Env
+	if len(c.defaultEnv) > 0 {
+		// the last definition of a variable wins, so the request's env vars override the defaults
+		env = append(append([]string{}, c.defaultEnv...), runReq.Env...)
+	}
+	wd := runReq.WD
+	if wd == "" {
+		wd = c.defaultWD
+	}
+	return c.commandClient.StartProc(ctx, process.StartProcRequest{
+		Command:   runReq.Command,
+		Args:      runReq.Args,
+		Env:       env,
+		CleanEnv:  runReq.CleanEnv,
+		WD:        wd,
+		ExpandEnv: runReq.ExpandEnv,
+		Stdin: process.InputFD{
+			Reader:    stdin,
+			File:      runReq.StdinFile,
+			Pipe:      runReq.StdinPipe,
+			ChunkSize: runReq.StdinChunkSize,
+			Window:    runReq.StdinWindow,
+		},
+		Stdout: process.OutputFD{
+			Writer:     runReq.Stdout,
+			File:       runReq.StdoutFile,
+			Pipe:       runReq.StdoutPipe,
+			BufferSize: runReq.OutputBufferSize,
+		},
+		Stderr: process.OutputFD{
+			Writer:     runReq.Stderr,
+			File:       runReq.StderrFile,
+			Pipe:       runReq.StderrPipe,
+			BufferSize: runReq.OutputBufferSize,
+		},
+		Timeout:         runReq.Timeout,
+		StopSignal:      runReq.StopSignal,
+		KillGracePeriod: runReq.KillGracePeriod,
+		CancelPolicy:    runReq.CancelPolicy,
+		Credential:      runReq.Credential,
+		CgroupPath:      runReq.CgroupPath,
+		HideEnv:         runReq.HideEnv,
+	})
+}
+
+func (c *Client) Fetch(ctx context.Context, url, path string) error {
+	fetchReq := FetchRequest{
+		URL:  url,
+		Dest: path,
+	}
+	u := c.baseURL + "/fetch"
+	b, err := json.Marshal(fetchReq)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+
+	c.prepReq(httpReq)
+
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return &TransportError{Action: "fetching", Err: err}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		defer httpResp.Body.Close()
+		return responseError(httpResp, "fetching")
+	}
+	return nil
+}
+
+// Dial establishes a connection to the given address, using the node as a proxy.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext establishes a connection to the given address using the given network type, tunneled through a WebSocket connection with the node.
+// The connection is closed when the context is done. Its deadlines behave like those of a TCP connection,
+// so reads and writes past a deadline fail with a timeout error wrapping os.ErrDeadlineExceeded.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
 	u := c.baseURL + fmt.Sprintf("/connect/%s/%s", network, addr)
 
 	c.Logger.Debugw("dialing WebSocket", "URL", u)
-	wsConn, _, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.HTTPClient})
+	wsConn, resp, err := websocket.Dial(ctx, u, &websocket.DialOptions{HTTPClient: c.HTTPClient, HTTPHeader: c.headers})
+	if err != nil {
+		action := fmt.Sprintf("dialing %s %s", network, addr)
+		if resp != nil && resp.StatusCode != http.StatusSwitchingProtocols {
+			return nil, responseError(resp, action)
+		}
+		return nil, &TransportError{Action: action, Err: err}
+	}
+
+	return &TunnelConn{
+		Conn:       newDeadlineConn(ctx, wsConn),
+		localAddr:  tunnelAddr{network: network, addr: c.agentAddr},
+		remoteAddr: newTunnelRemoteAddr(network, addr),
+	}, nil
+}
+
+// DialWait is like DialContext, but retries with backoff until the address accepts the connection or the context is done,
+// such as to wait for a server process that was just started on the node to start listening.
+// The backoff is the same as WaitForServer's, see WithClientWaitInterval and WithClientWaitBackoff.
+// Errors that retrying won't fix, like TLS handshake errors, are returned right away.
+// If the context is done first, the last dial error is returned.
+func (c *Client) DialWait(ctx context.Context, network, addr string) (net.Conn, error) {
+	backoff := c.newWaitBackoff()
+	var lastErr error
+	for {
+		conn, err := c.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil && lastErr != nil {
+			// the context was done during the dial, so its error isn't interesting
+			return nil, lastErr
+		}
+		if !dialRetryable(err) {
+			return nil, err
+		}
+		lastErr = err
+		c.Logger.Debugf("dial error, retrying in %s: %s", backoff.interval, err)
+		if backoff.wait(ctx) != nil {
+			return nil, lastErr
+		}
+	}
+}
+
+// dialRetryable returns true if retrying a failed DialContext may succeed.
+func dialRetryable(err error) bool {
+	var agentErr *AgentError
+	if errors.As(err, &agentErr) {
+		return agentErr.Retryable()
+	}
+	var transportErr *TransportError
+	if errors.As(err, &transportErr) {
+		return transportErr.Retryable()
+	}
+	return false
+}
+
+// DialWebSocket opens a raw WebSocket connection to an arbitrary path on the agent, such as a custom endpoint added with WithHandler.
+// The connection uses the client's TLS config and dialer, so it's authenticated the same way as the built-in endpoints.
+// The caller owns the connection, including the framing of messages and closing it.
+func (c *Client) DialWebSocket(ctx context.Context, urlPath string, opts *websocket.DialOptions) (*websocket.Conn, error) {
+	dialOpts := websocket.DialOptions{}
+	if opts != nil {
+		dialOpts = *opts
+	}
+	dialOpts.HTTPClient = c.HTTPClient
+	dialOpts.HTTPHeader = dialOpts.HTTPHeader.Clone()
+	if dialOpts.HTTPHeader == nil {
+		dialOpts.HTTPHeader = http.Header{}
+	}
+	mergeHeaders(dialOpts.HTTPHeader, c.headers)
+
+	u := c.baseURL + urlPath
+	c.Logger.Debugw("dialing WebSocket", "URL", u)
+	wsConn, _, err := websocket.Dial(ctx, u, &dialOpts)
 	if err != nil {
-		return nil, fmt.Errorf("dialing WebSocket conn: %w", err)
+		return nil, fmt.Errorf("dialing WebSocket conn to %s: %w", urlPath, err)
+	}
+	return wsConn, nil
+}
+
+// TunnelConn is a connection tunneled through the node agent.
+// Its RemoteAddr is the address that was dialed from the node, and its LocalAddr is the address of the node agent,
+// which is where the tunneled connection originates.
+// The underlying WebSocket-backed conn is available as Conn.
+type TunnelConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (c *TunnelConn) LocalAddr() net.Addr  { return c.localAddr }
+func (c *TunnelConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// newTunnelRemoteAddr returns a *net.TCPAddr or *net.UDPAddr for literal IP addresses,
+// since some libraries expect those types, and otherwise an address that reports the network and addr as-is.
+// Host names aren't resolved, since they're resolved on the node, which may resolve them differently.
+func newTunnelRemoteAddr(network, addr string) net.Addr {
+	addrPort, err := netip.ParseAddrPort(addr)
+	if err == nil {
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			return net.TCPAddrFromAddrPort(addrPort)
+		case "udp", "udp4", "udp6":
+			return net.UDPAddrFromAddrPort(addrPort)
+		}
 	}
+	return tunnelAddr{network: network, addr: addr}
+}
 
-	return websocket.NetConn(ctx, wsConn, websocket.MessageBinary), nil
+type tunnelAddr struct {
+	network string
+	addr    string
 }
 
+func (a tunnelAddr) Network() string { return a.network }
+func (a tunnelAddr) String() string  { return a.addr }
+
+// WaitForServer probes the server until it responds or the context is done.
+// If the server is unreachable, this blocks until the context is done, see WaitForServerTimeout for a bounded variant.
+// The probes are configured with WithClientWaitInterval, WithClientWaitProbeTimeout, and WithClientWaitBackoff.
+// On failure, the error describes the probes that failed, distinguishing connection refused errors,
+// which are expected while the server starts, from TLS handshake errors, which usually indicate a misconfiguration.
 func (c *Client) WaitForServer(ctx context.Context) error {
-	ticker := time.NewTicker(c.waitInterval)
+	return c.waitForServer(ctx)
+}
+
+// WaitForServerTimeout is like WaitForServer, but also gives up after the client's wait timeout (see WithClientWaitTimeout).
+func (c *Client) WaitForServerTimeout(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, c.clock, c.waitTimeout)
+	defer cancel()
+	return c.waitForServer(ctx)
+}
+
+// waitProbes tracks the failed probes while waiting for the server.
+type waitProbes struct {
+	attempts    int
+	connRefused int
+	tlsErrs     int
+	lastTLSErr  error
+	lastErr     error
+}
+
+func (p *waitProbes) record(err error) {
+	p.lastErr = err
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		p.connRefused++
+	case isTLSError(err):
+		p.tlsErrs++
+		p.lastTLSErr = err
+	}
+}
+
+func (p *waitProbes) String() string {
+	s := fmt.Sprintf("%d probes, %d connection refused, %d TLS handshake errors", p.attempts, p.connRefused, p.tlsErrs)
+	if p.lastTLSErr != nil && p.lastTLSErr != p.lastErr {
+		s += fmt.Sprintf(", last TLS handshake error: %s", p.lastTLSErr)
+	}
+	if p.lastErr != nil {
+		s += fmt.Sprintf(", last error: %s", p.lastErr)
+	}
+	return s
+}
+
+// isTLSError returns true if the error is from a TLS handshake.
+// Alerts from the peer, such as a rejected client certificate, don't have an exported type, so they're matched by message.
+func isTLSError(err error) bool {
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	return errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certInvalidErr) ||
+		errors.As(err, &hostnameErr) ||
+		strings.Contains(err.Error(), "tls: ")
+}
+
+// minWaitInterval is the smallest interval between probes or dials, since tickers need a positive interval.
+const minWaitInterval = time.Millisecond
+
+// waitBackoff is the interval between probes when waiting for the server, and between dials with DialWait,
+// see WithClientWaitInterval and WithClientWaitBackoff.
+type waitBackoff struct {
+	clock       Clock
+	interval    time.Duration
+	factor      float64
+	maxInterval time.Duration
+}
+
+func (c *Client) newWaitBackoff() *waitBackoff {
+	b := &waitBackoff{
+		clock:       c.clock,
+		interval:    c.waitInterval,
+		factor:      c.waitBackoffFactor,
+		maxInterval: c.waitMaxInterval,
+	}
+	if b.factor < 1 {
+		b.factor = 1
+	}
+	if b.interval < minWaitInterval {
+		b.interval = minWaitInterval
+	}
+	return b
+}
+
+// wait waits for the current interval, or until the context is done, and then backs off the interval for the next wait.
+func (b *waitBackoff) wait(ctx context.Context) error {
+	ticker := b.clock.NewTicker(b.interval)
 	defer ticker.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-ticker.C():
+	}
+
+	next := float64(b.interval) * b.factor
+	if b.maxInterval > 0 && next > float64(b.maxInterval) {
+		next = float64(b.maxInterval)
+	}
+	if next >= math.MaxInt64 {
+		b.interval = math.MaxInt64
+	} else {
+		b.interval = time.Duration(next)
+	}
+	if b.interval < minWaitInterval {
+		b.interval = minWaitInterval
+	}
+	return nil
+}
+
+// waitForServer probes the server until one probe succeeds, backing off between failed probes.
+func (c *Client) waitForServer(ctx context.Context) error {
+	backoff := c.newWaitBackoff()
+	probes := &waitProbes{}
 	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ticker.C:
-			err := c.SendHeartbeat(ctx)
-			if err == nil {
-				c.Logger.Debug("heartbeat succeeded, done waiting for server")
-				return nil
-			}
-			c.Logger.Debugf("got heartbeat error: %s", err)
+		if err := backoff.wait(ctx); err != nil {
+			return fmt.Errorf("waiting for server at %s (%s): %w", c.baseURL, probes, err)
+		}
+
+		probes.attempts++
+		err := c.probe(ctx)
+		if err == nil {
+			c.Logger.Debug("probe succeeded, done waiting for server")
+			return nil
 		}
+		c.Logger.Debugf("got probe error: %s", err)
+		probes.record(err)
+	}
+}
+
+// probe sends a single heartbeat without retries, to check if the server is up.
+func (c *Client) probe(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, c.clock, c.waitProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/heartbeat", nil)
+	if err != nil {
+		return fmt.Errorf("building request: %w", err)
+	}
+	c.prepReq(req)
+	resp, err := c.noRetryClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected heartbeat status code %d", resp.StatusCode)
 	}
+	return nil
 }
 
 func (n *Client) StartHeartbeat() {
 	go n.startHeartbeatOnce.Do(func() {
-		ticker := time.NewTicker(10 * time.Second)
+		ticker := n.clock.NewTicker(10 * time.Second)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-n.stopHeartbeat:
 				return
-			case <-ticker.C:
+			case <-ticker.C():
 			}
 			err := n.SendHeartbeat(context.Background())
-			if err != nil {
-				n.Logger.Debugf("heartbeat error: %s", err)
+			if msg, ok := n.heartbeatErrors.Observe(n.clock.Now(), err); ok {
+				n.Logger.Warnf("heartbeat: %s", msg)
 			}
 		}
 	})
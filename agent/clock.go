@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// Clock provides the current time, tickers and timers for the agent's and client's internal timers,
+// such as the heartbeat watchdog, heartbeat intervals and request timeouts, so that tests can control time.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker is a ticker created by a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is a timer created by a Clock, which fires once.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, and returns false if it already fired or was stopped.
+	Stop() bool
+}
+
+// SystemClock is the Clock backed by the system time, which agents and clients use unless given another one.
+var SystemClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return &realTicker{t: time.NewTicker(d)} }
+
+func (realClock) NewTimer(d time.Duration) Timer { return &realTimer{t: time.NewTimer(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t *realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t *realTicker) Stop() { t.t.Stop() }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t *realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t *realTimer) Stop() bool { return t.t.Stop() }
+
+// timeoutContext is canceled when its clock's timer fires, after which its error is context.DeadlineExceeded.
+type timeoutContext struct {
+	context.Context
+	timedOut int32
+}
+
+func (c *timeoutContext) Err() error {
+	if atomic.LoadInt32(&c.timedOut) == 1 {
+		return context.DeadlineExceeded
+	}
+	return c.Context.Err()
+}
+
+// withTimeout is like context.WithTimeout, but the timeout is measured by the clock.
+func withTimeout(ctx context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	cancelCtx, cancel := context.WithCancel(ctx)
+	timeoutCtx := &timeoutContext{Context: cancelCtx}
+	timer := clock.NewTimer(d)
+	go func() {
+		defer timer.Stop()
+		select {
+		case <-cancelCtx.Done():
+		case <-timer.C():
+			if cancelCtx.Err() == nil {
+				atomic.StoreInt32(&timeoutCtx.timedOut, 1)
+				cancel()
+			}
+		}
+	}()
+	return timeoutCtx, cancel
+}
@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultErrorLogWindow is the default window over which repeated heartbeat errors are coalesced into a single log line.
+const DefaultErrorLogWindow = 1 * time.Minute
+
+// ErrorCoalescer coalesces repeated identical errors from a recurring operation, such as heartbeats,
+// so that an operation failing for a while doesn't flood the logs with identical lines.
+// The first occurrence of an error is logged, then repeats of it are logged at most once per window with a count,
+// and the recovery is logged once the operation succeeds again. It's safe for concurrent use.
+type ErrorCoalescer struct {
+	// Window is the minimum time between log lines for repeats of the same error. Zero logs every error.
+	Window time.Duration
+
+	mut        sync.Mutex
+	lastMsg    string
+	lastLogged time.Time
+	// repeats is the number of repeats of the last error since it was last logged.
+	repeats int
+	// failures is the number of consecutive failures.
+	failures int
+}
+
+// Observe records the outcome of an attempt of the operation, and returns the message to log for it, if any.
+func (e *ErrorCoalescer) Observe(now time.Time, err error) (string, bool) {
+	e.mut.Lock()
+	defer e.mut.Unlock()
+
+	if err == nil {
+		if e.failures == 0 {
+			return "", false
+		}
+		msg := fmt.Sprintf("recovered after %d consecutive failures", e.failures)
+		e.lastMsg, e.repeats, e.failures = "", 0, 0
+		return msg, true
+	}
+
+	e.failures++
+	msg := err.Error()
+	if msg != e.lastMsg {
+		logMsg := msg
+		if e.repeats > 0 {
+			logMsg = fmt.Sprintf("%s (previous error repeated %d more times)", msg, e.repeats)
+		}
+		e.lastMsg, e.lastLogged, e.repeats = msg, now, 0
+		return logMsg, true
+	}
+
+	e.repeats++
+	if elapsed := now.Sub(e.lastLogged); elapsed >= e.Window {
+		logMsg := fmt.Sprintf("%s (repeated %d times in %s)", msg, e.repeats, elapsed.Round(time.Second))
+		e.lastLogged, e.repeats = now, 0
+		return logMsg, true
+	}
+	return "", false
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+
+	"github.com/guseggert/clustertest/internal/diagnostics"
+	"github.com/julienschmidt/httprouter"
+)
+
+// WithDiagnosticsPaths sets the files collected by Client.CollectDiagnostics, in addition to the paths requested by the client,
+// such as the agent's own log file and key system logs. Directories are collected recursively.
+func WithDiagnosticsPaths(paths ...string) Option {
+	return func(n *NodeAgent) {
+		n.diagnosticsPaths = append(n.diagnosticsPaths, paths...)
+	}
+}
+
+// CollectDiagnostics returns a tar stream of the node's diagnostics files, for debugging failed tests.
+// The bundle contains the paths configured on the agent with WithDiagnosticsPaths, such as the agent's log, and the given paths.
+// Entries are named by their absolute paths without the leading slash. Paths that don't exist or can't be read are skipped,
+// and listed with their errors in a "diagnostics-errors.txt" entry at the end of the bundle.
+// The caller must close the returned reader.
+func (c *Client) CollectDiagnostics(ctx context.Context, paths ...string) (io.ReadCloser, error) {
+	u := c.baseURL + "/diagnostics"
+	if len(paths) > 0 {
+		u += "?" + url.Values{"path": paths}.Encode()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("building request: %w", err)
+	}
+	c.prepReq(httpReq)
+
+	httpResp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, &TransportError{Action: "collecting diagnostics", Err: err}
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		defer httpResp.Body.Close()
+		return nil, responseError(httpResp, "collecting diagnostics")
+	}
+	return httpResp.Body, nil
+}
+
+func (a *NodeAgent) diagnostics(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	paths := append(append([]string(nil), a.diagnosticsPaths...), r.URL.Query()["path"]...)
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			writeError(w, fmt.Sprintf("diagnostics path %q is not absolute", p), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := diagnostics.Write(w, paths); err != nil {
+		// the response is already being written, so the bundle is cut short
+		a.logger.Debugf("error writing diagnostics: %s", err)
+	}
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/julienschmidt/httprouter"
+)
+
+type RemoveGlobRequest struct {
+	Pattern string
+}
+
+type RemoveGlobResponse struct {
+	// Removed is the matching paths that were removed.
+	Removed []string
+	// Failed is the matching paths that couldn't be removed.
+	Failed []RemoveGlobFailure
+}
+
+// RemoveGlobFailure is a path matching a RemoveGlob pattern that couldn't be removed.
+type RemoveGlobFailure = clusteriface.RemoveGlobFailure
+
+// RemoveGlobError is returned by RemoveGlob when some of the matching paths couldn't be removed.
+type RemoveGlobError = clusteriface.RemoveGlobError
+
+// RemoveGlob removes the paths on the node matching the pattern, such as "/tmp/test-*", and any children they contain,
+// in a single round trip. The pattern must be absolute, and has the syntax of filepath.Match.
+// Removal continues past paths that can't be removed, in which case the returned error is a *RemoveGlobError listing them,
+// along with the paths that were removed. A pattern that matches nothing is not an error.
+func (c *Client) RemoveGlob(ctx context.Context, pattern string) ([]string, error) {
+	var resp RemoveGlobResponse
+	err := c.postJSONResp(ctx, "/removeglob", "removing paths matching pattern", RemoveGlobRequest{Pattern: pattern}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Failed) > 0 {
+		return resp.Removed, &RemoveGlobError{Failed: resp.Failed}
+	}
+	return resp.Removed, nil
+}
+
+func (a *NodeAgent) removeGlob(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	var req RemoveGlobRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		writeError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(req.Pattern) {
+		writeError(w, fmt.Sprintf("pattern %q is not absolute", req.Pattern), http.StatusBadRequest)
+		return
+	}
+	matches, err := filepath.Glob(req.Pattern)
+	if err != nil {
+		writeError(w, fmt.Sprintf("invalid pattern %q: %s", req.Pattern, err), http.StatusBadRequest)
+		return
+	}
+
+	resp := RemoveGlobResponse{Removed: []string{}}
+	for _, match := range matches {
+		err := os.RemoveAll(match)
+		if err != nil {
+			a.logger.Debugf("error removing %q: %s", match, err)
+			resp.Failed = append(resp.Failed, RemoveGlobFailure{Path: match, Error: err.Error()})
+			continue
+		}
+		resp.Removed = append(resp.Removed, match)
+	}
+	writeJSON(w, resp)
+}
@@ -0,0 +1,99 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendFileTargets(t *testing.T) {
+	ctx := context.Background()
+	client := startAgent(t)
+	dir := t.TempDir()
+	readFile := func(path string) string {
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("symlink", func(t *testing.T) {
+		target := filepath.Join(dir, "target")
+		link := filepath.Join(dir, "link")
+		require.NoError(t, os.WriteFile(target, []byte("old"), 0644))
+		require.NoError(t, os.Symlink(target, link))
+
+		require.NoError(t, client.SendFile(ctx, link, strings.NewReader("new")))
+		info, err := os.Lstat(link)
+		require.NoError(t, err)
+		assert.True(t, info.Mode()&os.ModeSymlink != 0)
+		assert.Equal(t, "new", readFile(target))
+	})
+
+	t.Run("dangling symlink", func(t *testing.T) {
+		target := filepath.Join(dir, "missing")
+		link := filepath.Join(dir, "dangling")
+		require.NoError(t, os.Symlink(target, link))
+
+		require.NoError(t, client.SendFile(ctx, link, strings.NewReader("new")))
+		info, err := os.Lstat(link)
+		require.NoError(t, err)
+		assert.True(t, info.Mode()&os.ModeSymlink != 0)
+		assert.Equal(t, "new", readFile(target))
+	})
+
+	t.Run("FIFO", func(t *testing.T) {
+		fifo := filepath.Join(dir, "fifo")
+		require.NoError(t, syscall.Mkfifo(fifo, 0644))
+		read := make(chan string, 1)
+		go func() {
+			b, _ := os.ReadFile(fifo)
+			read <- string(b)
+		}()
+
+		require.NoError(t, client.SendFile(ctx, fifo, strings.NewReader("through the pipe")))
+		assert.Equal(t, "through the pipe", <-read)
+		info, err := os.Lstat(fifo)
+		require.NoError(t, err)
+		assert.True(t, info.Mode()&os.ModeNamedPipe != 0)
+	})
+
+	t.Run("owner", func(t *testing.T) {
+		if os.Geteuid() != 0 {
+			t.Skip("changing file owners requires root")
+		}
+		path := filepath.Join(dir, "owned")
+		require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+		require.NoError(t, os.Chown(path, 1234, 5678))
+
+		require.NoError(t, client.SendFile(ctx, path, strings.NewReader("new")))
+		assert.Equal(t, "new", readFile(path))
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(1234), stat.Uid)
+		assert.Equal(t, uint32(5678), stat.Gid)
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root can create files in read-only directories")
+		}
+		roDir := filepath.Join(dir, "ro")
+		require.NoError(t, os.Mkdir(roDir, 0755))
+		path := filepath.Join(roDir, "file")
+		require.NoError(t, os.WriteFile(path, []byte("old"), 0644))
+		require.NoError(t, os.Chmod(roDir, 0555))
+		t.Cleanup(func() { os.Chmod(roDir, 0755) })
+
+		require.NoError(t, client.SendFile(ctx, path, strings.NewReader("new")))
+		assert.Equal(t, "new", readFile(path))
+	})
+}
@@ -0,0 +1,8 @@
+package agent
+
+import "os"
+
+// chownLike does nothing, since files on Windows don't have a numeric owner and group.
+func chownLike(f *os.File, existing os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// CommandPolicy restricts the commands that the agent runs, such as for agents exposed in a shared environment.
+//
+// Rules are either binary names like "rm", which match commands with that base name regardless of their directory,
+// or paths like "/usr/bin/rm", which match the command as given or as resolved from PATH.
+// Note that the policy only applies to the command itself, so allowing a shell or an interpreter allows running anything through it.
+type CommandPolicy struct {
+	// Allow, if not empty, is the rules for the commands that are allowed, and all other commands are rejected.
+	Allow []string
+	// Deny is the rules for the commands that are rejected, which takes precedence over Allow.
+	Deny []string
+}
+
+// Allowed returns true if the policy allows running the command.
+func (p CommandPolicy) Allowed(command string) bool {
+	if p.matches(p.Deny, command) {
+		return false
+	}
+	return len(p.Allow) == 0 || p.matches(p.Allow, command)
+}
+
+func (p CommandPolicy) matches(rules []string, command string) bool {
+	if len(rules) == 0 {
+		return false
+	}
+	resolved := command
+	if path, err := exec.LookPath(command); err == nil {
+		resolved = path
+	}
+	base := filepath.Base(command)
+	for _, rule := range rules {
+		if strings.ContainsAny(rule, `/\`) {
+			if rule == command || rule == resolved {
+				return true
+			}
+			continue
+		}
+		if rule == base {
+			return true
+		}
+	}
+	return false
+}
+
+// WithCommandPolicy restricts the commands that the agent runs to those allowed by the policy.
+// Processes with other commands are rejected, and starting them returns a StartError wrapping ErrCommandNotAllowed.
+func WithCommandPolicy(policy CommandPolicy) Option {
+	return func(n *NodeAgent) {
+		n.commandPolicy = &policy
+		n.commandServer.AllowCommand = policy.Allowed
+	}
+}
@@ -2,11 +2,17 @@ package process
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	clusteriface "github.com/guseggert/clustertest/cluster"
 	"go.uber.org/zap"
@@ -14,12 +20,24 @@ import (
 	"nhooyr.io/websocket/wsjson"
 )
 
-const readLimit = 32768
+const defaultStdinChunkSize = 32 * 1024
 
 type Client struct {
 	HTTPClient *http.Client
 	URL        string
 	Logger     *zap.SugaredLogger
+	// Hooks, if set, receives lifecycle events of the processes started by the client.
+	Hooks Hooks
+	// EnvFromContext, if set, is called with the context passed to StartProc, and returns env vars
+	// in "KEY=value" form to add to the process's environment, such as a trace ID to correlate remote logs with a test.
+	// Env vars in the request take precedence over these.
+	EnvFromContext func(ctx context.Context) []string
+	// MaxMessageSize is the maximum size of WebSocket messages in both directions (default DefaultMaxMessageSize).
+	// Larger messages reduce the overhead of streaming lots of stdin and output.
+	MaxMessageSize int
+	// Header, if set, is added to the WebSocket handshake request, such as for auth proxies in front of the server.
+	// The headers required by the WebSocket handshake take precedence.
+	Header http.Header
 }
 
 type InputFD struct {
@@ -28,11 +46,28 @@ type InputFD struct {
 	// If you signal the process and expect it to exit, then you should also return io.EOF from thi
 	Reader io.Reader
 	File   string
+	// Pipe makes stdin available to write to from the Process while it runs, instead of reading it from Reader.
+	Pipe bool
+	// ChunkSize is the maximum number of bytes read from Reader at a time, each of which is sent in its own message (default 32 KiB).
+	// Small chunks reduce latency for interactive input, while large chunks reduce overhead when piping lots of data.
+	// Chunks larger than the maximum message payload are split across multiple messages.
+	ChunkSize int
+	// Window is the maximum number of stdin bytes sent to the server that it hasn't yet written to the process (default DefaultStdinWindow).
+	// No more is read from Reader until the process consumes some of it, which bounds memory use when Reader is fast or infinite
+	// and the process is slow. Servers that only speak ProtocolV1 don't acknowledge stdin, so stdin isn't bounded with them,
+	// and setting Window is an error.
+	Window int
 }
 
 type OutputFD struct {
 	Writer io.Writer
 	File   string
+	// Pipe makes the output stream available to read from the Process as it is produced, instead of writing it to Writer.
+	Pipe bool
+	// BufferSize, if greater than zero, is the size of a server-side ring buffer for the output stream.
+	// This lets the process keep running when the client reads output slower than the process writes it,
+	// at the cost of dropping the oldest buffered bytes when the buffer is full.
+	BufferSize int
 }
 
 type StartProcRequest struct {
@@ -40,35 +75,210 @@ type StartProcRequest struct {
 	Args    []string
 	Env     []string
 	WD      string
+	// CleanEnv runs the process with only the variables in Env, instead of adding them to the server's environment.
+	CleanEnv bool
+	// ExpandEnv enables server-side expansion of $VAR and ${VAR} references in Command and Args,
+	// using the environment of the process. This is literal variable substitution, not shell parsing.
+	ExpandEnv bool
 
 	Stdin  InputFD
 	Stdout OutputFD
 	Stderr OutputFD
+
+	// Timeout, if greater than zero, is how long the process may run before the server stops it with StopSignal.
+	Timeout time.Duration
+	// StopSignal is the signal the server sends to stop the process when it times out,
+	// or when the connection to the client is lost, such as when the context passed to StartProc is canceled (default SIGKILL).
+	// If the process is still running KillGracePeriod after the stop signal, it is killed.
+	// If a stop signal is set and KillGracePeriod isn't, it defaults to clusteriface.DefaultKillGracePeriod.
+	StopSignal      syscall.Signal
+	KillGracePeriod time.Duration
+	// CancelPolicy, if set, is how the server stops the process when the connection to the client is lost,
+	// instead of StopSignal and KillGracePeriod.
+	CancelPolicy *clusteriface.CancelPolicy
+	// Credential, if set, runs the process as the given user and group. This is not supported on Windows.
+	Credential *clusteriface.Credential
+	// CgroupPath, if set, is an existing cgroup v2 directory into which the process is moved once it starts.
+	CgroupPath string
+	// HideEnv is the names of env vars in Env to omit from the StartInfo reported by the server, such as secrets.
+	HideEnv []string
+}
+
+// v2Fields returns the names of the fields set in the request that servers which only speak ProtocolV1 would ignore.
+func (r StartProcRequest) v2Fields() []string {
+	var fields []string
+	add := func(set bool, name string) {
+		if set {
+			fields = append(fields, name)
+		}
+	}
+	add(r.CleanEnv, "CleanEnv")
+	add(r.Stdin.Window > 0, "Stdin.Window")
+	add(r.Timeout > 0, "Timeout")
+	add(r.StopSignal != 0, "StopSignal")
+	add(r.KillGracePeriod > 0, "KillGracePeriod")
+	add(r.CancelPolicy != nil, "CancelPolicy")
+	add(r.Credential != nil, "Credential")
+	add(r.CgroupPath != "", "CgroupPath")
+	add(len(r.HideEnv) > 0, "HideEnv")
+	return fields
 }
 
 type Process struct {
 	runner *clientProcRunner
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
 }
 
+// Stdin returns a writer to stdin if it is piped, otherwise a writer whose writes fail.
+// Closing the writer closes the process's stdin.
+func (p *Process) Stdin() io.WriteCloser { return p.stdin }
+
+// Stdout returns a reader of stdout if it is piped, otherwise an empty reader.
+// Output is held until it is read, so none is missed by starting to read after the process has written it.
+func (p *Process) Stdout() io.Reader { return p.stdout }
+
+// Stderr returns a reader of stderr if it is piped, otherwise an empty reader.
+func (p *Process) Stderr() io.Reader { return p.stderr }
+
 func (p *Process) Wait(ctx context.Context) (*clusteriface.ProcessResult, error) {
 	return p.runner.wait(ctx)
 }
 
-func (p *Process) Signal(ctx context.Context, sig syscall.Signal) error {
-	return p.runner.signal(ctx, sig)
+// Signal sends the signal to the process, which is delivered by the server.
+// An error wrapping clusteriface.ErrProcessExited is returned if the process has already exited.
+func (p *Process) Signal(ctx context.Context, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %s", sig)
+	}
+	select {
+	case <-p.runner.exitedCh:
+		return clusteriface.ErrProcessExited
+	default:
+	}
+	err := p.runner.signal(ctx, s)
+	if err != nil {
+		select {
+		case <-p.runner.exitedCh:
+			return clusteriface.ErrProcessExited
+		default:
+		}
+		return fmt.Errorf("sending signal %d: %w", s, err)
+	}
+	return nil
+}
+
+// PID returns the process ID of the process on the node, waiting for the server to report that the process started.
+func (p *Process) PID(ctx context.Context) (int, error) {
+	info, err := p.runner.waitStarted(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return info.PID, nil
+}
+
+// StartInfo returns how the server started the process, waiting for the server to report that the process started.
+func (p *Process) StartInfo(ctx context.Context) (*StartInfo, error) {
+	return p.runner.waitStarted(ctx)
+}
+
+// Protocol returns the protocol version negotiated with the server, such as ProtocolV2.
+func (p *Process) Protocol() string {
+	return p.runner.protocol
+}
+
+// StdinStats returns statistics about the stdin consumed by the process so far.
+// Servers that only support ProtocolV1 don't report consumed stdin, in which case the stats are empty.
+func (p *Process) StdinStats() StdinStats {
+	return p.runner.stdinFlow.stats()
+}
+
+// Kill sends SIGKILL to the process and waits for the server to report that it exited and was reaped,
+// so that its resources, such as listening ports, have been released once this returns.
+// The result of the process is still returned by Wait. If the exit isn't confirmed before the context is done, an error is returned.
+func (p *Process) Kill(ctx context.Context) error {
+	return p.runner.kill(ctx)
 }
 
+// StartProc starts the process on the server, returning once the server reports that it started.
+// If the server rejects the process or fails to start it, a StartError is returned.
 func (c *Client) StartProc(ctx context.Context, req StartProcRequest) (*Process, error) {
+	proc := &Process{stdin: clusteriface.NotPipedStdin{}, stdout: eofReader{}, stderr: eofReader{}}
+	var stdinPipe *io.PipeReader
+	if req.Stdin.Pipe {
+		if req.Stdin.Reader != nil || req.Stdin.File != "" {
+			return nil, errors.New("stdin can't be both piped and read from a reader or file")
+		}
+		stdinPipe, proc.stdin = io.Pipe()
+		req.Stdin.Reader = stdinPipe
+	}
+	if req.Stdout.Pipe {
+		if req.Stdout.Writer != nil {
+			return nil, errors.New("stdout can't be both piped and written to a writer")
+		}
+		pr, pw := io.Pipe()
+		proc.stdout = pr
+		req.Stdout.Writer = pw
+	}
+	if req.Stderr.Pipe {
+		if req.Stderr.Writer != nil {
+			return nil, errors.New("stderr can't be both piped and written to a writer")
+		}
+		pr, pw := io.Pipe()
+		proc.stderr = pr
+		req.Stderr.Writer = pw
+	}
+
+	if c.EnvFromContext != nil {
+		req.Env = append(append([]string{}, c.EnvFromContext(ctx)...), req.Env...)
+	}
+
+	maxMessageSize := c.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	if maxMessageSize < MinMaxMessageSize {
+		return nil, fmt.Errorf("max message size %d is less than the minimum of %d", maxMessageSize, MinMaxMessageSize)
+	}
+
+	var hooks Hooks = NopHooks{}
+	if c.Hooks != nil {
+		hooks = c.Hooks
+	}
+
 	c.Logger.Debugw("dialing WebSocket for run", "URL", c.URL)
+	start := time.Now()
 	wsConn, _, err := websocket.Dial(ctx, c.URL, &websocket.DialOptions{
 		HTTPClient:      c.HTTPClient,
+		HTTPHeader:      c.Header,
 		CompressionMode: websocket.CompressionContextTakeover,
+		Subprotocols:    Protocols,
 	})
 	if err != nil {
 		c.Logger.Debugf("dial error: %s", err)
-		return nil, fmt.Errorf("establishing WebSocket conn to run: %w", err)
+		err = &DialError{Err: err}
+		hooks.OnError(req, err)
+		return nil, err
+	}
+	hooks.OnDial(req, time.Since(start))
+	protocol := negotiatedProtocol(wsConn.Subprotocol())
+	c.Logger.Debugf("negotiated protocol %s", protocol)
+	if protocol == ProtocolV1 {
+		// the server would silently ignore these, such as running the process as the agent's user instead of Credential
+		unsupported := req.v2Fields()
+		if maxMessageSize != DefaultMaxMessageSize {
+			unsupported = append(unsupported, "MaxMessageSize")
+		}
+		if len(unsupported) > 0 {
+			wsConn.Close(websocket.StatusNormalClosure, "")
+			err := &ProtocolError{Err: fmt.Errorf("the server only supports %s, which doesn't support %s", protocol, strings.Join(unsupported, ", "))}
+			hooks.OnError(req, err)
+			return nil, err
+		}
 	}
-	wsConn.SetReadLimit(readLimit)
+	wsConn.SetReadLimit(int64(maxMessageSize))
 
 	ctx, cancel := context.WithCancel(ctx)
 	runner := &clientProcRunner{
@@ -77,15 +287,26 @@ func (c *Client) StartProc(ctx context.Context, req StartProcRequest) (*Process,
 		ctx:    ctx,
 		cancel: cancel,
 		req:    req,
+		hooks:  hooks,
+		start:  start,
+
+		protocol:       protocol,
+		maxMessageSize: maxMessageSize,
 
 		stdout: io.Discard,
 		stderr: io.Discard,
 		stdin:  req.Stdin.Reader,
 
+		stdinPipe: stdinPipe,
+
 		stdoutCh: make(chan []byte),
 		stderrCh: make(chan []byte),
 
-		resultCh: make(chan cmdResult, 1),
+		resultCh:   make(chan cmdResult, 1),
+		startedCh:  make(chan struct{}),
+		exitedCh:   make(chan struct{}),
+		stdoutDone: make(chan struct{}),
+		stderrDone: make(chan struct{}),
 	}
 	if req.Stdout.Writer != nil {
 		runner.stdout = req.Stdout.Writer
@@ -93,30 +314,93 @@ func (c *Client) StartProc(ctx context.Context, req StartProcRequest) (*Process,
 	if req.Stderr.Writer != nil {
 		runner.stderr = req.Stderr.Writer
 	}
+	runner.stdinWriter = runner.newStdinWriter()
+	stdinWindow := int64(DefaultStdinWindow)
+	if req.Stdin.Window > 0 {
+		stdinWindow = int64(req.Stdin.Window)
+	}
+	if protocol == ProtocolV1 {
+		// the server doesn't acknowledge stdin, so stdin can't be flow-controlled
+		stdinWindow = math.MaxInt64
+	}
+	runner.stdinFlow = newFlowControlWriter(ctx, runner.stdinWriter, stdinWindow)
 
 	err = runner.run()
 	if err != nil {
 		return nil, err
 	}
-	return &Process{runner: runner}, nil
+	if protocol != ProtocolV1 {
+		// wait for the server to report that the process started, so that a rejected process fails here instead of in Wait,
+		// which ProtocolV1 servers don't report
+		_, err := runner.waitStarted(ctx)
+		if err != nil {
+			// the runner shuts down once the connection ends, after sending the result
+			select {
+			case res := <-runner.resultCh:
+				_, err = runner.processResult(ctx, res)
+			default:
+			}
+			runner.shutdown()
+			return nil, err
+		}
+	}
+	proc.runner = runner
+	return proc, nil
 }
 
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
 type clientProcRunner struct {
 	log    *zap.SugaredLogger
 	conn   *websocket.Conn
 	ctx    context.Context
 	cancel func()
 	req    StartProcRequest
+	hooks  Hooks
+	start  time.Time
+
+	// protocol is the negotiated protocol version.
+	protocol string
+	// maxMessageSize is the maximum size of messages in both directions.
+	maxMessageSize int
 
 	stderr io.Writer
 	stdout io.Writer
 	stdin  io.Reader
+	// stdinPipe is the read side of piped stdin, which is closed when stdin can no longer be sent, so that writes fail instead of blocking.
+	stdinPipe *io.PipeReader
 
 	stdoutCh chan []byte
 	stderrCh chan []byte
+	// stdoutCloseErr and stderrCloseErr are set before stdoutCh and stderrCh are closed if the output was cut short
+	// by the connection failing, and are passed to the output writers that support CloseWithError, such as piped output.
+	stdoutCloseErr error
+	stderrCloseErr error
+
+	// stdoutDone and stderrDone are closed when all output has been written to the output writers,
+	// after which stdoutErr and stderrErr hold the first error returned by the writers, if any.
+	stdoutDone chan struct{}
+	stderrDone chan struct{}
+	stdoutErr  error
+	stderrErr  error
+	// stdoutBytes and stderrBytes are the number of output bytes written to the output writers.
+	stdoutBytes int64
+	stderrBytes int64
 
 	resultCh chan cmdResult
 
+	// stdinWriter sends stdin to the server, paced by stdinFlow according to the acknowledgements from the server.
+	stdinWriter *wsJSONWriter
+	stdinFlow   *flowControlWriter
+
+	// startedCh is closed when the server reports that the process started, after which startInfo is set.
+	startedCh chan struct{}
+	startInfo StartInfo
+	// exitedCh is closed when the server reports that the process exited and was reaped.
+	exitedCh chan struct{}
+
 	wg sync.WaitGroup
 
 	closeConnOnce sync.Once
@@ -135,7 +419,9 @@ func (r *clientProcRunner) run() error {
 	err := r.writeFirstMessage()
 	if err != nil {
 		r.shutdown()
-		return fmt.Errorf("writing first message: %w", err)
+		err = &ProtocolError{Err: fmt.Errorf("writing first message: %w", err)}
+		r.hooks.OnError(r.req, err)
+		return err
 	}
 
 	r.wg.Add(2)
@@ -147,19 +433,104 @@ func (r *clientProcRunner) run() error {
 func (r *clientProcRunner) wait(ctx context.Context) (*clusteriface.ProcessResult, error) {
 	select {
 	case res := <-r.resultCh:
-		r.log.Debugf("got exit code %d with err: %s", res.code, res.err)
-		return &clusteriface.ProcessResult{ExitCode: res.code, TimeMS: res.timeMS}, res.err
+		return r.processResult(ctx, res)
 	case <-ctx.Done():
 		err := ctx.Err()
 		r.log.Debugf("wait context done: %s", err)
 		return nil, err
 	case <-r.ctx.Done():
+		// the runner shuts down right after receiving the result, so prefer the result if there is one
+		select {
+		case res := <-r.resultCh:
+			return r.processResult(ctx, res)
+		default:
+		}
 		err := r.ctx.Err()
 		r.log.Debugf("runResult context done: %s", err)
 		return nil, err
 	}
 }
 
+func (r *clientProcRunner) processResult(ctx context.Context, res cmdResult) (*clusteriface.ProcessResult, error) {
+	r.log.Debugf("got exit code %d with err: %s", res.code, res.err)
+	if res.partial != nil {
+		// wait for output that was already received to be written, so that the byte counts are accurate
+		_ = r.outputErr(ctx)
+		res.partial.Err = res.err
+		res.partial.StdoutBytes = atomic.LoadInt64(&r.stdoutBytes)
+		res.partial.StderrBytes = atomic.LoadInt64(&r.stderrBytes)
+		res.err = res.partial
+	} else if res.err == nil {
+		res.err = r.outputErr(ctx)
+	}
+	return &clusteriface.ProcessResult{
+		ExitCode:           res.code,
+		TimeMS:             res.timeMS,
+		StdoutDroppedBytes: res.stdoutDropped,
+		StderrDroppedBytes: res.stderrDropped,
+		Signaled:           res.signaled,
+		Signal:             res.signal,
+		Usage:              res.usage,
+		// older servers don't count bytes, so fall back to the bytes received and acknowledged by the server
+		StdoutBytes: max64(res.stdoutBytes, atomic.LoadInt64(&r.stdoutBytes)),
+		StderrBytes: max64(res.stderrBytes, atomic.LoadInt64(&r.stderrBytes)),
+		StdinBytes:  max64(res.stdinBytes, r.stdinFlow.stats().Bytes),
+
+		MaxRuntimeExceeded: res.maxRuntimeExceeded,
+		Reason:             res.reason,
+	}, res.err
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// outputErr waits for the output to be written and returns the first error returned by an output writer.
+// Piped output isn't waited for, since it is written as the caller reads it, which may be after waiting for the process.
+func (r *clientProcRunner) outputErr(ctx context.Context) error {
+	if !r.req.Stdout.Pipe {
+		select {
+		case <-r.stdoutDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.stdoutErr != nil {
+			return fmt.Errorf("writing stdout: %w", r.stdoutErr)
+		}
+	}
+	if !r.req.Stderr.Pipe {
+		select {
+		case <-r.stderrDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if r.stderrErr != nil {
+			return fmt.Errorf("writing stderr: %w", r.stderrErr)
+		}
+	}
+	return nil
+}
+
+func (r *clientProcRunner) waitStarted(ctx context.Context) (*StartInfo, error) {
+	select {
+	case <-r.startedCh:
+		return &r.startInfo, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.ctx.Done():
+		// the runner shuts down after the process exits, so prefer the start info if there is one
+		select {
+		case <-r.startedCh:
+			return &r.startInfo, nil
+		default:
+		}
+		return nil, fmt.Errorf("process was not reported as started: %w", r.ctx.Err())
+	}
+}
+
 func (r *clientProcRunner) signal(ctx context.Context, sig syscall.Signal) error {
 	return wsjson.Write(r.ctx, r.conn, procRequestMessage{
 		Signal: sig,
@@ -167,6 +538,37 @@ func (r *clientProcRunner) signal(ctx context.Context, sig syscall.Signal) error
 
 }
 
+func (r *clientProcRunner) kill(ctx context.Context) error {
+	select {
+	case <-r.exitedCh:
+		return nil
+	default:
+	}
+	err := r.signal(ctx, syscall.SIGKILL)
+	if err != nil {
+		select {
+		case <-r.exitedCh:
+			// the process exited before the signal was sent
+			return nil
+		default:
+		}
+		return fmt.Errorf("sending SIGKILL: %w", err)
+	}
+	select {
+	case <-r.exitedCh:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for killed process to exit: %w", ctx.Err())
+	case <-r.ctx.Done():
+		select {
+		case <-r.exitedCh:
+			return nil
+		default:
+		}
+		return fmt.Errorf("connection closed before the killed process was confirmed to exit: %w", r.ctx.Err())
+	}
+}
+
 func (r *clientProcRunner) close(code websocket.StatusCode, reason string) {
 	// websocket reason can't be above 123 chars
 	if len(reason) > 100 {
@@ -186,24 +588,43 @@ func (r *clientProcRunner) readMessages() {
 
 	closedStdout := false
 	var closeStdoutOnce sync.Once
-	closeStdout := func() {
+	closeStdout := func(err error) {
 		closeStdoutOnce.Do(func() {
 			closedStdout = true
+			r.stdoutCloseErr = err
 			close(r.stdoutCh)
 		})
 	}
 
 	closedStderr := false
 	var closeStderrOnce sync.Once
-	closeStderr := func() {
+	closeStderr := func(err error) {
 		closeStderrOnce.Do(func() {
 			closedStderr = true
+			r.stderrCloseErr = err
 			close(r.stderrCh)
 		})
 	}
 
-	defer closeStderr()
-	defer closeStdout()
+	defer closeStderr(nil)
+	defer closeStdout(nil)
+
+	started := false
+	stdoutComplete := false
+	stderrComplete := false
+	incomplete := func(err error) cmdResult {
+		return cmdResult{
+			code: -1,
+			err:  err,
+			partial: &PartialResultError{
+				Started:        started,
+				StdoutComplete: stdoutComplete,
+				StderrComplete: stderrComplete,
+				// the server only ends the output streams once the process has exited
+				Exited: stdoutComplete || stderrComplete,
+			},
+		}
+	}
 
 	// The client always initiates the close when it decides that it's done.
 	// Some important notes:
@@ -217,32 +638,75 @@ func (r *clientProcRunner) readMessages() {
 	for {
 		var msg procResponseMessage
 		err := wsjson.Read(r.ctx, r.conn, &msg)
-		if websocket.CloseStatus(err) != -1 {
-			r.resultCh <- cmdResult{code: -1, err: fmt.Errorf("conn unexpectedly closed: %w", err)}
-			closeStderr()
-			closeStdout()
+		var wsCloseErr websocket.CloseError
+		if errors.As(err, &wsCloseErr) && (&CloseError{Code: wsCloseErr.Code}).rejected() {
+			err = &StartError{Err: &CloseError{Code: wsCloseErr.Code, Reason: wsCloseErr.Reason}}
+			r.hooks.OnError(r.req, err)
+			r.resultCh <- cmdResult{code: -1, err: err}
+			closeStderr(err)
+			closeStdout(err)
+			return
+		}
+		if errors.As(err, &wsCloseErr) {
+			closeErr := &CloseError{Code: wsCloseErr.Code, Reason: wsCloseErr.Reason}
+			err = &ProtocolError{Err: fmt.Errorf("conn unexpectedly closed: %w", closeErr)}
+			r.hooks.OnError(r.req, err)
+			r.resultCh <- incomplete(err)
+			closeStderr(err)
+			closeStdout(err)
 			return
 		}
 		if err != nil {
 			r.log.Debugf("message reader got error: %s", err)
-			r.resultCh <- cmdResult{err: err}
+			err = &ProtocolError{Err: fmt.Errorf("reading message: %w", err)}
+			r.hooks.OnError(r.req, err)
+			r.resultCh <- incomplete(err)
+			closeStderr(err)
+			closeStdout(err)
 			r.close(websocket.StatusInternalError, err.Error())
 			return
 		}
+		if msg.StdinAck > 0 {
+			r.stdinFlow.ack(msg.StdinAck)
+		}
+		if msg.Started != nil && !started {
+			r.startInfo = *msg.Started
+			close(r.startedCh)
+			started = true
+			r.hooks.OnStart(r.req, r.startInfo.PID, time.Since(r.start))
+		}
 		if len(msg.Stderr.B) > 0 && !closedStderr {
 			r.stderrCh <- msg.Stderr.B
 		}
 		if msg.Stderr.Done {
-			closeStderr()
+			stderrComplete = true
+			closeStderr(nil)
 		}
 		if len(msg.Stdout.B) > 0 && !closedStdout {
 			r.stdoutCh <- msg.Stdout.B
 		}
 		if msg.Stdout.Done && !closedStdout {
-			closeStdout()
+			stdoutComplete = true
+			closeStdout(nil)
 		}
 		if msg.Result.Exited {
-			r.resultCh <- cmdResult{code: msg.Result.ExitCode, timeMS: msg.Result.TimeMS}
+			r.hooks.OnExit(r.req, msg.Result.ExitCode, time.Since(r.start))
+			close(r.exitedCh)
+			r.resultCh <- cmdResult{
+				code:          msg.Result.ExitCode,
+				timeMS:        msg.Result.TimeMS,
+				stdoutDropped: msg.Result.StdoutDropped,
+				stderrDropped: msg.Result.StderrDropped,
+				signaled:      msg.Result.Signaled,
+				signal:        msg.Result.Signal,
+				usage:         msg.Result.Usage,
+				stdoutBytes:   msg.Result.StdoutBytes,
+				stderrBytes:   msg.Result.StderrBytes,
+				stdinBytes:    msg.Result.StdinBytes,
+
+				maxRuntimeExceeded: msg.Result.MaxRuntimeExceeded,
+				reason:             msg.Result.Reason,
+			}
 			r.close(websocket.StatusNormalClosure, "")
 			return
 		}
@@ -252,36 +716,44 @@ func (r *clientProcRunner) readMessages() {
 func (r *clientProcRunner) writeFirstMessage() error {
 	return wsjson.Write(r.ctx, r.conn, procRequestMessage{
 		Req: &procReq{
-			Command: r.req.Command,
-			Args:    r.req.Args,
-			Env:     r.req.Env,
-			WD:      r.req.WD,
+			Command:   r.req.Command,
+			Args:      r.req.Args,
+			Env:       r.req.Env,
+			CleanEnv:  r.req.CleanEnv,
+			WD:        r.req.WD,
+			ExpandEnv: r.req.ExpandEnv,
 			Stdin: fdConfig{
 				File:    r.req.Stdin.File,
 				Discard: r.req.Stdin.Reader == nil && r.req.Stdin.File == "",
 			},
 			Stdout: fdConfig{
-				File:    r.req.Stdout.File,
-				Discard: r.req.Stdout.Writer == nil,
+				File:       r.req.Stdout.File,
+				Discard:    r.req.Stdout.Writer == nil,
+				BufferSize: r.req.Stdout.BufferSize,
 			},
 			Stderr: fdConfig{
-				File:    r.req.Stderr.File,
-				Discard: r.req.Stderr.Writer == nil,
+				File:       r.req.Stderr.File,
+				Discard:    r.req.Stderr.Writer == nil,
+				BufferSize: r.req.Stderr.BufferSize,
 			},
+			Timeout:         r.req.Timeout,
+			StopSignal:      r.req.StopSignal,
+			KillGracePeriod: r.req.KillGracePeriod,
+			CancelPolicy:    r.req.CancelPolicy,
+			Credential:      r.req.Credential,
+			CgroupPath:      r.req.CgroupPath,
+			HideEnv:         r.req.HideEnv,
+			MaxMessageSize:  r.maxMessageSize,
 		},
 	})
 }
 
-func (r *clientProcRunner) writeStdin() {
-	defer r.wg.Done()
-	if r.stdin == nil {
-		return
-	}
-
-	writer := &wsJSONWriter{
-		log:  r.log.Named("stdin_writer"),
-		ctx:  r.ctx,
-		conn: r.conn,
+func (r *clientProcRunner) newStdinWriter() *wsJSONWriter {
+	return &wsJSONWriter{
+		log:        r.log.Named("stdin_writer"),
+		ctx:        r.ctx,
+		conn:       r.conn,
+		maxPayload: maxPayloadSize(r.maxMessageSize),
 		writeMsg: func(b []byte) any {
 			return procRequestMessage{Stdin: fdPayload{B: b}}
 		},
@@ -289,45 +761,97 @@ func (r *clientProcRunner) writeStdin() {
 			return procRequestMessage{Stdin: fdPayload{Done: true}}
 		},
 	}
-	defer writer.Close()
-	_, err := io.Copy(writer, r.stdin)
+}
+
+func (r *clientProcRunner) writeStdin() {
+	defer r.wg.Done()
+	if r.stdin == nil {
+		return
+	}
+
+	defer r.stdinWriter.Close()
+	chunkSize := r.req.Stdin.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultStdinChunkSize
+	}
+	// hide any io.WriterTo implementation of the reader, so that the buffer size determines the chunk size
+	reader := struct{ io.Reader }{r.stdin}
+	_, err := io.CopyBuffer(r.stdinFlow, reader, make([]byte, chunkSize))
 	r.log.Debugw("done copying stdin", "Error", err)
+	if r.stdinPipe != nil {
+		r.stdinPipe.Close()
+	}
 }
 
 func (r *clientProcRunner) readStdout() {
 	defer r.wg.Done()
+	defer close(r.stdoutDone)
 	defer func() {
-		if closer, ok := r.stdout.(io.Closer); ok {
-			closer.Close()
-		}
+		closeOutput(r.stdout, r.stdoutCloseErr)
 	}()
 	for b := range r.stdoutCh {
-		_, err := r.stdout.Write(b)
+		if r.stdoutErr != nil {
+			continue
+		}
+		n, err := r.stdout.Write(b)
+		atomic.AddInt64(&r.stdoutBytes, int64(n))
 		if err != nil {
-			r.log.Debugf("stdout reader got write error: %s", err)
-			return
+			// keep draining so that the message reader isn't blocked and the exit code is still delivered
+			r.log.Debugf("stdout reader got write error, discarding the rest of stdout: %s", err)
+			r.stdoutErr = err
 		}
 	}
 }
 
 func (r *clientProcRunner) readStderr() {
 	defer r.wg.Done()
+	defer close(r.stderrDone)
 	defer func() {
-		if closer, ok := r.stderr.(io.Closer); ok {
-			closer.Close()
-		}
+		closeOutput(r.stderr, r.stderrCloseErr)
 	}()
 	for b := range r.stderrCh {
-		_, err := r.stderr.Write(b)
+		if r.stderrErr != nil {
+			continue
+		}
+		n, err := r.stderr.Write(b)
+		atomic.AddInt64(&r.stderrBytes, int64(n))
 		if err != nil {
-			r.log.Debugf("stderr reader got write error: %s", err)
-			return
+			// keep draining so that the message reader isn't blocked and the exit code is still delivered
+			r.log.Debugf("stderr reader got write error, discarding the rest of stderr: %s", err)
+			r.stderrErr = err
 		}
 	}
 }
 
+// closeOutput closes an output writer once all of its output has been written.
+// If the output was cut short by err, the writer is closed with it if it supports CloseWithError,
+// so that readers of piped output get the error instead of io.EOF.
+func closeOutput(w io.Writer, err error) {
+	if closer, ok := w.(interface{ CloseWithError(error) error }); ok && err != nil {
+		closer.CloseWithError(err)
+		return
+	}
+	if closer, ok := w.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 type cmdResult struct {
-	code   int
-	timeMS int64
+	code          int
+	timeMS        int64
+	stdoutDropped int64
+	stderrDropped int64
+	signaled      bool
+	signal        syscall.Signal
+	usage         clusteriface.ResourceUsage
+	stdoutBytes   int64
+	stderrBytes   int64
+	stdinBytes    int64
+	// maxRuntimeExceeded is true if the server killed the process for exceeding its max runtime.
+	maxRuntimeExceeded bool
+	// reason is why the process ended, if the server reported one.
+	reason clusteriface.ExitReason
 	err    error
+	// partial is set if communication failed before the result was received, and is completed when the result is processed.
+	partial *PartialResultError
 }
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package process
+
+import (
+	"os/exec"
+	"syscall"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// setCredential configures the command to run as the user and group of the credential.
+func setCredential(cmd *exec.Cmd, cred *clusteriface.Credential) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: cred.UID, Gid: cred.GID},
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package process
+
+import (
+	"errors"
+	"os/exec"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+func setCredential(cmd *exec.Cmd, cred *clusteriface.Credential) error {
+	return errors.New("running processes as another user is not supported on Windows")
+}
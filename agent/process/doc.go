@@ -9,11 +9,24 @@ The protocol proceeds as follows:
 
 1. The client opens a WebSocket connection with the server
 2. The client sends a request message containing the Command and Args fields, and optionally the Env and WD fields.
-3. The client and server then exchange messages containing stdin, stdout, and stderr bytes while the process runs.
-4. When the process exits, the server sends a response message with Exited=true and the ExitCode.
-5. The client initiates closing of the WebSocket connection.
+3. Once the process starts, the server sends a response message with Started set, describing how it started the process, including its PID.
+4. The client and server then exchange messages containing stdin, stdout, and stderr bytes while the process runs.
+5. When the process exits, the server sends a response message with Exited=true and the ExitCode.
+6. The client initiates closing of the WebSocket connection.
 
-The server does not buffer any stdout or stderr, which generally means that the client must read them to completion before the process will exit cleanly.
+By default the server does not buffer any stdout or stderr, which generally means that the client must read them to completion before the process will exit cleanly. The client can instead request a bounded server-side ring buffer per output stream, in which case the process is not blocked by a slow client, and the oldest buffered bytes are dropped when the buffer is full. The number of dropped bytes is reported in the exit message.
+
+Stdin is flow-controlled: the server acknowledges the stdin bytes it has written to the process with StdinAck response messages, and the client stops sending stdin while more than InputFD.Window bytes are unacknowledged. This bounds the stdin buffered in the connection and on the server when the process consumes stdin slowly.
+
+Messages are limited to a maximum size in both directions, DefaultMaxMessageSize unless the client requests a different size in its first message. Stdin, stdout, and stderr bytes are split across as many messages as needed to stay under the limit, so arbitrarily large writes are streamed.
+
+The protocol is versioned. The client offers the versions it supports as WebSocket subprotocols, and the server picks the most preferred one that it also supports, which gates the features that the client and server use. Peers that don't negotiate a subprotocol speak the original version, ProtocolV1, which has no stdin flow control or configurable message size, and ignores the process options added since, such as Timeout and Credential. The client refuses to start a process that uses any of those with a ProtocolV1 server, instead of running it without them.
+
+The server can limit the number of concurrently-running processes, in which case it closes connections beyond the limit with the StatusTooManyProcesses close status instead of starting the process.
+Similarly, it closes connections for processes whose commands are rejected by its AllowCommand policy with the StatusCommandNotAllowed close status.
+When the server fails to start a process, such as when its command isn't found, it closes the connection with the StatusStartFailed close status.
+When the server closes a connection before sending the process result, the client surfaces the close status and reason as a CloseError.
+The client waits for the server to report that the process started before returning from StartProc, so that a rejected process or one that failed to start is returned by StartProc as a StartError, instead of by Wait.
 
 Signaling is not implemented, but should be easy to add if the use case arises.
 */
@@ -0,0 +1,98 @@
+package process
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultStdinWindow is the default maximum number of stdin bytes sent to the server that it hasn't acknowledged yet.
+const DefaultStdinWindow = 1024 * 1024
+
+// StdinStats describes the stdin bytes consumed by a process.
+type StdinStats struct {
+	// Bytes is the number of stdin bytes that the server acknowledged writing to the process.
+	Bytes int64
+	// Duration is the time from the first stdin write until the last acknowledgement.
+	Duration time.Duration
+}
+
+// Throughput returns the effective stdin throughput in bytes per second.
+func (s StdinStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// flowControlWriter paces writes so that at most window bytes are in flight, that is sent but not yet
+// acknowledged by the server as written to the process. This bounds the amount of stdin buffered
+// in the WebSocket conn and on the server when the process consumes stdin slower than it's sent.
+type flowControlWriter struct {
+	w      io.Writer
+	ctx    context.Context
+	window int64
+
+	// ackCh is signaled when bytes are acknowledged.
+	ackCh chan struct{}
+
+	mut      sync.Mutex
+	inFlight int64
+	acked    int64
+	first    time.Time
+	last     time.Time
+}
+
+func newFlowControlWriter(ctx context.Context, w io.Writer, window int64) *flowControlWriter {
+	return &flowControlWriter{
+		w:      w,
+		ctx:    ctx,
+		window: window,
+		ackCh:  make(chan struct{}, 1),
+	}
+}
+
+func (f *flowControlWriter) Write(b []byte) (int, error) {
+	for {
+		f.mut.Lock()
+		if f.inFlight < f.window {
+			f.inFlight += int64(len(b))
+			if f.first.IsZero() {
+				f.first = time.Now()
+			}
+			f.mut.Unlock()
+			break
+		}
+		f.mut.Unlock()
+		select {
+		case <-f.ackCh:
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+	}
+	return f.w.Write(b)
+}
+
+// ack records that n bytes were consumed by the process, unblocking writers waiting for the window.
+func (f *flowControlWriter) ack(n int64) {
+	f.mut.Lock()
+	f.inFlight -= n
+	f.acked += n
+	f.last = time.Now()
+	f.mut.Unlock()
+	select {
+	case f.ackCh <- struct{}{}:
+	default:
+	}
+}
+
+func (f *flowControlWriter) stats() StdinStats {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	s := StdinStats{Bytes: f.acked}
+	if !f.first.IsZero() {
+		s.Duration = f.last.Sub(f.first)
+	}
+	return s
+}
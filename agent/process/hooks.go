@@ -0,0 +1,24 @@
+package process
+
+import "time"
+
+// Hooks receives structured lifecycle events of the processes started by a Client, such as for test observability.
+// Hooks are called synchronously from the goroutines managing the process, so they should return quickly.
+type Hooks interface {
+	// OnDial is called when the WebSocket connection for a process is established, with the time it took to dial.
+	OnDial(req StartProcRequest, dur time.Duration)
+	// OnStart is called when the server reports that the process started, with the time since StartProc was called.
+	OnStart(req StartProcRequest, pid int, dur time.Duration)
+	// OnExit is called when the process exits, with its exit code and the time since StartProc was called.
+	OnExit(req StartProcRequest, code int, dur time.Duration)
+	// OnError is called when dialing or communicating with the server fails.
+	OnError(req StartProcRequest, err error)
+}
+
+// NopHooks is a Hooks implementation that does nothing, which can be embedded to implement only some of the hooks.
+type NopHooks struct{}
+
+func (NopHooks) OnDial(StartProcRequest, time.Duration)       {}
+func (NopHooks) OnStart(StartProcRequest, int, time.Duration) {}
+func (NopHooks) OnExit(StartProcRequest, int, time.Duration)  {}
+func (NopHooks) OnError(StartProcRequest, error)              {}
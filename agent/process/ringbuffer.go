@@ -0,0 +1,128 @@
+package process
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ringBuffer is a bounded buffer of output bytes which is drained asynchronously to an underlying writer.
+// Writes never block on the underlying writer, so a slow reader can't stall the process that is writing.
+// When the buffer is full, the oldest bytes are dropped to make room for new ones, and the dropped bytes are counted.
+type ringBuffer struct {
+	w io.WriteCloser
+
+	mut     sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	start   int
+	n       int
+	closed  bool
+	dropped int64
+	err     error
+
+	done chan struct{}
+}
+
+func newRingBuffer(w io.WriteCloser, size int) *ringBuffer {
+	r := &ringBuffer{
+		w:    w,
+		buf:  make([]byte, size),
+		done: make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mut)
+	go r.drain()
+	return r
+}
+
+func (r *ringBuffer) Write(b []byte) (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.closed {
+		return 0, errors.New("write to closed ring buffer")
+	}
+	written := len(b)
+	size := len(r.buf)
+	if len(b) > size {
+		r.dropped += int64(len(b) - size)
+		b = b[len(b)-size:]
+	}
+	if overflow := r.n + len(b) - size; overflow > 0 {
+		r.start = (r.start + overflow) % size
+		r.n -= overflow
+		r.dropped += int64(overflow)
+	}
+	end := (r.start + r.n) % size
+	copied := copy(r.buf[end:], b)
+	copy(r.buf, b[copied:])
+	r.n += len(b)
+	r.cond.Signal()
+	return written, nil
+}
+
+// drain writes buffered bytes to the underlying writer until the buffer is closed and empty.
+// If the underlying writer fails, the rest of the output is dropped.
+func (r *ringBuffer) drain() {
+	defer close(r.done)
+	for {
+		r.mut.Lock()
+		for r.n == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if r.n == 0 && r.closed {
+			r.mut.Unlock()
+			return
+		}
+		k := r.n
+		if r.start+k > len(r.buf) {
+			k = len(r.buf) - r.start
+		}
+		chunk := make([]byte, k)
+		copy(chunk, r.buf[r.start:r.start+k])
+		r.start = (r.start + k) % len(r.buf)
+		r.n -= k
+		failed := r.err != nil
+		r.mut.Unlock()
+
+		if failed {
+			r.addDropped(int64(k))
+			continue
+		}
+		_, err := r.w.Write(chunk)
+		if err != nil {
+			r.mut.Lock()
+			r.err = err
+			r.dropped += int64(k)
+			r.mut.Unlock()
+		}
+	}
+}
+
+func (r *ringBuffer) addDropped(n int64) {
+	r.mut.Lock()
+	r.dropped += n
+	r.mut.Unlock()
+}
+
+// Dropped returns the number of bytes that have been dropped.
+func (r *ringBuffer) Dropped() int64 {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.dropped
+}
+
+// Close waits for the buffer to drain and then closes the underlying writer.
+func (r *ringBuffer) Close() error {
+	r.mut.Lock()
+	r.closed = true
+	r.cond.Signal()
+	r.mut.Unlock()
+
+	<-r.done
+
+	err := r.w.Close()
+	if r.err != nil {
+		return r.err
+	}
+	return err
+}
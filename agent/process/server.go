@@ -2,15 +2,22 @@ package process
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/cgroup"
+	"github.com/guseggert/clustertest/internal/iocount"
 	"go.uber.org/zap"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
@@ -18,18 +25,56 @@ import (
 
 type Server struct {
 	Log *zap.SugaredLogger
+	// MaxProcs is the maximum number of processes that may run concurrently.
+	// Connections beyond the limit are closed with StatusTooManyProcesses. Zero means no limit.
+	MaxProcs int
+	// Protocols are the protocol versions the server supports, from most to least preferred (default Protocols).
+	// This is mostly useful for testing compatibility with older servers.
+	Protocols []string
+	// AllowCommand, if set, is called with the command of each process before it's started,
+	// after expanding env vars if requested, and processes whose commands it returns false for are rejected with StatusCommandNotAllowed.
+	AllowCommand func(command string) bool
+	// MaxRuntime, if greater than zero, is the maximum time any process may run, regardless of its request's Timeout,
+	// after which the process is killed and its result reports MaxRuntimeExceeded.
+	MaxRuntime time.Duration
+
+	procs int64
+}
+
+// Running returns the number of processes currently run by the server.
+func (s *Server) Running() int {
+	procs := int(atomic.LoadInt64(&s.procs))
+	// connections beyond the limit are counted until they're rejected
+	if s.MaxProcs > 0 && procs > s.MaxProcs {
+		return s.MaxProcs
+	}
+	return procs
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	protocols := s.Protocols
+	if protocols == nil {
+		protocols = Protocols
+	}
 	wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		CompressionMode: websocket.CompressionContextTakeover,
+		Subprotocols:    protocols,
 	})
 	if err != nil {
 		s.Log.Debugf("error accepting WebSocket conn: %s", err)
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		return
 	}
-	s.Log.Debug("accepted WebSocket conn")
+	protocol := negotiatedProtocol(wsConn.Subprotocol())
+	s.Log.Debugf("accepted WebSocket conn with protocol %s", protocol)
+
+	procs := atomic.AddInt64(&s.procs, 1)
+	defer atomic.AddInt64(&s.procs, -1)
+	if s.MaxProcs > 0 && procs > int64(s.MaxProcs) {
+		s.Log.Debugf("rejecting process, %d processes are already running", s.MaxProcs)
+		wsConn.Close(StatusTooManyProcesses, fmt.Sprintf("too many processes, the limit is %d", s.MaxProcs))
+		return
+	}
 
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
@@ -39,6 +84,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		ctx:     ctx,
 		cancel:  cancel,
 		stdinCh: make(chan []byte),
+		exited:  make(chan struct{}),
+
+		protocol:     protocol,
+		allowCommand: s.AllowCommand,
+		maxRuntime:   s.MaxRuntime,
 	}
 	runner.run()
 }
@@ -49,11 +99,50 @@ type serverProcRunner struct {
 	ctx    context.Context
 	cancel func()
 
+	// protocol is the negotiated protocol version.
+	protocol string
+	// allowCommand is the server's command policy, if any.
+	allowCommand func(command string) bool
+
 	cmd *exec.Cmd
+	// exited is closed once the process has exited.
+	exited chan struct{}
+	// env is the env vars set by the request, and hideEnv is the names of those to omit from the start info.
+	env     []string
+	hideEnv []string
+	// timeout is how long the process may run before it is stopped, if greater than zero.
+	timeout time.Duration
+	// maxRuntime is the server's cap on how long the process may run before it is killed, if greater than zero.
+	maxRuntime time.Duration
+	// stopReason is why the server stopped the process, if it did, see setStopReason.
+	stopReasonMut sync.Mutex
+	stopReason    clusteriface.ExitReason
+	// cgroupPath is the cgroup of the process, if any, and oomKills is the number of OOM kills in it when the process started,
+	// for detecting whether the process was OOM killed.
+	cgroupPath string
+	oomKills   int64
+	// stopSignal and killGracePeriod are how the process is stopped, see stop.
+	stopSignal      syscall.Signal
+	killGracePeriod time.Duration
+	// cancelPolicy, if set, is how the process is stopped when the client goes away, instead of the stop signal.
+	cancelPolicy *clusteriface.CancelPolicy
+	stopOnce     sync.Once
 
 	stderrCloser io.Closer
 	stdoutCloser io.Closer
 
+	// stdoutRing and stderrRing are the output ring buffers, if enabled.
+	stdoutRing *ringBuffer
+	stderrRing *ringBuffer
+
+	// stdoutBytes, stderrBytes, and stdinBytes count the bytes the process wrote to stdout and stderr and was sent on stdin.
+	// Output written to files isn't counted as it's written, and is instead the size of the files, stdoutFile and stderrFile.
+	stdoutBytes int64
+	stderrBytes int64
+	stdinBytes  int64
+	stdoutFile  string
+	stderrFile  string
+
 	// stdinWriter is the writer for stdin, if piping stdin is enabled.
 	stdinWriter io.Writer
 	// stdinCloser is the closer for stdin (could be either a pipe or a file).
@@ -66,24 +155,157 @@ type serverProcRunner struct {
 }
 
 func (r *serverProcRunner) shutdown() {
-	if r.cmd.Process != nil {
-		r.cmd.Process.Kill()
+	r.setStopReason(clusteriface.ExitReasonKilledOnDisconnect)
+	if r.cancelPolicy != nil && len(r.cancelPolicy.Steps) > 0 {
+		r.stopWith(r.cancelPolicy.Steps)
+	} else {
+		r.stop()
 	}
 	r.cancel()
 	r.wg.Wait()
 }
 
+// setStopReason records why the server is stopping the process, unless it has already exited or is already being stopped,
+// in which case the first reason is kept.
+func (r *serverProcRunner) setStopReason(reason clusteriface.ExitReason) {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return
+	}
+	r.stopReasonMut.Lock()
+	defer r.stopReasonMut.Unlock()
+	select {
+	case <-r.exited:
+		return
+	default:
+	}
+	if r.stopReason == "" {
+		r.stopReason = reason
+	}
+}
+
+// exitReason returns why the process ended, once it has exited.
+func (r *serverProcRunner) exitReason() clusteriface.ExitReason {
+	r.stopReasonMut.Lock()
+	reason := r.stopReason
+	r.stopReasonMut.Unlock()
+	if reason != "" {
+		return reason
+	}
+	ws, ok := r.cmd.ProcessState.Sys().(syscall.WaitStatus)
+	if !ok || !ws.Signaled() {
+		return ""
+	}
+	if r.cgroupPath != "" {
+		oomKills, err := cgroup.OOMKills(r.cgroupPath)
+		if err != nil {
+			r.log.Debugf("error reading OOM kills of cgroup %q: %s", r.cgroupPath, err)
+		} else if oomKills > r.oomKills {
+			return clusteriface.ExitReasonOOM
+		}
+	}
+	return clusteriface.ExitReasonSignaled
+}
+
+// stop stops the process if it is still running, by sending the stop signal and then killing the process
+// if it hasn't exited after the kill grace period.
+func (r *serverProcRunner) stop() {
+	r.stopWith([]clusteriface.CancelStep{{Signal: r.stopSignal, Grace: r.killGracePeriod}})
+}
+
+// stopWith stops the process if it is still running, by sending the signal of each step in turn until the process exits,
+// and then killing the process if it hasn't exited after the grace period of the last step.
+// The process is only stopped once, so later calls have no effect.
+func (r *serverProcRunner) stopWith(steps []clusteriface.CancelStep) {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		select {
+		case <-r.exited:
+			return
+		default:
+		}
+		for _, step := range steps {
+			if step.Signal == 0 || step.Signal == syscall.SIGKILL {
+				break
+			}
+			r.signal(step.Signal)
+			select {
+			case <-r.exited:
+				return
+			case <-time.After(step.Grace):
+				r.log.Debugf("process %d did not exit within %s of signal %d", r.cmd.Process.Pid, step.Grace, step.Signal)
+			}
+		}
+		r.cmd.Process.Kill()
+	})
+}
+
+// stopAfter stops the process if it's still running after the timeout.
+func (r *serverProcRunner) stopAfter(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		r.log.Debugf("process %d timed out after %s, stopping it", r.cmd.Process.Pid, timeout)
+		r.setStopReason(clusteriface.ExitReasonTimeout)
+		r.stop()
+	case <-r.exited:
+	}
+}
+
+// killAfter kills the process if it's still running after the server's max runtime.
+// Unlike stopAfter, the process isn't sent the stop signal first, since the max runtime is a hard cap.
+func (r *serverProcRunner) killAfter(maxRuntime time.Duration) {
+	timer := time.NewTimer(maxRuntime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		r.log.Warnf("process %d exceeded the max runtime of %s, killing it", r.cmd.Process.Pid, maxRuntime)
+		r.setStopReason(clusteriface.ExitReasonRuntimeCap)
+		r.cmd.Process.Kill()
+	case <-r.exited:
+	}
+}
+
 func (r *serverProcRunner) run() {
 	// read the first message
 	startTime, err := r.readFirstMessageAndStart()
+	if errors.Is(err, ErrCommandNotAllowed) {
+		r.log.Debugf("rejecting process: %s", err)
+		reason := err.Error()
+		// websocket reason can't be above 123 chars
+		if len(reason) > 100 {
+			reason = reason[0:100]
+		}
+		r.conn.Close(StatusCommandNotAllowed, reason)
+		r.shutdown()
+		return
+	}
 	if err != nil {
 		r.log.Debugf("error reading first message: %s", err)
-		r.conn.Close(websocket.StatusInternalError, fmt.Sprintf("reading first message: %s", err))
+		reason := fmt.Sprintf("starting process: %s", err)
+		if len(reason) > 100 {
+			reason = reason[0:100]
+		}
+		r.conn.Close(StatusStartFailed, reason)
 		r.shutdown()
 		return
 	}
 	r.log.Debug("process started")
 
+	err = wsjson.Write(r.ctx, r.conn, procResponseMessage{Started: r.startInfo()})
+	if err != nil {
+		r.log.Debugf("error sending started message: %s", err)
+	}
+
+	if r.timeout > 0 {
+		go r.stopAfter(r.timeout)
+	}
+	if r.maxRuntime > 0 {
+		go r.killAfter(r.maxRuntime)
+	}
+
 	r.wg.Add(3)
 	go r.readMessages()
 	go r.readStdin()
@@ -134,25 +356,36 @@ func (r *serverProcRunner) readMessages() {
 			closedStdin = true
 		}
 		if msg.Signal != 0 {
-			var sig os.Signal
-			switch msg.Signal {
-			case syscall.SIGINT:
-				sig = os.Interrupt
-			case syscall.SIGKILL:
-				sig = os.Kill
-			default:
-				r.log.Debugf("unknown signal type %d, ignoring", msg.Signal)
-			}
-			_ = r.cmd.Process.Signal(sig)
+			r.signal(msg.Signal)
 		}
 	}
 }
 
+func (r *serverProcRunner) signal(s syscall.Signal) {
+	var sig os.Signal
+	switch s {
+	case syscall.SIGINT:
+		sig = os.Interrupt
+	case syscall.SIGKILL:
+		sig = os.Kill
+	default:
+		sig = s
+	}
+	// Windows has no signals other than kill, so other signals terminate the process with TerminateProcess
+	if runtime.GOOS == "windows" {
+		sig = os.Kill
+	}
+	_ = r.cmd.Process.Signal(sig)
+}
+
 func (r *serverProcRunner) waitAndWriteResult(startTime time.Time) {
 	defer r.wg.Done()
 
 	err := r.cmd.Wait()
 	timeMS := time.Since(startTime).Milliseconds()
+	r.stopReasonMut.Lock()
+	close(r.exited)
+	r.stopReasonMut.Unlock()
 
 	exitCode := r.cmd.ProcessState.ExitCode()
 	if err != nil {
@@ -170,32 +403,104 @@ func (r *serverProcRunner) waitAndWriteResult(startTime time.Time) {
 		r.log.Warnf("error closing stdout: %s", err)
 	}
 
-	r.log.Debugf("process %d exited with error code %d, sending message", r.cmd.Process.Pid, r.cmd.ProcessState.ExitCode())
-	err = wsjson.Write(r.ctx, r.conn, procResponseMessage{
-		Result: procResult{
-			Exited:   true,
-			ExitCode: exitCode,
-			TimeMS:   timeMS,
-		},
-	})
+	reason := r.exitReason()
+	// the reason is logged since the result can't be sent if the process was killed because the client went away
+	r.log.Debugw("process exited, sending result", "PID", r.cmd.Process.Pid, "ExitCode", exitCode, "Reason", string(reason))
+	result := procResult{
+		Exited:   true,
+		ExitCode: exitCode,
+		TimeMS:   timeMS,
+		Usage:    clusteriface.ProcessUsage(r.cmd.ProcessState),
+
+		StdoutBytes: outputBytes(r.stdoutFile, &r.stdoutBytes),
+		StderrBytes: outputBytes(r.stderrFile, &r.stderrBytes),
+		StdinBytes:  atomic.LoadInt64(&r.stdinBytes),
+
+		MaxRuntimeExceeded: reason == clusteriface.ExitReasonRuntimeCap,
+		Reason:             reason,
+	}
+	if r.stdoutRing != nil {
+		result.StdoutDropped = r.stdoutRing.Dropped()
+	}
+	if r.stderrRing != nil {
+		result.StderrDropped = r.stderrRing.Dropped()
+	}
+	if ws, ok := r.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		result.Signaled = true
+		result.Signal = ws.Signal()
+	}
+	err = wsjson.Write(r.ctx, r.conn, procResponseMessage{Result: result})
 	if err != nil {
 		r.log.Debugf("error sending exit code: %s", err)
 	}
 }
 
+// outputBytes returns the number of bytes written to an output stream, which is the size of the file if it was written to one.
+func outputBytes(file string, counter *int64) int64 {
+	if file == "" {
+		return atomic.LoadInt64(counter)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
 func (r *serverProcRunner) readFirstMessageAndStart() (time.Time, error) {
 	var req procRequestMessage
 	err := wsjson.Read(r.ctx, r.conn, &req)
 	if err != nil {
 		return time.Time{}, err
 	}
-	r.log.Debugw("got first message", "Message", req)
+	r.log.Debugw("got first message", "Message", redactMessage(req))
+
+	if req.Req == nil {
+		return time.Time{}, errors.New("first message contained no request")
+	}
+
+	maxMessageSize := req.Req.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+	if maxMessageSize < MinMaxMessageSize {
+		return time.Time{}, fmt.Errorf("max message size %d is less than the minimum of %d", maxMessageSize, MinMaxMessageSize)
+	}
+	r.conn.SetReadLimit(int64(maxMessageSize))
 
-	cmd := exec.Command(req.Req.Command, req.Req.Args...)
+	env := os.Environ()
+	if req.Req.CleanEnv {
+		// an empty, non-nil env, since a nil one inherits the server's environment
+		env = []string{}
+	}
+	env = clusteriface.NormalizeEnv(append(env, req.Req.Env...))
+
+	command, args := req.Req.Command, req.Req.Args
+	if req.Req.ExpandEnv {
+		command, args = clusteriface.ExpandEnv(env, command, args)
+	}
+	if r.allowCommand != nil && !r.allowCommand(command) {
+		return time.Time{}, fmt.Errorf("%w: %q", ErrCommandNotAllowed, command)
+	}
+
+	cmd := exec.Command(command, args...)
 	cmd.Dir = req.Req.WD
-	if len(req.Req.Env) > 0 {
-		cmd.Env = append(os.Environ(), req.Req.Env...)
+	cmd.Env = env
+	if req.Req.Credential != nil {
+		err := setCredential(cmd, req.Req.Credential)
+		if err != nil {
+			return time.Time{}, err
+		}
 	}
+	r.env = clusteriface.NormalizeEnv(req.Req.Env)
+	r.hideEnv = req.Req.HideEnv
+	r.timeout = req.Req.Timeout
+	r.stopSignal = req.Req.StopSignal
+	r.killGracePeriod = req.Req.KillGracePeriod
+	if r.killGracePeriod <= 0 && r.stopSignal != 0 && r.stopSignal != syscall.SIGKILL {
+		r.killGracePeriod = clusteriface.DefaultKillGracePeriod
+	}
+	r.cancelPolicy = req.Req.CancelPolicy
 
 	if req.Req.Stdin.File != "" {
 		fmt.Printf("opening %s\n", req.Req.Stdin.File)
@@ -222,21 +527,29 @@ func (r *serverProcRunner) readFirstMessageAndStart() (time.Time, error) {
 			return time.Time{}, fmt.Errorf("opening stdout file %q: %w", req.Req.Stdout.File, err)
 		}
 		r.stdoutCloser = f
+		r.stdoutFile = req.Req.Stdout.File
 		cmd.Stdout = f
 	} else if req.Req.Stdout.Discard {
+		// a nil writer is discarded by the stdlib, and still counted below
 		r.stdoutCloser = &noopWriteCloser{io.Discard}
-		cmd.Stdout = io.Discard
 	} else {
 		w := &wsJSONWriter{
-			log:  r.log.Named("stdout_writer"),
-			ctx:  r.ctx,
-			conn: r.conn,
+			log:        r.log.Named("stdout_writer"),
+			ctx:        r.ctx,
+			conn:       r.conn,
+			maxPayload: maxPayloadSize(maxMessageSize),
 			writeMsg: func(b []byte) any {
 				return procResponseMessage{Stdout: fdPayload{B: b}}
 			},
 		}
-		r.stdoutCloser = w
-		cmd.Stdout = w
+		if req.Req.Stdout.BufferSize > 0 {
+			r.stdoutRing = newRingBuffer(w, req.Req.Stdout.BufferSize)
+			r.stdoutCloser = r.stdoutRing
+			cmd.Stdout = r.stdoutRing
+		} else {
+			r.stdoutCloser = w
+			cmd.Stdout = w
+		}
 	}
 
 	if req.Req.Stderr.File != "" {
@@ -245,26 +558,113 @@ func (r *serverProcRunner) readFirstMessageAndStart() (time.Time, error) {
 			return time.Time{}, fmt.Errorf("opening stderr file %q: %w", req.Req.Stderr.File, err)
 		}
 		r.stderrCloser = f
+		r.stderrFile = req.Req.Stderr.File
 		cmd.Stderr = f
 	} else if req.Req.Stderr.Discard {
 		r.stderrCloser = &noopWriteCloser{io.Discard}
-		cmd.Stderr = io.Discard
 	} else {
 		w := &wsJSONWriter{
-			log:  r.log.Named("stderr_writer"),
-			ctx:  r.ctx,
-			conn: r.conn,
+			log:        r.log.Named("stderr_writer"),
+			ctx:        r.ctx,
+			conn:       r.conn,
+			maxPayload: maxPayloadSize(maxMessageSize),
 			writeMsg: func(b []byte) any {
 				return procResponseMessage{Stderr: fdPayload{B: b}}
 			},
 		}
-		r.stderrCloser = w
-		cmd.Stderr = w
+		if req.Req.Stderr.BufferSize > 0 {
+			r.stderrRing = newRingBuffer(w, req.Req.Stderr.BufferSize)
+			r.stderrCloser = r.stderrRing
+			cmd.Stderr = r.stderrRing
+		} else {
+			r.stderrCloser = w
+			cmd.Stderr = w
+		}
 	}
 
+	// output to files is written by the process directly, so only wrap the other writers, which are already copied to by the stdlib
+	var stdoutBytes, stderrBytes *int64
+	if r.stdoutFile == "" {
+		stdoutBytes = &r.stdoutBytes
+	}
+	if r.stderrFile == "" {
+		stderrBytes = &r.stderrBytes
+	}
+	cmd.Stdout, cmd.Stderr = iocount.Output(cmd.Stdout, cmd.Stderr, stdoutBytes, stderrBytes)
+
 	r.cmd = cmd
 
-	return time.Now(), cmd.Start()
+	startTime := time.Now()
+	err = cmd.Start()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if req.Req.CgroupPath != "" {
+		// the count is only used to detect OOM kills, so the process can still run if it can't be read
+		r.oomKills, _ = cgroup.OOMKills(req.Req.CgroupPath)
+		err := cgroup.AddProcess(req.Req.CgroupPath, cmd.Process.Pid)
+		if err != nil {
+			// the process was started but won't be waited on by waitAndWriteResult, so kill and reap it here,
+			// closing stdin so that the stdlib's copy to it finishes
+			cmd.Process.Kill()
+			r.stdinCloser.Close()
+			cmd.Wait()
+			r.stopReasonMut.Lock()
+			close(r.exited)
+			r.stopReasonMut.Unlock()
+			return time.Time{}, err
+		}
+		r.cgroupPath = req.Req.CgroupPath
+	}
+	return startTime, nil
+}
+
+// redactMessage returns a copy of the request message whose hidden env vars have redacted values, for logging,
+// since agent logs are collected from nodes.
+func redactMessage(msg procRequestMessage) procRequestMessage {
+	if msg.Req == nil || len(msg.Req.HideEnv) == 0 {
+		return msg
+	}
+	hidden := map[string]bool{}
+	for _, k := range msg.Req.HideEnv {
+		hidden[k] = true
+	}
+	req := *msg.Req
+	req.Env = make([]string, len(msg.Req.Env))
+	for i, kv := range msg.Req.Env {
+		if k, _, _ := strings.Cut(kv, "="); hidden[k] {
+			kv = k + "=REDACTED"
+		}
+		req.Env[i] = kv
+	}
+	msg.Req = &req
+	return msg
+}
+
+// startInfo describes how the process was started, with the env vars set by the request except for hidden ones.
+func (r *serverProcRunner) startInfo() *procStarted {
+	hidden := map[string]bool{}
+	for _, k := range r.hideEnv {
+		hidden[k] = true
+	}
+	var env []string
+	for _, kv := range r.env {
+		k, _, _ := strings.Cut(kv, "=")
+		if !hidden[k] {
+			env = append(env, kv)
+		}
+	}
+	wd := r.cmd.Dir
+	if wd == "" {
+		wd, _ = os.Getwd()
+	}
+	return &procStarted{
+		PID:  r.cmd.Process.Pid,
+		Path: r.cmd.Path,
+		Args: r.cmd.Args,
+		Env:  env,
+		WD:   wd,
+	}
 }
 
 func (r *serverProcRunner) readStdin() {
@@ -275,10 +675,19 @@ func (r *serverProcRunner) readStdin() {
 
 	defer r.stdinCloser.Close()
 	for b := range r.stdinCh {
-		_, err := r.stdinWriter.Write(b)
+		n, err := r.stdinWriter.Write(b)
+		atomic.AddInt64(&r.stdinBytes, int64(n))
 		if err != nil {
 			r.log.Debugf("stdin reader got write error: %s", err)
 			return
 		}
+		if r.protocol == ProtocolV1 {
+			continue
+		}
+		// acknowledge the consumed bytes so that the client can send more
+		err = wsjson.Write(r.ctx, r.conn, procResponseMessage{StdinAck: int64(len(b))})
+		if err != nil {
+			r.log.Debugf("error acknowledging stdin: %s", err)
+		}
 	}
 }
@@ -1,20 +1,199 @@
 package process
 
-import "syscall"
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"nhooyr.io/websocket"
+)
+
+// StatusTooManyProcesses is the WebSocket close status used by the server when it rejects a process
+// because the maximum number of concurrent processes are already running.
+const StatusTooManyProcesses websocket.StatusCode = 4429
+
+// StatusCommandNotAllowed is the WebSocket close status used by the server when it rejects a process
+// because its command is not allowed by the server's policy.
+const StatusCommandNotAllowed websocket.StatusCode = 4403
+
+// StatusStartFailed is the WebSocket close status used by the server when it fails to start a process,
+// such as when its command isn't found.
+const StatusStartFailed websocket.StatusCode = 4500
+
+// Protocol versions, which are negotiated as WebSocket subprotocols when connecting, so that the protocol can evolve
+// without breaking clients and servers of different versions. Peers that don't negotiate a subprotocol speak ProtocolV1.
+const (
+	// ProtocolV1 is the original protocol.
+	ProtocolV1 = "clustertest.process.v1"
+	// ProtocolV2 adds stdin flow control with StdinAck messages, a configurable maximum message size,
+	// and the process options that ProtocolV1 servers ignore, such as Timeout, Credential, and CgroupPath.
+	ProtocolV2 = "clustertest.process.v2"
+)
+
+// Protocols are the protocol versions supported by this package, from most to least preferred.
+var Protocols = []string{ProtocolV2, ProtocolV1}
+
+// negotiatedProtocol returns the protocol version for the negotiated WebSocket subprotocol.
+func negotiatedProtocol(subprotocol string) string {
+	if subprotocol == "" {
+		return ProtocolV1
+	}
+	return subprotocol
+}
+
+// DefaultMaxMessageSize is the default maximum size of a WebSocket message of the protocol, in both directions.
+// Stdin and output are split into messages whose encoded size is under the maximum, so any size of write can be streamed.
+const DefaultMaxMessageSize = 32 * 1024
+
+// MinMaxMessageSize is the smallest allowed maximum message size.
+const MinMaxMessageSize = 4 * 1024
+
+// messageOverhead is a conservative bound on the encoded size of a message excluding its stdin or output bytes.
+const messageOverhead = 1024
+
+// maxPayloadSize returns the maximum number of stdin or output bytes in a message, given the maximum message size.
+// The bytes are base64-encoded in JSON, which encodes each 3 bytes in 4.
+func maxPayloadSize(maxMessageSize int) int {
+	return (maxMessageSize - messageOverhead) / 4 * 3
+}
+
+// ErrTooManyProcesses is returned when the server rejects a process because too many processes are running.
+// The process was never started, so it's safe to retry later.
+var ErrTooManyProcesses = errors.New("too many concurrent processes")
+
+// ErrCommandNotAllowed is returned when the server rejects a process because its command is not allowed by the server's policy.
+// The process was never started.
+var ErrCommandNotAllowed = errors.New("command not allowed")
+
+// ErrStartFailed is returned when the server fails to start a process, such as when its command isn't found.
+var ErrStartFailed = errors.New("process failed to start")
+
+// StartError is returned by StartProc when the server rejects the process or fails to start it,
+// so that it can be told apart from a failure of the running process, such as a ProtocolError.
+// The process was never started. Err is a CloseError, which wraps ErrTooManyProcesses, ErrCommandNotAllowed, or ErrStartFailed.
+type StartError struct {
+	Err error
+}
+
+func (e *StartError) Error() string { return "starting process: " + e.Err.Error() }
+
+func (e *StartError) Unwrap() error { return e.Err }
+
+// DialError is returned when the WebSocket connection to the server can't be established.
+// The process was never started, so it's usually safe to retry.
+type DialError struct {
+	Err error
+}
+
+func (e *DialError) Error() string { return "establishing WebSocket conn to run: " + e.Err.Error() }
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// PartialResultError is returned when communication with the server fails before the process result is received,
+// and describes how far the process got, such as to distinguish a process that produced nothing and died
+// from one that produced all of its output before the connection failed.
+type PartialResultError struct {
+	Err error
+	// Started is true if the server reported that the process started.
+	Started bool
+	// StdoutBytes and StderrBytes are the number of output bytes written to the output writers.
+	StdoutBytes int64
+	StderrBytes int64
+	// StdoutComplete and StderrComplete are true if the server reported the end of the output stream,
+	// which happens when the process exits.
+	StdoutComplete bool
+	StderrComplete bool
+	// Exited is true if the process is known to have exited, because the server reported the end of an output stream,
+	// even though its result wasn't received. It's only known for output streams that are sent to the client,
+	// so it's false if it's unknown, such as when the output is written to files on the server or discarded.
+	Exited bool
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("%s (started=%t, exited=%t, stdout bytes=%d, stderr bytes=%d, stdout complete=%t, stderr complete=%t)",
+		e.Err, e.Started, e.Exited, e.StdoutBytes, e.StderrBytes, e.StdoutComplete, e.StderrComplete)
+}
+
+func (e *PartialResultError) Unwrap() error { return e.Err }
+
+// ProtocolError is returned when communicating with the server fails after the connection was established,
+// such as when the connection is unexpectedly closed or a message can't be read or written.
+// The process may or may not have been started, so retrying is only safe if the command is idempotent.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string { return e.Err.Error() }
+
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// CloseError is the close status and reason of a connection that the server closed before the process result was received,
+// which distinguishes, for example, a server internal error from a rejection.
+// It's wrapped by the error returned from waiting on the process, and can be accessed with errors.As.
+type CloseError struct {
+	Code   websocket.StatusCode
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("connection closed with status %s (%d): %q", e.Code, int(e.Code), e.Reason)
+}
+
+// Unwrap returns ErrTooManyProcesses or ErrCommandNotAllowed if the server rejected the process,
+// because of its concurrency limit or its command policy respectively, or ErrStartFailed if it failed to start it.
+func (e *CloseError) Unwrap() error {
+	switch e.Code {
+	case StatusTooManyProcesses:
+		return ErrTooManyProcesses
+	case StatusCommandNotAllowed:
+		return ErrCommandNotAllowed
+	case StatusStartFailed:
+		return ErrStartFailed
+	}
+	return nil
+}
+
+// rejected returns true if the server rejected the process or failed to start it.
+func (e *CloseError) rejected() bool {
+	return e.Unwrap() != nil
+}
 
 type procReq struct {
 	Command string
 	Args    []string
 	Env     []string
-	WD      string
-	Stdin   fdConfig
-	Stdout  fdConfig
-	Stderr  fdConfig
+	// CleanEnv runs the process with only Env, instead of adding it to the server's environment.
+	CleanEnv bool
+	WD       string
+	// ExpandEnv enables expansion of $VAR and ${VAR} references in Command and Args, using the process's environment.
+	ExpandEnv bool
+	Stdin     fdConfig
+	Stdout    fdConfig
+	Stderr    fdConfig
+
+	// Timeout, if greater than zero, is how long the process may run before it is stopped.
+	Timeout time.Duration
+	// StopSignal and KillGracePeriod are how the process is stopped, when it times out or the client goes away.
+	StopSignal      syscall.Signal
+	KillGracePeriod time.Duration
+	// CancelPolicy, if set, is how the process is stopped when the client goes away, instead of StopSignal and KillGracePeriod.
+	CancelPolicy *clusteriface.CancelPolicy
+	Credential   *clusteriface.Credential
+	CgroupPath   string
+	// HideEnv is the names of env vars to omit from the StartInfo sent back to the client.
+	HideEnv []string
+	// MaxMessageSize is the maximum size of the subsequent messages in both directions, if greater than zero.
+	// Otherwise it is DefaultMaxMessageSize.
+	MaxMessageSize int
 }
 
 type fdConfig struct {
 	Discard bool
 	File    string
+	// BufferSize is the size of the server-side ring buffer for an output stream, if greater than zero.
+	BufferSize int
 }
 
 type fdPayload struct {
@@ -36,13 +215,51 @@ type procResult struct {
 	Exited   bool
 	ExitCode int
 	TimeMS   int64
+	// StdoutDropped and StderrDropped are the number of output bytes dropped by server-side ring buffers.
+	StdoutDropped int64
+	StderrDropped int64
+	// Signaled is true if the process was terminated by a signal, in which case Signal is the signal.
+	Signaled bool
+	Signal   syscall.Signal
+	Usage    clusteriface.ResourceUsage
+	// StdoutBytes, StderrBytes, and StdinBytes are the number of bytes the process wrote to stdout and stderr,
+	// and the number of stdin bytes written to it, regardless of where the output went.
+	StdoutBytes int64
+	StderrBytes int64
+	StdinBytes  int64
+	// MaxRuntimeExceeded is true if the server killed the process for exceeding the server's max runtime.
+	MaxRuntimeExceeded bool
+	// Reason is why the process ended, which is empty if it exited on its own. Older servers don't send it.
+	Reason clusteriface.ExitReason
+}
+
+// procStarted is sent by the server once the process has started.
+type procStarted = StartInfo
+
+// StartInfo describes exactly how the server started a process, for debugging
+// when env var expansion or PATH resolution changes what actually runs.
+type StartInfo struct {
+	PID int
+	// Path is the resolved path of the executable.
+	Path string
+	// Args is the final argv of the process, including argv[0], after env var expansion.
+	Args []string
+	// Env is the env vars set by the request, except for those in StartProcRequest.HideEnv,
+	// with only the last definition of each variable and sorted by name.
+	// The process also inherits the environment of the server.
+	Env []string
+	// WD is the working directory of the process.
+	WD string
 }
 
 // procResponseMessage is a command response message.
 // Only the last message of the stream will contain process exit information.
-// Messages before the last may contain stdout or stderr bytes.
+// Messages before the last may contain stdout or stderr bytes, or that the process started.
 type procResponseMessage struct {
-	Stdout fdPayload
-	Stderr fdPayload
-	Result procResult
+	Stdout  fdPayload
+	Stderr  fdPayload
+	Started *procStarted
+	// StdinAck is the number of stdin bytes written to the process since the previous acknowledgement.
+	StdinAck int64
+	Result   procResult
 }
@@ -14,6 +14,9 @@ type wsJSONWriter struct {
 	ctx  context.Context
 	conn *websocket.Conn
 
+	// maxPayload is the maximum number of bytes sent in a message, larger writes are split across multiple messages.
+	maxPayload int
+
 	// writeMsg is called with the bytes passed to write, and the return value is JSON-encoded and sent as an outgoing WebSocket message.
 	writeMsg func(b []byte) any
 	// writeMsg is called when the writer is closed, and the return value is JSON-encoded and sent as an outgoing WebSocket message.
@@ -23,8 +26,7 @@ type wsJSONWriter struct {
 func (w *wsJSONWriter) Write(b []byte) (int, error) {
 	w.log.Debugf("writing %d bytes", len(b))
 	// break the messages into chunks based on max message size
-	// the write limit is probably over-conservative, we are estimating the final encoded json size
-	writeLimit := readLimit / 3
+	writeLimit := w.maxPayload
 	leftToWrite := b
 	for {
 		toWrite := leftToWrite
@@ -0,0 +1,51 @@
+package agent
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/sysstats"
+	"github.com/julienschmidt/httprouter"
+)
+
+// statsSampleInterval is how long sampled system stats are reused, so that polling the stats of a node is cheap.
+const statsSampleInterval = 1 * time.Second
+
+// NodeStats is the current load of a node, see clusteriface.NodeStats.
+// The agent samples the system stats at most once per second.
+type NodeStats = clusteriface.NodeStats
+
+// Stats returns the current load of the node.
+func (c *Client) Stats(ctx context.Context) (NodeStats, error) {
+	var stats NodeStats
+	err := c.getJSON(ctx, "/stats", "getting node stats", &stats)
+	return stats, err
+}
+
+func (a *NodeAgent) stats(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	a.statsMut.Lock()
+	now := a.clock.Now()
+	if a.statsSampledAt.IsZero() || now.Sub(a.statsSampledAt) >= statsSampleInterval {
+		sys, err := sysstats.Sample()
+		if err != nil {
+			a.logger.Debugf("error sampling system stats: %s", err)
+		}
+		a.sysStats, a.statsSampledAt = sys, now
+	}
+	sys, sampledAt := a.sysStats, a.statsSampledAt
+	a.statsMut.Unlock()
+
+	writeJSON(w, NodeStats{
+		RunningProcesses:   a.commandServer.Running(),
+		NumCPU:             runtime.NumCPU(),
+		LoadAverage1:       sys.LoadAverage1,
+		MemTotalBytes:      sys.MemTotalBytes,
+		MemAvailableBytes:  sys.MemAvailableBytes,
+		DiskTotalBytes:     sys.DiskTotalBytes,
+		DiskAvailableBytes: sys.DiskAvailableBytes,
+		SampledAt:          sampledAt,
+	})
+}
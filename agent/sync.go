@@ -0,0 +1,141 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// SyncDirOption configures SyncDir, see clusteriface.SyncDirOption.
+type SyncDirOption = clusteriface.SyncDirOption
+
+// SyncResult reports the files handled by SyncDir, see clusteriface.SyncResult.
+type SyncResult = clusteriface.SyncResult
+
+var (
+	// SyncChecksum compares files by their SHA-256 checksums instead of their modification times, see clusteriface.SyncChecksum.
+	SyncChecksum = clusteriface.SyncChecksum
+	// SyncDelete deletes remote files that don't exist locally.
+	SyncDelete = clusteriface.SyncDelete
+)
+
+// SyncDir makes the remote directory contain the regular files of the local directory, like rsync,
+// transferring only the files that are new or changed. Files are considered unchanged if their sizes
+// and modification times, to the second, are equal, or with SyncChecksum, if their checksums are equal.
+// Transferred files get the mode and modification time of the local files.
+// Symlinks and other non-regular files are ignored, and empty directories are not created.
+func (c *Client) SyncDir(ctx context.Context, localDir, remoteDir string, opts ...SyncDirOption) (*SyncResult, error) {
+	var o clusteriface.SyncDirOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	remoteEntries, err := c.Manifest(ctx, remoteDir, o.Checksum)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("getting remote manifest: %w", err)
+	}
+	remote := map[string]ManifestEntry{}
+	for _, e := range remoteEntries {
+		remote[e.Path] = e
+	}
+
+	result := &SyncResult{}
+	local := map[string]bool{}
+	err = filepath.WalkDir(localDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		relSlash := filepath.ToSlash(rel)
+		local[relSlash] = true
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if remoteEntry, ok := remote[relSlash]; ok && remoteEntry.Size == fi.Size() {
+			unchanged := remoteEntry.ModTime.Unix() == fi.ModTime().Unix()
+			if o.Checksum {
+				sum, err := fileSHA256(p)
+				if err != nil {
+					return err
+				}
+				unchanged = remoteEntry.SHA256 == sum
+			}
+			if unchanged {
+				result.Skipped = append(result.Skipped, relSlash)
+				return nil
+			}
+		}
+
+		err = c.sendLocalFileWithInfo(ctx, p, fi, path.Join(remoteDir, relSlash))
+		if err != nil {
+			return fmt.Errorf("transferring %q: %w", relSlash, err)
+		}
+		result.Transferred = append(result.Transferred, relSlash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Delete {
+		for relSlash := range remote {
+			if local[relSlash] {
+				continue
+			}
+			err := c.Remove(ctx, path.Join(remoteDir, relSlash))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("deleting %q: %w", relSlash, err)
+			}
+			result.Deleted = append(result.Deleted, relSlash)
+		}
+		sort.Strings(result.Deleted)
+	}
+	return result, nil
+}
+
+// sendLocalFileWithInfo uploads the local file, setting the mode and modification time of the remote file to those of the local file.
+func (c *Client) sendLocalFileWithInfo(ctx context.Context, localPath string, fi os.FileInfo, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := http.Header{}
+	header.Set(FileModeHeader, strconv.FormatUint(uint64(fi.Mode().Perm()), 8))
+	header.Set(FileModTimeHeader, fi.ModTime().Format(time.RFC3339Nano))
+	_, err = c.sendFile(ctx, remotePath, f, fi.Size(), header)
+	return err
+}
+
+// Manifest lists the regular files in the directory tree on the node, optionally with their SHA-256 checksums.
+// This returns os.ErrNotExist if the directory is not found.
+func (c *Client) Manifest(ctx context.Context, dirPath string, checksum bool) ([]ManifestEntry, error) {
+	urlPath := path.Join("/manifest", dirPath)
+	if checksum {
+		urlPath += "?checksum=1"
+	}
+	var entries []ManifestEntry
+	err := c.getJSON(ctx, urlPath, "getting manifest", &entries)
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -129,7 +129,10 @@ func setCN(cn string, dn pkix.Name) pkix.Name {
 	return dn
 }
 
-func buildCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, subject *pkix.Name) (*Cert, error) {
+// DefaultServerName is the name in the agent certs generated by GenerateCerts, which clients verify the agent's cert against by default.
+const DefaultServerName = "nodeagent"
+
+func buildCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, subject *pkix.Name, dnsName string) (*Cert, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
@@ -138,7 +141,7 @@ func buildCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, subject *pkix.Na
 	c := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject:      *subject,
-		DNSNames:     []string{"nodeagent"},
+		DNSNames:     []string{dnsName},
 		NotBefore:    time.Now(),
 		NotAfter:     time.Now().AddDate(0, 0, 7),
 		KeyUsage:     x509.KeyUsageDigitalSignature,
@@ -186,13 +189,13 @@ func GenerateCerts() (*Certs, error) {
 	}
 
 	serverSubject := pkix.Name{CommonName: "nodeagent"}
-	serverCert, err := buildCert(caCert.x509Cert, caCert.privKey, &serverSubject)
+	serverCert, err := buildCert(caCert.x509Cert, caCert.privKey, &serverSubject, DefaultServerName)
 	if err != nil {
 		return nil, fmt.Errorf("building server cert: %w", err)
 	}
 
 	clientSubject := pkix.Name{CommonName: "nodeagent"}
-	clientCert, err := buildCert(caCert.x509Cert, caCert.privKey, &clientSubject)
+	clientCert, err := buildCert(caCert.x509Cert, caCert.privKey, &clientSubject, DefaultServerName)
 	if err != nil {
 		return nil, fmt.Errorf("building client cert: %w", err)
 	}
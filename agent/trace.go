@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// RequestTiming is a breakdown of the time taken by a request to the agent, for diagnosing slow or distant nodes.
+// There is no DNS phase, since the client dials the node's IP address directly.
+type RequestTiming struct {
+	Method string
+	Path   string
+	// ReusedConn is true if the request used an idle connection, in which case there is no connect or TLS handshake phase.
+	ReusedConn bool
+	// Connect is the time taken to establish the TCP connection.
+	Connect time.Duration
+	// TLSHandshake is the time taken by the TLS handshake.
+	TLSHandshake time.Duration
+	// FirstByte is the time from starting the request until the first byte of the response was received.
+	FirstByte time.Duration
+}
+
+// WithClientRequestTiming calls f with the timing of each request to the agent once the first byte of its response is received.
+// Requests that fail before receiving a response aren't reported. This is disabled by default, so there's no overhead unless it's set.
+// f is called from the goroutine making the request, so it should return quickly.
+func WithClientRequestTiming(f func(RequestTiming)) ClientOption {
+	return func(c *Client) {
+		c.onRequestTiming = f
+	}
+}
+
+// traceReq instruments the request to report its timing, if enabled.
+func (c *Client) traceReq(r *http.Request) {
+	if c.onRequestTiming == nil {
+		return
+	}
+	// A dial started for the request can finish concurrently with the request, such as when the request is given
+	// an idle connection in the meantime, so the dial phases are recorded under a lock and only count for new connections.
+	var mut sync.Mutex
+	timing := RequestTiming{Method: r.Method, Path: r.URL.Path}
+	var start, connectStart, tlsStart time.Time
+	var connect, tlsHandshake time.Duration
+	locked := func(f func()) {
+		mut.Lock()
+		defer mut.Unlock()
+		f()
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			locked(func() { start = time.Now() })
+		},
+		ConnectStart: func(string, string) {
+			locked(func() { connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			locked(func() { connect = time.Since(connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			locked(func() { tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			locked(func() { tlsHandshake = time.Since(tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			locked(func() {
+				timing.ReusedConn = info.Reused
+				if !info.Reused {
+					timing.Connect = connect
+					timing.TLSHandshake = tlsHandshake
+				}
+			})
+		},
+		GotFirstResponseByte: func() {
+			var t RequestTiming
+			locked(func() {
+				timing.FirstByte = time.Since(start)
+				t = timing
+			})
+			c.onRequestTiming(t)
+		},
+	}
+	*r = *r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
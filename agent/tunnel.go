@@ -0,0 +1,189 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// deadlineConn is a net.Conn over a WebSocket connection whose deadlines behave like those of a TCP conn:
+// reads and writes past a deadline fail with a net.Error whose Timeout method returns true, wrapping os.ErrDeadlineExceeded,
+// and a read that times out can be retried after extending the deadline.
+// This is unlike websocket.NetConn, which closes the WebSocket connection once a deadline passes.
+//
+// A write that times out still closes the connection, since a partially written message can't be recovered,
+// and a write deadline only applies to writes started after it's set.
+type deadlineConn struct {
+	ws     *websocket.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	readMut sync.Mutex
+	pending []byte
+	// msgs is the messages read from the WebSocket connection, which is closed after readErr is set.
+	msgs    chan []byte
+	readErr error
+
+	writeMut sync.Mutex
+
+	readDeadline  connDeadline
+	writeDeadline connDeadline
+}
+
+// newDeadlineConn returns a conn for binary messages over the WebSocket connection, which is closed when the context is done.
+func newDeadlineConn(ctx context.Context, ws *websocket.Conn) *deadlineConn {
+	ctx, cancel := context.WithCancel(ctx)
+	c := &deadlineConn{
+		ws:     ws,
+		ctx:    ctx,
+		cancel: cancel,
+		msgs:   make(chan []byte),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop reads messages in the background, so that a read deadline passing doesn't interrupt reading a message.
+func (c *deadlineConn) readLoop() {
+	defer close(c.msgs)
+	for {
+		typ, b, err := c.ws.Read(c.ctx)
+		if err != nil {
+			switch websocket.CloseStatus(err) {
+			case websocket.StatusNormalClosure, websocket.StatusGoingAway:
+				err = io.EOF
+			}
+			c.readErr = err
+			return
+		}
+		if typ != websocket.MessageBinary {
+			c.readErr = fmt.Errorf("unexpected message type %v", typ)
+			c.ws.Close(websocket.StatusUnsupportedData, c.readErr.Error())
+			return
+		}
+		select {
+		case c.msgs <- b:
+		case <-c.ctx.Done():
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.readMut.Lock()
+	defer c.readMut.Unlock()
+
+	for len(c.pending) == 0 {
+		timeout, changed, stop := c.readDeadline.wait()
+		select {
+		case msg, ok := <-c.msgs:
+			stop()
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending = msg
+		case <-changed:
+			stop()
+		case <-timeout:
+			return 0, &net.OpError{Op: "read", Net: "websocket", Err: os.ErrDeadlineExceeded}
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.writeMut.Lock()
+	defer c.writeMut.Unlock()
+
+	ctx := c.ctx
+	if deadline := c.writeDeadline.get(); !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return 0, &net.OpError{Op: "write", Net: "websocket", Err: os.ErrDeadlineExceeded}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	err := c.ws.Write(ctx, websocket.MessageBinary, b)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, &net.OpError{Op: "write", Net: "websocket", Err: os.ErrDeadlineExceeded}
+		}
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *deadlineConn) Close() error {
+	err := c.ws.Close(websocket.StatusNormalClosure, "")
+	c.cancel()
+	return err
+}
+
+func (c *deadlineConn) LocalAddr() net.Addr  { return tunnelAddr{network: "websocket"} }
+func (c *deadlineConn) RemoteAddr() net.Addr { return tunnelAddr{network: "websocket"} }
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// connDeadline is a deadline that can be changed while it's being waited on.
+type connDeadline struct {
+	mut sync.Mutex
+	t   time.Time
+	// changed is closed when the deadline changes.
+	changed chan struct{}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+	}
+	d.changed = make(chan struct{})
+}
+
+func (d *connDeadline) get() time.Time {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return d.t
+}
+
+// wait returns a channel that receives once the deadline passes, which is nil if there is no deadline,
+// a channel that is closed when the deadline changes, and a function to release the timer.
+func (d *connDeadline) wait() (<-chan time.Time, <-chan struct{}, func()) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	if d.t.IsZero() {
+		return nil, d.changed, func() {}
+	}
+	timer := time.NewTimer(time.Until(d.t))
+	return timer.C, d.changed, func() { timer.Stop() }
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -21,26 +23,85 @@ import (
 	"go.uber.org/zap"
 )
 
+// userDataTemplate installs the node agent as a cloud-init per-boot script, so that it is restarted when the instance reboots,
+// and then starts it for the first boot.
+// The certs are written to a file that only root can read, and passed to the agent in env vars rather than flags,
+// so that other users on the node, such as processes run with StartProcRequest.Credential, can't read the agent's key.
 const userDataTemplate = `#!/bin/bash
 mkdir /node
 cd /node
 curl --retry 3 '{{.NodeAgentURL}}' > nodeagent
 chmod +x nodeagent
+(umask 077 && cat > /node/nodeagent.env <<'ENV'
+NODEAGENT_CA_CERT_PEM={{.CACertPEMEncoded}}
+NODEAGENT_CERT_PEM={{.CertPEMEncoded}}
+NODEAGENT_KEY_PEM={{.KeyPEMEncoded}}
+ENV
+)
+mkdir -p /var/lib/cloud/scripts/per-boot
+cat > /var/lib/cloud/scripts/per-boot/nodeagent.sh <<'SCRIPT'
+#!/bin/bash
+cd /node
+set -a
+. /node/nodeagent.env
+set +a
 nohup ./nodeagent \
-  --heartbeat-timeout 1m \
+  --heartbeat-timeout {{.HeartbeatTimeout}} \
   --on-heartbeat-failure shutdown \
-  --ca-cert-pem {{.CACertPEMEncoded}} \
-  --cert-pem {{.CertPEMEncoded}} \
-  --key-pem {{.KeyPEMEncoded}} \
-  &>/var/log/nodeagent &
+  --diagnostics-path /var/log/nodeagent \
+  --diagnostics-path /var/log/cloud-init-output.log \
+  &>>/var/log/nodeagent &
+SCRIPT
+chmod 700 /var/lib/cloud/scripts/per-boot/nodeagent.sh
+/var/lib/cloud/scripts/per-boot/nodeagent.sh
 `
 
 type Cluster struct {
+	// Nodes are the nodes created or adopted by the cluster.
+	//
+	// Deprecated: use ListNodes, which all backends implement.
 	Nodes []*Node
 
 	InstanceType       string
 	CleanupWait        bool
 	RunInstancesConfig func(*ec2.RunInstancesInput) error
+	// NoPublicIP disables public IP assignment, in which case the private IP is dialed unless ElasticIPs is set.
+	NoPublicIP bool
+	// DialPrivateIP causes the agent client to dial the private IP of instances instead of the public IP.
+	// The test runner must have a route to the private IP, such as via a VPN or by running in the same VPC.
+	DialPrivateIP bool
+	// ElasticIPs allocates and associates an Elastic IP with each instance, which is released when the node is stopped.
+	ElasticIPs bool
+	// LaunchTemplate is the launch template to launch instances from, if any.
+	LaunchTemplate *ec2.LaunchTemplateSpecification
+	// MaxLifetime is the maximum lifetime of a node, after which it is stopped automatically.
+	// Zero means nodes live until they are explicitly stopped.
+	MaxLifetime time.Duration
+	// PlacementGroup is the name of the placement group to launch instances into, if any.
+	PlacementGroup string
+	// EphemeralPlacementGroup creates a cluster placement group for the nodes, which is deleted on cleanup.
+	// This is ignored if PlacementGroup is set.
+	EphemeralPlacementGroup bool
+	// HeartbeatTimeout is how long node agents wait without a heartbeat before shutting down their instances (default 1m).
+	HeartbeatTimeout time.Duration
+	// IsRetryable classifies errors from AWS operations, such as launching and terminating instances, as retryable.
+	// If nil, DefaultIsRetryable is used.
+	IsRetryable func(err error) bool
+	// RetryTimeout is how long retryable AWS operations are retried for (default 1m).
+	RetryTimeout time.Duration
+	// LaunchCandidates are the combinations of availability zone, subnet, and instance type to try in order
+	// when launching instances, moving on to the next one when a launch fails because of insufficient capacity.
+	LaunchCandidates []LaunchCandidate
+	// LaunchTimeout is the overall deadline for launching instances across all launch candidates, if greater than zero.
+	LaunchTimeout time.Duration
+	// AgentClientOptions are passed to the agent client of each node, such as agent.WithClientMaxFileTransfers.
+	AgentClientOptions []agent.ClientOption
+	// Tags are added to the instances when they're launched. They must be within EC2's limits on tags,
+	// which is checked before launching.
+	Tags map[string]string
+	// NameInstance, if set, returns the "Name" tag of the instance with the given index among all the nodes of the cluster,
+	// which is set right after the instances are launched. This takes precedence over a "Name" tag in Tags.
+	NameInstance func(index int) string
 
 	ctx    context.Context
 	config *config
@@ -84,11 +145,36 @@ func (c *Cluster) WithKeyName(s string) *Cluster {
 
 func (c *Cluster) WithInstanceType(s string) *Cluster {
 	c.InstanceType = s
+	c.config.instanceTypeSet = true
+	return c
+}
+
+// WithLaunchTemplate launches instances from the given EC2 launch template, identified by its ID or name.
+// The version can be a version number, "$Latest", or "$Default", and if empty the default version is used.
+//
+// The launch template provides the instance configuration, such as networking, IAM, and tags.
+// The cluster only sets the user data needed to bootstrap the node agent, and the fields explicitly
+// configured with WithInstanceType, WithAMIID, and WithKeyName, which override the template.
+// If any of WithPublicSubnetID, WithInstanceSecurityGroupID, or WithNoPublicIP are used, the template's primary network interface
+// is replaced by one with those settings, which also assigns a public IP unless WithNoPublicIP is used.
+// Other fields can be overridden with WithRunInstancesInput.
+func (c *Cluster) WithLaunchTemplate(idOrName, version string) *Cluster {
+	spec := &ec2.LaunchTemplateSpecification{}
+	if strings.HasPrefix(idOrName, "lt-") {
+		spec.LaunchTemplateId = &idOrName
+	} else {
+		spec.LaunchTemplateName = &idOrName
+	}
+	if version != "" {
+		spec.Version = &version
+	}
+	c.LaunchTemplate = spec
 	return c
 }
 
 func (c *Cluster) WithPublicSubnetID(subnetID string) *Cluster {
 	c.config.subnetID = subnetID
+	c.config.subnetIDSet = true
 	return c
 }
 
@@ -100,6 +186,7 @@ func (c *Cluster) WithInstanceProfileARN(a arn.ARN) *Cluster {
 
 func (c *Cluster) WithInstanceSecurityGroupID(id string) *Cluster {
 	c.config.instanceSecurityGroupID = id
+	c.config.securityGroupIDSet = true
 	return c
 }
 
@@ -108,13 +195,49 @@ func (c *Cluster) WithS3BucketARN(a arn.ARN) *Cluster {
 	return c
 }
 
+// WithSession sets the AWS session to use, instead of one built from the default credential chain and shared config.
 func (c *Cluster) WithSession(sess *session.Session) *Cluster {
 	c.config.session = sess
 	return c
 }
 
+// WithCredentials sets the AWS credentials to use, overriding those of the session.
+// For example, use stscreds.NewCredentials to assume a role.
+func (c *Cluster) WithCredentials(creds *credentials.Credentials) *Cluster {
+	c.config.credentials = creds
+	return c
+}
+
+// WithRegion sets the AWS region to launch nodes in, overriding that of the session.
+func (c *Cluster) WithRegion(region string) *Cluster {
+	c.config.region = region
+	return c
+}
+
+// WithCerts sets the certs used for mTLS with node agents, which is useful for adopting instances launched with the same certs.
+// By default, new certs are generated for each cluster.
+func (c *Cluster) WithCerts(certs *agent.Certs) *Cluster {
+	c.config.cert = certs
+	return c
+}
+
+// WithNodeAgentBin sets the path to the x86_64 node agent binary.
 func (c *Cluster) WithNodeAgentBin(binPath string) *Cluster {
-	c.config.nodeAgentBin = binPath
+	return c.WithNodeAgentBinForArch(ec2.ArchitectureTypeX8664, binPath)
+}
+
+// WithNodeAgentBinForArch sets the path to the node agent binary for the given EC2 architecture ("x86_64" or "arm64").
+// The binary is uploaded to S3 for nodes to download.
+// By default, this searches up from PWD for "nodeagent" for x86_64, or "nodeagent-arm64" for arm64.
+func (c *Cluster) WithNodeAgentBinForArch(arch, binPath string) *Cluster {
+	c.config.nodeAgentBins[arch] = binPath
+	return c
+}
+
+// WithNodeAgentURLForArch sets a URL from which nodes of the given EC2 architecture ("x86_64" or "arm64") download the node agent binary.
+// This takes precedence over a binary path, and nothing is uploaded to S3.
+func (c *Cluster) WithNodeAgentURLForArch(arch, url string) *Cluster {
+	c.config.nodeAgentURLs[arch] = url
 	return c
 }
 
@@ -124,11 +247,115 @@ func (c *Cluster) WithCleanupWait() *Cluster {
 	return c
 }
 
+// WithNoPublicIP launches instances without a public IP, so that the agent is dialed on the private IP.
+func (c *Cluster) WithNoPublicIP() *Cluster {
+	c.NoPublicIP = true
+	return c
+}
+
+// WithDialPrivateIP causes the agent client to dial the private IP of instances even if they have a public IP.
+func (c *Cluster) WithDialPrivateIP() *Cluster {
+	c.DialPrivateIP = true
+	return c
+}
+
+// WithElasticIPs allocates an Elastic IP for each instance, for stable addressing across instance restarts.
+// The Elastic IPs are released when nodes are stopped.
+func (c *Cluster) WithElasticIPs() *Cluster {
+	c.ElasticIPs = true
+	return c
+}
+
+// WithMaxLifetime causes nodes to be stopped automatically once they have been alive for d,
+// as a safety net against leaking instances if the test process never cleans them up.
+// The agent's heartbeat timeout already terminates instances when the test process exits,
+// so this mostly guards against long-running or hung test processes.
+func (c *Cluster) WithMaxLifetime(d time.Duration) *Cluster {
+	c.MaxLifetime = d
+	return c
+}
+
+// WithHeartbeatTimeout sets how long a node agent waits without receiving a heartbeat before shutting down its instance, which terminates it.
+// Nodes send heartbeats while the test process runs, so this bounds how long instances outlive a crashed test process.
+func (c *Cluster) WithHeartbeatTimeout(d time.Duration) *Cluster {
+	c.HeartbeatTimeout = d
+	return c
+}
+
+// WithPlacementGroup launches instances into the existing placement group with the given name.
+func (c *Cluster) WithPlacementGroup(name string) *Cluster {
+	c.PlacementGroup = name
+	return c
+}
+
+// WithEphemeralPlacementGroup launches instances into a new cluster placement group, for low-latency networking between nodes.
+// The placement group is created when the first nodes are launched, and deleted on cleanup,
+// which waits for the instances to terminate since a placement group can't be deleted while it contains instances.
+// Launching nodes fails early if the instance type doesn't support cluster placement groups.
+func (c *Cluster) WithEphemeralPlacementGroup() *Cluster {
+	c.EphemeralPlacementGroup = true
+	return c
+}
+
+// WithIsRetryable sets the function that decides which errors from AWS operations are retried, instead of DefaultIsRetryable.
+// For example, to also retry capacity errors:
+//
+//	c.WithIsRetryable(func(err error) bool {
+//		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InsufficientInstanceCapacity" {
+//			return true
+//		}
+//		return aws.DefaultIsRetryable(err)
+//	})
+func (c *Cluster) WithIsRetryable(f func(err error) bool) *Cluster {
+	c.IsRetryable = f
+	return c
+}
+
+// WithRetryTimeout sets how long retryable AWS operations are retried for, with exponential backoff between attempts.
+func (c *Cluster) WithRetryTimeout(d time.Duration) *Cluster {
+	c.RetryTimeout = d
+	return c
+}
+
+// WithLaunchCandidates sets the combinations of availability zone, subnet, and instance type to try in order when launching instances.
+// When a launch fails because of insufficient capacity, the next candidate is tried, and LastLaunch reports the candidate that succeeded.
+// The timeout, if greater than zero, is an overall deadline for launching across all candidates.
+func (c *Cluster) WithLaunchCandidates(timeout time.Duration, candidates ...LaunchCandidate) *Cluster {
+	c.LaunchCandidates = candidates
+	c.LaunchTimeout = timeout
+	return c
+}
+
+// WithHeartbeatLogWindow sets the window over which repeated identical heartbeat errors of a node are coalesced into a single log line
+// (default agent.DefaultErrorLogWindow), so that an unreachable node doesn't flood the logs. Zero logs every error.
+// This only applies to nodes created after it's set.
+func (c *Cluster) WithHeartbeatLogWindow(d time.Duration) *Cluster {
+	c.config.heartbeats.mut.Lock()
+	defer c.config.heartbeats.mut.Unlock()
+	c.config.heartbeats.logWindow = d
+	return c
+}
+
+// WithAgentClientOptions configures the agent client of each node, such as with agent.WithClientMaxFileTransfers.
+func (c *Cluster) WithAgentClientOptions(opts ...agent.ClientOption) *Cluster {
+	c.AgentClientOptions = append(c.AgentClientOptions, opts...)
+	return c
+}
+
 func (c *Cluster) WithAMIID(amiID string) *Cluster {
 	c.config.amiID = amiID
 	return c
 }
 
+// WithAMISSMParameter resolves the AMI ID from an SSM parameter when the cluster is loaded, instead of using a fixed AMI ID,
+// so that tests are portable across regions. For example, "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+// for the latest Amazon Linux 2023, or "/aws/service/canonical/ubuntu/server/22.04/stable/current/amd64/hvm/ebs-gp2/ami-id" for Ubuntu.
+// The parameter must be for an AMI of the instance type's architecture. WithAMIID takes precedence over this.
+func (c *Cluster) WithAMISSMParameter(name string) *Cluster {
+	c.config.amiSSMParameter = name
+	return c
+}
+
 func (c *Cluster) Context(ctx context.Context) *Cluster {
 	newC := *c
 	newC.ctx = ctx
@@ -144,9 +371,15 @@ func (c *Cluster) Context(ctx context.Context) *Cluster {
 // By default, this looks for the node agent binary by searching up from PWD for a "nodeagent" file.
 func NewCluster() *Cluster {
 	return &Cluster{
-		InstanceType: "t3.micro",
-		ctx:          context.Background(),
-		config:       &config{},
+		InstanceType:     "t3.micro",
+		HeartbeatTimeout: 1 * time.Minute,
+		RetryTimeout:     1 * time.Minute,
+		ctx:              context.Background(),
+		config: &config{
+			nodeAgentBins: map[string]string{},
+			nodeAgentURLs: map[string]string{},
+			heartbeats:    heartbeatManager{logWindow: agent.DefaultErrorLogWindow, clock: agent.SystemClock},
+		},
 	}
 }
 
@@ -197,13 +430,84 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 	if err := c.ensureLoaded(); err != nil {
 		return nil, err
 	}
-	req, _ := c.config.s3Client.GetObjectRequest(&s3.GetObjectInput{
-		Bucket: &c.config.nodeAgentS3Bucket,
-		Key:    &c.config.nodeAgentS3Key,
-	})
-	nodeagentURL, err := req.Presign(5 * time.Minute)
+	if err := c.ensurePlacementGroup(ctx); err != nil {
+		return nil, err
+	}
+	input, err := c.newNodesInput(n)
 	if err != nil {
-		return nil, fmt.Errorf("presigning node agent URL: %w", err)
+		return nil, err
+	}
+
+	reservations, err := c.launchInstances(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("launching instance: %w", err)
+	}
+
+	if len(reservations.Instances) != n {
+		err := fmt.Errorf("expected %d instances instance but got %d", n, len(reservations.Instances))
+		return nil, c.terminateUntracked(ctx, reservations.Instances, err)
+	}
+	// instances that aren't named still work, so a failure to name them doesn't fail the launch
+	if err := c.nameInstances(ctx, reservations.Instances, len(c.Nodes)); err != nil {
+		c.config.log.Warnf("%s", err)
+	}
+
+	instances, err := c.waitForInstances(ctx, reservations.Instances)
+	if err != nil {
+		return nil, c.terminateUntracked(ctx, reservations.Instances, fmt.Errorf("waiting for instances: %w", err))
+	}
+
+	var ifaceNodes clusteriface.Nodes
+	var nodes []*Node
+	for i, inst := range instances {
+		node, err := c.newNode(ctx, inst, c.ElasticIPs)
+		if err != nil {
+			// the nodes constructed so far are tracked and terminated on cleanup, but the rest of the instances aren't
+			return nil, c.terminateUntracked(ctx, instances[i:], err)
+		}
+		nodes = append(nodes, node)
+		ifaceNodes = append(ifaceNodes, node)
+		c.addNode(node)
+	}
+
+	err = c.waitForNodesHeartbeats(ctx, nodes)
+	if err != nil {
+		return nil, err
+	}
+
+	return ifaceNodes, nil
+}
+
+// terminateUntracked terminates launched instances that aren't tracked as nodes because launching failed,
+// which would otherwise keep running until their agents' heartbeats time out, and returns the launch error.
+func (c *Cluster) terminateUntracked(ctx context.Context, instances []*ec2.Instance, err error) error {
+	if len(instances) == 0 {
+		return err
+	}
+	var instanceIDs []*string
+	for _, inst := range instances {
+		instanceIDs = append(instanceIDs, inst.InstanceId)
+	}
+	termErr := c.terminateInstances(ctx, instanceIDs)
+	if termErr != nil && !isInstanceNotFound(termErr) {
+		return fmt.Errorf("%w (and terminating the %d untracked instances failed: %s)", err, len(instanceIDs), termErr)
+	}
+	return err
+}
+
+// newNodesInput builds the RunInstances input for launching n nodes, including the user data that installs and starts the node agent.
+func (c *Cluster) newNodesInput(n int) (*ec2.RunInstancesInput, error) {
+	nodeagentURL := c.config.nodeAgentURL
+	if nodeagentURL == "" {
+		req, _ := c.config.s3Client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: &c.config.nodeAgentS3Bucket,
+			Key:    &c.config.nodeAgentS3Key,
+		})
+		presignedURL, err := req.Presign(5 * time.Minute)
+		if err != nil {
+			return nil, fmt.Errorf("presigning node agent URL: %w", err)
+		}
+		nodeagentURL = presignedURL
 	}
 
 	tmpl, err := template.New("").Parse(userDataTemplate)
@@ -221,18 +525,82 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 		"CACertPEMEncoded": caCertPEMEncoded,
 		"CertPEMEncoded":   certPEMEncoded,
 		"KeyPEMEncoded":    keyPEMEncoded,
+		"HeartbeatTimeout": c.HeartbeatTimeout.String(),
 	})
 	if err != nil {
 		return nil, fmt.Errorf("executing user data template: %w", err)
 	}
 
-	userData := base64.StdEncoding.EncodeToString(buf.Bytes())
+	return c.launchInput(n, base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
 
+// launchInput builds the RunInstances input for launching n nodes with the given user data,
+// with the cluster's tags and RunInstancesConfig applied.
+func (c *Cluster) launchInput(n int, userData string) (*ec2.RunInstancesInput, error) {
+	input := c.runInstancesInput(n, userData)
+	tags, err := c.launchTags(n)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		input.TagSpecifications = append(input.TagSpecifications, &ec2.TagSpecification{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         tags,
+		})
+	}
+	if c.RunInstancesConfig != nil {
+		err := c.RunInstancesConfig(input)
+		if err != nil {
+			return nil, fmt.Errorf("calling RunInstancesConfig function: %w", err)
+		}
+	}
+	return input, nil
+}
+
+// runInstancesInput builds the input for launching n instances with the given user data.
+// When launching from a launch template, only the user data and explicitly-configured fields are set,
+// so that everything else comes from the template.
+func (c *Cluster) runInstancesInput(n int, userData string) *ec2.RunInstancesInput {
 	n64 := int64(n)
 	var keyName *string
 	if c.config.KeyName != "" {
 		keyName = &c.config.KeyName
 	}
+	if c.LaunchTemplate != nil {
+		input := &ec2.RunInstancesInput{
+			LaunchTemplate:                    c.LaunchTemplate,
+			MaxCount:                          &n64,
+			MinCount:                          &n64,
+			KeyName:                           keyName,
+			InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+			UserData:                          &userData,
+		}
+		if c.config.amiID != "" {
+			input.ImageId = &c.config.amiID
+		}
+		if c.config.instanceTypeSet {
+			input.InstanceType = &c.InstanceType
+		}
+		if pg := c.placementGroup(); pg != "" {
+			input.Placement = &ec2.Placement{GroupName: &pg}
+		}
+		// explicitly-configured networking overrides the template, since the IP that is dialed depends on it
+		if c.config.subnetIDSet || c.config.securityGroupIDSet || c.NoPublicIP {
+			iface := &ec2.InstanceNetworkInterfaceSpecification{
+				AssociatePublicIpAddress: aws.Bool(!c.NoPublicIP),
+				DeleteOnTermination:      aws.Bool(true),
+				DeviceIndex:              aws.Int64(0),
+			}
+			if c.config.subnetIDSet {
+				iface.SubnetId = &c.config.subnetID
+			}
+			if c.config.securityGroupIDSet {
+				iface.Groups = []*string{&c.config.instanceSecurityGroupID}
+			}
+			input.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{iface}
+		}
+		return input
+	}
 	input := &ec2.RunInstancesInput{
 		ImageId:                           &c.config.amiID,
 		IamInstanceProfile:                &ec2.IamInstanceProfileSpecification{Arn: &c.config.instanceProfileARN},
@@ -243,71 +611,167 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 		InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
 		UserData:                          &userData,
 		NetworkInterfaces: []*ec2.InstanceNetworkInterfaceSpecification{{
-			AssociatePublicIpAddress: aws.Bool(true),
+			AssociatePublicIpAddress: aws.Bool(!c.NoPublicIP),
 			DeleteOnTermination:      aws.Bool(true),
 			Groups:                   []*string{&c.config.instanceSecurityGroupID},
 			SubnetId:                 &c.config.subnetID,
 			DeviceIndex:              aws.Int64(0),
 		}},
 	}
-	if c.RunInstancesConfig != nil {
-		c.RunInstancesConfig(input)
+	if pg := c.placementGroup(); pg != "" {
+		input.Placement = &ec2.Placement{GroupName: &pg}
 	}
+	return input
+}
 
-	reservations, err := c.config.ec2Client.RunInstancesWithContext(ctx, input)
+// newNode constructs a node for a running instance, optionally associating a new Elastic IP with it.
+func (c *Cluster) newNode(ctx context.Context, inst *ec2.Instance, elasticIP bool) (*Node, error) {
+	node := &Node{
+		sess:        c.config.session,
+		ec2Client:   c.config.ec2Client,
+		instanceID:  *inst.InstanceId,
+		accountID:   c.config.accountID,
+		cleanupWait: c.CleanupWait,
+		log:         c.config.log.Named("node"),
+		heartbeats:  &c.config.heartbeats,
+		retry:       c.retry,
+	}
+	if elasticIP {
+		err := node.associateElasticIP(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	node.setMetadata(inst)
+	ip, err := c.dialIP(inst, node)
+	if err == nil {
+		node.agentClient, err = agent.NewClient(c.config.log, c.config.cert, ip, 8080, c.AgentClientOptions...)
+		if err != nil {
+			err = fmt.Errorf("constructing node agent client: %w", err)
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("launching instance: %w", err)
+		// the node isn't returned, so nothing else would release its Elastic IP
+		if releaseErr := node.releaseElasticIP(ctx); releaseErr != nil {
+			return nil, fmt.Errorf("%w (and releasing its Elastic IP failed: %s)", err, releaseErr)
+		}
+		return nil, err
 	}
+	return node, nil
+}
 
-	if len(reservations.Instances) != n {
-		return nil, fmt.Errorf("expected %d instances instance but got %d", n, len(reservations.Instances))
+// addNode adds a node to the cluster's nodes, starting its heartbeats and its max lifetime.
+// The max lifetime only starts once the node is tracked, so that instances the cluster doesn't own,
+// such as ones that AdoptByTag declined, are never terminated by it.
+func (c *Cluster) addNode(node *Node) {
+	c.Nodes = append(c.Nodes, node)
+	node.StartHeartbeat()
+	if c.MaxLifetime > 0 {
+		node.startLifetimeTimer(c.MaxLifetime)
 	}
+}
 
-	instances, err := c.waitForInstances(ctx, reservations.Instances)
+// UnhealthyInstancesError is returned when adopted instances do not respond to heartbeats.
+type UnhealthyInstancesError struct {
+	InstanceIDs []string
+}
+
+func (e *UnhealthyInstancesError) Error() string {
+	return fmt.Sprintf("instances did not respond to heartbeats: %s", strings.Join(e.InstanceIDs, ", "))
+}
+
+// AdoptByTag finds running instances with the given tag, such as instances launched by a previous test run, and adds them to the cluster as nodes.
+// The instances must be running an agent that trusts the cluster's certs, so the certs used to launch them must be provided with WithCerts.
+// Instances that don't respond to a heartbeat are not adopted, and are reported in an *UnhealthyInstancesError along with the healthy nodes.
+func (c *Cluster) AdoptByTag(ctx context.Context, key, value string) (clusteriface.Nodes, error) {
+	if err := c.ensureLoaded(); err != nil {
+		return nil, err
+	}
+	pages, err := collectPagesWithContext(
+		ctx,
+		&ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				{Name: aws.String("tag:" + key), Values: []*string{&value}},
+				{Name: aws.String("instance-state-name"), Values: []*string{aws.String(ec2.InstanceStateNameRunning)}},
+			},
+		},
+		c.config.ec2Client.DescribeInstancesPagesWithContext,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("waiting for instances: %w", err)
+		return nil, fmt.Errorf("describing instances with tag %s=%s: %w", key, value, err)
 	}
 
-	var ifaceNodes clusteriface.Nodes
 	var nodes []*Node
-	for _, inst := range instances {
-		nodeAgentClient, err := agent.NewClient(c.config.log, c.config.cert, *inst.PublicIpAddress, 8080)
-		if err != nil {
-			return nil, fmt.Errorf("constructing node agent client: %w", err)
-		}
-		node := &Node{
-			agentClient: nodeAgentClient,
-			sess:        c.config.session,
-			ec2Client:   c.config.ec2Client,
-			instanceID:  *inst.InstanceId,
-			accountID:   c.config.accountID,
-			cleanupWait: c.CleanupWait,
+	for _, page := range pages {
+		for _, res := range page.Reservations {
+			for _, inst := range res.Instances {
+				node, err := c.newNode(ctx, inst, false)
+				if err != nil {
+					return nil, err
+				}
+				nodes = append(nodes, node)
+			}
 		}
-		nodes = append(nodes, node)
-		ifaceNodes = append(ifaceNodes, node)
-		c.Nodes = append(c.Nodes, node)
-		node.agentClient.StartHeartbeat()
 	}
 
-	err = c.waitForNodesHeartbeats(ctx, nodes)
-	if err != nil {
-		return nil, err
+	healthy := make([]bool, len(nodes))
+	heartbeatCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		i, node := i, node
+		go func() {
+			defer wg.Done()
+			healthy[i] = c.waitForNodeHeartbeat(heartbeatCtx, node) == nil
+		}()
 	}
+	wg.Wait()
 
+	var ifaceNodes clusteriface.Nodes
+	var unhealthy []string
+	for i, node := range nodes {
+		if !healthy[i] {
+			unhealthy = append(unhealthy, node.instanceID)
+			continue
+		}
+		ifaceNodes = append(ifaceNodes, node)
+		c.addNode(node)
+	}
+	if len(unhealthy) > 0 {
+		return ifaceNodes, &UnhealthyInstancesError{InstanceIDs: unhealthy}
+	}
 	return ifaceNodes, nil
 }
 
-func (c *Cluster) waitForNodeHeartbeat(ctx context.Context, node *Node) {
+// dialIP returns the IP that the agent client should dial for the instance.
+func (c *Cluster) dialIP(inst *ec2.Instance, node *Node) (string, error) {
+	if c.DialPrivateIP || (c.NoPublicIP && !c.ElasticIPs) {
+		if inst.PrivateIpAddress == nil {
+			return "", fmt.Errorf("instance %q has no private IP", *inst.InstanceId)
+		}
+		return *inst.PrivateIpAddress, nil
+	}
+	if node.elasticIP != "" {
+		return node.elasticIP, nil
+	}
+	if inst.PublicIpAddress == nil {
+		return "", fmt.Errorf("instance %q has no public IP", *inst.InstanceId)
+	}
+	return *inst.PublicIpAddress, nil
+}
+
+func (c *Cluster) waitForNodeHeartbeat(ctx context.Context, node *Node) error {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
-			return
+			return ctx.Err()
 		case <-ticker.C:
 			err := node.Heartbeat(ctx)
 			if err == nil {
-				return
+				return nil
 			}
 		}
 	}
@@ -341,15 +805,34 @@ func (c *Cluster) NewNode(ctx context.Context) (clusteriface.Node, error) {
 	return nodes[0], nil
 }
 
+// ListNodes returns the nodes created or adopted by the cluster.
+func (c *Cluster) ListNodes() clusteriface.Nodes {
+	nodes := make(clusteriface.Nodes, len(c.Nodes))
+	for i, n := range c.Nodes {
+		nodes[i] = n
+	}
+	return nodes
+}
+
 func (c *Cluster) Cleanup(ctx context.Context) error {
 	if err := c.ensureLoaded(); err != nil {
 		return err
 	}
-	for _, n := range c.Nodes {
-		err := n.Stop(ctx)
+	errs := c.TerminateNodes(ctx, c.Nodes)
+	if len(errs) > 0 {
+		return &TerminateError{Errors: errs}
+	}
+	if c.CleanupWait && len(c.Nodes) > 0 {
+		var instanceIDs []*string
+		for _, n := range c.Nodes {
+			instanceIDs = append(instanceIDs, &n.instanceID)
+		}
+		err := c.config.ec2Client.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: instanceIDs,
+		})
 		if err != nil {
-			return fmt.Errorf("stopping node %s: %w", n, err)
+			return fmt.Errorf("waiting for instances to terminate: %w", err)
 		}
 	}
-	return nil
+	return c.deleteEphemeralPlacementGroup(ctx)
 }
@@ -0,0 +1,209 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeAWS is an endpoint for all AWS services that implements just enough of them to load a cluster and dry-run a launch,
+// and records the requests it gets.
+type fakeAWS struct {
+	// ssmParameters are the values of the SSM parameters.
+	ssmParameters map[string]string
+
+	mut sync.Mutex
+	// requests are the actions of the requests, such as "ec2:RunInstances", or the method and path for S3.
+	requests []string
+	// runInstances are the form values of the RunInstances requests.
+	runInstances []url.Values
+}
+
+func (f *fakeAWS) record(action string) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.requests = append(f.requests, action)
+}
+
+func (f *fakeAWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// SSM uses the JSON protocol, with the action in a header
+	if target := r.Header.Get("X-Amz-Target"); target != "" {
+		f.record(target)
+		var req struct{ Names []string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		type parameter struct{ Name, Value string }
+		resp := struct {
+			Parameters        []parameter
+			InvalidParameters []string
+		}{Parameters: []parameter{}, InvalidParameters: []string{}}
+		for _, name := range req.Names {
+			if value, ok := f.ssmParameters[name]; ok {
+				resp.Parameters = append(resp.Parameters, parameter{Name: name, Value: value})
+			} else {
+				resp.InvalidParameters = append(resp.InvalidParameters, name)
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	// STS and EC2 use the query protocol, with the action in the form, while S3 requests are for a bucket path
+	if r.URL.Path != "/" {
+		f.record(r.Method + " " + r.URL.Path)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.Form.Get("Action")
+	w.Header().Set("Content-Type", "text/xml")
+	switch action {
+	case "GetCallerIdentity":
+		f.record("sts:" + action)
+		fmt.Fprint(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><GetCallerIdentityResult>`+
+			`<Arn>arn:aws:iam::123456789012:user/test</Arn><UserId>test</UserId><Account>123456789012</Account>`+
+			`</GetCallerIdentityResult></GetCallerIdentityResponse>`)
+	case "DescribeInstanceTypes":
+		f.record("ec2:" + action)
+		fmt.Fprint(w, `<DescribeInstanceTypesResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/"><instanceTypeSet><item>`+
+			`<instanceType>t3.micro</instanceType><processorInfo><supportedArchitectures><item>x86_64</item></supportedArchitectures></processorInfo>`+
+			`</item></instanceTypeSet></DescribeInstanceTypesResponse>`)
+	case "RunInstances":
+		f.record("ec2:" + action)
+		f.mut.Lock()
+		f.runInstances = append(f.runInstances, r.Form)
+		f.mut.Unlock()
+		if r.Form.Get("DryRun") != "true" {
+			http.Error(w, "only dry runs are supported", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprint(w, `<Response><Errors><Error><Code>DryRunOperation</Code>`+
+			`<Message>Request would have succeeded, but DryRun flag is set.</Message></Error></Errors><RequestID>test</RequestID></Response>`)
+	default:
+		f.record("unknown:" + action)
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `<Response><Errors><Error><Code>InvalidAction</Code><Message>%s</Message></Error></Errors></Response>`, action)
+	}
+}
+
+// newFakeAWSCluster returns a cluster whose AWS requests go to the fake, and which is configured not to need the clustertest stack.
+func newFakeAWSCluster(t *testing.T, fake *fakeAWS) *Cluster {
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String(srv.URL),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	require.NoError(t, err)
+
+	// a node agent binary that would be uploaded to S3 when the cluster is fully loaded
+	nodeAgentBin := filepath.Join(t.TempDir(), "nodeagent")
+	require.NoError(t, os.WriteFile(nodeAgentBin, []byte("nodeagent"), 0755))
+
+	return NewCluster().
+		WithSession(sess).
+		WithLogger(zap.NewNop().Sugar()).
+		WithInstanceProfileARN(arn.ARN{Partition: "aws", Service: "iam", AccountID: "123456789012", Resource: "instance-profile/test"}).
+		WithS3BucketARN(arn.ARN{Partition: "aws", Service: "s3", Resource: "bucket"}).
+		WithPublicSubnetID("subnet-test").
+		WithInstanceSecurityGroupID("sg-test").
+		WithNodeAgentBin(nodeAgentBin)
+}
+
+func TestDryRun(t *testing.T) {
+	fake := &fakeAWS{}
+	c := newFakeAWSCluster(t, fake).WithAMIID("ami-test")
+
+	res, err := c.DryRun(c.ctx, 2)
+	require.NoError(t, err)
+	assert.True(t, res.WouldSucceed, res.String())
+
+	// the launch is only validated, and the node agent isn't uploaded
+	assert.Equal(t, []string{"sts:GetCallerIdentity", "ec2:DescribeInstanceTypes", "ec2:RunInstances"}, fake.requests)
+	require.Len(t, fake.runInstances, 1)
+	assert.Equal(t, "true", fake.runInstances[0].Get("DryRun"))
+	assert.Equal(t, "ami-test", fake.runInstances[0].Get("ImageId"))
+	assert.Equal(t, "2", fake.runInstances[0].Get("MaxCount"))
+	assert.Empty(t, fake.runInstances[0].Get("UserData"))
+}
+
+func TestWithAMISSMParameter(t *testing.T) {
+	const (
+		al2023 = "/aws/service/ami-amazon-linux-latest/al2023-ami-kernel-default-x86_64"
+		ecs    = "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"
+	)
+	ssmParameters := map[string]string{
+		al2023: "ami-al2023",
+		// the ECS-optimized parameters are JSON
+		ecs: `{"image_id":"ami-ecs","image_name":"amzn2-ami-ecs-hvm"}`,
+	}
+
+	cases := []struct {
+		name      string
+		configure func(c *Cluster) *Cluster
+		expAMI    string
+		expErr    string
+	}{
+		{
+			name:      "plain AMI ID",
+			configure: func(c *Cluster) *Cluster { return c.WithAMISSMParameter(al2023) },
+			expAMI:    "ami-al2023",
+		},
+		{
+			name:      "JSON with image_id",
+			configure: func(c *Cluster) *Cluster { return c.WithAMISSMParameter(ecs) },
+			expAMI:    "ami-ecs",
+		},
+		{
+			name:      "AMI ID takes precedence",
+			configure: func(c *Cluster) *Cluster { return c.WithAMISSMParameter(al2023).WithAMIID("ami-explicit") },
+			expAMI:    "ami-explicit",
+		},
+		{
+			name:      "missing parameter",
+			configure: func(c *Cluster) *Cluster { return c.WithAMISSMParameter("/missing") },
+			expErr:    `SSM parameter "/missing" not found`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			fake := &fakeAWS{ssmParameters: ssmParameters}
+			cluster := c.configure(newFakeAWSCluster(t, fake))
+
+			_, err := cluster.DryRun(cluster.ctx, 1)
+			if c.expErr != "" {
+				require.ErrorContains(t, err, c.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, fake.runInstances, 1)
+			assert.Equal(t, c.expAMI, fake.runInstances[0].Get("ImageId"))
+		})
+	}
+}
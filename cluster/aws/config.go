@@ -8,12 +8,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/guseggert/clustertest/agent"
 	"github.com/guseggert/clustertest/internal/files"
 	"go.uber.org/zap"
@@ -22,21 +26,49 @@ import (
 type config struct {
 	loadedMut sync.Mutex
 	loaded    bool
+	// awsLoaded is true once the AWS configuration is loaded, which happens before the rest of the config is loaded.
+	awsLoaded bool
+
+	placementMut          sync.Mutex
+	placementGroupChecked bool
+	// ephemeralPlacementGroup is the name of the placement group created for the cluster, if any.
+	ephemeralPlacementGroup string
+
+	launchMut sync.Mutex
+	// lastLaunch is the launch candidate of the most recent successful launch.
+	lastLaunch LaunchCandidate
+	// amiArch is the architecture of the AMI, once it has been described for checking launch candidates.
+	amiArch string
+
+	heartbeats heartbeatManager
 
 	nodeAgentBin            string
+	nodeAgentBins           map[string]string
+	nodeAgentURLs           map[string]string
+	nodeAgentURL            string
+	arch                    string
 	log                     *zap.SugaredLogger
 	cert                    *agent.Certs
 	session                 *session.Session
+	credentials             *credentials.Credentials
+	region                  string
 	ec2Client               *ec2.EC2
 	s3Client                *s3.S3
 	instanceProfileARN      string
 	instanceSecurityGroupID string
 	amiID                   string
-	accountID               string
-	subnetID                string
-	nodeAgentS3Bucket       string
-	nodeAgentS3Key          string
-	KeyName                 string
+	// amiSSMParameter is the SSM parameter that the AMI ID is resolved from, if set.
+	amiSSMParameter   string
+	accountID         string
+	subnetID          string
+	nodeAgentS3Bucket string
+	nodeAgentS3Key    string
+	KeyName           string
+	instanceTypeSet   bool
+	// subnetIDSet and securityGroupIDSet are true if the subnet and security group were set explicitly,
+	// rather than from the stack outputs, in which case they override the launch template.
+	subnetIDSet        bool
+	securityGroupIDSet bool
 }
 
 func (c *Cluster) ensureLoaded() error {
@@ -46,6 +78,56 @@ func (c *Cluster) ensureLoaded() error {
 		return nil
 	}
 
+	err := c.loadAWSConfig()
+	if err != nil {
+		return err
+	}
+
+	if c.config.cert == nil {
+		cert, err := agent.GenerateCerts()
+		if err != nil {
+			return fmt.Errorf("generating cert: %w", err)
+		}
+		c.config.cert = cert
+	}
+
+	c.config.nodeAgentURL = c.config.nodeAgentURLs[c.config.arch]
+	if c.config.nodeAgentURL == "" {
+		c.config.nodeAgentBin = c.config.nodeAgentBins[c.config.arch]
+		if c.config.nodeAgentBin == "" {
+			nab, err := files.FindNodeAgentBinForArch(goArch(c.config.arch))
+			if err != nil {
+				return fmt.Errorf("finding node agent bin for architecture %s: %w", c.config.arch, err)
+			}
+			c.config.nodeAgentBin = nab
+		}
+
+		// upload the node agent to S3
+		nodeAgentKey, err := provideFileViaS3(c.config.s3Client, c.config.nodeAgentS3Bucket, c.config.nodeAgentBin)
+		if err != nil {
+			return fmt.Errorf("uploading node agent to S3: %w", err)
+		}
+		c.config.nodeAgentS3Key = nodeAgentKey
+	}
+
+	c.config.loaded = true
+	return nil
+}
+
+// ensureAWSLoaded is like ensureLoaded, but only loads the AWS configuration, such as the session, clients, and AMI,
+// without generating certs or uploading the node agent to S3, for validating launches without side effects.
+func (c *Cluster) ensureAWSLoaded() error {
+	c.config.loadedMut.Lock()
+	defer c.config.loadedMut.Unlock()
+	return c.loadAWSConfig()
+}
+
+// loadAWSConfig loads the AWS configuration, unless it's already loaded. The caller must hold loadedMut.
+func (c *Cluster) loadAWSConfig() error {
+	if c.config.awsLoaded {
+		return nil
+	}
+
 	if c.config.log == nil {
 		l, err := zap.NewProduction()
 		if err != nil {
@@ -61,6 +143,23 @@ func (c *Cluster) ensureLoaded() error {
 		}
 		c.config.session = sess
 	}
+	if c.config.credentials != nil || c.config.region != "" {
+		awsConfig := aws.NewConfig()
+		if c.config.credentials != nil {
+			awsConfig = awsConfig.WithCredentials(c.config.credentials)
+		}
+		if c.config.region != "" {
+			awsConfig = awsConfig.WithRegion(c.config.region)
+		}
+		c.config.session = c.config.session.Copy(awsConfig)
+	}
+
+	// validate the credentials early, since otherwise failures surface as confusing errors from whichever call is made first
+	identity, err := sts.New(c.config.session).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return fmt.Errorf("validating AWS credentials: %w", err)
+	}
+	c.config.log.Debugf("using AWS identity %s", *identity.Arn)
 
 	if c.config.accountID == "" { // TODO: improve :/
 		outputsMap, err := fetchStackOutputs(c.config.session)
@@ -75,57 +174,97 @@ func (c *Cluster) ensureLoaded() error {
 
 		c.config.accountID = outputs.accountID
 		c.config.instanceProfileARN = outputs.ec2InstanceProfileARN
-		c.config.instanceSecurityGroupID = outputs.ec2SecurityGroupID
-		c.config.subnetID = outputs.publicSubnetIDs[0]
+		if !c.config.securityGroupIDSet {
+			c.config.instanceSecurityGroupID = outputs.ec2SecurityGroupID
+		}
+		if !c.config.subnetIDSet {
+			c.config.subnetID = outputs.publicSubnetIDs[0]
+		}
 		c.config.nodeAgentS3Bucket = outputs.s3Bucket
 	}
 
-	if c.config.amiID == "" {
-		amiID, err := fetchAMIID(c.config.session)
+	c.config.s3Client = s3.New(c.config.session)
+	c.config.ec2Client = ec2.New(c.config.session)
+
+	if c.config.arch == "" {
+		arch, err := c.fetchArchitecture()
 		if err != nil {
-			return fmt.Errorf("fetching AMI ID: %w", err)
+			return fmt.Errorf("determining instance architecture: %w", err)
 		}
-		c.config.amiID = amiID
+		c.config.arch = arch
 	}
 
-	if c.config.cert == nil {
-		cert, err := agent.GenerateCerts()
+	// the AMI ID is resolved once per cluster, which is for a single region, and then reused for every launch
+	if c.config.amiID == "" && c.config.amiSSMParameter != "" {
+		amiID, err := fetchAMIIDFromSSM(c.config.session, c.config.amiSSMParameter)
 		if err != nil {
-			return fmt.Errorf("generating cert: %w", err)
+			return fmt.Errorf("fetching AMI ID: %w", err)
 		}
-		c.config.cert = cert
+		c.config.log.Debugf("resolved AMI ID %s from SSM parameter %s in region %s", amiID, c.config.amiSSMParameter, c.config.region)
+		c.config.amiID = amiID
 	}
-
-	if c.config.nodeAgentBin == "" {
-		nab, err := files.FindNodeAgentBin()
+	if c.config.amiID == "" && c.LaunchTemplate == nil {
+		key := "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"
+		if c.config.arch == ec2.ArchitectureTypeArm64 {
+			key = "/aws/service/ecs/optimized-ami/amazon-linux-2/arm64/recommended"
+		}
+		amiID, err := fetchAMIIDFromSSM(c.config.session, key)
 		if err != nil {
-			return fmt.Errorf("finding node agent bin: %w", err)
+			return fmt.Errorf("fetching AMI ID: %w", err)
 		}
-		c.config.nodeAgentBin = nab
+		c.config.amiID = amiID
 	}
 
-	c.config.s3Client = s3.New(c.config.session)
-	c.config.ec2Client = ec2.New(c.config.session)
+	c.config.awsLoaded = true
+	return nil
+}
 
-	// upload the node agent to S3
-	nodeAgentKey, err := provideFileViaS3(c.config.s3Client, c.config.nodeAgentS3Bucket, c.config.nodeAgentBin)
+// fetchArchitecture returns the EC2 architecture of the cluster's instance type, either "x86_64" or "arm64".
+// When launching from a launch template without an explicit instance type, this defaults to "x86_64".
+func (c *Cluster) fetchArchitecture() (string, error) {
+	if c.LaunchTemplate != nil && !c.config.instanceTypeSet {
+		return ec2.ArchitectureTypeX8664, nil
+	}
+	out, err := c.config.ec2Client.DescribeInstanceTypes(&ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{&c.InstanceType},
+	})
 	if err != nil {
-		return fmt.Errorf("uploading node agent to S3: %w", err)
+		return "", fmt.Errorf("describing instance type %q: %w", c.InstanceType, err)
+	}
+	if len(out.InstanceTypes) != 1 {
+		return "", fmt.Errorf("expected 1 instance type for %q, got %d", c.InstanceType, len(out.InstanceTypes))
 	}
-	c.config.nodeAgentS3Key = nodeAgentKey
+	for _, arch := range out.InstanceTypes[0].ProcessorInfo.SupportedArchitectures {
+		if *arch == ec2.ArchitectureTypeArm64 {
+			return ec2.ArchitectureTypeArm64, nil
+		}
+	}
+	return ec2.ArchitectureTypeX8664, nil
+}
 
-	c.config.loaded = true
-	return nil
+// goArch returns the GOARCH corresponding to an EC2 architecture.
+func goArch(arch string) string {
+	if arch == ec2.ArchitectureTypeArm64 {
+		return "arm64"
+	}
+	return "amd64"
 }
 
-func fetchAMIID(sess *session.Session) (string, error) {
+// fetchAMIIDFromSSM resolves an AMI ID from an SSM parameter, whose value is either the AMI ID,
+// as with the Amazon Linux and Ubuntu public parameters, or JSON with an "image_id" field, as with the ECS-optimized ones.
+func fetchAMIIDFromSSM(sess *session.Session, key string) (string, error) {
 	ssmClient := ssm.New(sess)
-	key := "/aws/service/ecs/optimized-ami/amazon-linux-2/recommended"
 	res, err := ssmClient.GetParameters(&ssm.GetParametersInput{Names: []*string{&key}})
 	if err != nil {
-		return "", fmt.Errorf("fetching AMI ID: %w", err)
+		return "", fmt.Errorf("fetching SSM parameter %q: %w", key, err)
+	}
+	if len(res.Parameters) == 0 {
+		return "", fmt.Errorf("SSM parameter %q not found", key)
 	}
 	val := *res.Parameters[0].Value
+	if strings.HasPrefix(val, "ami-") {
+		return val, nil
+	}
 	m := map[string]interface{}{}
 	err = json.Unmarshal([]byte(val), &m)
 	if err != nil {
@@ -0,0 +1,131 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/pricing"
+)
+
+// CostSpec describes a set of instances for estimating their cost.
+type CostSpec struct {
+	// InstanceType is the EC2 instance type. If empty, the cluster's instance type is used.
+	InstanceType string
+	// Count is the number of instances.
+	Count int
+	// Spot estimates the cost of spot instances instead of on-demand instances.
+	Spot bool
+}
+
+// EstimateCost returns the estimated cost in USD per hour of running the given instances in the cluster's region.
+// On-demand prices come from the AWS Pricing API, and spot prices from the current spot price history,
+// using the most expensive availability zone. This only includes the cost of the instances running Linux,
+// not of storage, data transfer, Elastic IPs, etc., so it should be treated as approximate.
+func (c *Cluster) EstimateCost(ctx context.Context, spec CostSpec) (float64, error) {
+	if err := c.ensureLoaded(); err != nil {
+		return 0, err
+	}
+	instanceType := spec.InstanceType
+	if instanceType == "" {
+		instanceType = c.InstanceType
+	}
+	var price float64
+	var err error
+	if spec.Spot {
+		price, err = c.spotPrice(ctx, instanceType)
+	} else {
+		price, err = c.onDemandPrice(ctx, instanceType)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return price * float64(spec.Count), nil
+}
+
+func (c *Cluster) onDemandPrice(ctx context.Context, instanceType string) (float64, error) {
+	region := *c.config.session.Config.Region
+	r, ok := endpoints.AwsPartition().Regions()[region]
+	if !ok {
+		return 0, fmt.Errorf("unknown region %q", region)
+	}
+
+	// the Pricing API is only available in a few regions, and prices for all regions are available in each
+	pricingClient := pricing.New(c.config.session, aws.NewConfig().WithRegion(endpoints.UsEast1RegionID))
+	filter := func(field, value string) *pricing.Filter {
+		return &pricing.Filter{Type: aws.String(pricing.FilterTypeTermMatch), Field: aws.String(field), Value: aws.String(value)}
+	}
+	out, err := pricingClient.GetProductsWithContext(ctx, &pricing.GetProductsInput{
+		ServiceCode: aws.String("AmazonEC2"),
+		Filters: []*pricing.Filter{
+			filter("instanceType", instanceType),
+			filter("location", r.Description()),
+			filter("operatingSystem", "Linux"),
+			filter("tenancy", "Shared"),
+			filter("preInstalledSw", "NA"),
+			filter("capacitystatus", "Used"),
+		},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting price of instance type %q: %w", instanceType, err)
+	}
+	for _, product := range out.PriceList {
+		price, ok := onDemandPriceFromProduct(product)
+		if ok {
+			return price, nil
+		}
+	}
+	return 0, fmt.Errorf("no on-demand price found for instance type %q in region %q", instanceType, region)
+}
+
+// onDemandPriceFromProduct extracts the hourly USD price from a Pricing API product document,
+// which looks like {"terms": {"OnDemand": {"<offer>": {"priceDimensions": {"<dimension>": {"pricePerUnit": {"USD": "0.0104"}}}}}}}.
+func onDemandPriceFromProduct(product aws.JSONValue) (float64, bool) {
+	terms, _ := product["terms"].(map[string]interface{})
+	onDemand, _ := terms["OnDemand"].(map[string]interface{})
+	for _, offer := range onDemand {
+		offerMap, _ := offer.(map[string]interface{})
+		dimensions, _ := offerMap["priceDimensions"].(map[string]interface{})
+		for _, dimension := range dimensions {
+			dimensionMap, _ := dimension.(map[string]interface{})
+			pricePerUnit, _ := dimensionMap["pricePerUnit"].(map[string]interface{})
+			usd, _ := pricePerUnit["USD"].(string)
+			price, err := strconv.ParseFloat(usd, 64)
+			if err == nil {
+				return price, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c *Cluster) spotPrice(ctx context.Context, instanceType string) (float64, error) {
+	out, err := c.config.ec2Client.DescribeSpotPriceHistoryWithContext(ctx, &ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       []*string{&instanceType},
+		ProductDescriptions: []*string{aws.String("Linux/UNIX")},
+		StartTime:           aws.Time(time.Now()),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("getting spot price of instance type %q: %w", instanceType, err)
+	}
+	var maxPrice float64
+	found := false
+	for _, p := range out.SpotPriceHistory {
+		price, err := strconv.ParseFloat(*p.SpotPrice, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parsing spot price %q: %w", *p.SpotPrice, err)
+		}
+		if price > maxPrice {
+			maxPrice = price
+		}
+		found = true
+	}
+	if !found {
+		return 0, fmt.Errorf("no spot price found for instance type %q", instanceType)
+	}
+	return maxPrice, nil
+}
@@ -0,0 +1,70 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// DryRunResult is the result of validating a launch of nodes with DryRun.
+type DryRunResult struct {
+	// WouldSucceed is true if EC2 accepted the launch request.
+	WouldSucceed bool
+	// Reason is the error that EC2 rejected the launch request with, if it would fail.
+	Reason error
+}
+
+func (r DryRunResult) String() string {
+	if r.WouldSucceed {
+		return "launch would succeed"
+	}
+	return fmt.Sprintf("launch would fail: %s", r.Reason)
+}
+
+// DryRun validates that launching n nodes would succeed, without launching any instances, such as to catch misconfiguration cheaply in CI.
+// It sends the RunInstances request that NewNodes would send with DryRun set, so that EC2 checks the permissions,
+// instance type, AMI, subnet, security group, and instance profile. Only the first launch candidate is checked.
+// An ephemeral placement group isn't created for the dry run, so the request is validated without it.
+// Nothing is created or uploaded, so the node agent isn't uploaded to S3 and the request is validated without the user data
+// that bootstraps it.
+//
+// Rejections of the request are reported in the result, while other errors, such as failing to reach EC2, are returned as errors.
+func (c *Cluster) DryRun(ctx context.Context, n int) (DryRunResult, error) {
+	if err := c.ensureAWSLoaded(); err != nil {
+		return DryRunResult{}, err
+	}
+	input, err := c.launchInput(n, "")
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	input.UserData = nil
+	var candidate LaunchCandidate
+	if len(c.LaunchCandidates) > 0 {
+		candidate = c.LaunchCandidates[0]
+	}
+	input, err = c.launchCandidateInput(ctx, input, candidate)
+	if err != nil {
+		return DryRunResult{}, err
+	}
+	input.DryRun = aws.Bool(true)
+
+	err = c.retry(ctx, "dry-running launch of instances", func() error {
+		_, err := c.config.ec2Client.RunInstancesWithContext(ctx, input)
+		return err
+	})
+	var reqErr awserr.RequestFailure
+	switch {
+	case err == nil:
+		// EC2 always fails dry runs, but treat this as success in case it doesn't
+		return DryRunResult{WouldSucceed: true}, nil
+	case errors.As(err, &reqErr) && reqErr.Code() == "DryRunOperation":
+		return DryRunResult{WouldSucceed: true}, nil
+	case errors.As(err, &reqErr) && reqErr.StatusCode() < 500:
+		return DryRunResult{Reason: err}, nil
+	default:
+		return DryRunResult{}, fmt.Errorf("dry-running launch of instances: %w", err)
+	}
+}
@@ -0,0 +1,175 @@
+package aws
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+)
+
+// heartbeatInterval is how often each node is sent a heartbeat.
+const heartbeatInterval = 10 * time.Second
+
+// NodeHealth is the heartbeat health of a node.
+type NodeHealth struct {
+	InstanceID string
+	// LastHeartbeat is when the node last responded to a heartbeat, which is zero if it never has.
+	LastHeartbeat time.Time
+	// LastError is the error from the most recent failed heartbeat, if any.
+	LastError error
+	// ConsecutiveFailures is the number of heartbeats that have failed since the node last responded to one.
+	ConsecutiveFailures int
+}
+
+// Healthy returns true if the node responded to its most recent heartbeat.
+func (h NodeHealth) Healthy() bool {
+	return h.ConsecutiveFailures == 0
+}
+
+// heartbeatManager sends heartbeats to all of a cluster's nodes from a single goroutine,
+// staggering them across the heartbeat interval to smooth out the load, instead of each node running its own ticker.
+// The goroutine only runs while there are nodes to send heartbeats to.
+type heartbeatManager struct {
+	mut     sync.Mutex
+	nodes   []*Node
+	health  map[string]*NodeHealth
+	running bool
+	// clock schedules the heartbeats and timestamps their results.
+	clock agent.Clock
+	// logWindow is the window over which repeated identical heartbeat errors of a node are coalesced into a single log line.
+	logWindow time.Duration
+	errors    map[string]*agent.ErrorCoalescer
+}
+
+// add starts sending heartbeats to the node, if they aren't already being sent.
+func (m *heartbeatManager) add(n *Node) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.health == nil {
+		m.health = map[string]*NodeHealth{}
+		m.errors = map[string]*agent.ErrorCoalescer{}
+	}
+	if _, ok := m.health[n.instanceID]; ok {
+		return
+	}
+	m.nodes = append(m.nodes, n)
+	m.health[n.instanceID] = &NodeHealth{InstanceID: n.instanceID}
+	m.errors[n.instanceID] = &agent.ErrorCoalescer{Window: m.logWindow}
+	if !m.running {
+		m.running = true
+		go m.run()
+	}
+}
+
+// remove stops sending heartbeats to the node.
+func (m *heartbeatManager) remove(n *Node) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if _, ok := m.health[n.instanceID]; !ok {
+		return
+	}
+	delete(m.health, n.instanceID)
+	delete(m.errors, n.instanceID)
+	for i, node := range m.nodes {
+		if node == n {
+			m.nodes = append(m.nodes[:i:i], m.nodes[i+1:]...)
+			break
+		}
+	}
+}
+
+// snapshot returns the nodes currently sent heartbeats, and stops the goroutine if there are none.
+func (m *heartbeatManager) snapshot() []*Node {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if len(m.nodes) == 0 {
+		m.running = false
+		return nil
+	}
+	return append([]*Node(nil), m.nodes...)
+}
+
+func (m *heartbeatManager) run() {
+	for {
+		nodes := m.snapshot()
+		if nodes == nil {
+			return
+		}
+		// spread the round of heartbeats evenly across the interval,
+		// sending each one asynchronously so that a slow node doesn't delay the others
+		gap := m.clock.NewTicker(heartbeatInterval / time.Duration(len(nodes)))
+		for _, n := range nodes {
+			n := n
+			go m.send(n)
+			<-gap.C()
+		}
+		gap.Stop()
+	}
+}
+
+func (m *heartbeatManager) send(n *Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatInterval)
+	defer cancel()
+	err := n.agentClient.SendHeartbeat(ctx)
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	h, ok := m.health[n.instanceID]
+	if !ok {
+		// the node was removed in the meantime
+		return
+	}
+	if msg, ok := m.errors[n.instanceID].Observe(m.clock.Now(), err); ok {
+		n.log.Warnf("heartbeat for instance %q: %s", n.instanceID, msg)
+	}
+	if err != nil {
+		h.LastError = err
+		h.ConsecutiveFailures++
+		return
+	}
+	h.LastHeartbeat = m.clock.Now()
+	h.LastError = nil
+	h.ConsecutiveFailures = 0
+}
+
+// healthOf returns the health of the nodes being sent heartbeats, sorted by instance ID.
+func (m *heartbeatManager) healthOf() []NodeHealth {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	var health []NodeHealth
+	for _, h := range m.health {
+		health = append(health, *h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].InstanceID < health[j].InstanceID })
+	return health
+}
+
+// Health returns the heartbeat health of the cluster's running nodes, sorted by instance ID.
+// Heartbeats are sent to each node every 10 seconds, staggered across the cluster.
+func (c *Cluster) Health() []NodeHealth {
+	return c.config.heartbeats.healthOf()
+}
+
+// UnhealthyNodes returns the health of the cluster's running nodes that failed their most recent heartbeat.
+func (c *Cluster) UnhealthyNodes() []NodeHealth {
+	var unhealthy []NodeHealth
+	for _, h := range c.Health() {
+		if !h.Healthy() {
+			unhealthy = append(unhealthy, h)
+		}
+	}
+	return unhealthy
+}
+
+// StartHeartbeat starts sending heartbeats to the node from the cluster's shared heartbeat schedule,
+// which keeps the node's agent from shutting down its instance. Nodes created by the cluster already send heartbeats.
+func (n *Node) StartHeartbeat() {
+	n.heartbeats.add(n)
+}
+
+// StopHeartbeat stops sending heartbeats to the node, after which its agent shuts down its instance once its heartbeat timeout elapses.
+func (n *Node) StopHeartbeat() {
+	n.heartbeats.remove(n)
+}
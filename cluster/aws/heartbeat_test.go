@@ -0,0 +1,197 @@
+package aws
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/guseggert/clustertest/agent"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeClock is a Clock whose time only moves when advanced, which fires all of its running tickers and the timers that are due.
+type fakeClock struct {
+	mut     sync.Mutex
+	now     time.Time
+	tickers map[*fakeTicker]bool
+	timers  map[*fakeTimer]time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), tickers: map[*fakeTicker]bool{}, timers: map[*fakeTimer]time.Time{}}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) agent.Ticker {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	t := &fakeTicker{clock: c, c: make(chan time.Time, 1)}
+	c.tickers[t] = true
+	return t
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) agent.Timer {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1)}
+	c.timers[t] = c.now.Add(d)
+	return t
+}
+
+// running returns the number of tickers that haven't been stopped.
+func (c *fakeClock) running() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.tickers)
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.now = c.now.Add(d)
+	for t := range c.tickers {
+		select {
+		case t.c <- c.now:
+		default:
+		}
+	}
+	for t, deadline := range c.timers {
+		if !deadline.After(c.now) {
+			t.c <- c.now
+			delete(c.timers, t)
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *fakeClock
+	c     chan time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.mut.Lock()
+	defer t.clock.mut.Unlock()
+	delete(t.clock.tickers, t)
+}
+
+type fakeTimer struct {
+	clock *fakeClock
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mut.Lock()
+	defer t.clock.mut.Unlock()
+	_, pending := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return pending
+}
+
+// freePort returns a local TCP port that nothing is listening on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+	return port
+}
+
+// newHeartbeatNode returns a node whose agent client connects to the given port.
+func newHeartbeatNode(t *testing.T, certs *agent.Certs, instanceID string, port int, m *heartbeatManager) *Node {
+	log := zap.NewNop().Sugar()
+	client, err := agent.NewClient(log, certs, "127.0.0.1", port)
+	require.NoError(t, err)
+	return &Node{agentClient: client, instanceID: instanceID, log: log, heartbeats: m}
+}
+
+func TestHeartbeatManager(t *testing.T) {
+	certs, err := agent.GenerateCerts()
+	require.NoError(t, err)
+
+	// the agent runs on its own clock, so that advancing it doesn't also schedule heartbeats
+	agentClock := newFakeClock()
+	torndown := make(chan struct{})
+	port := freePort(t)
+	a, err := agent.NewNodeAgent(
+		certs.CA.CertPEMBytes,
+		certs.Server.CertPEMBytes,
+		certs.Server.KeyPEMBytes,
+		agent.WithListenAddr(net.JoinHostPort("127.0.0.1", strconv.Itoa(port))),
+		agent.WithLogger(zap.NewNop()),
+		agent.WithClock(agentClock),
+		agent.WithHeartbeatTimeout(time.Minute),
+		agent.WithHeartbeatFailureHandler(func() { close(torndown) }),
+	)
+	require.NoError(t, err)
+	go a.Run()
+	t.Cleanup(func() { require.NoError(t, a.Stop()) })
+
+	clock := newFakeClock()
+	m := &heartbeatManager{logWindow: agent.DefaultErrorLogWindow, clock: clock}
+	healthy := newHeartbeatNode(t, certs, "i-healthy", port, m)
+	require.NoError(t, healthy.agentClient.WaitForServer(context.Background()))
+	// nothing listens on the unreachable node's port, so its heartbeats fail
+	unreachable := newHeartbeatNode(t, certs, "i-unreachable", freePort(t), m)
+
+	healthOf := func(instanceID string) NodeHealth {
+		for _, h := range m.healthOf() {
+			if h.InstanceID == instanceID {
+				return h
+			}
+		}
+		t.Fatalf("no health for instance %q", instanceID)
+		return NodeHealth{}
+	}
+
+	healthy.StartHeartbeat()
+	unreachable.StartHeartbeat()
+
+	// run the schedule for longer than the agent's heartbeat timeout, which the heartbeats keep from elapsing
+	for i := 0; i < 20; i++ {
+		require.Eventually(t, func() bool { return clock.running() == 1 }, 5*time.Second, time.Millisecond)
+		clock.Advance(heartbeatInterval / 2)
+		agentClock.Advance(heartbeatInterval / 2)
+	}
+	require.Eventually(t, func() bool {
+		return healthOf("i-healthy").LastHeartbeat.After(clock.Now().Add(-heartbeatInterval))
+	}, 5*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return healthOf("i-unreachable").ConsecutiveFailures >= 2 }, 5*time.Second, time.Millisecond)
+
+	h := healthOf("i-healthy")
+	assert.True(t, h.Healthy())
+	assert.NoError(t, h.LastError)
+	u := healthOf("i-unreachable")
+	assert.False(t, u.Healthy())
+	assert.Error(t, u.LastError)
+	assert.True(t, u.LastHeartbeat.IsZero())
+	select {
+	case <-torndown:
+		t.Fatal("agent torn down while receiving heartbeats")
+	default:
+	}
+
+	// once the node misses its heartbeats, its agent tears itself down after the heartbeat timeout
+	healthy.StopHeartbeat()
+	unreachable.StopHeartbeat()
+	assert.Empty(t, m.healthOf())
+	agentClock.Advance(2 * time.Minute)
+	select {
+	case <-torndown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("agent not torn down after missing heartbeats")
+	}
+}
@@ -0,0 +1,245 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// LaunchCandidate is a combination of instance placement and type to try launching instances with.
+// Empty fields are not overridden.
+type LaunchCandidate struct {
+	// InstanceType is the EC2 instance type, which must support the architecture of the cluster's AMI.
+	// This is checked before launching, so that a mismatch fails the launch instead of launching instances that can't boot.
+	InstanceType string
+	// AvailabilityZone is the availability zone to launch instances in.
+	// If SubnetID is empty and the cluster isn't using a launch template, this uses the subnet in the availability zone
+	// that is in the same VPC as the cluster's subnet.
+	AvailabilityZone string
+	// SubnetID is the subnet to launch instances in.
+	SubnetID string
+}
+
+func (l LaunchCandidate) String() string {
+	var parts []string
+	if l.InstanceType != "" {
+		parts = append(parts, "instance type "+l.InstanceType)
+	}
+	if l.AvailabilityZone != "" {
+		parts = append(parts, "availability zone "+l.AvailabilityZone)
+	}
+	if l.SubnetID != "" {
+		parts = append(parts, "subnet "+l.SubnetID)
+	}
+	if len(parts) == 0 {
+		return "default placement and instance type"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// capacityErrorCodes are the error codes of launch failures that another availability zone or instance type may not have.
+var capacityErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity":         true,
+	"InsufficientHostCapacity":             true,
+	"InsufficientReservedInstanceCapacity": true,
+	"InsufficientCapacity":                 true,
+	"Unsupported":                          true,
+}
+
+func isCapacityError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && capacityErrorCodes[awsErr.Code()]
+}
+
+// LastLaunch returns the launch candidate that the most recent successful launch of nodes used.
+func (c *Cluster) LastLaunch() LaunchCandidate {
+	c.config.launchMut.Lock()
+	defer c.config.launchMut.Unlock()
+	return c.config.lastLaunch
+}
+
+// launchInstances launches instances with the input, trying each launch candidate in turn until one isn't rejected for capacity.
+func (c *Cluster) launchInstances(ctx context.Context, input *ec2.RunInstancesInput) (*ec2.Reservation, error) {
+	candidates := c.LaunchCandidates
+	if len(candidates) == 0 {
+		candidates = []LaunchCandidate{{}}
+	}
+	if c.LaunchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.LaunchTimeout)
+		defer cancel()
+	}
+
+	err := c.checkCandidateArchitectures(ctx, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, candidate := range candidates {
+		candidateInput, err := c.launchCandidateInput(ctx, input, candidate)
+		if err != nil {
+			return nil, err
+		}
+		var reservation *ec2.Reservation
+		err = c.retry(ctx, "launching instances", func() error {
+			var err error
+			reservation, err = c.config.ec2Client.RunInstancesWithContext(ctx, candidateInput)
+			return err
+		})
+		if err == nil {
+			if len(candidates) > 1 {
+				c.config.log.Infof("launched instances with %s", candidate)
+			}
+			c.config.launchMut.Lock()
+			c.config.lastLaunch = candidate
+			c.config.launchMut.Unlock()
+			return reservation, nil
+		}
+		if !isCapacityError(err) || ctx.Err() != nil {
+			return nil, err
+		}
+		c.config.log.Infof("launching instances with %s failed, trying the next candidate: %s", candidate, err)
+		errs = append(errs, fmt.Sprintf("%s: %s", candidate, err))
+	}
+	return nil, fmt.Errorf("all launch candidates failed: %s", strings.Join(errs, "; "))
+}
+
+// checkCandidateArchitectures returns an error if the instance type of any launch candidate doesn't support the architecture of the AMI.
+func (c *Cluster) checkCandidateArchitectures(ctx context.Context, candidates []LaunchCandidate) error {
+	var instanceTypes []*string
+	seen := map[string]bool{}
+	for _, candidate := range candidates {
+		if candidate.InstanceType != "" && !seen[candidate.InstanceType] {
+			seen[candidate.InstanceType] = true
+			instanceTypes = append(instanceTypes, aws.String(candidate.InstanceType))
+		}
+	}
+	if len(instanceTypes) == 0 {
+		return nil
+	}
+
+	arch, err := c.amiArchitecture(ctx)
+	if err != nil {
+		return err
+	}
+	out, err := c.config.ec2Client.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{InstanceTypes: instanceTypes})
+	if err != nil {
+		return fmt.Errorf("describing launch candidate instance types: %w", err)
+	}
+	var unsupported []string
+	for _, info := range out.InstanceTypes {
+		supported := false
+		if info.ProcessorInfo != nil {
+			for _, a := range info.ProcessorInfo.SupportedArchitectures {
+				if aws.StringValue(a) == arch {
+					supported = true
+				}
+			}
+		}
+		if !supported {
+			unsupported = append(unsupported, aws.StringValue(info.InstanceType))
+		}
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("launch candidate instance types %s don't support the AMI's architecture %s", strings.Join(unsupported, ", "), arch)
+	}
+	return nil
+}
+
+// amiArchitecture returns the architecture of the cluster's AMI.
+// When launching from a launch template without an explicit AMI, this is the architecture of the cluster's instance type.
+func (c *Cluster) amiArchitecture(ctx context.Context) (string, error) {
+	if c.config.amiID == "" {
+		return c.config.arch, nil
+	}
+	c.config.launchMut.Lock()
+	defer c.config.launchMut.Unlock()
+	if c.config.amiArch != "" {
+		return c.config.amiArch, nil
+	}
+	out, err := c.config.ec2Client.DescribeImagesWithContext(ctx, &ec2.DescribeImagesInput{ImageIds: []*string{&c.config.amiID}})
+	if err != nil {
+		return "", fmt.Errorf("describing AMI %q: %w", c.config.amiID, err)
+	}
+	if len(out.Images) != 1 {
+		return "", fmt.Errorf("expected 1 AMI with ID %q, got %d", c.config.amiID, len(out.Images))
+	}
+	c.config.amiArch = aws.StringValue(out.Images[0].Architecture)
+	return c.config.amiArch, nil
+}
+
+// launchCandidateInput returns a copy of the input with the overrides of the launch candidate.
+func (c *Cluster) launchCandidateInput(ctx context.Context, input *ec2.RunInstancesInput, candidate LaunchCandidate) (*ec2.RunInstancesInput, error) {
+	in := *input
+	// the client token makes retries idempotent, in case a failed request actually launched the instances,
+	// and must differ between candidates since they have different parameters
+	if in.ClientToken == nil {
+		in.ClientToken = aws.String(fmt.Sprintf("clustertest-%d", time.Now().UnixNano()))
+	}
+	if candidate.InstanceType != "" {
+		in.InstanceType = aws.String(candidate.InstanceType)
+	}
+	if candidate.SubnetID == "" && candidate.AvailabilityZone == "" {
+		return &in, nil
+	}
+
+	if len(in.NetworkInterfaces) > 0 {
+		subnetID := candidate.SubnetID
+		if subnetID == "" {
+			var err error
+			subnetID, err = c.subnetInAZ(ctx, candidate.AvailabilityZone)
+			if err != nil {
+				return nil, err
+			}
+		}
+		iface := *in.NetworkInterfaces[0]
+		iface.SubnetId = aws.String(subnetID)
+		in.NetworkInterfaces = append([]*ec2.InstanceNetworkInterfaceSpecification{&iface}, in.NetworkInterfaces[1:]...)
+		return &in, nil
+	}
+
+	if candidate.SubnetID != "" {
+		in.SubnetId = aws.String(candidate.SubnetID)
+	}
+	if candidate.AvailabilityZone != "" {
+		placement := &ec2.Placement{}
+		if in.Placement != nil {
+			*placement = *in.Placement
+		}
+		placement.AvailabilityZone = aws.String(candidate.AvailabilityZone)
+		in.Placement = placement
+	}
+	return &in, nil
+}
+
+// subnetInAZ returns the ID of the subnet in the availability zone that is in the same VPC as the cluster's subnet.
+func (c *Cluster) subnetInAZ(ctx context.Context, az string) (string, error) {
+	out, err := c.config.ec2Client.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
+		SubnetIds: []*string{&c.config.subnetID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing subnet %q: %w", c.config.subnetID, err)
+	}
+	if len(out.Subnets) != 1 {
+		return "", fmt.Errorf("expected 1 subnet with ID %q, got %d", c.config.subnetID, len(out.Subnets))
+	}
+	out, err = c.config.ec2Client.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{out.Subnets[0].VpcId}},
+			{Name: aws.String("availability-zone"), Values: []*string{&az}},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("describing subnets in availability zone %q: %w", az, err)
+	}
+	if len(out.Subnets) == 0 {
+		return "", fmt.Errorf("no subnet in availability zone %q in the VPC of subnet %q", az, c.config.subnetID)
+	}
+	return *out.Subnets[0].SubnetId, nil
+}
@@ -5,12 +5,17 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/guseggert/clustertest/agent"
 	clusteriface "github.com/guseggert/clustertest/cluster"
+	"go.uber.org/zap"
 )
 
 type Node struct {
@@ -21,40 +26,353 @@ type Node struct {
 	instanceID  string
 	cleanupWait bool
 
-	heartbeatOnce     sync.Once
-	stopHeartbeatOnce sync.Once
-	stopHeartbeat     chan struct{}
+	elasticIP              string
+	elasticIPAllocationID  string
+	elasticIPAssociationID string
+
+	log *zap.SugaredLogger
+
+	metadataMut sync.Mutex
+	metadata    InstanceMetadata
+
+	// lifetimeTimer stops the node when its max lifetime expires, if one is set.
+	lifetimeTimer *time.Timer
+
+	// stopMut serializes stopping the node, and stopped is set once its instance is terminated,
+	// so that stopping it again is a no-op.
+	stopMut sync.Mutex
+	stopped bool
+	// retry is the cluster's retry policy for AWS operations.
+	retry func(ctx context.Context, op string, f func() error) error
+
+	// heartbeats is the cluster's heartbeat manager, which sends the node heartbeats.
+	heartbeats *heartbeatManager
 }
 
 func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
-	return n.agentClient.StartProc(ctx, req)
+	proc, err := n.agentClient.StartProc(ctx, req)
+	if err != nil {
+		return nil, n.wrapErr(err)
+	}
+	return proc, nil
 }
 
 func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader) error {
-	return n.agentClient.SendFile(ctx, filePath, contents)
+	return n.wrapErr(n.agentClient.SendFile(ctx, filePath, contents))
+}
+
+func (n *Node) SendBytes(ctx context.Context, filePath string, data []byte, opts ...clusteriface.SendOption) error {
+	return n.wrapErr(n.agentClient.SendBytes(ctx, filePath, data, opts...))
+}
+
+func (n *Node) SendFileWithOptions(ctx context.Context, filePath string, contents io.Reader, opts ...agent.SendOption) (*agent.SendResult, error) {
+	res, err := n.agentClient.SendFileWithOptions(ctx, filePath, contents, opts...)
+	return res, n.wrapErr(err)
+}
+
+func (n *Node) SendLocalFile(ctx context.Context, localPath, remotePath string, opts ...clusteriface.SendLocalFileOption) (int64, error) {
+	size, err := n.agentClient.SendLocalFile(ctx, localPath, remotePath, opts...)
+	return size, n.wrapErr(err)
 }
 
 func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
-	return n.agentClient.ReadFile(ctx, path)
+	rc, err := n.agentClient.ReadFile(ctx, path)
+	return rc, n.wrapErr(err)
+}
+
+func (n *Node) OpenFile(ctx context.Context, path string, opts ...agent.ReadFileOption) (*agent.File, error) {
+	f, err := n.agentClient.OpenFile(ctx, path, opts...)
+	return f, n.wrapErr(err)
+}
+
+func (n *Node) DownloadFile(ctx context.Context, remotePath, localPath string, opts ...clusteriface.DownloadFileOption) (int64, error) {
+	size, err := n.agentClient.DownloadFile(ctx, remotePath, localPath, opts...)
+	return size, n.wrapErr(err)
+}
+
+func (n *Node) SyncDir(ctx context.Context, localDir, remoteDir string, opts ...clusteriface.SyncDirOption) (*clusteriface.SyncResult, error) {
+	res, err := n.agentClient.SyncDir(ctx, localDir, remoteDir, opts...)
+	return res, n.wrapErr(err)
+}
+
+func (n *Node) Remove(ctx context.Context, path string) error {
+	return n.wrapErr(n.agentClient.Remove(ctx, path))
+}
+
+func (n *Node) RemoveAll(ctx context.Context, path string) error {
+	return n.wrapErr(n.agentClient.RemoveAll(ctx, path))
+}
+
+func (n *Node) TempDir(ctx context.Context, prefix string) (string, func(ctx context.Context) error, error) {
+	dir, cleanup, err := n.agentClient.TempDir(ctx, prefix)
+	return dir, cleanup, n.wrapErr(err)
+}
+
+func (n *Node) Environ(ctx context.Context, redact ...string) ([]string, error) {
+	env, err := n.agentClient.Environ(ctx, redact...)
+	return env, n.wrapErr(err)
+}
+
+func (n *Node) Checksum(ctx context.Context, path string, algo clusteriface.ChecksumAlgorithm) (string, error) {
+	sum, err := n.agentClient.Checksum(ctx, path, algo)
+	return sum, n.wrapErr(err)
 }
 
 func (n *Node) Heartbeat(ctx context.Context) error {
 	return n.agentClient.SendHeartbeat(ctx)
 }
 
+func (n *Node) Ping(ctx context.Context) (time.Duration, error) {
+	rtt, err := n.agentClient.Ping(ctx)
+	return rtt, n.wrapErr(err)
+}
+
+func (n *Node) ClockOffset(ctx context.Context) (time.Duration, error) {
+	offset, err := n.agentClient.ClockOffset(ctx)
+	return offset, n.wrapErr(err)
+}
+
+func (n *Node) OS(ctx context.Context) (string, error) {
+	info, err := n.agentClient.Info(ctx)
+	if err != nil {
+		return "", n.wrapErr(err)
+	}
+	return info.OS, nil
+}
+
+func (n *Node) Stat(ctx context.Context, path string) (*agent.FileInfo, error) {
+	fi, err := n.agentClient.Stat(ctx, path)
+	return fi, n.wrapErr(err)
+}
+
+func (n *Node) ReadDir(ctx context.Context, path string) ([]agent.FileInfo, error) {
+	fis, err := n.agentClient.ReadDir(ctx, path)
+	return fis, n.wrapErr(err)
+}
+
+func (n *Node) Symlink(ctx context.Context, oldname, newname string) error {
+	return n.wrapErr(n.agentClient.Symlink(ctx, oldname, newname))
+}
+
+func (n *Node) Rename(ctx context.Context, oldpath, newpath string) error {
+	return n.wrapErr(n.agentClient.Rename(ctx, oldpath, newpath))
+}
+
+func (n *Node) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return n.wrapErr(n.agentClient.Chmod(ctx, path, mode))
+}
+
+func (n *Node) Chown(ctx context.Context, path string, uid, gid int) error {
+	return n.wrapErr(n.agentClient.Chown(ctx, path, uid, gid))
+}
+
 func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
-	return n.agentClient.DialContext(ctx, network, addr)
+	conn, err := n.agentClient.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, n.wrapErr(err)
+	}
+	return conn, nil
+}
+
+// DialWait is like Dial, but retries until the address accepts the connection or the context is done.
+func (n *Node) DialWait(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := n.agentClient.DialWait(ctx, network, addr)
+	if err != nil {
+		return nil, n.wrapErr(err)
+	}
+	return conn, nil
+}
+
+// CollectDiagnostics returns a tar stream of the node agent's log, the cloud-init output log, and the given paths.
+// See agent.Client.CollectDiagnostics.
+func (n *Node) CollectDiagnostics(ctx context.Context, paths ...string) (io.ReadCloser, error) {
+	rc, err := n.agentClient.CollectDiagnostics(ctx, paths...)
+	if err != nil {
+		return nil, n.wrapErr(err)
+	}
+	return rc, nil
+}
+
+// RemoveGlob removes the paths on the node matching the pattern. See agent.Client.RemoveGlob.
+func (n *Node) RemoveGlob(ctx context.Context, pattern string) ([]string, error) {
+	removed, err := n.agentClient.RemoveGlob(ctx, pattern)
+	return removed, n.wrapErr(err)
+}
+
+// Stats returns the current load of the node. See clusteriface.NodeStats.
+func (n *Node) Stats(ctx context.Context) (clusteriface.NodeStats, error) {
+	stats, err := n.agentClient.Stats(ctx)
+	return stats, n.wrapErr(err)
 }
 
 func (n *Node) Fetch(ctx context.Context, url, path string) error {
-	return n.agentClient.Fetch(ctx, url, path)
+	return n.wrapErr(n.agentClient.Fetch(ctx, url, path))
 }
 
-func (n *Node) Stop(ctx context.Context) error {
-	n.agentClient.StopHeartbeat()
-	_, err := n.ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+// InstanceMetadata describes the EC2 instance of a node.
+// Fields that the instance doesn't have, such as the public IP of an instance without one, are empty.
+type InstanceMetadata struct {
+	InstanceID       string
+	AccountID        string
+	Region           string
+	AvailabilityZone string
+	InstanceType     string
+	ImageID          string
+	Architecture     string
+	PrivateIP        string
+	PublicIP         string
+	LaunchTime       time.Time
+}
+
+// Metadata returns the metadata of the node's instance, as of when the node was created or last refreshed.
+func (n *Node) Metadata() InstanceMetadata {
+	n.metadataMut.Lock()
+	defer n.metadataMut.Unlock()
+	return n.metadata
+}
+
+// RefreshMetadata re-fetches the metadata of the node's instance and returns it.
+func (n *Node) RefreshMetadata(ctx context.Context) (InstanceMetadata, error) {
+	out, err := n.ec2Client.DescribeInstancesWithContext(ctx, &ec2.DescribeInstancesInput{
 		InstanceIds: []*string{&n.instanceID},
 	})
+	if err != nil {
+		return InstanceMetadata{}, fmt.Errorf("describing instance %q: %w", n.instanceID, err)
+	}
+	if len(out.Reservations) != 1 || len(out.Reservations[0].Instances) != 1 {
+		return InstanceMetadata{}, fmt.Errorf("expected 1 instance with ID %q", n.instanceID)
+	}
+	n.setMetadata(out.Reservations[0].Instances[0])
+	return n.Metadata(), nil
+}
+
+func (n *Node) setMetadata(inst *ec2.Instance) {
+	md := InstanceMetadata{
+		InstanceID:   n.instanceID,
+		AccountID:    n.accountID,
+		Region:       aws.StringValue(n.sess.Config.Region),
+		InstanceType: aws.StringValue(inst.InstanceType),
+		ImageID:      aws.StringValue(inst.ImageId),
+		Architecture: aws.StringValue(inst.Architecture),
+		PrivateIP:    aws.StringValue(inst.PrivateIpAddress),
+		PublicIP:     aws.StringValue(inst.PublicIpAddress),
+		LaunchTime:   aws.TimeValue(inst.LaunchTime),
+	}
+	if inst.Placement != nil {
+		md.AvailabilityZone = aws.StringValue(inst.Placement.AvailabilityZone)
+	}
+	if n.elasticIP != "" {
+		md.PublicIP = n.elasticIP
+	}
+	n.metadataMut.Lock()
+	n.metadata = md
+	n.metadataMut.Unlock()
+}
+
+// wrapErr wraps a non-nil error with the identity of the node, so that errors from operations across many nodes are self-identifying.
+func (n *Node) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", n, err)
+}
+
+// associateElasticIP allocates an Elastic IP and associates it with the instance.
+func (n *Node) associateElasticIP(ctx context.Context) error {
+	allocOut, err := n.ec2Client.AllocateAddressWithContext(ctx, &ec2.AllocateAddressInput{
+		Domain: aws.String(ec2.DomainTypeVpc),
+	})
+	if err != nil {
+		return fmt.Errorf("allocating Elastic IP for instance %q: %w", n.instanceID, err)
+	}
+	n.elasticIP = *allocOut.PublicIp
+	n.elasticIPAllocationID = *allocOut.AllocationId
+
+	assocOut, err := n.ec2Client.AssociateAddressWithContext(ctx, &ec2.AssociateAddressInput{
+		AllocationId: allocOut.AllocationId,
+		InstanceId:   &n.instanceID,
+	})
+	if err != nil {
+		if releaseErr := n.releaseElasticIP(ctx); releaseErr != nil {
+			return fmt.Errorf("associating Elastic IP %q with instance %q: %w (and releasing it failed: %s)", n.elasticIP, n.instanceID, err, releaseErr)
+		}
+		return fmt.Errorf("associating Elastic IP %q with instance %q: %w", n.elasticIP, n.instanceID, err)
+	}
+	n.elasticIPAssociationID = *assocOut.AssociationId
+	return nil
+}
+
+// releaseElasticIP disassociates and releases the node's Elastic IP, if it has one.
+func (n *Node) releaseElasticIP(ctx context.Context) error {
+	if n.elasticIPAllocationID == "" {
+		return nil
+	}
+	if n.elasticIPAssociationID != "" {
+		_, err := n.ec2Client.DisassociateAddressWithContext(ctx, &ec2.DisassociateAddressInput{
+			AssociationId: &n.elasticIPAssociationID,
+		})
+		if err != nil {
+			return fmt.Errorf("disassociating Elastic IP %q: %w", n.elasticIP, err)
+		}
+	}
+	_, err := n.ec2Client.ReleaseAddressWithContext(ctx, &ec2.ReleaseAddressInput{
+		AllocationId: &n.elasticIPAllocationID,
+	})
+	if err != nil {
+		return fmt.Errorf("releasing Elastic IP %q: %w", n.elasticIP, err)
+	}
+	n.elasticIPAllocationID = ""
+	return nil
+}
+
+// startLifetimeTimer stops the node after d has elapsed.
+func (n *Node) startLifetimeTimer(d time.Duration) {
+	n.lifetimeTimer = time.AfterFunc(d, func() {
+		n.log.Infof("max lifetime of %s expired for instance %q, stopping it", d, n.instanceID)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		err := n.Stop(ctx)
+		if err != nil {
+			n.log.Errorf("error stopping instance %q after max lifetime expired: %s", n.instanceID, err)
+		}
+	})
+}
+
+// prepareStop stops the node's background activity and releases its resources, in preparation for terminating its instance.
+// It must be called with stopMut held.
+func (n *Node) prepareStop(ctx context.Context) error {
+	if n.lifetimeTimer != nil {
+		n.lifetimeTimer.Stop()
+	}
+	n.StopHeartbeat()
+	return n.releaseElasticIP(ctx)
+}
+
+// Stop terminates the node's instance.
+// This is idempotent, since cleanup paths often run more than once: stopping a node that is already stopped is a no-op,
+// and an instance that EC2 has already terminated or no longer knows about is considered stopped.
+// If this fails, it can be retried.
+func (n *Node) Stop(ctx context.Context) error {
+	n.stopMut.Lock()
+	defer n.stopMut.Unlock()
+	if n.stopped {
+		return nil
+	}
+	err := n.prepareStop(ctx)
+	if err != nil {
+		return err
+	}
+	err = n.retry(ctx, "terminating instance", func() error {
+		_, err := n.ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: []*string{&n.instanceID},
+		})
+		return err
+	})
+	if isInstanceNotFound(err) {
+		n.log.Debugf("instance %q not found, assuming it is already terminated", n.instanceID)
+		n.stopped = true
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("terminating instance %q: %w", n.instanceID, err)
 	}
@@ -62,10 +380,55 @@ func (n *Node) Stop(ctx context.Context) error {
 		err = n.ec2Client.WaitUntilInstanceTerminated(&ec2.DescribeInstancesInput{
 			InstanceIds: []*string{&n.instanceID},
 		})
-		if err != nil {
+		if err != nil && !isInstanceNotFound(err) {
 			return fmt.Errorf("waiting for instance %q to stop: %w", n.instanceID, err)
 		}
 	}
+	n.stopped = true
+	return nil
+}
+
+// isInstanceNotFound returns true if the error is from EC2 not knowing about an instance,
+// which happens for instances that were terminated long enough ago.
+func isInstanceNotFound(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == "InvalidInstanceID.NotFound"
+}
+
+// rebootTimeout is the maximum time to wait for the node agent to come back after a reboot.
+const rebootTimeout = 10 * time.Minute
+
+// Reboot reboots the instance and waits for the node agent to come back up.
+// The instance keeps its IP addresses across reboots, so the node can continue to be used afterwards.
+// Processes and tunneled connections are lost, as is anything not persisted to disk.
+// This returns an error if the node agent doesn't come back within 10 minutes.
+func (n *Node) Reboot(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, rebootTimeout)
+	defer cancel()
+
+	_, err := n.ec2Client.RebootInstancesWithContext(ctx, &ec2.RebootInstancesInput{
+		InstanceIds: []*string{&n.instanceID},
+	})
+	if err != nil {
+		return fmt.Errorf("rebooting instance %q: %w", n.instanceID, err)
+	}
+
+	// the reboot is asynchronous, so wait for the agent to go down first,
+	// so that the agent from before the reboot isn't mistaken for the one after it
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for n.agentClient.SendHeartbeat(ctx) == nil {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for instance %q to go down for reboot: %w", n.instanceID, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	err = n.agentClient.WaitForServer(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for node agent on instance %q to come back after reboot: %w", n.instanceID, err)
+	}
 	return nil
 }
 
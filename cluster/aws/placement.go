@@ -0,0 +1,119 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// ensurePlacementGroup creates the ephemeral placement group if needed, and validates that the instance type
+// supports the strategy of the placement group. This is a no-op if nodes aren't launched into a placement group.
+func (c *Cluster) ensurePlacementGroup(ctx context.Context) error {
+	c.config.placementMut.Lock()
+	defer c.config.placementMut.Unlock()
+	if c.config.placementGroupChecked {
+		return nil
+	}
+	if c.PlacementGroup == "" && !c.EphemeralPlacementGroup {
+		return nil
+	}
+
+	strategy := ec2.PlacementStrategyCluster
+	if c.PlacementGroup != "" {
+		out, err := c.config.ec2Client.DescribePlacementGroupsWithContext(ctx, &ec2.DescribePlacementGroupsInput{
+			GroupNames: []*string{&c.PlacementGroup},
+		})
+		if err != nil {
+			return fmt.Errorf("describing placement group %q: %w", c.PlacementGroup, err)
+		}
+		if len(out.PlacementGroups) != 1 {
+			return fmt.Errorf("expected 1 placement group named %q, got %d", c.PlacementGroup, len(out.PlacementGroups))
+		}
+		strategy = *out.PlacementGroups[0].Strategy
+	}
+
+	if c.LaunchTemplate == nil || c.config.instanceTypeSet {
+		err := c.validatePlacementStrategy(ctx, strategy)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.PlacementGroup == "" {
+		name := fmt.Sprintf("clustertest-%d", time.Now().UnixNano())
+		_, err := c.config.ec2Client.CreatePlacementGroupWithContext(ctx, &ec2.CreatePlacementGroupInput{
+			GroupName: &name,
+			Strategy:  aws.String(strategy),
+		})
+		if err != nil {
+			return fmt.Errorf("creating placement group: %w", err)
+		}
+		c.config.ephemeralPlacementGroup = name
+		c.config.log.Debugf("created placement group %q", name)
+	}
+
+	c.config.placementGroupChecked = true
+	return nil
+}
+
+// placementGroup returns the name of the placement group to launch instances into, or "" if none.
+func (c *Cluster) placementGroup() string {
+	if c.PlacementGroup != "" {
+		return c.PlacementGroup
+	}
+	return c.config.ephemeralPlacementGroup
+}
+
+// validatePlacementStrategy returns an error if the cluster's instance type doesn't support the placement strategy.
+func (c *Cluster) validatePlacementStrategy(ctx context.Context, strategy string) error {
+	out, err := c.config.ec2Client.DescribeInstanceTypesWithContext(ctx, &ec2.DescribeInstanceTypesInput{
+		InstanceTypes: []*string{&c.InstanceType},
+	})
+	if err != nil {
+		return fmt.Errorf("describing instance type %q: %w", c.InstanceType, err)
+	}
+	if len(out.InstanceTypes) != 1 {
+		return fmt.Errorf("expected 1 instance type for %q, got %d", c.InstanceType, len(out.InstanceTypes))
+	}
+	info := out.InstanceTypes[0].PlacementGroupInfo
+	if info != nil {
+		for _, s := range info.SupportedStrategies {
+			if *s == strategy {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("instance type %q does not support %q placement groups", c.InstanceType, strategy)
+}
+
+// deleteEphemeralPlacementGroup deletes the placement group if it was created by the cluster.
+// A placement group can't be deleted while it contains instances, so this waits for the instances to terminate first.
+func (c *Cluster) deleteEphemeralPlacementGroup(ctx context.Context) error {
+	name := c.config.ephemeralPlacementGroup
+	if name == "" {
+		return nil
+	}
+	var instanceIDs []*string
+	for _, n := range c.Nodes {
+		instanceIDs = append(instanceIDs, aws.String(n.instanceID))
+	}
+	if len(instanceIDs) > 0 {
+		err := c.config.ec2Client.WaitUntilInstanceTerminatedWithContext(ctx, &ec2.DescribeInstancesInput{
+			InstanceIds: instanceIDs,
+		})
+		if err != nil {
+			return fmt.Errorf("waiting for instances to terminate before deleting placement group %q: %w", name, err)
+		}
+	}
+	_, err := c.config.ec2Client.DeletePlacementGroupWithContext(ctx, &ec2.DeletePlacementGroupInput{
+		GroupName: &name,
+	})
+	if err != nil {
+		return fmt.Errorf("deleting placement group %q: %w", name, err)
+	}
+	c.config.ephemeralPlacementGroup = ""
+	return nil
+}
@@ -0,0 +1,51 @@
+package aws
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// maxRetryBackoff is the maximum delay between attempts of a retried AWS operation.
+const maxRetryBackoff = 30 * time.Second
+
+// DefaultIsRetryable is the default retry classification of errors from AWS operations,
+// which retries throttling errors and server errors.
+func DefaultIsRetryable(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	return false
+}
+
+// retry calls f until it succeeds, returns an error that isn't retryable, or the retry timeout elapses,
+// backing off exponentially between attempts.
+func (c *Cluster) retry(ctx context.Context, op string, f func() error) error {
+	isRetryable := c.IsRetryable
+	if isRetryable == nil {
+		isRetryable = DefaultIsRetryable
+	}
+	deadline := time.Now().Add(c.RetryTimeout)
+	backoff := 500 * time.Millisecond
+	for {
+		err := f()
+		if err == nil || !isRetryable(err) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		c.config.log.Debugf("%s failed, retrying in %s: %s", op, backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
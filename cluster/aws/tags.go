@@ -0,0 +1,116 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// EC2 limits on the tags of a resource.
+const (
+	maxTags        = 50
+	maxTagKeyLen   = 128
+	maxTagValueLen = 256
+)
+
+// nameTagKey is the key of the tag that the EC2 console shows as the name of an instance.
+const nameTagKey = "Name"
+
+// WithTags adds tags to the instances the cluster launches, such as for cost attribution or for cleanup with AdoptByTag.
+func (c *Cluster) WithTags(tags map[string]string) *Cluster {
+	if c.Tags == nil {
+		c.Tags = map[string]string{}
+	}
+	for k, v := range tags {
+		c.Tags[k] = v
+	}
+	return c
+}
+
+// WithInstanceNames sets the function that names the instances the cluster launches, with their "Name" tag.
+// The index is that of the instance among all the nodes of the cluster, starting from zero.
+func (c *Cluster) WithInstanceNames(f func(index int) string) *Cluster {
+	c.NameInstance = f
+	return c
+}
+
+// validateTags returns an error if the tags violate EC2's limits on tags.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("%d tags exceeds the limit of %d tags per instance", len(tags), maxTags)
+	}
+	for k, v := range tags {
+		if k == "" {
+			return fmt.Errorf("tag key is empty")
+		}
+		if n := utf8.RuneCountInString(k); n > maxTagKeyLen {
+			return fmt.Errorf("tag key %q is %d characters, longer than the limit of %d", k, n, maxTagKeyLen)
+		}
+		if n := utf8.RuneCountInString(v); n > maxTagValueLen {
+			return fmt.Errorf("value of tag %q is %d characters, longer than the limit of %d", k, n, maxTagValueLen)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("tag key %q uses the reserved prefix \"aws:\"", k)
+		}
+	}
+	return nil
+}
+
+// launchTags returns the tags to launch instances with, sorted by key, or an error if they're invalid.
+// Instance names are validated here, but set after launch, since they differ between the instances of a launch.
+func (c *Cluster) launchTags(n int) ([]*ec2.Tag, error) {
+	all := map[string]string{}
+	for k, v := range c.Tags {
+		all[k] = v
+	}
+	if c.NameInstance != nil {
+		start := len(c.Nodes)
+		for i := start; i < start+n; i++ {
+			all[nameTagKey] = c.NameInstance(i)
+			if err := validateTags(all); err != nil {
+				return nil, fmt.Errorf("invalid tags for instance %d: %w", i, err)
+			}
+		}
+		delete(all, nameTagKey)
+	}
+	if err := validateTags(all); err != nil {
+		return nil, fmt.Errorf("invalid tags: %w", err)
+	}
+
+	keys := make([]string, 0, len(all))
+	for k := range all {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var tags []*ec2.Tag
+	for _, k := range keys {
+		tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(all[k])})
+	}
+	return tags, nil
+}
+
+// nameInstances sets the Name tags of newly-launched instances, whose indexes start at start.
+func (c *Cluster) nameInstances(ctx context.Context, instances []*ec2.Instance, start int) error {
+	if c.NameInstance == nil {
+		return nil
+	}
+	for i, inst := range instances {
+		name := c.NameInstance(start + i)
+		err := c.retry(ctx, "naming instance", func() error {
+			_, err := c.config.ec2Client.CreateTagsWithContext(ctx, &ec2.CreateTagsInput{
+				Resources: []*string{inst.InstanceId},
+				Tags:      []*ec2.Tag{{Key: aws.String(nameTagKey), Value: aws.String(name)}},
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("naming instance %q %q: %w", *inst.InstanceId, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// terminateBatchSize is the maximum number of instances terminated per TerminateInstances request.
+const terminateBatchSize = 1000
+
+// TerminateError is returned when some instances fail to terminate.
+type TerminateError struct {
+	// Errors maps the IDs of the instances that failed to terminate to their errors.
+	Errors map[string]error
+}
+
+func (e *TerminateError) Error() string {
+	var msgs []string
+	for id, err := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", id, err))
+	}
+	sort.Strings(msgs)
+	return fmt.Sprintf("terminating %d instances: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// TerminateNodes stops the given nodes, terminating their instances in batches.
+// A single invalid instance fails its whole batch, so failed batches are retried per-instance
+// to isolate the failures from the rest, and retryable failures such as throttling are retried with backoff.
+// Nodes that are already stopped are skipped, and instances that EC2 no longer knows about are considered terminated.
+// This returns a map of instance ID to error for the instances that failed to terminate, which is empty if all succeeded.
+func (c *Cluster) TerminateNodes(ctx context.Context, nodes []*Node) map[string]error {
+	errs := map[string]error{}
+	var instanceIDs []*string
+	byID := map[string]*Node{}
+	// the nodes stay locked until their instances are terminated, so that they aren't stopped concurrently,
+	// such as by their max lifetimes, which would release their Elastic IPs twice
+	var locked []*Node
+	defer func() {
+		for _, n := range locked {
+			n.stopMut.Unlock()
+		}
+	}()
+	for _, n := range nodes {
+		if _, ok := byID[n.instanceID]; ok {
+			continue
+		}
+		n.stopMut.Lock()
+		if n.stopped {
+			n.stopMut.Unlock()
+			continue
+		}
+		locked = append(locked, n)
+		byID[n.instanceID] = n
+		err := n.prepareStop(ctx)
+		if err != nil {
+			errs[n.instanceID] = err
+			continue
+		}
+		instanceIDs = append(instanceIDs, &n.instanceID)
+	}
+
+	for start := 0; start < len(instanceIDs); start += terminateBatchSize {
+		end := start + terminateBatchSize
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+		batch := instanceIDs[start:end]
+		err := c.terminateInstances(ctx, batch)
+		if err == nil {
+			for _, id := range batch {
+				byID[*id].stopped = true
+			}
+			continue
+		}
+		if len(batch) > 1 {
+			c.config.log.Debugf("terminating batch of %d instances failed, retrying individually: %s", len(batch), err)
+		}
+		for _, id := range batch {
+			if len(batch) > 1 {
+				err = c.terminateInstances(ctx, []*string{id})
+			}
+			if err != nil && !isInstanceNotFound(err) {
+				errs[*id] = err
+				continue
+			}
+			byID[*id].stopped = true
+		}
+	}
+	return errs
+}
+
+// terminateInstances terminates the instances, retrying retryable failures.
+func (c *Cluster) terminateInstances(ctx context.Context, instanceIDs []*string) error {
+	return c.retry(ctx, "terminating instances", func() error {
+		_, err := c.config.ec2Client.TerminateInstancesWithContext(ctx, &ec2.TerminateInstancesInput{
+			InstanceIds: instanceIDs,
+		})
+		return err
+	})
+}
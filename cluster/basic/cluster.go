@@ -73,6 +73,19 @@ func (c *Cluster) MustNewNodes(n int) []*Node {
 	return nodes
 }
 
+// Nodes returns the nodes of the cluster.
+func (c *Cluster) Nodes() []*Node {
+	var basicNodes []*Node
+	for _, n := range c.Cluster.ListNodes() {
+		basicNodes = append(basicNodes, &Node{
+			Node: n,
+			Log:  c.Log.Named("basic_node"),
+			Ctx:  context.Background(),
+		})
+	}
+	return basicNodes
+}
+
 func (c *Cluster) Cleanup() error {
 	return c.Cluster.Cleanup(c.Ctx)
 }
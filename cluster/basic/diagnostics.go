@@ -0,0 +1,68 @@
+package basic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// CollectDiagnostics writes the diagnostics bundle of each node to "node-<index>.tar" in dir, which is created if needed.
+// The bundles include the paths, in addition to the files the node's agent always collects, such as its log.
+// Nodes that don't support collecting diagnostics are skipped.
+func CollectDiagnostics(ctx context.Context, dir string, nodes []*Node, paths ...string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("creating diagnostics dir: %w", err)
+	}
+	errs := forEachNode(ctx, nodes, nil, func(ctx context.Context, i int, node *Node) error {
+		collector, ok := node.Node.(clusteriface.DiagnosticsCollector)
+		if !ok {
+			return nil
+		}
+		return writeDiagnostics(ctx, collector, filepath.Join(dir, fmt.Sprintf("node-%d.tar", i)), paths)
+	})
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("collecting diagnostics of node %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func writeDiagnostics(ctx context.Context, collector clusteriface.DiagnosticsCollector, path string, paths []string) error {
+	rc, err := collector.CollectDiagnostics(ctx, paths...)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CollectDiagnosticsOnFailure collects the diagnostics of the nodes into dir with CollectDiagnostics when the test fails,
+// turning opaque CI failures into debuggable artifacts. Cleanups run in reverse order, so if the cluster is cleaned up with t.Cleanup,
+// this must be called after registering that cleanup, so that the diagnostics are collected before the nodes are stopped.
+func CollectDiagnosticsOnFailure(t testing.TB, dir string, nodes []*Node, paths ...string) {
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		err := CollectDiagnostics(context.Background(), dir, nodes, paths...)
+		if err != nil {
+			t.Logf("collecting diagnostics: %s", err)
+			return
+		}
+		t.Logf("collected node diagnostics in %s", dir)
+	})
+}
@@ -0,0 +1,97 @@
+package basic
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// maxJSONLineSize is the maximum size of a line decoded by RunJSONLines.
+const maxJSONLineSize = 16 * 1024 * 1024
+
+// RunJSONLines runs the command on the node and decodes each line of its stdout into a T as it is produced,
+// which is useful for tools that emit newline-delimited JSON. Empty lines are skipped.
+//
+// Lines that can't be decoded are sent to the error channel without stopping the stream, as are errors running the process,
+// including a non-zero exit code as with Node.Run. Both channels are closed once the process exits and its output is decoded.
+// The caller must receive from both channels until they are closed, such as in a select loop, otherwise the stream blocks.
+//
+// The request's stdout is piped, so it can't specify Stdout, StdoutFile, or StdoutPipe.
+func RunJSONLines[T any](ctx context.Context, n *Node, req clusteriface.StartProcRequest) (<-chan T, <-chan error) {
+	valCh := make(chan T)
+	errCh := make(chan error)
+
+	go func() {
+		defer close(errCh)
+		defer close(valCh)
+
+		sendErr := func(err error) bool {
+			select {
+			case errCh <- err:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if req.Stdout != nil || req.StdoutFile != "" || req.StdoutPipe {
+			sendErr(errors.New("stdout can't be specified when decoding JSON lines"))
+			return
+		}
+		req.StdoutPipe = true
+		proc, err := n.Context(ctx).StartProc(req)
+		if err != nil {
+			sendErr(fmt.Errorf("starting process: %w", err))
+			return
+		}
+		stdout := proc.Process.Stdout()
+		// drain any output that isn't decoded, so that the process isn't blocked writing to stdout
+		defer io.Copy(io.Discard, stdout)
+
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, maxJSONLineSize)
+		lineNum := 0
+		for scanner.Scan() {
+			lineNum++
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			var v T
+			err := json.Unmarshal(line, &v)
+			if err != nil {
+				if !sendErr(fmt.Errorf("decoding line %d: %w", lineNum, err)) {
+					return
+				}
+				continue
+			}
+			select {
+			case valCh <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			if !sendErr(fmt.Errorf("reading line %d: %w", lineNum+1, err)) {
+				return
+			}
+			io.Copy(io.Discard, stdout)
+		}
+
+		res, err := proc.Wait()
+		if err != nil {
+			sendErr(fmt.Errorf("waiting for process to exit: %w", err))
+			return
+		}
+		if res.ExitCode != 0 {
+			sendErr(exitCodeError(res))
+		}
+	}()
+
+	return valCh, errCh
+}
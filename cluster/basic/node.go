@@ -2,8 +2,11 @@ package basic
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"time"
 
 	clusteriface "github.com/guseggert/clustertest/cluster"
 	"go.uber.org/zap"
@@ -47,17 +50,108 @@ func (n *Node) Run(req clusteriface.StartProcRequest) (*clusteriface.ProcessResu
 		return nil, fmt.Errorf("waiting for process to exit: %w", err)
 	}
 	if res.ExitCode != 0 {
-		return nil, fmt.Errorf("non-zero exit code %d", res.ExitCode)
+		return nil, exitCodeError(res)
 	}
 	return res, nil
 }
 
+// exitCodeError returns the error for a process that exited with a non-zero exit code, including why it ended if known.
+func exitCodeError(res *clusteriface.ProcessResult) error {
+	if res.Reason != "" {
+		return fmt.Errorf("non-zero exit code %d (%s)", res.ExitCode, res.Reason)
+	}
+	return fmt.Errorf("non-zero exit code %d", res.ExitCode)
+}
+
 func (n *Node) MustRun(req clusteriface.StartProcRequest) *clusteriface.ProcessResult {
 	pr, err := n.Run(req)
 	Must(err)
 	return pr
 }
 
+// OS returns the operating system of the node, as a GOOS value, assuming Linux if the node doesn't report it.
+func (n *Node) OS() (string, error) {
+	if oser, ok := n.Node.(clusteriface.OSer); ok {
+		return oser.OS(n.Ctx)
+	}
+	return "linux", nil
+}
+
+// RunShell runs the script with the shell of the node's operating system, which is cmd on Windows and sh elsewhere,
+// and waits for it to exit. The request is used for the other fields, such as Stdout.
+func (n *Node) RunShell(script string, req clusteriface.StartProcRequest) (*clusteriface.ProcessResult, error) {
+	goos, err := n.OS()
+	if err != nil {
+		return nil, fmt.Errorf("getting OS of node: %w", err)
+	}
+	shellReq := clusteriface.ShellRequest(goos, script)
+	req.Command = shellReq.Command
+	req.Args = shellReq.Args
+	return n.Run(req)
+}
+
+func (n *Node) MustRunShell(script string, req clusteriface.StartProcRequest) *clusteriface.ProcessResult {
+	res, err := n.RunShell(script, req)
+	Must(err)
+	return res
+}
+
+// Ping returns the round-trip time of a minimal request to the node.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.Pinger.
+func (n *Node) Ping() (time.Duration, error) {
+	pinger, ok := n.Node.(clusteriface.Pinger)
+	if !ok {
+		return 0, fmt.Errorf("pinging node: %w", clusteriface.ErrNotSupported)
+	}
+	return pinger.Ping(n.Ctx)
+}
+
+func (n *Node) MustPing() time.Duration {
+	return Must2(n.Ping())
+}
+
+// DialWait dials the address from the node, retrying until it accepts the connection or the context is done.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.WaitDialer.
+func (n *Node) DialWait(network, address string) (net.Conn, error) {
+	dialer, ok := n.Node.(clusteriface.WaitDialer)
+	if !ok {
+		return nil, fmt.Errorf("dialing %s: %w", address, clusteriface.ErrNotSupported)
+	}
+	return dialer.DialWait(n.Ctx, network, address)
+}
+
+func (n *Node) MustDialWait(network, address string) net.Conn {
+	return Must2(n.DialWait(network, address))
+}
+
+// CollectDiagnostics returns a tar stream of the node's diagnostics files and the given absolute paths, which the caller must close.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.DiagnosticsCollector.
+func (n *Node) CollectDiagnostics(paths ...string) (io.ReadCloser, error) {
+	collector, ok := n.Node.(clusteriface.DiagnosticsCollector)
+	if !ok {
+		return nil, fmt.Errorf("collecting diagnostics: %w", clusteriface.ErrNotSupported)
+	}
+	return collector.CollectDiagnostics(n.Ctx, paths...)
+}
+
+func (n *Node) MustCollectDiagnostics(paths ...string) io.ReadCloser {
+	return Must2(n.CollectDiagnostics(paths...))
+}
+
+// Stats returns the current load of the node.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.StatsReporter.
+func (n *Node) Stats() (clusteriface.NodeStats, error) {
+	reporter, ok := n.Node.(clusteriface.StatsReporter)
+	if !ok {
+		return clusteriface.NodeStats{}, fmt.Errorf("getting node stats: %w", clusteriface.ErrNotSupported)
+	}
+	return reporter.Stats(n.Ctx)
+}
+
+func (n *Node) MustStats() clusteriface.NodeStats {
+	return Must2(n.Stats())
+}
+
 // RootDir returns the root directory of the node.
 func (n *Node) RootDir() string {
 	if rootDirer, ok := n.Node.(interface{ RootDir() string }); ok {
@@ -74,6 +168,20 @@ func (n *Node) MustSendFile(filePath string, contents io.Reader) {
 	Must(n.SendFile(filePath, contents))
 }
 
+// SendBytes writes the data to the file on the node, such as a config file.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.BytesSender.
+func (n *Node) SendBytes(filePath string, data []byte, opts ...clusteriface.SendOption) error {
+	sender, ok := n.Node.(clusteriface.BytesSender)
+	if !ok {
+		return fmt.Errorf("sending bytes: %w", clusteriface.ErrNotSupported)
+	}
+	return sender.SendBytes(n.Ctx, filePath, data, opts...)
+}
+
+func (n *Node) MustSendBytes(filePath string, data []byte, opts ...clusteriface.SendOption) {
+	Must(n.SendBytes(filePath, data, opts...))
+}
+
 func (n *Node) ReadFile(filePath string) (io.ReadCloser, error) {
 	return n.Node.ReadFile(n.Ctx, filePath)
 }
@@ -83,3 +191,154 @@ func (n *Node) MustReadFile(filePath string) io.ReadCloser {
 	Must(err)
 	return r
 }
+
+// SendLocalFile uploads the local file at localPath to remotePath on the node, returning the number of bytes sent.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.LocalFileSender.
+func (n *Node) SendLocalFile(localPath, remotePath string, opts ...clusteriface.SendLocalFileOption) (int64, error) {
+	sender, ok := n.Node.(clusteriface.LocalFileSender)
+	if !ok {
+		return 0, fmt.Errorf("sending local file: %w", clusteriface.ErrNotSupported)
+	}
+	return sender.SendLocalFile(n.Ctx, localPath, remotePath, opts...)
+}
+
+func (n *Node) MustSendLocalFile(localPath, remotePath string, opts ...clusteriface.SendLocalFileOption) int64 {
+	return Must2(n.SendLocalFile(localPath, remotePath, opts...))
+}
+
+// DownloadFile downloads the file at remotePath on the node to localPath, returning the number of bytes written.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.FileDownloader.
+func (n *Node) DownloadFile(remotePath, localPath string, opts ...clusteriface.DownloadFileOption) (int64, error) {
+	downloader, ok := n.Node.(clusteriface.FileDownloader)
+	if !ok {
+		return 0, fmt.Errorf("downloading file: %w", clusteriface.ErrNotSupported)
+	}
+	return downloader.DownloadFile(n.Ctx, remotePath, localPath, opts...)
+}
+
+func (n *Node) MustDownloadFile(remotePath, localPath string, opts ...clusteriface.DownloadFileOption) int64 {
+	return Must2(n.DownloadFile(remotePath, localPath, opts...))
+}
+
+// SyncDir makes the remote directory contain the regular files of the local directory, transferring only the files that are new or changed.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.DirSyncer.
+func (n *Node) SyncDir(localDir, remoteDir string, opts ...clusteriface.SyncDirOption) (*clusteriface.SyncResult, error) {
+	syncer, ok := n.Node.(clusteriface.DirSyncer)
+	if !ok {
+		return nil, fmt.Errorf("syncing dir: %w", clusteriface.ErrNotSupported)
+	}
+	return syncer.SyncDir(n.Ctx, localDir, remoteDir, opts...)
+}
+
+func (n *Node) MustSyncDir(localDir, remoteDir string, opts ...clusteriface.SyncDirOption) *clusteriface.SyncResult {
+	return Must2(n.SyncDir(localDir, remoteDir, opts...))
+}
+
+// TempDir creates a new, unique directory on the node whose name starts with prefix,
+// and returns its path and a func to remove it and its contents, which can be called any number of times.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.TempDirer.
+func (n *Node) TempDir(prefix string) (string, func(ctx context.Context) error, error) {
+	tempDirer, ok := n.Node.(clusteriface.TempDirer)
+	if !ok {
+		return "", nil, fmt.Errorf("creating temp dir: %w", clusteriface.ErrNotSupported)
+	}
+	return tempDirer.TempDir(n.Ctx, prefix)
+}
+
+func (n *Node) MustTempDir(prefix string) (string, func(ctx context.Context) error) {
+	dir, cleanup, err := n.TempDir(prefix)
+	Must(err)
+	return dir, cleanup
+}
+
+// RemoveAll removes the path on the node and any children it contains. A path that doesn't exist is not an error.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.AllRemover.
+func (n *Node) RemoveAll(path string) error {
+	remover, ok := n.Node.(clusteriface.AllRemover)
+	if !ok {
+		return fmt.Errorf("removing path: %w", clusteriface.ErrNotSupported)
+	}
+	return remover.RemoveAll(n.Ctx, path)
+}
+
+func (n *Node) MustRemoveAll(path string) {
+	Must(n.RemoveAll(path))
+}
+
+// RemoveGlob removes the paths on the node matching the absolute pattern, such as "/tmp/test-*", and any children they contain,
+// and returns the removed paths. See clusteriface.GlobRemover.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.GlobRemover.
+func (n *Node) RemoveGlob(pattern string) ([]string, error) {
+	remover, ok := n.Node.(clusteriface.GlobRemover)
+	if !ok {
+		return nil, fmt.Errorf("removing paths matching pattern: %w", clusteriface.ErrNotSupported)
+	}
+	return remover.RemoveGlob(n.Ctx, pattern)
+}
+
+func (n *Node) MustRemoveGlob(pattern string) []string {
+	return Must2(n.RemoveGlob(pattern))
+}
+
+// Environ returns the environment that processes on the node inherit, with the values of env vars
+// whose keys match any of the redact patterns replaced with clusteriface.RedactedValue.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.Environer.
+func (n *Node) Environ(redact ...string) ([]string, error) {
+	environer, ok := n.Node.(clusteriface.Environer)
+	if !ok {
+		return nil, fmt.Errorf("getting node environment: %w", clusteriface.ErrNotSupported)
+	}
+	return environer.Environ(n.Ctx, redact...)
+}
+
+func (n *Node) MustEnviron(redact ...string) []string {
+	return Must2(n.Environ(redact...))
+}
+
+// Checksum returns the hex-encoded checksum of the file on the node, computed by the node.
+// An error wrapping clusteriface.ErrNotSupported is returned if the node doesn't implement clusteriface.Checksummer.
+func (n *Node) Checksum(path string, algo clusteriface.ChecksumAlgorithm) (string, error) {
+	checksummer, ok := n.Node.(clusteriface.Checksummer)
+	if !ok {
+		return "", fmt.Errorf("getting checksum: %w", clusteriface.ErrNotSupported)
+	}
+	return checksummer.Checksum(n.Ctx, path, algo)
+}
+
+func (n *Node) MustChecksum(path string, algo clusteriface.ChecksumAlgorithm) string {
+	return Must2(n.Checksum(path, algo))
+}
+
+// DefaultMaxReadFileBytes is the size limit used by ReadFileBytes if none is given.
+const DefaultMaxReadFileBytes = 10 * 1024 * 1024
+
+// ErrFileTooLarge is returned by ReadFileBytes when the file exceeds the size limit.
+var ErrFileTooLarge = errors.New("file too large")
+
+// ReadFileBytes reads the whole file into memory, returning an error wrapping ErrFileTooLarge if the file is larger than maxSize bytes.
+// If maxSize is not greater than zero, DefaultMaxReadFileBytes is used. This protects against accidentally reading a huge file into memory.
+func (n *Node) ReadFileBytes(filePath string, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxReadFileBytes
+	}
+	r, err := n.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	// read one byte past the limit to detect files that exceed it
+	b, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %w", filePath, err)
+	}
+	if int64(len(b)) > maxSize {
+		return nil, fmt.Errorf("reading %q: %w: exceeds the limit of %d bytes", filePath, ErrFileTooLarge, maxSize)
+	}
+	return b, nil
+}
+
+func (n *Node) MustReadFileBytes(filePath string, maxSize int64) []byte {
+	b, err := n.ReadFileBytes(filePath, maxSize)
+	Must(err)
+	return b
+}
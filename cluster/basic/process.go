@@ -2,7 +2,7 @@ package basic
 
 import (
 	"context"
-	"syscall"
+	"os"
 
 	clusteriface "github.com/guseggert/clustertest/cluster"
 )
@@ -28,10 +28,26 @@ func (p *Process) MustWait() *clusteriface.ProcessResult {
 	return res
 }
 
-func (p *Process) Signal(sig syscall.Signal) error {
+func (p *Process) Signal(sig os.Signal) error {
 	return p.Process.Signal(p.Ctx, sig)
 }
 
-func (p *Process) MustSignal(sig syscall.Signal) {
+func (p *Process) MustSignal(sig os.Signal) {
 	Must(p.Signal(sig))
 }
+
+func (p *Process) PID() (int, error) {
+	return p.Process.PID(p.Ctx)
+}
+
+func (p *Process) MustPID() int {
+	return Must2(p.PID())
+}
+
+func (p *Process) Kill() error {
+	return p.Process.Kill(p.Ctx)
+}
+
+func (p *Process) MustKill() {
+	Must(p.Kill())
+}
@@ -0,0 +1,176 @@
+package basic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+type runEachOptions struct {
+	concurrency   int
+	failFast      bool
+	captureOutput bool
+}
+
+type RunEachOption func(o *runEachOptions)
+
+// RunEachConcurrency bounds the number of processes that RunEach runs at once.
+// By default, there is no bound.
+func RunEachConcurrency(n int) RunEachOption {
+	return func(o *runEachOptions) { o.concurrency = n }
+}
+
+// RunEachFailFast causes RunEach to cancel the rest of the processes when one fails.
+// By default, all processes are run to completion regardless of failures.
+func RunEachFailFast() RunEachOption {
+	return func(o *runEachOptions) { o.failFast = true }
+}
+
+// RunEachCaptureOutput captures the stdout and stderr of each process in its NodeRunResult, for RunAll.
+// Output is also written to the request's Stdout and Stderr, if set.
+func RunEachCaptureOutput() RunEachOption {
+	return func(o *runEachOptions) { o.captureOutput = true }
+}
+
+// RunEach runs a node-specific command on each node and waits for them all to finish.
+// The command for each node is built by calling f with the node's index and the node,
+// which is useful for heterogeneous workloads such as running a server on one node and clients on the rest.
+//
+// The results and errors are ordered the same as nodes. A process that exits with a non-zero exit code is an error, as with Node.Run.
+// With RunEachFailFast, processes that were canceled or never started because of another failure have the context's error.
+func RunEach(ctx context.Context, nodes []*Node, f func(i int, n *Node) clusteriface.StartProcRequest, opts ...RunEachOption) ([]*clusteriface.ProcessResult, []error) {
+	results := make([]*clusteriface.ProcessResult, len(nodes))
+	errs := forEachNode(ctx, nodes, opts, func(ctx context.Context, i int, node *Node) error {
+		var err error
+		results[i], err = node.Context(ctx).Run(f(i, node))
+		return err
+	})
+	return results, errs
+}
+
+// NodeRunResult is the result of running a command on one node with RunAll.
+type NodeRunResult struct {
+	// Index is the index of the node in the nodes passed to RunAll.
+	Index int
+	Node  *Node
+	// ExitCode is the exit code of the process, or -1 if it didn't exit normally, such as if it couldn't be started.
+	ExitCode int
+	// Duration is the wall-clock time from starting the process until it exited or failed, as measured locally.
+	Duration time.Duration
+	// Err is the error running the process, including a non-zero exit code as with Node.Run.
+	Err error
+	// Result is the process result, or nil if the process didn't exit normally.
+	Result *clusteriface.ProcessResult
+	// Stdout and Stderr are the output of the process, if RunEachCaptureOutput was used.
+	Stdout []byte
+	Stderr []byte
+}
+
+// RunAll runs the command on each node and waits for them all to finish, returning a result per node in the same order as nodes.
+// Unlike RunEach, the result of each node includes its exit code even if it is non-zero, how long it took, and optionally its output,
+// such as to find the slowest or failed nodes. The options are the same as for RunEach.
+func RunAll(ctx context.Context, nodes []*Node, req clusteriface.StartProcRequest, opts ...RunEachOption) []NodeRunResult {
+	o := &runEachOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	results := make([]NodeRunResult, len(nodes))
+	for i, node := range nodes {
+		results[i] = NodeRunResult{Index: i, Node: node, ExitCode: -1}
+	}
+	errs := forEachNode(ctx, nodes, opts, func(ctx context.Context, i int, node *Node) error {
+		res := &results[i]
+		nodeReq := req
+		var stdout, stderr bytes.Buffer
+		if o.captureOutput {
+			nodeReq.Stdout = teeWriter(&stdout, req.Stdout)
+			nodeReq.Stderr = teeWriter(&stderr, req.Stderr)
+		}
+		start := time.Now()
+		err := runWithExitCode(ctx, node, nodeReq, res)
+		res.Duration = time.Since(start)
+		if o.captureOutput {
+			res.Stdout = stdout.Bytes()
+			res.Stderr = stderr.Bytes()
+		}
+		return err
+	})
+	for i, err := range errs {
+		results[i].Err = err
+	}
+	return results
+}
+
+// runWithExitCode is like Node.Run, but records the result even if the exit code is non-zero.
+func runWithExitCode(ctx context.Context, node *Node, req clusteriface.StartProcRequest, res *NodeRunResult) error {
+	proc, err := node.Node.StartProc(ctx, req)
+	if err != nil {
+		return err
+	}
+	pr, err := proc.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for process to exit: %w", err)
+	}
+	res.Result = pr
+	res.ExitCode = pr.ExitCode
+	if pr.ExitCode != 0 {
+		return exitCodeError(pr)
+	}
+	return nil
+}
+
+// teeWriter returns a writer to buf and w, if w is set.
+func teeWriter(buf *bytes.Buffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buf
+	}
+	return io.MultiWriter(buf, w)
+}
+
+// forEachNode calls f for each node concurrently, subject to the options, and returns the errors ordered the same as nodes.
+func forEachNode(ctx context.Context, nodes []*Node, opts []RunEachOption, f func(ctx context.Context, i int, node *Node) error) []error {
+	o := &runEachOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	concurrency := o.concurrency
+	if concurrency <= 0 || concurrency > len(nodes) {
+		concurrency = len(nodes)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make([]error, len(nodes))
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	wg.Add(len(nodes))
+	for i, node := range nodes {
+		go func(i int, node *Node) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = ctx.Err()
+				return
+			}
+			defer func() { <-sem }()
+			if err := ctx.Err(); err != nil {
+				errs[i] = err
+				return
+			}
+
+			errs[i] = f(ctx, i, node)
+			if errs[i] != nil && o.failFast {
+				cancel()
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	return errs
+}
@@ -8,6 +8,9 @@ type Cluster interface {
 	// NewNodes creates nodes and adds them to the cluster. Generally this should return when the nodes are ready to use.
 	NewNodes(ctx context.Context, n int) (Nodes, error)
 
+	// ListNodes returns the nodes of the cluster, in the order they were created.
+	ListNodes() Nodes
+
 	// Cleanup destroys all cluster nodes and any other state related to the cluster.
 	Cleanup(ctx context.Context) error
 }
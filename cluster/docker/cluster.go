@@ -58,8 +58,13 @@ type Cluster struct {
 	DockerClient          *client.Client
 	RemoveContainers      bool
 	CreateContainerConfig func(*CreateContainerConfig) error
+	// AgentClientOptions are passed to the agent client of each node, such as agent.WithClientMaxFileTransfers.
+	AgentClientOptions []agent.ClientOption
 
-	nodesMut      sync.Mutex
+	nodesMut sync.Mutex
+	// Nodes are the nodes created by the cluster.
+	//
+	// Deprecated: use ListNodes, which all backends implement.
 	Nodes         []*Node
 	nodeIDcounter int
 
@@ -86,6 +91,12 @@ func (c *Cluster) WithCreateContainerConfig(f func(*CreateContainerConfig) error
 	return c
 }
 
+// WithAgentClientOptions configures the agent client of each node, such as with agent.WithClientMaxFileTransfers.
+func (c *Cluster) WithAgentClientOptions(opts ...agent.ClientOption) *Cluster {
+	c.AgentClientOptions = append(c.AgentClientOptions, opts...)
+	return c
+}
+
 // NewCluster creates a new local Docker cluster.
 // By default, this looks for the node agent binary by searching up from PWD for a "nodeagent" file.
 func NewCluster() (*Cluster, error) {
@@ -219,7 +230,8 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 			return nil, fmt.Errorf("starting container %q: %w", containerID, err)
 		}
 
-		agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", hostPort, agent.WithClientWaitInterval(100*time.Millisecond))
+		agentClient, err := agent.NewClient(c.Log, c.Certs, "127.0.0.1", hostPort,
+			append([]agent.ClientOption{agent.WithClientWaitInterval(100 * time.Millisecond)}, c.AgentClientOptions...)...)
 		if err != nil {
 			return nil, fmt.Errorf("building nodeagent client: %w", err)
 		}
@@ -249,6 +261,16 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 	return newNodes, nil
 }
 
+func (c *Cluster) ListNodes() clusteriface.Nodes {
+	c.nodesMut.Lock()
+	defer c.nodesMut.Unlock()
+	nodes := make(clusteriface.Nodes, len(c.Nodes))
+	for i, n := range c.Nodes {
+		nodes[i] = n
+	}
+	return nodes
+}
+
 func (c *Cluster) Cleanup(ctx context.Context) error {
 	c.nodesMut.Lock()
 	nodes := c.Nodes
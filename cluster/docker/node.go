@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"time"
 
 	"github.com/docker/docker/client"
 	"github.com/guseggert/clustertest/agent"
@@ -22,7 +24,6 @@ type Node struct {
 }
 
 func (n *Node) runEnv(reqEnv map[string]string) []string {
-	var env []string
 	envMap := map[string]string{}
 	for k, v := range n.Env {
 		envMap[k] = v
@@ -30,10 +31,7 @@ func (n *Node) runEnv(reqEnv map[string]string) []string {
 	for k, v := range reqEnv {
 		envMap[k] = v
 	}
-	for k, v := range envMap {
-		env = append(env, fmt.Sprintf("%s=%s", k, v))
-	}
-	return env
+	return clusteriface.EnvFromMap(envMap)
 }
 
 func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
@@ -44,10 +42,54 @@ func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader
 	return n.agentClient.SendFile(ctx, filePath, contents)
 }
 
+func (n *Node) SendBytes(ctx context.Context, filePath string, data []byte, opts ...clusteriface.SendOption) error {
+	return n.agentClient.SendBytes(ctx, filePath, data, opts...)
+}
+
+func (n *Node) SendFileWithOptions(ctx context.Context, filePath string, contents io.Reader, opts ...agent.SendOption) (*agent.SendResult, error) {
+	return n.agentClient.SendFileWithOptions(ctx, filePath, contents, opts...)
+}
+
+func (n *Node) SendLocalFile(ctx context.Context, localPath, remotePath string, opts ...clusteriface.SendLocalFileOption) (int64, error) {
+	return n.agentClient.SendLocalFile(ctx, localPath, remotePath, opts...)
+}
+
 func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
 	return n.agentClient.ReadFile(ctx, path)
 }
 
+func (n *Node) OpenFile(ctx context.Context, path string, opts ...agent.ReadFileOption) (*agent.File, error) {
+	return n.agentClient.OpenFile(ctx, path, opts...)
+}
+
+func (n *Node) DownloadFile(ctx context.Context, remotePath, localPath string, opts ...clusteriface.DownloadFileOption) (int64, error) {
+	return n.agentClient.DownloadFile(ctx, remotePath, localPath, opts...)
+}
+
+func (n *Node) SyncDir(ctx context.Context, localDir, remoteDir string, opts ...clusteriface.SyncDirOption) (*clusteriface.SyncResult, error) {
+	return n.agentClient.SyncDir(ctx, localDir, remoteDir, opts...)
+}
+
+func (n *Node) Remove(ctx context.Context, path string) error {
+	return n.agentClient.Remove(ctx, path)
+}
+
+func (n *Node) RemoveAll(ctx context.Context, path string) error {
+	return n.agentClient.RemoveAll(ctx, path)
+}
+
+func (n *Node) TempDir(ctx context.Context, prefix string) (string, func(ctx context.Context) error, error) {
+	return n.agentClient.TempDir(ctx, prefix)
+}
+
+func (n *Node) Environ(ctx context.Context, redact ...string) ([]string, error) {
+	return n.agentClient.Environ(ctx, redact...)
+}
+
+func (n *Node) Checksum(ctx context.Context, path string, algo clusteriface.ChecksumAlgorithm) (string, error) {
+	return n.agentClient.Checksum(ctx, path, algo)
+}
+
 func (n *Node) Stop(ctx context.Context) error {
 	n.agentClient.StopHeartbeat()
 	err := n.dockerClient.ContainerStop(ctx, n.ContainerID, nil)
@@ -64,10 +106,71 @@ func (n *Node) Stop(ctx context.Context) error {
 	return nil
 }
 
+func (n *Node) ClockOffset(ctx context.Context) (time.Duration, error) {
+	return n.agentClient.ClockOffset(ctx)
+}
+
+func (n *Node) Ping(ctx context.Context) (time.Duration, error) {
+	return n.agentClient.Ping(ctx)
+}
+
+func (n *Node) OS(ctx context.Context) (string, error) {
+	info, err := n.agentClient.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	return info.OS, nil
+}
+
+func (n *Node) Stat(ctx context.Context, path string) (*agent.FileInfo, error) {
+	return n.agentClient.Stat(ctx, path)
+}
+
+func (n *Node) ReadDir(ctx context.Context, path string) ([]agent.FileInfo, error) {
+	return n.agentClient.ReadDir(ctx, path)
+}
+
+func (n *Node) Symlink(ctx context.Context, oldname, newname string) error {
+	return n.agentClient.Symlink(ctx, oldname, newname)
+}
+
+func (n *Node) Rename(ctx context.Context, oldpath, newpath string) error {
+	return n.agentClient.Rename(ctx, oldpath, newpath)
+}
+
+func (n *Node) Chmod(ctx context.Context, path string, mode os.FileMode) error {
+	return n.agentClient.Chmod(ctx, path, mode)
+}
+
+func (n *Node) Chown(ctx context.Context, path string, uid, gid int) error {
+	return n.agentClient.Chown(ctx, path, uid, gid)
+}
+
 func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
 	return n.agentClient.DialContext(ctx, network, addr)
 }
 
+// CollectDiagnostics returns a tar stream of the given paths in the container. See agent.Client.CollectDiagnostics.
+// The node agent logs to the container's output, so its log isn't included.
+func (n *Node) CollectDiagnostics(ctx context.Context, paths ...string) (io.ReadCloser, error) {
+	return n.agentClient.CollectDiagnostics(ctx, paths...)
+}
+
+// DialWait is like Dial, but retries until the address accepts the connection or the context is done.
+func (n *Node) DialWait(ctx context.Context, network, addr string) (net.Conn, error) {
+	return n.agentClient.DialWait(ctx, network, addr)
+}
+
+// RemoveGlob removes the paths in the container matching the pattern. See agent.Client.RemoveGlob.
+func (n *Node) RemoveGlob(ctx context.Context, pattern string) ([]string, error) {
+	return n.agentClient.RemoveGlob(ctx, pattern)
+}
+
+// Stats returns the current load of the node. See clusteriface.NodeStats.
+func (n *Node) Stats(ctx context.Context) (clusteriface.NodeStats, error) {
+	return n.agentClient.Stats(ctx)
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("local node id=%d", n.ID)
 }
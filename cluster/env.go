@@ -0,0 +1,111 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// EnvFromMap returns env vars in the form "k=v" from a map, sorted by name,
+// so that building StartProcRequest.Env from a map is deterministic.
+func EnvFromMap(m map[string]string) []string {
+	env := make([]string, 0, len(m))
+	for k, v := range m {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// NormalizeEnv returns env vars in the form "k=v" with only the last definition of each variable,
+// which is the one that takes effect with os/exec, sorted by name for stable logging.
+// As with os/exec, variable names are case-insensitive on Windows.
+func NormalizeEnv(env []string) []string {
+	last := map[string]string{}
+	for _, kv := range env {
+		last[envKey(kv)] = kv
+	}
+	keys := make([]string, 0, len(last))
+	for k := range last {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	normalized := make([]string, len(keys))
+	for i, k := range keys {
+		normalized[i] = last[k]
+	}
+	return normalized
+}
+
+// ExpandEnv replaces $VAR and ${VAR} references in the command and args with values from env, in the form "k=v",
+// for implementations of StartProcRequest.ExpandEnv.
+// This is literal variable substitution, not shell parsing, so there is no quoting, escaping, or default values.
+// Undefined variables are replaced with the empty string, and if a variable is defined multiple times, the last definition wins.
+// As with NormalizeEnv, variable names are case-insensitive on Windows.
+func ExpandEnv(env []string, command string, args []string) (string, []string) {
+	vals := map[string]string{}
+	for _, kv := range env {
+		k, v := splitEnv(kv)
+		vals[envName(k)] = v
+	}
+	mapping := func(k string) string { return vals[envName(k)] }
+
+	expandedArgs := make([]string, len(args))
+	for i, arg := range args {
+		expandedArgs[i] = os.Expand(arg, mapping)
+	}
+	return os.Expand(command, mapping), expandedArgs
+}
+
+// envKey returns the name of an env var in the form "k=v", normalized for comparison with envName.
+func envKey(kv string) string {
+	k, _ := splitEnv(kv)
+	return envName(k)
+}
+
+// splitEnv splits an env var in the form "k=v" into its name and value.
+func splitEnv(kv string) (string, string) {
+	// Windows has hidden per-drive variables like "=C:=C:\dir", whose names start with "="
+	if kv == "" {
+		return "", ""
+	}
+	if i := strings.Index(kv[1:], "="); i >= 0 {
+		return kv[:i+1], kv[i+2:]
+	}
+	return kv, ""
+}
+
+// envName normalizes an env var name for comparison, since names are case-insensitive on Windows.
+func envName(k string) string {
+	if runtime.GOOS == "windows" {
+		return strings.ToUpper(k)
+	}
+	return k
+}
+
+// RedactedValue replaces the values of redacted env vars, see RedactEnv.
+const RedactedValue = "REDACTED"
+
+// RedactEnv returns a copy of the env vars in the form "k=v", with the values of those whose keys match any of the patterns,
+// in path.Match syntax such as "AWS_*", replaced with RedactedValue.
+func RedactEnv(env []string, patterns ...string) ([]string, error) {
+	redacted := make([]string, len(env))
+	for i, kv := range env {
+		redacted[i] = kv
+		k, _, _ := strings.Cut(kv, "=")
+		for _, pattern := range patterns {
+			matched, err := path.Match(pattern, k)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+			if matched {
+				redacted[i] = k + "=" + RedactedValue
+				break
+			}
+		}
+	}
+	return redacted, nil
+}
@@ -0,0 +1,20 @@
+package cluster
+
+// ExitReason describes why a process ended, beyond its exit code, such as whether the node stopped it.
+// It's empty if the process exited on its own, whatever its exit code.
+type ExitReason string
+
+const (
+	// ExitReasonTimeout is a process stopped because it ran longer than StartProcRequest.Timeout.
+	ExitReasonTimeout ExitReason = "timeout"
+	// ExitReasonRuntimeCap is a process killed because it ran longer than the node's cap on process runtime.
+	ExitReasonRuntimeCap ExitReason = "runtime-cap"
+	// ExitReasonOOM is a process killed by the OOM killer of its cgroup, see StartProcRequest.CgroupPath.
+	// OOM kills are only detected for processes run in a cgroup, others killed by the OOM killer are ExitReasonSignaled.
+	ExitReasonOOM ExitReason = "oom"
+	// ExitReasonSignaled is a process terminated by a signal that the node didn't send to stop it,
+	// such as one sent with Process.Signal or Process.Kill, or a SIGSEGV.
+	ExitReasonSignaled ExitReason = "signaled"
+	// ExitReasonKilledOnDisconnect is a process stopped because the client that started it went away.
+	ExitReasonKilledOnDisconnect ExitReason = "killed-on-disconnect"
+)
@@ -0,0 +1,197 @@
+package cluster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// ChecksumAlgorithm is an algorithm for computing checksums of files.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	// ChecksumCRC32C is CRC-32 with the Castagnoli polynomial, which is much faster than SHA-256 but only detects accidental changes.
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// NewHash returns a new hash computing checksums with the algorithm, or an error if the algorithm isn't supported.
+func (a ChecksumAlgorithm) NewHash() (hash.Hash, error) {
+	switch a {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", a)
+	}
+}
+
+// FileChecksum returns the hex-encoded checksum of the local file, such as to compare it with the checksum of a file on a node.
+func FileChecksum(path string, algo ChecksumAlgorithm) (string, error) {
+	h, err := algo.NewHash()
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ErrChecksumMismatch is returned when an uploaded file doesn't match its checksum, such as with SendChecksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// SendOptions are the options of an upload with SendBytes, which are set with SendOption.
+type SendOptions struct {
+	// Mode is the permission bits of the remote file, if ModeSet is true.
+	Mode    os.FileMode
+	ModeSet bool
+	// Checksum is the algorithm of the checksum that the node verifies, if not empty.
+	Checksum ChecksumAlgorithm
+	// Compress compresses the upload, for nodes that upload over the network.
+	Compress bool
+}
+
+// SendOption configures an upload with SendBytes.
+type SendOption func(o *SendOptions)
+
+// SendMode sets the permission bits of the remote file.
+func SendMode(mode os.FileMode) SendOption {
+	return func(o *SendOptions) {
+		o.Mode = mode
+		o.ModeSet = true
+	}
+}
+
+// SendChecksum has the node verify the checksum of the file it received, using the given algorithm.
+// The checksum is of the contents as written to the file, even if they were compressed for the upload.
+// If it doesn't match, the remote file isn't written and an error wrapping ErrChecksumMismatch is returned.
+func SendChecksum(algo ChecksumAlgorithm) SendOption {
+	return func(o *SendOptions) {
+		o.Checksum = algo
+	}
+}
+
+// SendCompressed gzips the upload, which the node decompresses before writing the file, such as for large text fixtures.
+// Contents that are already compressed, such as gzip, zip, or image files, are sent as-is, as are uploads to nodes
+// that don't support compressed uploads.
+func SendCompressed() SendOption {
+	return func(o *SendOptions) {
+		o.Compress = true
+	}
+}
+
+// SendLocalFileOptions are the options of an upload with SendLocalFile, which are set with SendLocalFileOption.
+type SendLocalFileOptions struct {
+	// PreserveMode sets the permission bits of the remote file to those of the local file.
+	PreserveMode bool
+}
+
+// SendLocalFileOption configures an upload with SendLocalFile.
+type SendLocalFileOption func(o *SendLocalFileOptions)
+
+// PreserveMode sets the permission bits of the remote file to those of the local file.
+func PreserveMode() SendLocalFileOption {
+	return func(o *SendLocalFileOptions) {
+		o.PreserveMode = true
+	}
+}
+
+// DownloadFileOptions are the options of a download with DownloadFile, which are set with DownloadFileOption.
+type DownloadFileOptions struct {
+	// PreserveMode sets the permission bits of the local file to those of the remote file.
+	PreserveMode bool
+	// PreserveModTime sets the modification time of the local file to that of the remote file.
+	PreserveModTime bool
+	// SHA256 is the expected hex-encoded SHA-256 checksum of the file, in lowercase, if not empty.
+	SHA256 string
+}
+
+// DownloadFileOption configures a download with DownloadFile.
+type DownloadFileOption func(o *DownloadFileOptions)
+
+// PreserveRemoteMode sets the permission bits of the local file to those of the remote file.
+func PreserveRemoteMode() DownloadFileOption {
+	return func(o *DownloadFileOptions) {
+		o.PreserveMode = true
+	}
+}
+
+// PreserveRemoteModTime sets the modification time of the local file to that of the remote file, with second granularity.
+func PreserveRemoteModTime() DownloadFileOption {
+	return func(o *DownloadFileOptions) {
+		o.PreserveModTime = true
+	}
+}
+
+// VerifySHA256 fails the download if the SHA-256 checksum of the file, hex-encoded, doesn't match the given one.
+func VerifySHA256(sum string) DownloadFileOption {
+	return func(o *DownloadFileOptions) {
+		o.SHA256 = strings.ToLower(sum)
+	}
+}
+
+// SyncDirOptions are the options of SyncDir, which are set with SyncDirOption.
+type SyncDirOptions struct {
+	// Checksum compares files by their SHA-256 checksums instead of their sizes and modification times.
+	Checksum bool
+	// Delete deletes remote files that don't exist locally.
+	Delete bool
+}
+
+// SyncDirOption configures SyncDir.
+type SyncDirOption func(o *SyncDirOptions)
+
+// SyncChecksum compares files by their SHA-256 checksums instead of their modification times, which is slower
+// since every file is read on both sides, but catches changes that preserve the size and modification time.
+func SyncChecksum() SyncDirOption {
+	return func(o *SyncDirOptions) {
+		o.Checksum = true
+	}
+}
+
+// SyncDelete deletes remote files that don't exist locally.
+func SyncDelete() SyncDirOption {
+	return func(o *SyncDirOptions) {
+		o.Delete = true
+	}
+}
+
+// SyncResult reports the files handled by SyncDir, as slash-separated paths relative to the synced directories.
+type SyncResult struct {
+	Transferred []string
+	Skipped     []string
+	Deleted     []string
+}
+
+// RemoveGlobFailure is a path matching a RemoveGlob pattern that couldn't be removed.
+type RemoveGlobFailure struct {
+	Path  string
+	Error string
+}
+
+// RemoveGlobError is returned by RemoveGlob when some of the matching paths couldn't be removed.
+type RemoveGlobError struct {
+	Failed []RemoveGlobFailure
+}
+
+func (e *RemoveGlobError) Error() string {
+	var failures []string
+	for _, f := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%s: %s", f.Path, f.Error))
+	}
+	return fmt.Sprintf("failed to remove %d paths: %s", len(e.Failed), strings.Join(failures, "; "))
+}
@@ -70,6 +70,14 @@ func (c *Cluster) NewNodes(ctx context.Context, n int) (clusteriface.Nodes, erro
 	return newNodes, nil
 }
 
+func (c *Cluster) ListNodes() clusteriface.Nodes {
+	nodes := make(clusteriface.Nodes, len(c.nodes))
+	for i, n := range c.nodes {
+		nodes[i] = n
+	}
+	return nodes
+}
+
 func (c *Cluster) Cleanup(ctx context.Context) error {
 	if err := c.init(); err != nil {
 		return err
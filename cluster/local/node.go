@@ -1,49 +1,171 @@
 package local
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	clusteriface "github.com/guseggert/clustertest/cluster"
+	"github.com/guseggert/clustertest/internal/cgroup"
+	"github.com/guseggert/clustertest/internal/diagnostics"
+	"github.com/guseggert/clustertest/internal/iocount"
+	"github.com/guseggert/clustertest/internal/sysstats"
 )
 
 type Node struct {
 	ID  int
 	Env map[string]string
 	Dir string
+
+	// running is the number of processes started by the node that haven't exited.
+	running int64
 }
 
 type result struct {
-	code   int
-	timeMS int64
-	err    error
+	code        int
+	timeMS      int64
+	signaled    bool
+	signal      syscall.Signal
+	usage       clusteriface.ResourceUsage
+	reason      clusteriface.ExitReason
+	stdoutBytes int64
+	stderrBytes int64
+	stdinBytes  int64
+	err         error
+}
+
+// countingWriteCloser counts the bytes written to a piped stdin.
+type countingWriteCloser struct {
+	iocount.Writer
+	io.Closer
+}
+
+// outputBytes is the number of bytes written to stdout or stderr, which are counted by the writer unless they were written to a file.
+func outputBytes(file string, counter *int64) int64 {
+	if file == "" {
+		return atomic.LoadInt64(counter)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 type proc struct {
+	pid    int
+	stdin  io.WriteCloser
+	stdout io.Reader
+	stderr io.Reader
 	wait   func(context.Context) (*clusteriface.ProcessResult, error)
-	signal func(context.Context, syscall.Signal) error
+	signal func(context.Context, os.Signal) error
+	// exited is closed once the process has exited and been reaped.
+	exited chan struct{}
 }
 
 func (p *proc) Wait(ctx context.Context) (*clusteriface.ProcessResult, error) { return p.wait(ctx) }
-func (p *proc) Signal(ctx context.Context, sig syscall.Signal) error          { return p.signal(ctx, sig) }
+func (p *proc) Signal(ctx context.Context, sig os.Signal) error               { return p.signal(ctx, sig) }
+func (p *proc) PID(ctx context.Context) (int, error)                          { return p.pid, nil }
+func (p *proc) Stdout() io.Reader                                             { return p.stdout }
+func (p *proc) Stderr() io.Reader                                             { return p.stderr }
+func (p *proc) Stdin() io.WriteCloser                                         { return p.stdin }
+
+func (p *proc) Kill(ctx context.Context) error {
+	select {
+	case <-p.exited:
+		return nil
+	default:
+	}
+	if err := p.signal(ctx, os.Kill); err != nil && !errors.Is(err, clusteriface.ErrProcessExited) {
+		return err
+	}
+	select {
+	case <-p.exited:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for killed process to exit: %w", ctx.Err())
+	}
+}
 
 func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest) (clusteriface.Process, error) {
-	cmd := exec.Command(req.Command, req.Args...)
-	if len(req.Env) > 0 {
-		cmd.Env = append(os.Environ(), req.Env...)
+	stdin, err := req.StdinReaderContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if req.Credential != nil {
+		return nil, errors.New("running processes as another user is not supported by local nodes")
+	}
+
+	env := os.Environ()
+	if req.CleanEnv {
+		// an empty, non-nil env, since a nil one inherits the environment
+		env = []string{}
+	}
+	env = clusteriface.NormalizeEnv(append(env, req.Env...))
+
+	command, args := req.Command, req.Args
+	if req.ExpandEnv {
+		command, args = clusteriface.ExpandEnv(env, command, args)
+	}
+
+	// stdoutBytes, stderrBytes, and stdinBytes count the bytes the process wrote to stdout and stderr and read from stdin
+	var stdoutBytes, stderrBytes, stdinBytes int64
+
+	cmd := exec.Command(command, args...)
+	cmd.Env = env
+	cmd.Stdin = stdin
+	if _, isFile := stdin.(*os.File); stdin != nil && !isFile {
+		// files are passed to the process directly, so wrapping them would make Wait block on copying them, and they aren't counted
+		cmd.Stdin = &iocount.Reader{R: stdin, N: &stdinBytes}
+	}
+	var stdinWriter io.WriteCloser = clusteriface.NotPipedStdin{}
+	if req.StdinPipe {
+		if stdin != nil {
+			return nil, errors.New("stdin can't be both piped and read from a reader")
+		}
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, fmt.Errorf("piping stdin: %w", err)
+		}
+		stdinWriter = &countingWriteCloser{Writer: iocount.Writer{W: pipe, N: &stdinBytes}, Closer: pipe}
 	}
-	cmd.Stdin = req.Stdin
 	cmd.Stdout = req.Stdout
 	cmd.Stderr = req.Stderr
 	cmd.Dir = req.WD
 
+	var stdoutReader, stderrReader io.Reader = strings.NewReader(""), strings.NewReader("")
+	closeStdoutPipe, closeStderrPipe := func() {}, func() {}
+	if req.StdoutPipe {
+		if req.Stdout != nil {
+			return nil, errors.New("stdout can't be both piped and written to a writer")
+		}
+		pr, pw := io.Pipe()
+		stdoutReader, cmd.Stdout = pr, pw
+		closeStdoutPipe = func() { pw.Close() }
+	}
+	if req.StderrPipe {
+		if req.Stderr != nil {
+			return nil, errors.New("stderr can't be both piped and written to a writer")
+		}
+		pr, pw := io.Pipe()
+		stderrReader, cmd.Stderr = pr, pw
+		closeStderrPipe = func() { pw.Close() }
+	}
+
 	closeStdoutFile := func() error { return nil }
 	closeStderrFile := func() error { return nil }
 	if req.StdoutFile != "" {
@@ -64,71 +186,171 @@ func (n *Node) StartProc(ctx context.Context, req clusteriface.StartProcRequest)
 		closeStderrFile = f.Close
 	}
 
+	// output to files is written by the process directly, so only count the other writers, which are copied to by the stdlib
+	var stdoutCounter, stderrCounter *int64
+	if req.StdoutFile == "" {
+		stdoutCounter = &stdoutBytes
+	}
+	if req.StderrFile == "" {
+		stderrCounter = &stderrBytes
+	}
+	cmd.Stdout, cmd.Stderr = iocount.Output(cmd.Stdout, cmd.Stderr, stdoutCounter, stderrCounter)
+
+	// oomKills is the number of OOM kills in the cgroup when the process started, for detecting whether it was OOM killed
+	var oomKills int64
+	if req.CgroupPath != "" {
+		oomKills, _ = cgroup.OOMKills(req.CgroupPath)
+	}
+
 	start := time.Now()
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		return nil, fmt.Errorf("running command: %w", err)
 	}
+	if req.CgroupPath != "" {
+		err := cgroup.AddProcess(req.CgroupPath, cmd.Process.Pid)
+		if err != nil {
+			// the process won't be waited on by the caller, so kill and reap it here
+			cmd.Process.Kill()
+			cmd.Wait()
+			closeStdoutPipe()
+			closeStderrPipe()
+			closeStdoutFile()
+			closeStderrFile()
+			return nil, err
+		}
+	}
+
+	atomic.AddInt64(&n.running, 1)
 
 	// wait on the process to finish and send the result
 	resultChan := make(chan result, 1)
 	procExitedChan := make(chan struct{})
+	// timedOut is set to 1 if the process is stopped because of its timeout
+	var timedOut int32
 	go func() {
 		exitCode := 0
 		var resultErr error
 
 		err := cmd.Wait()
 		timeMS := time.Since(start).Milliseconds()
+		closeStdoutPipe()
+		closeStderrPipe()
 
 		defer closeStderrFile()
 		defer closeStdoutFile()
 
 		close(procExitedChan)
+		atomic.AddInt64(&n.running, -1)
+		res := result{
+			timeMS:      timeMS,
+			usage:       clusteriface.ProcessUsage(cmd.ProcessState),
+			stdoutBytes: outputBytes(req.StdoutFile, &stdoutBytes),
+			stderrBytes: outputBytes(req.StderrFile, &stderrBytes),
+			stdinBytes:  atomic.LoadInt64(&stdinBytes),
+		}
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.signaled = true
+			res.signal = ws.Signal()
+			res.reason = clusteriface.ExitReasonSignaled
+			if req.CgroupPath != "" {
+				if n, err := cgroup.OOMKills(req.CgroupPath); err == nil && n > oomKills {
+					res.reason = clusteriface.ExitReasonOOM
+				}
+			}
+		}
+		if atomic.LoadInt32(&timedOut) == 1 {
+			res.reason = clusteriface.ExitReasonTimeout
+		}
 		if err != nil {
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				exitCode = exitErr.ExitCode()
 			} else {
+				// the process may have exited normally even if copying its output failed
 				resultErr = err
 				exitCode = -1
+				if cmd.ProcessState != nil {
+					exitCode = cmd.ProcessState.ExitCode()
+				}
 			}
 		}
+		res.code = exitCode
+		res.err = resultErr
 		select {
 		case <-ctx.Done():
 			return
-		case resultChan <- result{code: exitCode, timeMS: timeMS, err: resultErr}:
+		case resultChan <- res:
 		}
 
 	}()
 
-	// kill the process if the context is canceled
+	// stop the process if the context is canceled or it times out
 	go func() {
+		var timeout <-chan time.Time
+		if req.Timeout > 0 {
+			timer := time.NewTimer(req.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		grace := req.KillGracePeriod
+		if grace <= 0 {
+			grace = clusteriface.DefaultKillGracePeriod
+		}
+		steps := []clusteriface.CancelStep{{Signal: req.StopSignal, Grace: grace}}
 		select {
 		case <-ctx.Done():
-			cmd.Process.Kill()
+			if req.CancelPolicy != nil && len(req.CancelPolicy.Steps) > 0 {
+				steps = req.CancelPolicy.Steps
+			}
+		case <-timeout:
+			atomic.StoreInt32(&timedOut, 1)
 		case <-procExitedChan:
+			return
 		}
+		for _, step := range steps {
+			if step.Signal == 0 || step.Signal == syscall.SIGKILL {
+				break
+			}
+			cmd.Process.Signal(step.Signal)
+			select {
+			case <-procExitedChan:
+				return
+			case <-time.After(step.Grace):
+			}
+		}
+		cmd.Process.Kill()
 	}()
 
 	return &proc{
+		pid:    cmd.Process.Pid,
+		stdin:  stdinWriter,
+		stdout: stdoutReader,
+		stderr: stderrReader,
+		exited: procExitedChan,
 		wait: func(ctx context.Context) (*clusteriface.ProcessResult, error) {
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
 			case res := <-resultChan:
-				return &clusteriface.ProcessResult{ExitCode: res.code, TimeMS: res.timeMS}, res.err
+				return &clusteriface.ProcessResult{
+					ExitCode:    res.code,
+					TimeMS:      res.timeMS,
+					Signaled:    res.signaled,
+					Signal:      res.signal,
+					Usage:       res.usage,
+					Reason:      res.reason,
+					StdoutBytes: res.stdoutBytes,
+					StderrBytes: res.stderrBytes,
+					StdinBytes:  res.stdinBytes,
+				}, res.err
 			}
 		},
-		signal: func(ctx context.Context, s syscall.Signal) error {
-			var sig os.Signal
-			switch s {
-			case syscall.SIGINT:
-				sig = os.Interrupt
-			case syscall.SIGKILL:
-				sig = os.Kill
-			default:
-				return fmt.Errorf("unsupported signal %d", s)
+		signal: func(ctx context.Context, sig os.Signal) error {
+			err := cmd.Process.Signal(sig)
+			if errors.Is(err, os.ErrProcessDone) {
+				return clusteriface.ErrProcessExited
 			}
-			return cmd.Process.Signal(sig)
+			return err
 		},
 	}, nil
 }
@@ -151,18 +373,302 @@ func (n *Node) SendFile(ctx context.Context, filePath string, contents io.Reader
 	return err
 }
 
+// SendBytes writes the data to the file. With SendChecksum, the written file is read back to verify it,
+// and compression is ignored, since nothing is sent over the network.
+func (n *Node) SendBytes(ctx context.Context, filePath string, data []byte, opts ...clusteriface.SendOption) error {
+	var o clusteriface.SendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var want string
+	if o.Checksum != "" {
+		h, err := o.Checksum.NewHash()
+		if err != nil {
+			return err
+		}
+		h.Write(data)
+		want = hex.EncodeToString(h.Sum(nil))
+	}
+
+	err := n.SendFile(ctx, filePath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if o.ModeSet {
+		err = os.Chmod(filePath, o.Mode.Perm())
+		if err != nil {
+			return fmt.Errorf("setting mode: %w", err)
+		}
+	}
+	if o.Checksum != "" {
+		got, err := clusteriface.FileChecksum(filePath, o.Checksum)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			os.Remove(filePath)
+			return fmt.Errorf("%w: expected %s %s, got %s", clusteriface.ErrChecksumMismatch, o.Checksum, want, got)
+		}
+	}
+	return nil
+}
+
+func (n *Node) SendLocalFile(ctx context.Context, localPath, remotePath string, opts ...clusteriface.SendLocalFileOption) (int64, error) {
+	var o clusteriface.SendLocalFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	f, err := os.Open(localPath)
+	if err != nil {
+		return 0, fmt.Errorf("opening local file: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stating local file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("local file %q is not a regular file", localPath)
+	}
+
+	err = n.SendFile(ctx, remotePath, f)
+	if err != nil {
+		return 0, err
+	}
+	if o.PreserveMode {
+		err = os.Chmod(remotePath, info.Mode().Perm())
+		if err != nil {
+			return info.Size(), fmt.Errorf("preserving mode: %w", err)
+		}
+	}
+	return info.Size(), nil
+}
+
+// DownloadFile copies the file at remotePath to localPath, through a temp file in the same directory
+// which is renamed into place once it is complete, like the agent's DownloadFile.
+func (n *Node) DownloadFile(ctx context.Context, remotePath, localPath string, opts ...clusteriface.DownloadFileOption) (int64, error) {
+	var o clusteriface.DownloadFileOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	remoteFile, err := os.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer remoteFile.Close()
+	info, err := remoteFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(localPath), "."+filepath.Base(localPath)+".tmp*")
+	if err != nil {
+		return 0, fmt.Errorf("creating temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			tmpFile.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hash), remoteFile)
+	if err != nil {
+		return 0, fmt.Errorf("copying file: %w", err)
+	}
+	if o.SHA256 != "" {
+		sum := hex.EncodeToString(hash.Sum(nil))
+		if sum != o.SHA256 {
+			return 0, fmt.Errorf("checksum mismatch for %q: expected SHA-256 %s, got %s", remotePath, o.SHA256, sum)
+		}
+	}
+	if o.PreserveMode {
+		err = tmpFile.Chmod(info.Mode().Perm())
+		if err != nil {
+			return 0, fmt.Errorf("preserving mode: %w", err)
+		}
+	}
+	err = tmpFile.Close()
+	if err != nil {
+		return 0, fmt.Errorf("closing temp file: %w", err)
+	}
+	if o.PreserveModTime {
+		modTime := info.ModTime().Truncate(time.Second)
+		err = os.Chtimes(tmpPath, modTime, modTime)
+		if err != nil {
+			return 0, fmt.Errorf("preserving modification time: %w", err)
+		}
+	}
+	err = os.Rename(tmpPath, localPath)
+	if err != nil {
+		return 0, fmt.Errorf("renaming temp file: %w", err)
+	}
+	succeeded = true
+	return written, nil
+}
+
+func (n *Node) Checksum(ctx context.Context, path string, algo clusteriface.ChecksumAlgorithm) (string, error) {
+	return clusteriface.FileChecksum(path, algo)
+}
+
 func (n *Node) ReadFile(ctx context.Context, path string) (io.ReadCloser, error) {
 	return os.Open(path)
 }
 
+func (n *Node) RemoveAll(ctx context.Context, path string) error {
+	return os.RemoveAll(path)
+}
+
+// RemoveGlob removes the paths matching the absolute pattern and any children they contain.
+// See clusteriface.GlobRemover.
+func (n *Node) RemoveGlob(ctx context.Context, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		return nil, fmt.Errorf("pattern %q is not absolute", pattern)
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	removed := []string{}
+	var failed []clusteriface.RemoveGlobFailure
+	for _, match := range matches {
+		err := os.RemoveAll(match)
+		if err != nil {
+			failed = append(failed, clusteriface.RemoveGlobFailure{Path: match, Error: err.Error()})
+			continue
+		}
+		removed = append(removed, match)
+	}
+	if len(failed) > 0 {
+		return removed, &clusteriface.RemoveGlobError{Failed: failed}
+	}
+	return removed, nil
+}
+
+// TempDir creates a new, unique directory in the default temporary directory, whose name starts with prefix,
+// and returns its path and a func to remove it and its contents, which does nothing once it has succeeded.
+func (n *Node) TempDir(ctx context.Context, prefix string) (string, func(ctx context.Context) error, error) {
+	dir, err := os.MkdirTemp("", prefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	var mut sync.Mutex
+	removed := false
+	cleanup := func(ctx context.Context) error {
+		mut.Lock()
+		defer mut.Unlock()
+		if removed {
+			return nil
+		}
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return fmt.Errorf("removing temp dir %q: %w", dir, err)
+		}
+		removed = true
+		return nil
+	}
+	return dir, cleanup, nil
+}
+
+// Environ returns the environment of the current process, which local processes inherit.
+func (n *Node) Environ(ctx context.Context, redact ...string) ([]string, error) {
+	return clusteriface.RedactEnv(os.Environ(), redact...)
+}
+
 func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
 	return net.Dial(network, addr)
 }
 
+// The intervals between attempts of DialWait, which doubles from dialWaitInterval up to dialWaitMaxInterval.
+const (
+	dialWaitInterval    = 10 * time.Millisecond
+	dialWaitMaxInterval = time.Second
+)
+
+// DialWait is like Dial, but retries until the address accepts the connection or the context is done.
+// Errors that retrying won't fix, like invalid addresses, are returned right away.
+// If the context is done first, the last dial error is returned.
+func (n *Node) DialWait(ctx context.Context, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	interval := dialWaitInterval
+	for {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if !dialRetryable(err) {
+			return nil, err
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		interval *= 2
+		if interval > dialWaitMaxInterval {
+			interval = dialWaitMaxInterval
+		}
+	}
+}
+
+// dialRetryable returns true if retrying a failed dial may succeed, which it won't for invalid addresses.
+func dialRetryable(err error) bool {
+	var addrErr *net.AddrError
+	var dnsErr *net.DNSError
+	var networkErr net.UnknownNetworkError
+	return !errors.As(err, &addrErr) && !errors.As(err, &dnsErr) && !errors.As(err, &networkErr)
+}
+
+// CollectDiagnostics returns a tar stream of the files at the given absolute paths, like the agent's diagnostics bundles.
+// Local nodes have no files of their own to collect.
+func (n *Node) CollectDiagnostics(ctx context.Context, paths ...string) (io.ReadCloser, error) {
+	for _, p := range paths {
+		if !filepath.IsAbs(p) {
+			return nil, fmt.Errorf("diagnostics path %q is not absolute", p)
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(diagnostics.Write(pw, paths))
+	}()
+	return pr, nil
+}
+
 func (n *Node) Stop(ctx context.Context) error {
 	return nil
 }
 
+// Ping returns zero, since local nodes are in the current process, unless the context is done.
+func (n *Node) Ping(ctx context.Context) (time.Duration, error) {
+	return 0, ctx.Err()
+}
+
+// Stats returns the current load of the machine, and the number of processes started by the node that are still running.
+func (n *Node) Stats(ctx context.Context) (clusteriface.NodeStats, error) {
+	sys, err := sysstats.Sample()
+	return clusteriface.NodeStats{
+		RunningProcesses:   int(atomic.LoadInt64(&n.running)),
+		NumCPU:             runtime.NumCPU(),
+		LoadAverage1:       sys.LoadAverage1,
+		MemTotalBytes:      sys.MemTotalBytes,
+		MemAvailableBytes:  sys.MemAvailableBytes,
+		DiskTotalBytes:     sys.DiskTotalBytes,
+		DiskAvailableBytes: sys.DiskAvailableBytes,
+		SampledAt:          time.Now(),
+	}, err
+}
+
+func (n *Node) OS(ctx context.Context) (string, error) {
+	return runtime.GOOS, nil
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("local node id=%d", n.ID)
 }
@@ -0,0 +1,146 @@
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	clusteriface "github.com/guseggert/clustertest/cluster"
+)
+
+// SyncDir makes remoteDir contain the regular files of localDir, copying only the files that are new or changed,
+// with the same rules as the agent's SyncDir.
+func (n *Node) SyncDir(ctx context.Context, localDir, remoteDir string, opts ...clusteriface.SyncDirOption) (*clusteriface.SyncResult, error) {
+	var o clusteriface.SyncDirOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	remote, err := regularFiles(remoteDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("listing remote dir: %w", err)
+	}
+	local, err := regularFiles(localDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing local dir: %w", err)
+	}
+
+	result := &clusteriface.SyncResult{}
+	rels := make([]string, 0, len(local))
+	for rel := range local {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	for _, rel := range rels {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		localPath := filepath.Join(localDir, filepath.FromSlash(rel))
+		remotePath := filepath.Join(remoteDir, filepath.FromSlash(rel))
+		fi := local[rel]
+		unchanged, err := sameFile(localPath, fi, remotePath, remote[rel], o.Checksum)
+		if err != nil {
+			return nil, err
+		}
+		if unchanged {
+			result.Skipped = append(result.Skipped, rel)
+			continue
+		}
+		err = copyFileWithInfo(localPath, fi, remotePath)
+		if err != nil {
+			return nil, fmt.Errorf("transferring %q: %w", rel, err)
+		}
+		result.Transferred = append(result.Transferred, rel)
+	}
+
+	if o.Delete {
+		for rel := range remote {
+			if _, ok := local[rel]; ok {
+				continue
+			}
+			err := os.Remove(filepath.Join(remoteDir, filepath.FromSlash(rel)))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("deleting %q: %w", rel, err)
+			}
+			result.Deleted = append(result.Deleted, rel)
+		}
+		sort.Strings(result.Deleted)
+	}
+	return result, nil
+}
+
+// regularFiles returns the regular files in the directory tree, by their slash-separated paths relative to the directory.
+func regularFiles(dir string) (map[string]os.FileInfo, error) {
+	files := map[string]os.FileInfo{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(rel)] = fi
+		return nil
+	})
+	return files, err
+}
+
+// sameFile returns true if the remote file is considered unchanged from the local file,
+// because their sizes and modification times to the second are equal, or with checksum, their checksums.
+func sameFile(localPath string, local os.FileInfo, remotePath string, remote os.FileInfo, checksum bool) (bool, error) {
+	if remote == nil || remote.Size() != local.Size() {
+		return false, nil
+	}
+	if !checksum {
+		return remote.ModTime().Unix() == local.ModTime().Unix(), nil
+	}
+	localSum, err := clusteriface.FileChecksum(localPath, clusteriface.ChecksumSHA256)
+	if err != nil {
+		return false, err
+	}
+	remoteSum, err := clusteriface.FileChecksum(remotePath, clusteriface.ChecksumSHA256)
+	if err != nil {
+		return false, err
+	}
+	return localSum == remoteSum, nil
+}
+
+// copyFileWithInfo copies the file, setting the mode and modification time of the copy to those of the original.
+func copyFileWithInfo(src string, fi os.FileInfo, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
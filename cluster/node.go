@@ -1,50 +1,279 @@
 package cluster
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"strings"
 	"syscall"
+	"time"
 )
 
 type Process interface {
-	// Wait waits for the process to exit and returns its exit code.
+	// Wait waits for the process to exit and returns its exit status and resource usage.
 	Wait(context.Context) (*ProcessResult, error)
-	// Sends a signal to the process.
-	Signal(context.Context, syscall.Signal) error
+	// Signal sends a signal to the process, such as SIGHUP to make a server reload its config.
+	// Signals other than a syscall.Signal are not supported, and neither are signals that the node's OS doesn't support.
+	// An error wrapping ErrProcessExited is returned if the process has already exited.
+	Signal(context.Context, os.Signal) error
+	// PID returns the process ID of the process on the node, waiting for the process to start if necessary.
+	PID(context.Context) (int, error)
+	// Kill sends SIGKILL to the process and waits for it to be reaped, so that its resources, such as ports, are released.
+	// An error is returned if the process isn't confirmed to have exited before the context is done.
+	Kill(context.Context) error
+	// Stdout returns a reader of the process's stdout as it is produced, if StartProcRequest.StdoutPipe was set.
+	// Otherwise the reader is empty.
+	Stdout() io.Reader
+	// Stderr returns a reader of the process's stderr as it is produced, if StartProcRequest.StderrPipe was set.
+	// Otherwise the reader is empty. Reads of piped stdout and stderr return io.EOF once all of the output has been read,
+	// or the error if the connection to the node fails before then.
+	Stderr() io.Reader
+	// Stdin returns a writer to the process's stdin, if StartProcRequest.StdinPipe was set, which must be closed to close stdin.
+	// Otherwise writes fail.
+	Stdin() io.WriteCloser
 }
 
 type ProcessResult struct {
 	ExitCode int
 	TimeMS   int64
+	// StdoutDroppedBytes and StderrDroppedBytes are the number of output bytes dropped because the output buffer was full.
+	// See StartProcRequest.OutputBufferSize.
+	StdoutDroppedBytes int64
+	StderrDroppedBytes int64
+	// Signaled is true if the process was terminated by a signal, such as SIGKILL from the OOM killer or SIGSEGV.
+	// In that case Signal is the signal that terminated it, and ExitCode is -1.
+	Signaled bool
+	Signal   syscall.Signal
+	// Usage is the resources used by the process, which is reported the same way whether the process was run to completion or started.
+	Usage ResourceUsage
+	// StdoutBytes and StderrBytes are the number of bytes the process wrote to stdout and stderr,
+	// which are counted even if the output is discarded or written to a file on the node.
+	// If Stdout and Stderr are the same writer, the output of both is counted in StdoutBytes.
+	// StdinBytes is the number of bytes from Stdin, StdinBytes, StdinString, StdinFunc, or StdinPipe written to the process's stdin.
+	// Implementations that don't count bytes report zero, and the local node doesn't count a Stdin that is an *os.File.
+	StdoutBytes int64
+	StderrBytes int64
+	StdinBytes  int64
+	// MaxRuntimeExceeded is true if the node killed the process because it ran longer than the node's cap on process runtime,
+	// which applies regardless of StartProcRequest.Timeout. The process is killed with SIGKILL, so Signaled is also true.
+	MaxRuntimeExceeded bool
+	// Reason is why the process ended, such as ExitReasonTimeout, to tell apart the ways a process can fail.
+	// It's empty if the process exited on its own, and implementations that don't report reasons leave it empty.
+	Reason ExitReason
+}
+
+// ResourceUsage is the resources used by a process, as reported by the OS when it exits.
+// Fields that the OS of the node doesn't report are zero.
+type ResourceUsage struct {
+	// UserTime and SystemTime are the CPU time spent in user and kernel mode.
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// MaxRSSBytes is the peak resident set size.
+	MaxRSSBytes int64
+}
+
+// ProcessUsage returns the resource usage of an exited process, for implementations of Process.
+func ProcessUsage(state *os.ProcessState) ResourceUsage {
+	if state == nil {
+		return ResourceUsage{}
+	}
+	return ResourceUsage{
+		UserTime:    state.UserTime(),
+		SystemTime:  state.SystemTime(),
+		MaxRSSBytes: maxRSSBytes(state),
+	}
 }
 
 type StartProcRequest struct {
 	Command string
 	Args    []string
 	// Env is the environment variables of the process, in the form "k=v".
-	// If unspecified, the environment variables to use are implementation-defined.
+	// By default they are added to the environment of the node's agent, which the process otherwise inherits,
+	// with these taking precedence.
+	// If a variable is defined multiple times, the last definition wins, as with os/exec,
+	// so the order matters. Use EnvFromMap to build it deterministically from a map.
 	Env []string
+	// CleanEnv runs the process with only the variables in Env, instead of adding them to the agent's environment,
+	// such as for tests that depend on PATH or the locale to be deterministic.
+	// Note that without PATH, the command must be found by the agent, which uses its own PATH.
+	CleanEnv bool
 	// WD is the working directory of the process.
 	// If unspecified, this is implementation-defined.
 	WD string
+	// ExpandEnv enables expansion of $VAR and ${VAR} references in Command and Args, using the environment of the process on the node.
+	// This is literal variable substitution, not shell parsing, so there is no quoting, escaping, or default values,
+	// and undefined variables are replaced with the empty string.
+	ExpandEnv bool
 
 	// Stdin is a reader which, when specified, is sent to the process's stdin.
 	Stdin io.Reader
+	// StdinBytes and StdinString are conveniences for sending fixed input to the process's stdin.
+	// Stdin is closed after the input is consumed. Only one of Stdin, StdinBytes, StdinString, and StdinFunc may be specified.
+	StdinBytes  []byte
+	StdinString string
+	// StdinFunc generates the process's stdin programmatically, such as input that depends on timing.
+	// It's called for each chunk of stdin until it returns true for done, after which stdin is closed.
+	// The chunk returned with done is still sent. It's called from a single goroutine, and not after the context passed to StartProc is done.
+	StdinFunc func() (chunk []byte, done bool)
+	// StdinPipe makes the process's stdin available to write to with Process.Stdin while the process runs,
+	// such as for interactive processes whose input depends on their output. It can't be used with the other stdin fields.
+	StdinPipe bool
 	// StdinFile is a server-side file which should be read into stdin. If specified, Stdin is ignored.
 	StdinFile string
+	// StdinChunkSize is the maximum number of bytes read from Stdin and sent to the node at a time.
+	// If unspecified, this is implementation-defined.
+	StdinChunkSize int
+	// StdinWindow is the maximum number of stdin bytes sent to the node that the process hasn't consumed yet,
+	// after which reading from Stdin pauses until the process catches up.
+	// If unspecified, this is implementation-defined.
+	StdinWindow int
 
 	// Stdout is a writer which, when specified, receives the stdout of the process.
 	Stdout io.Writer
 	// StdoutFile is a server-side file to which stdout should be written. If specified, Stdout is ignored.
 	StdoutFile string
+	// StdoutPipe makes stdout available to read from Process.Stdout while the process runs, and can't be used with Stdout.
+	// The reader must be read to EOF, otherwise the process blocks writing to stdout, unless OutputBufferSize is set.
+	// No output is lost before the reader is first read, so output written as soon as the process starts,
+	// such as a "ready" line, can be read any time after StartProc returns. With OutputBufferSize it can instead be dropped
+	// if more than the buffer size is written before it is read.
+	StdoutPipe bool
 
 	// Stderr is a writer which, when specified, receives the stderr of the process.
 	Stderr io.Writer
 	// StderrFile is a server-side file to which stderr should be written. If specified, Stderr is ignored.
 	StderrFile string
+	// StderrPipe makes stderr available to read from Process.Stderr while the process runs, and can't be used with Stderr.
+	// The reader must be read to EOF, otherwise the process blocks writing to stderr, unless OutputBufferSize is set.
+	StderrPipe bool
+
+	// OutputBufferSize, if greater than zero, is the size of a bounded buffer for each of stdout and stderr, on the node.
+	// Normally a process blocks writing output until the output is received, so a slow reader stalls the process.
+	// With a buffer, the process can keep running while the output is received, and when the buffer is full
+	// the oldest buffered bytes are dropped. Dropped bytes are counted in the ProcessResult.
+	// This trades completeness of output for liveness of the process.
+	OutputBufferSize int
+
+	// Timeout, if greater than zero, is how long the process may run before the node stops it with StopSignal.
+	Timeout time.Duration
+	// StopSignal is the signal used to stop the process when Timeout elapses, or when the process is abandoned,
+	// such as when the context passed to StartProc is canceled (default SIGKILL).
+	// If the process is still running KillGracePeriod after the stop signal, it is killed.
+	// If a stop signal is set and KillGracePeriod isn't, it defaults to DefaultKillGracePeriod.
+	StopSignal      syscall.Signal
+	KillGracePeriod time.Duration
+	// CancelPolicy, if set, is how the node stops the process when it is abandoned, instead of StopSignal and KillGracePeriod,
+	// such as to send SIGINT, then SIGTERM, and then kill the process. It doesn't apply when Timeout elapses.
+	CancelPolicy *CancelPolicy
+	// Credential, if set, runs the process as the given user and group, which usually requires privileges on the node.
+	// This is not supported on Windows nodes.
+	Credential *Credential
+	// CgroupPath, if set, is an existing cgroup v2 directory on the node, such as "/sys/fs/cgroup/test",
+	// into which the process is moved once it starts, so that the limits of the cgroup such as memory.max and cpu.max apply to it.
+	// Children forked by the process before it is moved are not in the cgroup. This is only supported on Linux nodes.
+	CgroupPath string
+
+	// HideEnv is the names of env vars in Env which are omitted when the node reports how it started the process,
+	// such as secrets. See agent.StartInfo.
+	HideEnv []string
+}
+
+// CancelPolicy is a sequence of signals sent to stop an abandoned process, such as when the context passed to StartProc
+// is canceled or the connection to the node is lost, like process supervisors use to shut down their children cleanly.
+// Each step's signal is sent in turn, moving on to the next step if the process is still running after the step's grace period,
+// and the process is killed if it's still running after the last step.
+type CancelPolicy struct {
+	Steps []CancelStep
+}
+
+// CancelStep is a step of a CancelPolicy.
+type CancelStep struct {
+	// Signal is the signal to send. SIGKILL or zero kills the process, ending the policy.
+	Signal syscall.Signal
+	// Grace is how long to wait for the process to exit before the next step.
+	Grace time.Duration
+}
+
+// Credential is the user and group to run a process as.
+type Credential struct {
+	UID uint32
+	GID uint32
 }
 
+// StdinReader returns the reader for the process's stdin from whichever of Stdin, StdinBytes, or StdinString is specified,
+// or nil if none are. It is an error to specify more than one.
+func (r StartProcRequest) StdinReader() (io.Reader, error) {
+	return r.StdinReaderContext(context.Background())
+}
+
+// StdinReaderContext is like StdinReader, but the reader of StdinFunc stops generating stdin once the context is done.
+func (r StartProcRequest) StdinReaderContext(ctx context.Context) (io.Reader, error) {
+	n := 0
+	var reader io.Reader
+	if r.Stdin != nil {
+		n++
+		reader = r.Stdin
+	}
+	if r.StdinBytes != nil {
+		n++
+		reader = bytes.NewReader(r.StdinBytes)
+	}
+	if r.StdinString != "" {
+		n++
+		reader = strings.NewReader(r.StdinString)
+	}
+	if r.StdinFunc != nil {
+		n++
+		reader = &funcReader{ctx: ctx, f: r.StdinFunc}
+	}
+	if n > 1 {
+		return nil, errors.New("only one of Stdin, StdinBytes, StdinString, and StdinFunc may be specified")
+	}
+	return reader, nil
+}
+
+// funcReader reads the chunks generated by a StdinFunc.
+type funcReader struct {
+	ctx     context.Context
+	f       func() ([]byte, bool)
+	pending []byte
+	done    bool
+}
+
+func (r *funcReader) Read(b []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.ctx.Err(); err != nil {
+			return 0, err
+		}
+		r.pending, r.done = r.f()
+	}
+	n := copy(b, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// DefaultKillGracePeriod is how long a process has to exit after its StopSignal before it is killed,
+// when StartProcRequest.KillGracePeriod isn't set.
+const DefaultKillGracePeriod = 10 * time.Second
+
+// ErrProcessExited is returned when signaling a process that has already exited.
+var ErrProcessExited = errors.New("process has exited")
+
+// ErrStdinNotPiped is returned when writing to the stdin of a process whose stdin is not piped.
+var ErrStdinNotPiped = errors.New("stdin is not piped, see StartProcRequest.StdinPipe")
+
+// NotPipedStdin is the stdin writer of processes whose stdin is not piped, which fails writes with ErrStdinNotPiped.
+type NotPipedStdin struct{}
+
+func (NotPipedStdin) Write([]byte) (int, error) { return 0, ErrStdinNotPiped }
+func (NotPipedStdin) Close() error              { return nil }
+
 // Node is generally a host or container, and is a member of a cluster.
 // The implementation defines how to coordinate the node.
 type Node interface {
@@ -62,4 +291,130 @@ type Fetcher interface {
 	Fetch(ctx context.Context, url, path string) error
 }
 
+// An optional node interface for nodes that report their operating system.
+type OSer interface {
+	// OS returns the operating system of the node, as a GOOS value such as "linux" or "windows".
+	OS(ctx context.Context) (string, error)
+}
+
+// ErrNotSupported is returned when using an optional node interface, such as LocalFileSender, with a node that doesn't implement it.
+var ErrNotSupported = errors.New("not supported by the node")
+
+// An optional node interface for uploading local files by path.
+type LocalFileSender interface {
+	// SendLocalFile uploads the local file at localPath to remotePath on the node, returning the number of bytes sent.
+	SendLocalFile(ctx context.Context, localPath, remotePath string, opts ...SendLocalFileOption) (int64, error)
+}
+
+// An optional node interface for downloading files from the node to local paths.
+type FileDownloader interface {
+	// DownloadFile downloads the file at remotePath on the node to localPath, returning the number of bytes written.
+	// localPath is either left untouched or replaced atomically.
+	DownloadFile(ctx context.Context, remotePath, localPath string, opts ...DownloadFileOption) (int64, error)
+}
+
+// An optional node interface for syncing local directories to the node.
+type DirSyncer interface {
+	// SyncDir makes the remote directory contain the regular files of the local directory, like rsync,
+	// transferring only the files that are new or changed.
+	SyncDir(ctx context.Context, localDir, remoteDir string, opts ...SyncDirOption) (*SyncResult, error)
+}
+
+// An optional node interface for creating scratch directories on the node.
+type TempDirer interface {
+	// TempDir creates a new, unique directory on the node whose name starts with prefix,
+	// and returns its path and a func to remove it and its contents, which can be called any number of times.
+	TempDir(ctx context.Context, prefix string) (string, func(ctx context.Context) error, error)
+}
+
+// An optional node interface for removing directory trees on the node.
+type AllRemover interface {
+	// RemoveAll removes the path on the node and any children it contains. A path that doesn't exist is not an error.
+	RemoveAll(ctx context.Context, path string) error
+}
+
+// An optional node interface for removing the paths on the node that match a pattern.
+type GlobRemover interface {
+	// RemoveGlob removes the paths on the node matching the pattern, such as "/tmp/test-*", and any children they contain.
+	// The pattern must be absolute, and has the syntax of filepath.Match.
+	// Removal continues past paths that can't be removed, in which case the returned error is a *RemoveGlobError
+	// listing them, along with the paths that were removed. A pattern that matches nothing is not an error.
+	RemoveGlob(ctx context.Context, pattern string) ([]string, error)
+}
+
+// An optional node interface for nodes that report the environment that processes inherit.
+type Environer interface {
+	// Environ returns the environment in "k=v" form that processes on the node inherit, with the values of env vars
+	// whose keys match any of the redact patterns, in path.Match syntax such as "AWS_*", replaced with RedactedValue.
+	Environ(ctx context.Context, redact ...string) ([]string, error)
+}
+
+// An optional node interface for computing checksums of files on the node.
+type Checksummer interface {
+	// Checksum returns the hex-encoded checksum of the file on the node, computed by the node, such as to verify a transfer.
+	// See FileChecksum to compute the checksum of a local file.
+	Checksum(ctx context.Context, path string, algo ChecksumAlgorithm) (string, error)
+}
+
+// An optional node interface for measuring the round-trip time to the node.
+type Pinger interface {
+	// Ping sends a minimal request to the node and returns its round-trip time, such as to assert network conditions between nodes.
+	Ping(ctx context.Context) (time.Duration, error)
+}
+
+// An optional node interface for dialing addresses that aren't listening yet.
+type WaitDialer interface {
+	// DialWait is like Dial, but retries until the address accepts the connection or the context is done,
+	// such as to wait for a server process that was just started on the node to start listening.
+	DialWait(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// An optional node interface for collecting files from the node for debugging, such as logs.
+type DiagnosticsCollector interface {
+	// CollectDiagnostics returns a tar stream of the node's diagnostics files and the given absolute paths,
+	// which the caller must close. Entries are named by their absolute paths without the leading slash.
+	CollectDiagnostics(ctx context.Context, paths ...string) (io.ReadCloser, error)
+}
+
+// An optional node interface for uploading in-memory data to the node.
+type BytesSender interface {
+	// SendBytes writes the data to the file on the node, such as a config file.
+	// Unlike SendFile, the length of the data is known up front, so the node verifies that it received all of it.
+	SendBytes(ctx context.Context, filePath string, data []byte, opts ...SendOption) error
+}
+
+// NodeStats is the current load of a node, such as for placing processes on the least-loaded node of a cluster.
+// The system stats are only collected on Linux, they are zero on other platforms.
+type NodeStats struct {
+	// RunningProcesses is the number of processes currently run by the node.
+	RunningProcesses int
+	// NumCPU is the number of logical CPUs of the node.
+	NumCPU int
+	// LoadAverage1 is the 1-minute load average of the node, which can be compared with NumCPU.
+	LoadAverage1      float64
+	MemTotalBytes     uint64
+	MemAvailableBytes uint64
+	// DiskTotalBytes and DiskAvailableBytes are for the filesystem of the working directory of the node's agent,
+	// which is where processes run by default.
+	DiskTotalBytes     uint64
+	DiskAvailableBytes uint64
+	// SampledAt is when the system stats were sampled.
+	SampledAt time.Time
+}
+
+// An optional node interface for nodes that report their load.
+type StatsReporter interface {
+	// Stats returns the current load of the node.
+	Stats(ctx context.Context) (NodeStats, error)
+}
+
+// ShellRequest returns a request that runs the script with the shell of the given operating system,
+// which is cmd on Windows and sh elsewhere.
+func ShellRequest(goos, script string) StartProcRequest {
+	if goos == "windows" {
+		return StartProcRequest{Command: "cmd", Args: []string{"/C", script}}
+	}
+	return StartProcRequest{Command: "sh", Args: []string{"-c", script}}
+}
+
 type Nodes []Node
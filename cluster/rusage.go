@@ -0,0 +1,21 @@
+//go:build !windows
+
+package cluster
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+)
+
+func maxRSSBytes(state *os.ProcessState) int64 {
+	rusage, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return 0
+	}
+	// macOS reports the max RSS in bytes, other unixes in kilobytes
+	if runtime.GOOS == "darwin" {
+		return int64(rusage.Maxrss)
+	}
+	return int64(rusage.Maxrss) * 1024
+}
@@ -0,0 +1,7 @@
+package cluster
+
+import "os"
+
+func maxRSSBytes(state *os.ProcessState) int64 {
+	return 0
+}
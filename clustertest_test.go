@@ -1,11 +1,20 @@
 package clustertest
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"net"
+	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/guseggert/clustertest/cluster"
 	"github.com/guseggert/clustertest/cluster/basic"
@@ -13,6 +22,7 @@ import (
 	"github.com/guseggert/clustertest/cluster/local"
 	"github.com/guseggert/clustertest/internal/test"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -28,6 +38,7 @@ func TestStdoutFile(t *testing.T) {
 			t.Cleanup(c.MustCleanup)
 
 			nodes := c.MustNewNodes(1)
+			assert.Len(t, c.Nodes(), 1)
 
 			// In parallel, write a test file on each node and "cat" its contents back.
 			group, groupCtx := errgroup.WithContext(context.Background())
@@ -75,3 +86,530 @@ func TestStdoutFile(t *testing.T) {
 	run(t, "local cluster", local.NewCluster(), false)
 	run(t, "Docker cluster", docker.MustNewCluster(), true)
 }
+
+func newLocalNodes(t *testing.T, n int) []*basic.Node {
+	c := basic.New(local.NewCluster())
+	t.Cleanup(c.MustCleanup)
+	return c.MustNewNodes(n)
+}
+
+func TestRunEach(t *testing.T) {
+	ctx := context.Background()
+	nodes := newLocalNodes(t, 3)
+
+	t.Run("results are ordered like the nodes", func(t *testing.T) {
+		// the nodes finish in the reverse order
+		stdouts := make([]bytes.Buffer, len(nodes))
+		results, errs := basic.RunEach(ctx, nodes, func(i int, n *basic.Node) cluster.StartProcRequest {
+			return cluster.StartProcRequest{
+				Command: "sh",
+				Args:    []string{"-c", fmt.Sprintf("sleep 0.%d; echo %d", len(nodes)-i, i)},
+				Stdout:  &stdouts[i],
+			}
+		})
+		require.Len(t, results, len(nodes))
+		for i := range nodes {
+			assert.NoError(t, errs[i])
+			assert.Equal(t, 0, results[i].ExitCode)
+			assert.Equal(t, fmt.Sprintf("%d\n", i), stdouts[i].String())
+		}
+	})
+
+	t.Run("fail fast cancels the rest", func(t *testing.T) {
+		start := time.Now()
+		_, errs := basic.RunEach(ctx, nodes, func(i int, n *basic.Node) cluster.StartProcRequest {
+			if i == 0 {
+				return cluster.StartProcRequest{Command: "false"}
+			}
+			return cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}}
+		}, basic.RunEachFailFast())
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.ErrorContains(t, errs[0], "non-zero exit code 1")
+		for _, err := range errs[1:] {
+			assert.ErrorIs(t, err, context.Canceled)
+		}
+	})
+
+	t.Run("concurrency is bounded", func(t *testing.T) {
+		// each process records how many are running when it starts
+		dir := t.TempDir()
+		nodes := newLocalNodes(t, 4)
+		start := time.Now()
+		_, errs := basic.RunEach(ctx, nodes, func(i int, n *basic.Node) cluster.StartProcRequest {
+			return cluster.StartProcRequest{
+				Command: "sh",
+				Args: []string{"-c", fmt.Sprintf(
+					`touch %[1]s/running.%[2]d; ls %[1]s | grep -c running > %[1]s/count.%[2]d; sleep 0.3; rm %[1]s/running.%[2]d`,
+					dir, i,
+				)},
+			}
+		}, basic.RunEachConcurrency(2))
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+		// 4 processes 2 at a time take 2 rounds
+		assert.GreaterOrEqual(t, time.Since(start), 600*time.Millisecond)
+		for i := range nodes {
+			b, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("count.%d", i)))
+			require.NoError(t, err)
+			count, err := strconv.Atoi(strings.TrimSpace(string(b)))
+			require.NoError(t, err)
+			assert.LessOrEqual(t, count, 2)
+		}
+	})
+}
+
+func TestRunAll(t *testing.T) {
+	ctx := context.Background()
+	nodes := newLocalNodes(t, 3)
+
+	t.Run("exit codes and output", func(t *testing.T) {
+		// each process claims a different exit code, so some fail
+		dir := t.TempDir()
+		results := basic.RunAll(ctx, nodes, cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", fmt.Sprintf(`for i in 0 1 2; do mkdir %s/$i 2>/dev/null && echo $i && echo stderr >&2 && exit $i; done`, dir)},
+		}, basic.RunEachCaptureOutput())
+		require.Len(t, results, len(nodes))
+
+		var codes []int
+		for i, res := range results {
+			assert.Equal(t, i, res.Index)
+			assert.Same(t, nodes[i], res.Node)
+			assert.Greater(t, res.Duration, time.Duration(0))
+			assert.Equal(t, fmt.Sprintf("%d\n", res.ExitCode), string(res.Stdout))
+			assert.Equal(t, "stderr\n", string(res.Stderr))
+			require.NotNil(t, res.Result)
+			assert.Equal(t, res.ExitCode, res.Result.ExitCode)
+			if res.ExitCode == 0 {
+				assert.NoError(t, res.Err)
+			} else {
+				assert.ErrorContains(t, res.Err, fmt.Sprintf("non-zero exit code %d", res.ExitCode))
+			}
+			codes = append(codes, res.ExitCode)
+		}
+		assert.ElementsMatch(t, []int{0, 1, 2}, codes)
+	})
+
+	t.Run("process that can't start", func(t *testing.T) {
+		results := basic.RunAll(ctx, nodes, cluster.StartProcRequest{Command: "does-not-exist"})
+		for _, res := range results {
+			assert.Equal(t, -1, res.ExitCode)
+			assert.Error(t, res.Err)
+			assert.Nil(t, res.Result)
+		}
+	})
+}
+
+func TestRunJSONLines(t *testing.T) {
+	ctx := context.Background()
+	node := newLocalNodes(t, 1)[0]
+
+	type line struct{ N int }
+	collect := func(req cluster.StartProcRequest) ([]line, []error) {
+		valCh, errCh := basic.RunJSONLines[line](ctx, node, req)
+		var vals []line
+		var errs []error
+		for valCh != nil || errCh != nil {
+			select {
+			case v, ok := <-valCh:
+				if !ok {
+					valCh = nil
+					continue
+				}
+				vals = append(vals, v)
+			case err, ok := <-errCh:
+				if !ok {
+					errCh = nil
+					continue
+				}
+				errs = append(errs, err)
+			}
+		}
+		return vals, errs
+	}
+
+	t.Run("decoded lines", func(t *testing.T) {
+		vals, errs := collect(cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", `printf '{"N":1}\n\n{"N":2}\n{"N":3}'`},
+		})
+		assert.Empty(t, errs)
+		assert.Equal(t, []line{{N: 1}, {N: 2}, {N: 3}}, vals)
+	})
+
+	t.Run("malformed line", func(t *testing.T) {
+		vals, errs := collect(cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", `printf '{"N":1}\nnot json\n{"N":3}\n'`},
+		})
+		// the stream continues after the malformed line
+		assert.Equal(t, []line{{N: 1}, {N: 3}}, vals)
+		require.Len(t, errs, 1)
+		assert.ErrorContains(t, errs[0], "decoding line 2")
+	})
+
+	t.Run("non-zero exit", func(t *testing.T) {
+		vals, errs := collect(cluster.StartProcRequest{
+			Command: "sh",
+			Args:    []string{"-c", `printf '{"N":1}\n'; exit 3`},
+		})
+		assert.Equal(t, []line{{N: 1}}, vals)
+		require.Len(t, errs, 1)
+		assert.ErrorContains(t, errs[0], "non-zero exit code 3")
+	})
+}
+
+// minimalNode hides the optional interfaces of the node it wraps.
+type minimalNode struct{ cluster.Node }
+
+func TestSendLocalFile(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	dir := t.TempDir()
+	localPath := filepath.Join(dir, "local")
+	require.NoError(t, os.WriteFile(localPath, []byte("hello"), 0640))
+	remotePath := filepath.Join(dir, "remote", "file")
+
+	n, err := node.SendLocalFile(localPath, remotePath, cluster.PreserveMode())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	b, err := os.ReadFile(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	info, err := os.Stat(remotePath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	minimal := &basic.Node{Node: minimalNode{node.Node}, Ctx: node.Ctx}
+	_, err = minimal.SendLocalFile(localPath, remotePath)
+	assert.ErrorIs(t, err, cluster.ErrNotSupported)
+}
+
+func TestDownloadFile(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	dir := t.TempDir()
+	remotePath := filepath.Join(dir, "remote")
+	require.NoError(t, os.WriteFile(remotePath, []byte("hello"), 0640))
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, os.Chtimes(remotePath, modTime, modTime))
+	localPath := filepath.Join(dir, "local")
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	n, err := node.DownloadFile(remotePath, localPath, cluster.PreserveRemoteMode(), cluster.PreserveRemoteModTime(), cluster.VerifySHA256(sum))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+	b, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	info, err := os.Stat(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	assert.True(t, modTime.Equal(info.ModTime()))
+
+	// a mismatched checksum leaves the local file untouched
+	require.NoError(t, os.WriteFile(remotePath, []byte("changed"), 0640))
+	_, err = node.DownloadFile(remotePath, localPath, cluster.VerifySHA256(sum))
+	assert.ErrorContains(t, err, "checksum mismatch")
+	b, err = os.ReadFile(localPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestSyncDir(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(t.TempDir(), "remote")
+	write := func(dir, name, contents string) {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(contents), 0644))
+	}
+	write(localDir, "a", "a")
+	write(localDir, "sub/b", "b")
+
+	res, err := node.SyncDir(localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "sub/b"}, res.Transferred)
+	assert.Empty(t, res.Skipped)
+	b, err := os.ReadFile(filepath.Join(remoteDir, "sub", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(b))
+
+	// only the changed file is transferred, and the remote-only file is deleted
+	write(localDir, "a", "A2")
+	write(remoteDir, "extra", "extra")
+	res, err = node.SyncDir(localDir, remoteDir, cluster.SyncDelete())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+	assert.Equal(t, []string{"sub/b"}, res.Skipped)
+	assert.Equal(t, []string{"extra"}, res.Deleted)
+	assert.NoFileExists(t, filepath.Join(remoteDir, "extra"))
+
+	// a change that preserves the size and modification time is only detected with checksums
+	info, err := os.Stat(filepath.Join(localDir, "a"))
+	require.NoError(t, err)
+	write(localDir, "a", "A3")
+	require.NoError(t, os.Chtimes(filepath.Join(localDir, "a"), info.ModTime(), info.ModTime()))
+	res, err = node.SyncDir(localDir, remoteDir)
+	require.NoError(t, err)
+	assert.Empty(t, res.Transferred)
+	res, err = node.SyncDir(localDir, remoteDir, cluster.SyncChecksum())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, res.Transferred)
+}
+
+func TestTempDir(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+
+	dir, cleanup, err := node.TempDir("clustertest-")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(filepath.Base(dir), "clustertest-"))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0644))
+
+	require.NoError(t, cleanup(context.Background()))
+	assert.NoDirExists(t, dir)
+	// later calls do nothing
+	require.NoError(t, cleanup(context.Background()))
+
+	dir = t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	require.NoError(t, node.RemoveAll(filepath.Join(dir, "a")))
+	assert.NoDirExists(t, filepath.Join(dir, "a"))
+	require.NoError(t, node.RemoveAll(filepath.Join(dir, "missing")))
+}
+
+func TestEnviron(t *testing.T) {
+	t.Setenv("CLUSTERTEST_GREETING", "hello")
+	t.Setenv("CLUSTERTEST_SECRET_TOKEN", "hunter2")
+	node := newLocalNodes(t, 1)[0]
+
+	env, err := node.Environ("CLUSTERTEST_SECRET_*")
+	require.NoError(t, err)
+	assert.Contains(t, env, "CLUSTERTEST_GREETING=hello")
+	assert.Contains(t, env, "CLUSTERTEST_SECRET_TOKEN="+cluster.RedactedValue)
+
+	_, err = node.Environ("[")
+	assert.ErrorContains(t, err, "invalid pattern")
+}
+
+func TestChecksum(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("hello"), 0644))
+
+	sum, err := node.Checksum(path, cluster.ChecksumSHA256)
+	require.NoError(t, err)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", sum)
+	sum, err = node.Checksum(path, cluster.ChecksumCRC32C)
+	require.NoError(t, err)
+	assert.Equal(t, "9a71bb4c", sum)
+
+	_, err = node.Checksum(path, "md5")
+	assert.ErrorContains(t, err, "unsupported checksum algorithm")
+}
+
+func TestPing(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	rtt, err := node.Ping()
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), rtt)
+
+	minimal := &basic.Node{Node: minimalNode{node.Node}, Ctx: node.Ctx}
+	_, err = minimal.Ping()
+	assert.ErrorIs(t, err, cluster.ErrNotSupported)
+}
+
+func TestDialWait(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+
+	// reserve a port, and start listening on it after the first dials fail
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { l.Close() })
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := node.Context(ctx).DialWait("tcp", addr)
+	require.NoError(t, err)
+	conn.Close()
+
+	// an invalid address isn't retried
+	_, err = node.Context(ctx).DialWait("tcp", "127.0.0.1:notaport")
+	require.Error(t, err)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	nodes := newLocalNodes(t, 2)
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "logs", "app.log")
+	require.NoError(t, os.MkdirAll(filepath.Dir(logPath), 0755))
+	require.NoError(t, os.WriteFile(logPath, []byte("log line\n"), 0644))
+	missingPath := filepath.Join(dir, "missing.log")
+
+	// each node writes a bundle with the files and the paths that couldn't be collected
+	outDir := filepath.Join(dir, "out")
+	require.NoError(t, basic.CollectDiagnostics(context.Background(), outDir, nodes, filepath.Join(dir, "logs"), missingPath))
+	for i := range nodes {
+		f, err := os.Open(filepath.Join(outDir, fmt.Sprintf("node-%d.tar", i)))
+		require.NoError(t, err)
+		files := map[string]string{}
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			b, err := io.ReadAll(tr)
+			require.NoError(t, err)
+			files[hdr.Name] = string(b)
+		}
+		f.Close()
+		assert.Equal(t, "log line\n", files[strings.TrimPrefix(filepath.ToSlash(logPath), "/")])
+		assert.Contains(t, files["diagnostics-errors.txt"], missingPath)
+	}
+
+	_, err := nodes[0].CollectDiagnostics("relative/path")
+	assert.ErrorContains(t, err, "not absolute")
+}
+
+func TestSendBytes(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	path := filepath.Join(t.TempDir(), "sub", "config")
+
+	err := node.SendBytes(path, []byte("hello"), cluster.SendMode(0600), cluster.SendChecksum(cluster.ChecksumSHA256), cluster.SendCompressed())
+	require.NoError(t, err)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	err = node.SendBytes(path, []byte("hello"), cluster.SendChecksum("md5"))
+	assert.ErrorContains(t, err, "unsupported checksum algorithm")
+}
+
+func TestStats(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	stats, err := node.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.RunningProcesses)
+	assert.Equal(t, runtime.NumCPU(), stats.NumCPU)
+	assert.False(t, stats.SampledAt.IsZero())
+
+	proc := node.MustStartProc(cluster.StartProcRequest{Command: "sleep", Args: []string{"10"}})
+	stats = node.MustStats()
+	assert.Equal(t, 1, stats.RunningProcesses)
+	proc.MustSignal(syscall.SIGKILL)
+	_, _ = proc.Wait()
+	stats = node.MustStats()
+	assert.Equal(t, 0, stats.RunningProcesses)
+
+	minimal := &basic.Node{Node: minimalNode{node.Node}, Ctx: node.Ctx}
+	_, err = minimal.Stats()
+	assert.ErrorIs(t, err, cluster.ErrNotSupported)
+}
+
+func TestRemoveGlob(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "test-a", "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "test-b"), []byte("b"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keep"), []byte("keep"), 0644))
+
+	removed := node.MustRemoveGlob(filepath.Join(dir, "test-*"))
+	assert.ElementsMatch(t, []string{filepath.Join(dir, "test-a"), filepath.Join(dir, "test-b")}, removed)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "keep", entries[0].Name())
+
+	removed = node.MustRemoveGlob(filepath.Join(dir, "nothing-*"))
+	assert.Empty(t, removed)
+
+	_, err = node.RemoveGlob("test-*")
+	assert.Error(t, err)
+
+	minimal := &basic.Node{Node: minimalNode{node.Node}, Ctx: node.Ctx}
+	_, err = minimal.RemoveGlob(filepath.Join(dir, "*"))
+	assert.ErrorIs(t, err, cluster.ErrNotSupported)
+}
+
+func TestStreamByteCounts(t *testing.T) {
+	node := newLocalNodes(t, 1)[0]
+
+	// output is counted even though it's discarded
+	res := node.MustRun(cluster.StartProcRequest{
+		Command:     "sh",
+		Args:        []string{"-c", "cat >/dev/null; head -c 100000 /dev/zero; printf err >&2"},
+		StdinString: "hello",
+	})
+	assert.Equal(t, int64(100000), res.StdoutBytes)
+	assert.Equal(t, int64(3), res.StderrBytes)
+	assert.Equal(t, int64(5), res.StdinBytes)
+
+	// a writer shared by stdout and stderr still gets both streams in order, and is counted as stdout
+	out := &bytes.Buffer{}
+	res = node.MustRun(cluster.StartProcRequest{
+		Command: "sh",
+		Args:    []string{"-c", "printf out; printf err >&2; printf out"},
+		Stdout:  out,
+		Stderr:  out,
+	})
+	assert.Equal(t, "outerrout", out.String())
+	assert.Equal(t, int64(9), res.StdoutBytes)
+	assert.Equal(t, int64(0), res.StderrBytes)
+
+	stdoutFile := filepath.Join(t.TempDir(), "stdout")
+	proc := node.MustStartProc(cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", "cat; printf err >&2"},
+		StdoutFile: stdoutFile,
+		StdinPipe:  true,
+	})
+	_, err := io.WriteString(proc.Process.Stdin(), "hello")
+	require.NoError(t, err)
+	require.NoError(t, proc.Process.Stdin().Close())
+	res = proc.MustWait()
+	assert.Equal(t, int64(5), res.StdoutBytes)
+	assert.Equal(t, int64(3), res.StderrBytes)
+	assert.Equal(t, int64(5), res.StdinBytes)
+}
+
+func TestExitReasonOOM(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are only supported on Linux")
+	}
+	node := newLocalNodes(t, 1)[0]
+
+	// a directory standing in for the cgroup, whose OOM kill count the process bumps before killing itself like the OOM killer would,
+	// after a delay so that the count is read before the process bumps it
+	cgroupPath := t.TempDir()
+	events := filepath.Join(cgroupPath, "memory.events")
+	require.NoError(t, os.WriteFile(events, []byte("oom 0\noom_kill 0\n"), 0644))
+	proc := node.MustStartProc(cluster.StartProcRequest{
+		Command:    "sh",
+		Args:       []string{"-c", fmt.Sprintf(`sleep 0.2; printf 'oom 1\noom_kill 1\n' > %s; kill -9 $$`, events)},
+		CgroupPath: cgroupPath,
+	})
+	res := proc.MustWait()
+	assert.Equal(t, cluster.ExitReasonOOM, res.Reason)
+}
@@ -13,6 +13,9 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
+// certEnvVars are the env vars that the certs can be passed in, instead of flags, which other users can see.
+var certEnvVars = []string{"NODEAGENT_CA_CERT_PEM", "NODEAGENT_CERT_PEM", "NODEAGENT_KEY_PEM"}
+
 func main() {
 	app := &cli.App{
 		Name:  "nodeagent",
@@ -33,20 +36,38 @@ func main() {
 				Usage: "The address for the HTTP server to listen on.",
 				Value: "0.0.0.0:8080",
 			},
+			&cli.IntFlag{
+				Name:  "max-processes",
+				Usage: "The maximum number of processes to run concurrently, or 0 for no limit.",
+				Value: 0,
+			},
+			&cli.DurationFlag{
+				Name:  "max-process-runtime",
+				Usage: "The maximum time any process may run before it's killed, regardless of its requested timeout, or 0 for no limit.",
+				Value: 0,
+			},
 			&cli.StringFlag{
-				Name:     "ca-cert-pem",
-				Usage:    "The CA cert PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:    "ca-cert-pem",
+				Usage:   "The CA cert PEM bytes to use (base64-encoded). Required unless --insecure-no-tls is set.",
+				EnvVars: []string{"NODEAGENT_CA_CERT_PEM"},
 			},
 			&cli.StringFlag{
-				Name:     "cert-pem",
-				Usage:    "The cert PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:    "cert-pem",
+				Usage:   "The cert PEM bytes to use (base64-encoded). Required unless --insecure-no-tls is set.",
+				EnvVars: []string{"NODEAGENT_CERT_PEM"},
 			},
 			&cli.StringFlag{
-				Name:     "key-pem",
-				Usage:    "The key PEM bytes to use (base64-encoded).",
-				Required: true,
+				Name:    "key-pem",
+				Usage:   "The key PEM bytes to use (base64-encoded). Required unless --insecure-no-tls is set.",
+				EnvVars: []string{"NODEAGENT_KEY_PEM"},
+			},
+			&cli.StringSliceFlag{
+				Name:  "diagnostics-path",
+				Usage: "A file or directory to include in diagnostics bundles, such as the agent's log file. May be repeated.",
+			},
+			&cli.BoolFlag{
+				Name:  "insecure-no-tls",
+				Usage: "Serve plain HTTP without mTLS, which disables encryption and authz. Only use this on a fully trusted network.",
 			},
 		},
 		Action: func(ctx *cli.Context) error {
@@ -56,6 +77,15 @@ func main() {
 			caCertPEMEncoded := ctx.String("ca-cert-pem")
 			certPEMEncoded := ctx.String("cert-pem")
 			keyPEMEncoded := ctx.String("key-pem")
+			insecureNoTLS := ctx.Bool("insecure-no-tls")
+			// processes run by the agent inherit its environment, so they mustn't inherit the certs
+			for _, k := range certEnvVars {
+				os.Unsetenv(k)
+			}
+
+			if !insecureNoTLS && (caCertPEMEncoded == "" || certPEMEncoded == "" || keyPEMEncoded == "") {
+				return fmt.Errorf("--ca-cert-pem, --cert-pem, and --key-pem are required unless --insecure-no-tls is set")
+			}
 
 			caCertPEMBytes, err := base64.StdEncoding.DecodeString(caCertPEMEncoded)
 			if err != nil {
@@ -87,14 +117,24 @@ func main() {
 				return fmt.Errorf("parsing heartbeat timeout: %w", err)
 			}
 
-			agent, err := agent.NewNodeAgent(
-				caCertPEMBytes,
-				certPEMBytes,
-				keyPEMBytes,
+			opts := []agent.Option{
 				agent.WithLogLevel(zapcore.DebugLevel),
 				agent.WithHeartbeatTimeout(heartbeatTimeout),
 				agent.WithListenAddr(listenAddr),
 				agent.WithHeartbeatFailureHandler(heartbeatFailureHandler),
+				agent.WithMaxProcesses(ctx.Int("max-processes")),
+				agent.WithMaxProcessRuntime(ctx.Duration("max-process-runtime")),
+				agent.WithDiagnosticsPaths(ctx.StringSlice("diagnostics-path")...),
+			}
+			if insecureNoTLS {
+				opts = append(opts, agent.WithInsecureNoTLS())
+			}
+
+			agent, err := agent.NewNodeAgent(
+				caCertPEMBytes,
+				certPEMBytes,
+				keyPEMBytes,
+				opts...,
 			)
 			if err != nil {
 				return fmt.Errorf("building agent: %w", err)
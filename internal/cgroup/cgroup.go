@@ -0,0 +1,40 @@
+package cgroup
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+)
+
+// AddProcess moves the process into the cgroup v2 directory.
+func AddProcess(cgroupPath string, pid int) error {
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("cgroups are not supported on %s", runtime.GOOS)
+	}
+	err := os.WriteFile(filepath.Join(cgroupPath, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+	if err != nil {
+		return fmt.Errorf("adding process to cgroup %q: %w", cgroupPath, err)
+	}
+	return nil
+}
+
+// OOMKills returns the number of processes in the cgroup v2 directory that were killed by the OOM killer,
+// for detecting an OOM kill by comparing the count before and after a process runs.
+func OOMKills(cgroupPath string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(cgroupPath, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		fields := bytes.Fields(scanner.Bytes())
+		if len(fields) == 2 && string(fields[0]) == "oom_kill" {
+			return strconv.ParseInt(string(fields[1]), 10, 64)
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,103 @@
+package diagnostics
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrorsName is the name of the entry in a diagnostics bundle that lists the paths that couldn't be collected.
+const ErrorsName = "diagnostics-errors.txt"
+
+// Write writes a tar stream of the files at the paths to w, recursing into directories.
+// Entries are named by their absolute paths without the leading slash. Paths that don't exist or can't be read are skipped,
+// and listed with their errors in an ErrorsName entry at the end of the bundle.
+// An error is only returned if writing to w fails, in which case the bundle is cut short.
+func Write(w io.Writer, paths []string) error {
+	tw := tar.NewWriter(w)
+	var errs []string
+	for _, p := range paths {
+		err := filepath.WalkDir(p, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s", path, err))
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			if err := addFile(tw, path); err != nil {
+				if _, ok := err.(*fileError); !ok {
+					return err
+				}
+				errs = append(errs, err.Error())
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(errs) > 0 {
+		b := []byte(strings.Join(errs, "\n") + "\n")
+		err := tw.WriteHeader(&tar.Header{Name: ErrorsName, Mode: 0644, Size: int64(len(b))})
+		if err == nil {
+			_, err = tw.Write(b)
+		}
+		if err != nil {
+			return fmt.Errorf("writing diagnostics errors: %w", err)
+		}
+	}
+	return tw.Close()
+}
+
+// fileError is an error reading a file for a diagnostics bundle, which is reported in the bundle instead of failing it.
+type fileError struct {
+	path string
+	err  error
+}
+
+func (e *fileError) Error() string { return fmt.Sprintf("%s: %s", e.path, e.err) }
+
+// addFile adds the file to the tar stream. Since log files may be written to while they're collected,
+// only the size at the time of opening is copied, and a file that shrinks in the meantime is padded with zeros.
+func addFile(tw *tar.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return &fileError{path: path, err: err}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return &fileError{path: path, err: err}
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return &fileError{path: path, err: err}
+	}
+	hdr.Name = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	n, err := io.Copy(tw, io.LimitReader(f, hdr.Size))
+	if err != nil {
+		return err
+	}
+	if n < hdr.Size {
+		_, err = io.CopyN(tw, zeroReader{}, hdr.Size-n)
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
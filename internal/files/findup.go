@@ -1,7 +1,6 @@
 package files
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,13 +28,23 @@ func FindUp(name, dir string) string {
 }
 
 func FindNodeAgentBin() (string, error) {
+	return FindNodeAgentBinForArch("amd64")
+}
+
+// FindNodeAgentBinForArch searches up from the working dir for the node agent bin for the given GOARCH.
+// The amd64 bin is named "nodeagent", and bins for other architectures are named "nodeagent-<arch>", as built by the Makefile.
+func FindNodeAgentBinForArch(arch string) (string, error) {
 	wd, err := os.Getwd()
 	if err != nil {
 		return "", fmt.Errorf("getting wd: %w", err)
 	}
-	nodeAgentBin := FindUp("nodeagent", wd)
+	name := "nodeagent"
+	if arch != "amd64" {
+		name = "nodeagent-" + arch
+	}
+	nodeAgentBin := FindUp(name, wd)
 	if nodeAgentBin == "" {
-		return "", errors.New("unable to find nodeagent bin")
+		return "", fmt.Errorf("unable to find %s bin, build it with 'make %s'", name, name)
 	}
 	return nodeAgentBin, nil
 }
@@ -0,0 +1,62 @@
+package iocount
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Writer counts the bytes written to the underlying writer.
+type Writer struct {
+	W io.Writer
+	N *int64
+}
+
+func (c *Writer) Write(b []byte) (int, error) {
+	n, err := c.W.Write(b)
+	atomic.AddInt64(c.N, int64(n))
+	return n, err
+}
+
+// Reader counts the bytes read from the underlying reader.
+type Reader struct {
+	R io.Reader
+	N *int64
+}
+
+func (c *Reader) Read(b []byte) (int, error) {
+	n, err := c.R.Read(b)
+	atomic.AddInt64(c.N, int64(n))
+	return n, err
+}
+
+// Output wraps the stdout and stderr writers of an exec.Cmd to count their bytes into stdoutN and stderrN.
+// A nil writer discards the output like it does for exec.Cmd, but it's still counted. A writer with a nil count isn't wrapped.
+// If stdout and stderr are the same writer, os/exec writes both streams to it from a single goroutine, such as for "2>&1",
+// so it's only wrapped once to keep it shared, and all of its bytes are counted into stdoutN.
+func Output(stdout, stderr io.Writer, stdoutN, stderrN *int64) (io.Writer, io.Writer) {
+	if stdout != nil && stdoutN != nil && stderrN != nil && sameWriter(stdout, stderr) {
+		w := &Writer{W: stdout, N: stdoutN}
+		return w, w
+	}
+	return wrap(stdout, stdoutN), wrap(stderr, stderrN)
+}
+
+func wrap(w io.Writer, n *int64) io.Writer {
+	if n == nil {
+		return w
+	}
+	if w == nil {
+		w = io.Discard
+	}
+	return &Writer{W: w, N: n}
+}
+
+// sameWriter is the comparison os/exec uses to detect a shared writer, which doesn't panic on incomparable types.
+func sameWriter(a, b io.Writer) (equal bool) {
+	defer func() {
+		if recover() != nil {
+			equal = false
+		}
+	}()
+	return a == b
+}
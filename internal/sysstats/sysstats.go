@@ -0,0 +1,10 @@
+package sysstats
+
+// Stats are the load, memory, and disk usage of the system.
+type Stats struct {
+	LoadAverage1       float64
+	MemTotalBytes      uint64
+	MemAvailableBytes  uint64
+	DiskTotalBytes     uint64
+	DiskAvailableBytes uint64
+}
@@ -0,0 +1,68 @@
+package sysstats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sample reads the load and memory from procfs, and the disk usage of the working directory's filesystem.
+// Stats that can't be read are left zero, and the first error is returned.
+func Sample() (Stats, error) {
+	var stats Stats
+	var firstErr error
+	setErr := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	loadavg, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		setErr(err)
+	} else if fields := strings.Fields(string(loadavg)); len(fields) > 0 {
+		stats.LoadAverage1, err = strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			setErr(fmt.Errorf("parsing load average: %w", err))
+		}
+	}
+
+	meminfo, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		setErr(err)
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(meminfo))
+		for scanner.Scan() {
+			// lines are like "MemTotal:       16318480 kB"
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			switch fields[0] {
+			case "MemTotal:":
+				stats.MemTotalBytes = kb * 1024
+			case "MemAvailable:":
+				stats.MemAvailableBytes = kb * 1024
+			}
+		}
+	}
+
+	var statfs syscall.Statfs_t
+	err = syscall.Statfs(".", &statfs)
+	if err != nil {
+		setErr(fmt.Errorf("statfs: %w", err))
+	} else {
+		stats.DiskTotalBytes = statfs.Blocks * uint64(statfs.Bsize)
+		stats.DiskAvailableBytes = statfs.Bavail * uint64(statfs.Bsize)
+	}
+
+	return stats, firstErr
+}
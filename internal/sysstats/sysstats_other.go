@@ -0,0 +1,8 @@
+//go:build !linux
+
+package sysstats
+
+// Sample isn't supported on this platform, so all the stats are zero.
+func Sample() (Stats, error) {
+	return Stats{}, nil
+}